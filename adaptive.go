@@ -0,0 +1,69 @@
+package traceroute
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Adaptive wait (-w MAX,HERE,NEAR)
+
+A hop that never answers costs the full wait time for every probe sent to it, and paths often
+end in a row of them. Like the traceroute command, the wait can be bound by what the hops
+already told us about the RTTs on the path:
+
+	wait = min(MAX, HERE × RTT of an answer from the same hop)    once the hop answered a probe
+	wait = min(MAX, NEAR × RTT of an answer from the nearest hop)  before that, the nearest hop
+	                                                                below it that answered
+
+MAX is Tracer.Wait, HERE is Tracer.WaitHere (traceroute's default is 3), NEAR is
+Tracer.WaitNear (traceroute's default is 10); 0 turns either off. The largest RTT seen at a hop
+counts, and the wait never goes below adaptiveMinWait, so the jitter of very short RTTs
+(a few microseconds on a LAN) doesn't make answers look lost.
+*/
+
+// adaptiveMinWait is the shortest wait the adaptive wait comes up with
+const adaptiveMinWait = 10 * time.Millisecond
+
+// adaptiveWait works out the wait for the probes of a trace from the RTTs seen so far. It is
+// safe for concurrent use, the Parallel scheduler and Concurrency send probes at once.
+type adaptiveWait struct {
+	max        time.Duration
+	here, near float64
+
+	mu   sync.Mutex
+	rtts map[int]time.Duration // largest RTT of the answers from each hop, by TTL
+}
+
+func newAdaptiveWait(max time.Duration, here, near float64) *adaptiveWait {
+	return &adaptiveWait{max: max, here: here, near: near, rtts: make(map[int]time.Duration)}
+}
+
+// record notes that a probe with TTL was answered after rtt
+func (a *adaptiveWait) record(TTL int, rtt time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rtts[TTL] = max(a.rtts[TTL], rtt)
+}
+
+// wait returns how long to wait for the answer to the next probe with TTL
+func (a *adaptiveWait) wait(TTL int) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if rtt, ok := a.rtts[TTL]; ok && a.here > 0 {
+		return a.bound(a.here, rtt)
+	}
+	if a.near > 0 {
+		for nearTTL := TTL - 1; nearTTL > 0; nearTTL-- {
+			if rtt, ok := a.rtts[nearTTL]; ok {
+				return a.bound(a.near, rtt)
+			}
+		}
+	}
+	return a.max
+}
+
+// bound returns factor × rtt, within adaptiveMinWait and the maximum wait
+func (a *adaptiveWait) bound(factor float64, rtt time.Duration) time.Duration {
+	return min(max(time.Duration(factor*float64(rtt)), adaptiveMinWait), a.max)
+}
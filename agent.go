@@ -0,0 +1,385 @@
+package traceroute
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+/*
+gRPC agent (traceroute agent)
+
+An Agent runs traces for a controller over gRPC, so a fleet of hosts can be told what to
+trace by one program, with the typed messages of the Agent service in traceroute.proto:
+
+	service Agent {
+	  rpc StartTrace(TraceRequest) returns (stream TraceEvent);
+	  rpc Traces(stream TraceRequest) returns (stream TraceEvent);
+	}
+
+StartTrace runs one trace. Traces runs every request the controller sends on the stream, at
+the same time, for as long as it keeps the stream open; the events of all of them come back
+on one stream, each carrying the id of its request. A trace sends an event for every probe as
+soon as it is done, then a last one (done) with the whole Result, also when it failed (error):
+
+	TraceEvent{id: "a", hop: {target: "example.com", ttl: 1, probe: 1, result: {...}}}
+	TraceEvent{id: "a", hop: {target: "example.com", ttl: 1, probe: 2, result: {...}}}
+	...
+	TraceEvent{id: "a", done: true, result: {target: "example.com", reached: true, hops: [...]}}
+
+A request Traces can't run (no target, an unknown method) only ends its own trace, with an
+error; StartTrace answers it with the status INVALID_ARGUMENT. The options of a request are
+those of POST /traces (see api.go), the others are the Agent's Tracer's.
+
+gRPC is protobuf messages over HTTP/2, which net/http speaks, with TLS or without (h2c, see
+http.Protocols). The Agent is an http.Handler doing the rest by hand, like protobuf.go does
+the messages: every message is framed by a byte telling whether it is compressed (never, the
+Agent doesn't compress and refuses compressed requests) and its length, 4 bytes big endian;
+the outcome of the call follows the last message as the trailers grpc-status and grpc-message.
+*/
+
+// gRPC status codes the Agent answers with
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+	grpcUnavailable     = 14
+)
+
+// grpcMaxMessage is the largest request message the Agent reads, gRPC's default
+const grpcMaxMessage = 4 << 20
+
+// Agent runs the traces a controller asks for over gRPC, see above. It is safe for
+// concurrent use; its fields must not change once it serves requests.
+type Agent struct {
+	Tracer     Tracer // what every trace is based on, see apiRequest for what a request sets
+	MaxRunning int    // traces running at once, over all calls; the others wait. 0 means 4
+
+	once   sync.Once
+	slots  chan struct{} // one for every running trace
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewAgent returns an Agent basing its traces on tracer
+func NewAgent(tracer Tracer) *Agent {
+	return &Agent{Tracer: tracer}
+}
+
+// Close stops the traces running, their calls end with the status UNAVAILABLE
+func (a *Agent) Close() error {
+	a.once.Do(a.init)
+	a.cancel()
+	return nil
+}
+
+func (a *Agent) init() {
+	running := a.MaxRunning
+	if running == 0 {
+		running = 4
+	}
+	a.slots = make(chan struct{}, running)
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+}
+
+// ServeHTTP serves the calls of the Agent service
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.once.Do(a.init)
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only: POST, content type application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	stream := &grpcStream{w: w, body: r.Body}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(a.ctx, cancel)
+	defer stop()
+
+	var err error
+	switch r.URL.Path {
+	case "/traceroute.Agent/StartTrace":
+		err = a.startTrace(ctx, stream)
+	case "/traceroute.Agent/Traces":
+		err = a.traces(ctx, stream)
+	default:
+		err = grpcError{grpcUnimplemented, fmt.Sprintf("unknown method %s", r.URL.Path)}
+	}
+	if err != nil && a.ctx.Err() != nil {
+		err = grpcError{grpcUnavailable, "the agent is shutting down"}
+	}
+	stream.end(err)
+}
+
+// startTrace serves StartTrace
+func (a *Agent) startTrace(ctx context.Context, stream *grpcStream) error {
+	msg, err := stream.read()
+	if err == io.EOF {
+		return grpcError{grpcInvalidArgument, "no TraceRequest"}
+	}
+	if err != nil {
+		return err
+	}
+	id, request, err := pbReadTraceRequest(msg)
+	if err != nil {
+		return grpcError{grpcInvalidArgument, err.Error()}
+	}
+	tracer, err := request.tracer(a.Tracer)
+	if err != nil {
+		return grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return a.run(ctx, stream, id, request.Target, tracer)
+}
+
+// traces serves Traces: a trace for every request, until the controller stops sending them
+// and they are all over, or ctx is done. A call ending with an error stops the traces still
+// running first.
+func (a *Agent) traces(ctx context.Context, stream *grpcStream) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	fail := func(err error) error {
+		cancel()
+		return err
+	}
+
+	// Reading blocks until the controller sends, it ends with the call
+	type read struct {
+		msg []byte
+		err error
+	}
+	requests := make(chan read)
+	go func() {
+		for {
+			msg, err := stream.read()
+			select {
+			case requests <- read{msg, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var next read
+		select {
+		case next = <-requests:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if next.err == io.EOF {
+			return nil
+		}
+		if next.err != nil {
+			return fail(next.err)
+		}
+		id, request, err := pbReadTraceRequest(next.msg)
+		if err != nil {
+			return fail(grpcError{grpcInvalidArgument, err.Error()})
+		}
+		tracer, err := request.tracer(a.Tracer)
+		if err != nil {
+			if err := stream.write(pbTraceEvent(id, nil, nil, err)); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.run(ctx, stream, id, request.Target, tracer) // a failed write fails the next read too
+		}()
+	}
+}
+
+// run runs a trace once a slot is free, sending its events
+func (a *Agent) run(ctx context.Context, stream *grpcStream, id, target string, tracer *Tracer) error {
+	select {
+	case a.slots <- struct{}{}:
+		defer func() { <-a.slots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var writeErr error
+	hook := tracer.Hooks.OnProbeReply
+	tracer.Hooks.OnProbeReply = func(r HopResult) {
+		if hook != nil {
+			hook(r)
+		}
+		if writeErr == nil {
+			writeErr = stream.write(pbTraceEvent(id, &r, nil, nil))
+		}
+	}
+	result, err := tracer.Trace(ctx, target)
+	if writeErr != nil {
+		return writeErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err() // nobody to tell anymore
+	}
+	if errors.Is(err, ErrMaxTTLExceeded) || errors.Is(err, ErrGapLimit) {
+		err = nil // result.Reached tells
+	}
+	return stream.write(pbTraceEvent(id, nil, result, err))
+}
+
+// pbReadTraceRequest decodes a TraceRequest message
+func pbReadTraceRequest(msg []byte) (string, apiRequest, error) {
+	var id string
+	var request apiRequest
+	err := pbFields(msg, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			id = string(data)
+		case 2:
+			request.Target = string(data)
+		case 3:
+			request.Method = string(data)
+		case 4:
+			request.Port = int(min(v, 1<<20)) // out of range either way, not wrapped around
+		case 5:
+			request.FirstTTL = int(min(v, 1<<20))
+		case 6:
+			request.MaxTTL = int(min(v, 1<<20))
+		case 7:
+			request.Queries = int(min(v, 1<<20))
+		case 8:
+			request.WaitMS = float64(v)
+		case 9:
+			request.IPv4 = v != 0
+		case 10:
+			request.IPv6 = v != 0
+		case 11:
+			request.Paris = v != 0
+		}
+		return nil
+	})
+	return id, request, err
+}
+
+// pbTraceEvent encodes a TraceEvent message: of a probe of the trace, or its end
+func pbTraceEvent(id string, probe *HopResult, result *Result, err error) pbMessage {
+	var event pbMessage
+	event.string(1, id)
+	if probe != nil {
+		var hop pbMessage
+		hop.string(1, probe.Target)
+		hop.varint(2, uint64(probe.TTL))
+		hop.varint(3, uint64(probe.Probe))
+		hop.bool(4, probe.Last)
+		hop.bytes(5, pbProbe(probe.probe()))
+		event.bytes(2, hop)
+		return event
+	}
+	if result != nil {
+		res := pbResult(result)
+		event.tag(3, pbBytes) // also an empty one
+		event = binary.AppendUvarint(event, uint64(len(res)))
+		event = append(event, res...)
+	}
+	if err != nil {
+		event.string(4, err.Error())
+	}
+	event.bool(5, true)
+	return event
+}
+
+// grpcError is the status a call ends with
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e grpcError) Error() string {
+	return fmt.Sprintf("gRPC status %d: %s", e.code, e.message)
+}
+
+// grpcStream reads and writes the messages of a call
+type grpcStream struct {
+	mu   sync.Mutex // writes come from every trace of the call
+	w    http.ResponseWriter
+	body io.Reader
+}
+
+// read returns the next message the client sent, io.EOF once it sent its last
+func (s *grpcStream) read() ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(s.body, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, grpcError{grpcInternal, fmt.Sprintf("reading the request: %v", err)}
+	}
+	if header[0] != 0 {
+		return nil, grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessage {
+		return nil, grpcError{grpcInvalidArgument, fmt.Sprintf("message of %d bytes is too large", length)}
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(s.body, msg); err != nil {
+		return nil, grpcError{grpcInternal, fmt.Sprintf("reading the request: %v", err)}
+	}
+	return msg, nil
+}
+
+// write sends msg to the client right away
+func (s *grpcStream) write(msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	if _, err := s.w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// end ends the call with the status of err: OK for nil
+func (s *grpcStream) end(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := grpcError{grpcOK, ""}
+	switch {
+	case err == nil:
+	case errors.As(err, &status):
+	case errors.Is(err, context.Canceled):
+		status = grpcError{grpcUnavailable, "canceled"} // the client went away, or the Agent was closed
+	default:
+		status = grpcError{grpcInternal, err.Error()}
+	}
+	s.w.Header().Set(http.TrailerPrefix+"Grpc-Status", fmt.Sprint(status.code))
+	if status.message != "" {
+		s.w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(status.message))
+	}
+}
+
+// grpcPercentEncode encodes message for the grpc-message trailer: printable ASCII but % as it
+// is, everything else percent-encoded
+func grpcPercentEncode(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
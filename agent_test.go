@@ -0,0 +1,243 @@
+package traceroute
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// agentEvent is a TraceEvent the Agent sent
+type agentEvent struct {
+	id     string
+	hop    []byte
+	result *Result
+	err    string
+	done   bool
+}
+
+// agentCall is the outcome of a call to the Agent
+type agentCall struct {
+	events  []agentEvent
+	status  string // the trailer grpc-status
+	message string // the trailer grpc-message
+	err     error
+}
+
+// agentServer serves agent over HTTP/2 without TLS (h2c), as gRPC clients call it
+func agentServer(t *testing.T, agent *Agent) (*httptest.Server, *http.Client) {
+	srv := httptest.NewUnstartedServer(agent)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { agent.Close() })
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(transport.CloseIdleConnections)
+	return srv, &http.Client{Transport: transport}
+}
+
+// grpcFrame frames msg as a gRPC message: not compressed, its length big endian
+func grpcFrame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...)
+}
+
+// traceRequest encodes a TraceRequest message
+func traceRequest(id, target string) []byte {
+	var request pbMessage
+	request.string(1, id)
+	request.string(2, target)
+	return request
+}
+
+// callAgent calls method of the Agent at url with body and reads the events and trailers
+func callAgent(client *http.Client, url, method string, body io.Reader) agentCall {
+	req, err := http.NewRequest(http.MethodPost, url+"/traceroute.Agent/"+method, body)
+	if err != nil {
+		return agentCall{err: err}
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		return agentCall{err: err}
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" {
+		return agentCall{err: errors.New("not a gRPC answer: " + resp.Proto + " " + resp.Status + " " + resp.Header.Get("Content-Type"))}
+	}
+
+	var call agentCall
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(resp.Body, header[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return agentCall{err: err}
+		}
+		if header[0] != 0 {
+			return agentCall{err: errors.New("compressed message")}
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(resp.Body, msg); err != nil {
+			return agentCall{err: err}
+		}
+		var event agentEvent
+		err := pbFields(msg, func(field int, v uint64, data []byte) error {
+			switch field {
+			case 1:
+				event.id = string(data)
+			case 2:
+				event.hop = data
+			case 3:
+				record := binary.AppendUvarint(nil, uint64(len(data)))
+				result, err := ReadProtobuf(bufio.NewReader(bytes.NewReader(append(record, data...))))
+				event.result = result
+				return err
+			case 4:
+				event.err = string(data)
+			case 5:
+				event.done = v != 0
+			}
+			return nil
+		})
+		if err != nil {
+			return agentCall{err: err}
+		}
+		call.events = append(call.events, event)
+	}
+	call.status, call.message = resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	return call
+}
+
+// blockingProber is a Prober whose probes are answered by nobody until the trace is stopped
+type blockingProber struct {
+	probing chan struct{} // a probe is out
+}
+
+func (p blockingProber) Probe(ctx context.Context, req ProbeRequest) (*Reply, error) {
+	select {
+	case p.probing <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingProber) Close() error {
+	return nil
+}
+
+func TestAgentStartTrace(t *testing.T) {
+	srv, client := agentServer(t, NewAgent(Tracer{Prober: pathProber{}, Queries: 2, Numeric: true}))
+
+	call := callAgent(client, srv.URL, "StartTrace", bytes.NewReader(grpcFrame(traceRequest("a", "192.0.2.3"))))
+	if call.err != nil {
+		t.Fatal(call.err)
+	}
+	if call.status != "0" || call.message != "" {
+		t.Errorf("call ended with status %q (%q), want 0", call.status, call.message)
+	}
+	if len(call.events) != 3*2+1 {
+		t.Fatalf("%d events, want one for each of the 6 probes and the last one", len(call.events))
+	}
+	for i, event := range call.events {
+		if event.id != "a" {
+			t.Errorf("event %d of request %q, want a", i, event.id)
+		}
+		if last := i == len(call.events)-1; event.done != last || (event.hop != nil) == last {
+			t.Errorf("event %d: done %v, hop %v, want a probe before the last, then done", i, event.done, event.hop != nil)
+		}
+	}
+	done := call.events[len(call.events)-1]
+	if done.err != "" || done.result == nil {
+		t.Fatalf("done with error %q and result %v", done.err, done.result)
+	}
+	checkPath(t, done.result, 3, 2)
+}
+
+func TestAgentErrors(t *testing.T) {
+	srv, client := agentServer(t, NewAgent(Tracer{Prober: pathProber{}, Numeric: true}))
+
+	for _, test := range []struct {
+		method  string
+		body    []byte
+		status  string
+		message string
+	}{
+		{"StartTrace", grpcFrame(traceRequest("a", "")), "3", "no target"},
+		{"StartTrace", nil, "3", "no TraceRequest"},
+		{"StartTrace", grpcFrame([]byte{0x0a, 0x05, 'a'}), "3", "truncated field 1"},
+		{"StartTrace", append([]byte{1}, grpcFrame(nil)[1:]...), "12", "compressed messages are not supported"},
+		{"Traces", grpcFrame([]byte{0x0a, 0x05, 'a'}), "3", "truncated field 1"},
+		{"Nope", nil, "12", "unknown method /traceroute.Agent/Nope"},
+		{"Nöpe", nil, "12", "unknown method /traceroute.Agent/N%C3%B6pe"}, // percent-encoded
+	} {
+		call := callAgent(client, srv.URL, test.method, bytes.NewReader(test.body))
+		if call.err != nil {
+			t.Errorf("%s %x: %v", test.method, test.body, call.err)
+			continue
+		}
+		if call.status != test.status || call.message != test.message {
+			t.Errorf("%s %x: status %q (%q), want %q (%q)", test.method, test.body, call.status, call.message, test.status, test.message)
+		}
+	}
+
+	// A request Traces can't run only ends its own trace
+	request := append(traceRequest("b", "192.0.2.3"), 0x38, 11) // queries 11
+	call := callAgent(client, srv.URL, "Traces", bytes.NewReader(grpcFrame(request)))
+	if call.err != nil {
+		t.Fatal(call.err)
+	}
+	if len(call.events) != 1 || call.events[0].id != "b" || call.events[0].err != "queries must be between 1 and 10" || !call.events[0].done {
+		t.Errorf("an invalid request of Traces sent %+v, want its trace done with an error", call.events)
+	}
+	if call.status != "0" {
+		t.Errorf("an invalid request of Traces ended the call with status %q (%q), want 0", call.status, call.message)
+	}
+}
+
+func TestAgentTracesInvalidRequest(t *testing.T) {
+	prober := blockingProber{probing: make(chan struct{}, 1)}
+	srv, client := agentServer(t, NewAgent(Tracer{Prober: prober, Numeric: true}))
+
+	// The controller keeps the call open, a trace runs, then a request it can't decode
+	body, requests := io.Pipe()
+	defer requests.Close()
+	calls := make(chan agentCall, 1)
+	go func() { calls <- callAgent(client, srv.URL, "Traces", body) }()
+
+	if _, err := requests.Write(grpcFrame(traceRequest("a", "192.0.2.3"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-prober.probing:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the trace didn't start")
+	}
+	if _, err := requests.Write(grpcFrame([]byte{0x0a, 0x05, 'a'})); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case call := <-calls:
+		if call.err != nil {
+			t.Fatal(call.err)
+		}
+		if call.status != "3" || call.message != "truncated field 1" {
+			t.Errorf("call ended with status %q (%q), want 3 (truncated field 1)", call.status, call.message)
+		}
+		if len(call.events) != 0 {
+			t.Errorf("the stopped trace sent %+v", call.events)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the call didn't end, it waits for the running trace")
+	}
+}
@@ -0,0 +1,469 @@
+package traceroute
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+REST API (traceroute serve)
+
+An APIServer runs traces on behalf of other services, which ask for them over HTTP instead of
+running the command and parsing its output. It is an http.Handler:
+
+	POST   /traces              start a trace, answered 202 Accepted with the trace (below) and
+	                            its URL in the Location header
+	GET    /traces              all traces kept, newest first, without their hops
+	GET    /traces/{id}         one trace, with the hops found so far
+	GET    /traces/{id}/stream  its probes as JSON lines (-o jsonl), those done so far right away
+	                            and the others as soon as they are done, until the trace is over
+	DELETE /traces/{id}         stop a trace that is queued or running, forget one that is over
+
+A trace is started with a JSON object naming the target, optionally with some options of the
+trace; the others are those of the Tracer the APIServer was made with:
+
+	{"target": "example.com", "method": "tcp", "port": 443, "first_ttl": 1, "max_ttl": 30,
+	 "queries": 3, "wait_ms": 2000, "ipv4": false, "ipv6": false, "paris": false}
+
+A trace is returned as:
+
+	{"id": 7, "status": "done", "target": "example.com", "request": {...},
+	 "created": "2026-10-16T00:31:07.123456Z", "started": "...", "ended": "...",
+	 "error": "...", "result": {...the Result of -o json...}}
+
+status is queued (waiting for one of the MaxRunning traces to finish), running, done (also when
+the destination wasn't reached), failed (error says why) or canceled (DELETE, or the APIServer
+was closed). Errors of the API itself are answered with their status and {"error": "..."}.
+
+Finished traces are kept until there are more than History of them, then the oldest go. The
+API has no authentication: serve it on a trusted network, or behind a proxy that has.
+*/
+
+// API trace statuses, see above
+const (
+	apiQueued   = "queued"
+	apiRunning  = "running"
+	apiDone     = "done"
+	apiFailed   = "failed"
+	apiCanceled = "canceled"
+)
+
+// APIServer runs traces requested over HTTP and keeps their results, see above. It is safe
+// for concurrent use; its fields must not change once it serves requests.
+type APIServer struct {
+	Tracer     Tracer // what every trace is based on, see apiRequest for what a request sets
+	MaxRunning int    // traces running at once, the others are queued; 0 means 4
+	MaxQueued  int    // traces waiting to run, more are turned away (503); 0 means 100
+	History    int    // finished traces kept, 0 means 100
+
+	once    sync.Once
+	mux     *http.ServeMux
+	slots   chan struct{} // one for every running trace
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	traces  []*apiTrace // oldest first
+	nextID  int
+	waiting int // queued traces
+}
+
+// apiRequest is what POST /traces takes, see above
+type apiRequest struct {
+	Target   string  `json:"target"`
+	Method   string  `json:"method,omitempty"`
+	Port     int     `json:"port,omitempty"`
+	FirstTTL int     `json:"first_ttl,omitempty"`
+	MaxTTL   int     `json:"max_ttl,omitempty"`
+	Queries  int     `json:"queries,omitempty"`
+	WaitMS   float64 `json:"wait_ms,omitempty"`
+	IPv4     bool    `json:"ipv4,omitempty"`
+	IPv6     bool    `json:"ipv6,omitempty"`
+	Paris    bool    `json:"paris,omitempty"`
+}
+
+// apiTrace is one trace of an APIServer; everything but id, request and cancel is guarded
+// by the APIServer's mu
+type apiTrace struct {
+	id      int
+	request apiRequest
+	cancel  context.CancelFunc
+
+	status  string
+	created time.Time
+	started time.Time
+	ended   time.Time
+	err     error
+	result  *Result       // the hops so far, the Result of Trace once it is over
+	probes  []HopResult   // for streams
+	changed chan struct{} // closed and replaced when a probe is added or the trace ends
+}
+
+type jsonAPITrace struct {
+	ID      int        `json:"id"`
+	Status  string     `json:"status"`
+	Target  string     `json:"target"`
+	Request apiRequest `json:"request"`
+	Created string     `json:"created"`
+	Started string     `json:"started,omitempty"`
+	Ended   string     `json:"ended,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Result  *Result    `json:"result,omitempty"`
+}
+
+// NewAPIServer returns an APIServer basing its traces on tracer
+func NewAPIServer(tracer Tracer) *APIServer {
+	return &APIServer{Tracer: tracer}
+}
+
+// ServeHTTP serves the API
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.once.Do(s.init)
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close stops the traces that are queued or running, and turns new ones away
+func (s *APIServer) Close() error {
+	s.once.Do(s.init)
+	s.cancel()
+	return nil
+}
+
+func (s *APIServer) init() {
+	running := s.MaxRunning
+	if running == 0 {
+		running = 4
+	}
+	s.slots = make(chan struct{}, running)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("POST /traces", s.start)
+	s.mux.HandleFunc("GET /traces", s.list)
+	s.mux.HandleFunc("GET /traces/{id}", s.get)
+	s.mux.HandleFunc("GET /traces/{id}/stream", s.stream)
+	s.mux.HandleFunc("DELETE /traces/{id}", s.delete)
+}
+
+// start handles POST /traces
+func (s *APIServer) start(w http.ResponseWriter, r *http.Request) {
+	var request apiRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	decoder.DisallowUnknownFields() // a misspelt option must not be ignored silently
+	if err := decoder.Decode(&request); err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	tracer, err := request.tracer(s.Tracer)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		apiError(w, http.StatusServiceUnavailable, errors.New("shutting down"))
+		return
+	}
+	maxQueued := s.MaxQueued
+	if maxQueued == 0 {
+		maxQueued = 100
+	}
+	if s.waiting >= maxQueued {
+		s.mu.Unlock()
+		apiError(w, http.StatusServiceUnavailable, fmt.Errorf("%d traces are waiting to run already, try again later", s.waiting))
+		return
+	}
+	s.nextID++
+	ctx, cancel := context.WithCancel(s.ctx)
+	t := &apiTrace{
+		id:      s.nextID,
+		request: request,
+		cancel:  cancel,
+		status:  apiQueued,
+		created: time.Now(),
+		result:  &Result{Target: request.Target},
+		changed: make(chan struct{}),
+	}
+	s.traces = append(s.traces, t)
+	s.waiting++
+	body := t.json(true)
+	s.mu.Unlock()
+
+	go s.run(ctx, t, tracer)
+	w.Header().Set("Location", fmt.Sprintf("/traces/%d", t.id))
+	apiJSON(w, http.StatusAccepted, body)
+}
+
+// tracer returns the Tracer of request, based on base, or why it is not a valid one
+func (request apiRequest) tracer(base Tracer) (*Tracer, error) {
+	tracer := base
+	switch {
+	case request.Target == "":
+		return nil, errors.New("no target")
+	case request.FirstTTL < 0 || request.MaxTTL < 0 || request.FirstTTL > 255 || request.MaxTTL > 255:
+		return nil, errors.New("first_ttl and max_ttl must be between 1 and 255")
+	case request.Queries < 0 || request.Queries > 10:
+		return nil, errors.New("queries must be between 1 and 10")
+	case request.WaitMS < 0 || request.WaitMS > 60000:
+		return nil, errors.New("wait_ms must be at most 60000")
+	case request.Port < 0 || request.Port > 65535:
+		return nil, errors.New("port must be between 1 and 65535")
+	case request.IPv4 && request.IPv6:
+		return nil, errors.New("ipv4 and ipv6 don't go together")
+	}
+	if request.Method != "" {
+		tracer.Method = request.Method
+	}
+	if request.Port != 0 {
+		tracer.Port = request.Port
+	}
+	if request.FirstTTL != 0 {
+		tracer.FirstTTL = request.FirstTTL
+	}
+	if request.MaxTTL != 0 {
+		tracer.MaxTTL = request.MaxTTL
+	}
+	if tracer.FirstTTL > cmp.Or(tracer.MaxTTL, 64) {
+		return nil, errors.New("first_ttl must not be above max_ttl")
+	}
+	if request.Queries != 0 {
+		tracer.Queries = request.Queries
+	}
+	if request.WaitMS != 0 {
+		tracer.Wait = time.Duration(request.WaitMS * float64(time.Millisecond))
+	}
+	if request.IPv4 || request.IPv6 {
+		tracer.IPv4, tracer.IPv6 = request.IPv4, request.IPv6
+	}
+	tracer.Paris = tracer.Paris || request.Paris
+	switch tracer.Method {
+	case "", MethodICMP, MethodUDP, MethodXEcho, MethodSCTP, MethodDCCP, MethodTCP, MethodQUIC:
+	default:
+		return nil, fmt.Errorf("unknown probe method %q (want %s, %s, %s, %s, %s, %s or %s)", tracer.Method, MethodICMP, MethodUDP, MethodXEcho, MethodSCTP, MethodDCCP, MethodTCP, MethodQUIC)
+	}
+	tracer.Multipath = false // Trace doesn't do it
+	return &tracer, nil
+}
+
+// run runs trace t once a slot is free
+func (s *APIServer) run(ctx context.Context, t *apiTrace, tracer *Tracer) {
+	defer t.cancel()
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	s.waiting--
+	if ctx.Err() != nil {
+		s.finish(t, nil, ctx.Err())
+		s.mu.Unlock()
+		return
+	}
+	t.status, t.started = apiRunning, time.Now()
+	s.mu.Unlock()
+
+	hook := tracer.Hooks.OnProbeReply
+	tracer.Hooks.OnProbeReply = func(r HopResult) {
+		if hook != nil {
+			hook(r)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		t.result.AddProbe(r)
+		t.probes = append(t.probes, r)
+		t.notify()
+	}
+	result, err := tracer.Trace(ctx, t.request.Target)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finish(t, result, err)
+}
+
+// finish records the outcome of trace t and forgets the oldest traces beyond History. s.mu
+// must be held.
+func (s *APIServer) finish(t *apiTrace, result *Result, err error) {
+	t.ended = time.Now()
+	if result != nil {
+		t.result = result
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		t.status = apiCanceled
+	case err == nil || errors.Is(err, ErrMaxTTLExceeded) || errors.Is(err, ErrGapLimit):
+		t.status = apiDone // reached or not, Result.Reached tells
+	default:
+		t.status, t.err = apiFailed, err
+	}
+	t.notify()
+
+	history := s.History
+	if history == 0 {
+		history = 100
+	}
+	finished := 0
+	for _, other := range s.traces {
+		if !other.ended.IsZero() {
+			finished++
+		}
+	}
+	kept := s.traces[:0]
+	for _, other := range s.traces {
+		if !other.ended.IsZero() && finished > history {
+			finished--
+			continue
+		}
+		kept = append(kept, other)
+	}
+	clear(s.traces[len(kept):])
+	s.traces = kept
+}
+
+// notify wakes up the streams of t. The APIServer's mu must be held.
+func (t *apiTrace) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// json returns t as it is returned by the API, with the hops unless brief. The APIServer's
+// mu must be held: the hops are encoded right away.
+func (t *apiTrace) json(brief bool) json.RawMessage {
+	trace := jsonAPITrace{
+		ID:      t.id,
+		Status:  t.status,
+		Target:  t.request.Target,
+		Request: t.request,
+		Created: TimestampRFC3339.Format(t.created),
+	}
+	if !t.started.IsZero() {
+		trace.Started = TimestampRFC3339.Format(t.started)
+	}
+	if !t.ended.IsZero() {
+		trace.Ended = TimestampRFC3339.Format(t.ended)
+	}
+	if t.err != nil {
+		trace.Error = t.err.Error()
+	}
+	if !brief {
+		trace.Result = t.result
+	}
+	b, _ := json.Marshal(trace)
+	return b
+}
+
+// find returns the trace of the request's {id}, or answers 404 and returns nil. The trace is
+// returned with s.mu held.
+func (s *APIServer) find(w http.ResponseWriter, r *http.Request) *apiTrace {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	s.mu.Lock()
+	if err == nil {
+		for _, t := range s.traces {
+			if t.id == id {
+				return t
+			}
+		}
+	}
+	s.mu.Unlock()
+	apiError(w, http.StatusNotFound, fmt.Errorf("no trace %q", r.PathValue("id")))
+	return nil
+}
+
+// list handles GET /traces
+func (s *APIServer) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	traces := make([]json.RawMessage, 0, len(s.traces))
+	for i := len(s.traces) - 1; i >= 0; i-- {
+		traces = append(traces, s.traces[i].json(true))
+	}
+	s.mu.Unlock()
+	apiJSON(w, http.StatusOK, traces)
+}
+
+// get handles GET /traces/{id}
+func (s *APIServer) get(w http.ResponseWriter, r *http.Request) {
+	t := s.find(w, r)
+	if t == nil {
+		return
+	}
+	body := t.json(false)
+	s.mu.Unlock()
+	apiJSON(w, http.StatusOK, body)
+}
+
+// stream handles GET /traces/{id}/stream
+func (s *APIServer) stream(w http.ResponseWriter, r *http.Request) {
+	t := s.find(w, r)
+	if t == nil {
+		return
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for sent := 0; ; {
+		s.mu.Lock()
+		probes, changed, over := t.probes[sent:], t.changed, !t.ended.IsZero()
+		s.mu.Unlock()
+		for _, probe := range probes {
+			if err := encoder.Encode(probe); err != nil {
+				return // the client went away
+			}
+		}
+		sent += len(probes)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if over {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// delete handles DELETE /traces/{id}
+func (s *APIServer) delete(w http.ResponseWriter, r *http.Request) {
+	t := s.find(w, r)
+	if t == nil {
+		return
+	}
+	if t.ended.IsZero() {
+		s.mu.Unlock()
+		t.cancel() // run records it as canceled
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	for i, other := range s.traces {
+		if other == t {
+			s.traces = append(s.traces[:i], s.traces[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiJSON answers with status and body as JSON
+func apiJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// apiError answers with status and err as {"error": "..."}
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,164 @@
+package traceroute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+/*
+RIPE Atlas JSON (-o atlas)
+
+WriteAtlas writes a Result the way RIPE Atlas reports traceroute measurements
+(https://atlas.ripe.net/docs/apis/result-format/), so parsers and visualizers built for
+Atlas results (e.g. RIPE's Sagan library) take local traces unchanged. One result is one
+line of JSON:
+
+	{"fw": 5080, "type": "traceroute", "msm_name": "Traceroute", "msm_id": 0, "prb_id": 0,
+	 "af": 4, "proto": "ICMP", "dst_name": "example.com", "dst_addr": "93.184.215.14",
+	 "src_addr": "192.168.1.10", "from": "192.168.1.10", "paris_id": 0, "size": 13,
+	 "timestamp": 1792110667, "endtime": 1792110671,
+	 "result": [
+	   {"hop": 1, "result": [{"from": "192.168.1.1", "rtt": 0.412, "ttl": 64}, {"x": "*"}, ...]},
+	   ...
+	   {"hop": 9, "result": [{"from": "93.184.215.14", "rtt": 9.812, "ttl": 56, "flags": "SA"}, ...]}]}
+
+A reply lists who answered, the RTT in milliseconds, the TTL the answer arrived with (when
+the socket tells, see Probe.ReplyTTL), a Destination Unreachable's code as "err" ("N"
+network, "H" host, "P" protocol, "p" port, "A" prohibited, "h" beyond scope, otherwise the
+number), and the flags of a TCP answer ("SA" for SYN-ACK, "R" or "RA" for a reset). A probe
+nobody answered is {"x": "*"}. "size" is the size of the probes without their IP header.
+
+There is no probe, measurement or firmware behind a local trace: msm_id and prb_id are 0,
+fw says which firmware's result format this follows. Atlas only traces with ICMP, UDP and
+TCP probes, SCTP, DCCP and Extended Echo traces can't be written.
+*/
+
+// atlasFirmware is the Atlas probe firmware version whose result format is written
+const atlasFirmware = 5080
+
+type atlasResult struct {
+	Firmware  int        `json:"fw"`
+	Type      string     `json:"type"`
+	Name      string     `json:"msm_name"`
+	MsmID     int        `json:"msm_id"`
+	PrbID     int        `json:"prb_id"`
+	AF        int        `json:"af"`
+	Proto     string     `json:"proto"`
+	DstName   string     `json:"dst_name"`
+	DstAddr   string     `json:"dst_addr"`
+	SrcAddr   string     `json:"src_addr,omitempty"`
+	From      string     `json:"from,omitempty"`
+	ParisID   int        `json:"paris_id"`
+	Size      int        `json:"size"`
+	Timestamp int64      `json:"timestamp"`
+	EndTime   int64      `json:"endtime"`
+	Result    []atlasHop `json:"result"`
+}
+
+type atlasHop struct {
+	Hop    int          `json:"hop"`
+	Result []atlasReply `json:"result"`
+}
+
+type atlasReply struct {
+	X     string   `json:"x,omitempty"`
+	From  string   `json:"from,omitempty"`
+	RTT   *float64 `json:"rtt,omitempty"`
+	TTL   int      `json:"ttl,omitempty"`
+	Err   any      `json:"err,omitempty"`
+	Flags string   `json:"flags,omitempty"`
+}
+
+// WriteAtlas writes r to w as a RIPE Atlas traceroute result, see atlas.go. t is the Tracer
+// that traced r, the result records how it probed.
+func (r *Result) WriteAtlas(w io.Writer, t *Tracer) error {
+	if r.Addr == nil {
+		return errors.New("no destination address to write")
+	}
+	proto, err := atlasProto(t)
+	if err != nil {
+		return err
+	}
+	family := familyOf(r.Addr.IP)
+	res := atlasResult{
+		Firmware:  atlasFirmware,
+		Type:      "traceroute",
+		Name:      "Traceroute",
+		AF:        4,
+		Proto:     proto,
+		DstName:   r.Target,
+		DstAddr:   r.Addr.IP.String(),
+		Size:      probeSize(t, r.Addr.IP) - family.innerHeaderLen,
+		Timestamp: r.Start.Unix(),
+		EndTime:   r.End.Unix(),
+		Result:    []atlasHop{},
+	}
+	if r.Addr.IP.To4() == nil {
+		res.AF = 6
+	}
+	if src, err := sourceAddrFor(r.Addr, socketConfig{device: t.Interface, source: t.Source}); err == nil {
+		res.SrcAddr, res.From = src.String(), src.String()
+	}
+
+	for _, hop := range r.Hops {
+		h := atlasHop{Hop: hop.TTL, Result: []atlasReply{}}
+		for _, probe := range hop.Probes {
+			h.Result = append(h.Result, atlasProbe(probe, family, t.TCPFlags == "ack"))
+		}
+		res.Result = append(res.Result, h)
+	}
+	return json.NewEncoder(w).Encode(res)
+}
+
+// atlasProto returns the Atlas protocol of the probes t sends
+func atlasProto(t *Tracer) (string, error) {
+	switch t.Method {
+	case "", MethodICMP:
+		return "ICMP", nil
+	case MethodUDP, MethodQUIC:
+		return "UDP", nil
+	case MethodTCP:
+		return "TCP", nil
+	}
+	return "", fmt.Errorf("RIPE Atlas has no traceroute protocol for %s probes", t.Method)
+}
+
+// atlasProbe returns the reply entry of a probe, ackProbe tells a reset of an ACK probe
+// (RST) from a reset of a SYN (RST-ACK)
+func atlasProbe(probe Probe, family ipFamily, ackProbe bool) atlasReply {
+	ipAddr, ok := probe.Addr.(*net.IPAddr)
+	if !ok {
+		return atlasReply{X: "*"}
+	}
+	rtt := float64(probe.RTT.Microseconds()) / 1000
+	reply := atlasReply{From: ipAddr.IP.String(), RTT: &rtt, TTL: probe.ReplyTTL}
+	if probe.Type == family.unreachable {
+		reply.Err = atlasUnreachable(family, probe.Code)
+	}
+	switch probe.Note {
+	case " [SYN-ACK]":
+		reply.Flags = "SA"
+	case " [RST]":
+		reply.Flags = "RA"
+		if ackProbe {
+			reply.Flags = "R"
+		}
+	}
+	return reply
+}
+
+// atlasUnreachable returns the "err" of a Destination Unreachable with code: the letter Atlas
+// has for what the code means, the code itself for others
+func atlasUnreachable(family ipFamily, code int) any {
+	letters := map[int]string{0: "N", 1: "H", 2: "P", 3: "p", 13: "A"}
+	if family.protocol == familyIPv6.protocol {
+		letters = map[int]string{0: "N", 1: "A", 2: "h", 3: "H", 4: "p"} // ICMPv6 numbers them differently
+	}
+	if letter, ok := letters[code]; ok {
+		return letter
+	}
+	return code
+}
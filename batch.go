@@ -0,0 +1,225 @@
+package traceroute
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Batched packet I/O
+
+A socket shared by many probes in flight (the socket of a trace read by a probeDemux, the
+sockets of a Session) costs two system calls per probe sent, setting the TTL and sending it,
+and one per message read, whoever it is for. With Concurrency, the Parallel scheduler or many
+traces on a Session, that is most of the CPU a trace takes. Where the socket can (raw sockets
+on Linux, see batch_linux.go), a packetWriter and a packetReader move the packets in batches
+instead, with sendmmsg and recvmmsg:
+
+	probes:  WriteTo ─┐
+	         WriteTo ─┼──> packetWriter ── sendmmsg (every packet with its TTL) ──> socket
+	         WriteTo ─┘       (the probes waiting to be sent when the last batch went out)
+
+	socket ── recvmmsg (what arrived, up to batchLen) ──> packetReader ──> one message at a time
+
+Every probe still waits until its packet went out, so its RTT is measured as before. A probe
+sent while no other one is waiting goes out alone, in a batch of one; the TTL travels with
+the packet (IP_TTL, IPV6_HOPLIMIT control messages), so that is one system call instead of
+two all the same. Elsewhere, and on the other socket types, probes are sent one at a time,
+with their TTL where the socket takes it (see ttl.go), and messages are read one at a time. Multipath traces send a
+probe only once the one before was answered, there is nothing to batch.
+*/
+
+// batchLen is how many packets are sent or read per system call at most
+const batchLen = 32
+
+// batchPacket is one packet sent or read in a batch
+type batchPacket struct {
+	b    []byte
+	addr net.Addr
+	ttl  int // TTL (hop limit) to send with, or it arrived with, 0 when unknown
+
+	received receiveTimes // when it was received, zero when unknown (see timestamps.go)
+	txID     uint32       // its number among the packets sent, with the NIC's timestamps (see txStamps)
+}
+
+// batchConn is a packetConn that sends and reads several packets per system call
+type batchConn interface {
+	packetConn
+	// writeBatch sends the packets with their TTLs, in order, and returns how many went out,
+	// fewer with the error of the first one that didn't
+	writeBatch(packets []batchPacket) (int, error)
+	// readBatch reads at least one message, and as many more as arrived, up to len(packets),
+	// into their b; it sets b to the ICMP message read, without IP header
+	readBatch(packets []batchPacket) (int, error)
+	// txStamps returns where the NIC's timestamps of the packets sent turn up, nil when
+	// they weren't asked for (see timestamps.go)
+	txStamps() *txStamps
+}
+
+// packetWriter sends the probes of everyone sharing a socket, each with a TTL of its own
+type packetWriter struct {
+	conn  packetConn
+	batch batchConn // conn, if it sends batches
+
+	mu sync.Mutex // held from setting the TTL until the probe went out, on sockets without per-packet TTLs
+
+	pending chan *batchWrite // probes waiting to be sent, handed to the goroutine of send
+	done    <-chan struct{}  // closed once the socket is
+}
+
+// batchWrite is a probe waiting for a packetWriter to send it
+type batchWrite struct {
+	packet batchPacket
+	sent   sendTimes  // when it went out, set before err gets the outcome
+	err    chan error // gets the outcome once it was sent
+}
+
+// newPacketWriter returns a packetWriter for conn, it sends batches until done is closed
+func newPacketWriter(conn packetConn, done <-chan struct{}) *packetWriter {
+	w := &packetWriter{conn: conn, done: done}
+	if c, ok := conn.(batchConn); ok {
+		w.batch = c
+		w.pending = make(chan *batchWrite)
+		go w.send()
+	}
+	return w
+}
+
+// writeTo sends b to dst with TTL, and returns once it went out, with when it did (see
+// timestamps.go)
+func (w *packetWriter) writeTo(b []byte, dst net.Addr, TTL int) (int, sendTimes, error) {
+	if w.batch == nil {
+		if c, ok := w.conn.(ttlWriter); ok {
+			sent := time.Now()
+			n, err := c.writeToTTL(b, dst, TTL)
+			return n, sendTimes{call: sent}, err
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err := w.conn.SetTTL(TTL); err != nil {
+			return 0, sendTimes{}, err
+		}
+		sent := time.Now()
+		n, err := w.conn.WriteTo(b, dst)
+		return n, sendTimes{call: sent}, err
+	}
+
+	out := &batchWrite{packet: batchPacket{b: b, addr: dst, ttl: TTL}, err: make(chan error, 1)}
+	select {
+	case w.pending <- out:
+	case <-w.done:
+		return 0, sendTimes{}, net.ErrClosed
+	}
+	if err := <-out.err; err != nil {
+		return 0, sendTimes{}, err
+	}
+	return len(b), out.sent, nil
+}
+
+// send sends the probes handed to writeTo, all of those waiting at once, until the socket
+// is closed
+func (w *packetWriter) send() {
+	for {
+		var writes []*batchWrite
+		select {
+		case out := <-w.pending:
+			writes = append(writes, out)
+		case <-w.done:
+			return
+		}
+	waiting:
+		for len(writes) < batchLen {
+			select {
+			case out := <-w.pending:
+				writes = append(writes, out)
+			default:
+				break waiting
+			}
+		}
+		w.flush(writes)
+	}
+}
+
+// flush sends writes in as few batches as it can, and tells every one of them how it went
+func (w *packetWriter) flush(writes []*batchWrite) {
+	packets := make([]batchPacket, len(writes))
+	for i, out := range writes {
+		packets[i] = out.packet
+	}
+	tx := w.batch.txStamps()
+	for len(writes) > 0 {
+		sent := time.Now()
+		n, err := w.batch.writeBatch(packets)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		for i, out := range writes[:n] {
+			out.sent = sendTimes{call: sent, tx: tx, txID: packets[i].txID}
+			out.err <- nil
+		}
+		writes, packets = writes[n:], packets[n:]
+		if err != nil && len(writes) > 0 {
+			writes[0].err <- err // the others get their own try
+			writes, packets = writes[1:], packets[1:]
+		}
+	}
+}
+
+// packetReader reads the ICMP messages arriving on a shared socket, one at a time to its
+// caller, in batches from the socket where it can
+type packetReader struct {
+	conn  packetConn
+	batch batchConn // conn, if it reads batches
+
+	packets []batchPacket   // the last batch read
+	buffers []*packetBuffer // the buffers of packets, nil once handed out
+	read    int             // how many of packets were read
+	next    int             // the one of them to hand out next
+}
+
+func newPacketReader(conn packetConn) *packetReader {
+	r := &packetReader{conn: conn}
+	if c, ok := conn.(batchConn); ok {
+		r.batch = c
+		r.packets = make([]batchPacket, batchLen)
+		r.buffers = make([]*packetBuffer, batchLen)
+	}
+	return r
+}
+
+// readFrom returns the next message, with who sent it and the TTL (hop limit) it arrived
+// with like readTTL. Its buffer is the caller's, to put back once done with it (see
+// buffers.go).
+func (r *packetReader) readFrom() (sessionPacket, error) {
+	if r.batch == nil {
+		buf := getPacketBuffer()
+		n, from, TTL, received, err := readStamped(r.conn, buf[:])
+		if err != nil {
+			putPacketBuffer(buf)
+			return sessionPacket{}, err
+		}
+		return sessionPacket{buf: buf, b: buf[:n], addr: from, ttl: TTL, received: received}, nil
+	}
+
+	if r.next == r.read {
+		for i := range r.packets {
+			if r.buffers[i] == nil {
+				r.buffers[i] = getPacketBuffer() // the one before was handed out
+			}
+			r.packets[i] = batchPacket{b: r.buffers[i][:]}
+		}
+		var err error
+		r.next = 0
+		if r.read, err = r.batch.readBatch(r.packets); err != nil {
+			r.read = 0
+			return sessionPacket{}, err
+		}
+	}
+	read := r.packets[r.next]
+	p := sessionPacket{buf: r.buffers[r.next], b: read.b, addr: read.addr, ttl: read.ttl, received: read.received}
+	r.buffers[r.next] = nil
+	r.next++
+	return p, nil
+}
@@ -0,0 +1,124 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// writeBatch sends packets with sendmmsg, each with its TTL as a control message, see batch.go
+func (c *rawConn) writeBatch(packets []batchPacket) (n int, err error) {
+	if c.tx != nil {
+		c.tx.mu.Lock()
+		defer c.tx.mu.Unlock()
+		c.tx.drain()
+		defer func() {
+			first := c.tx.count(n)
+			for i := range packets[:n] {
+				packets[i].txID = first + uint32(i)
+			}
+		}()
+	}
+
+	ms := make([]ipv4.Message, len(packets))
+	for i, p := range packets {
+		ms[i].Buffers = [][]byte{p.b}
+		ms[i].Addr = p.addr
+		ms[i].OOB = ttlControl(c.family, p.ttl)
+		if c.flowLabel != 0 {
+			ms[i].OOB = append(ms[i].OOB, flowLabelControl(c.flowLabel)...)
+		}
+	}
+	if c.p6 != nil {
+		return c.p6.WriteBatch(ms, 0)
+	}
+	return c.p4.WriteBatch(ms, 0)
+}
+
+func (c *rawConn) txStamps() *txStamps {
+	return c.tx
+}
+
+// readBatch reads messages with recvmmsg, see batch.go. The messages and their control
+// message buffers are allocated by the first call only, only one goroutine reads a socket.
+func (c *rawConn) readBatch(packets []batchPacket) (int, error) {
+	if len(c.readMessages) < len(packets) {
+		c.readMessages = make([]ipv4.Message, len(packets))
+		for i := range c.readMessages {
+			c.readMessages[i].Buffers = make([][]byte, 1)
+			if c.ttlMessages && c.p6 != nil {
+				c.readMessages[i].OOB = ipv6.NewControlMessage(ipv6.FlagHopLimit)
+			} else if c.ttlMessages {
+				c.readMessages[i].OOB = ipv4.NewControlMessage(ipv4.FlagTTL)
+			}
+			if c.timestamps {
+				c.readMessages[i].OOB = append(c.readMessages[i].OOB, make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(unix.Timespec{}))))...)
+			}
+			if c.tx != nil {
+				c.readMessages[i].OOB = append(c.readMessages[i].OOB, make([]byte, hardwareTimestampsLen)...)
+			}
+		}
+	}
+	ms := c.readMessages[:len(packets)]
+	for i, p := range packets {
+		ms[i].Buffers[0] = p.b
+		ms[i].OOB = ms[i].OOB[:cap(ms[i].OOB)]
+	}
+
+	var n int
+	var err error
+	if c.p6 != nil {
+		n, err = c.p6.ReadBatch(ms, 0)
+	} else {
+		n, err = c.p4.ReadBatch(ms, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for i, m := range ms[:n] {
+		p := &packets[i]
+		p.b, p.addr, p.ttl, p.received = p.b[:m.N], m.Addr, 0, receiveTimes{}
+		if c.timestamps || c.tx != nil {
+			p.received = controlTimes(m.OOB[:m.NN])
+		}
+		if c.p6 != nil {
+			var cm ipv6.ControlMessage
+			if cm.Parse(m.OOB[:m.NN]) == nil {
+				p.ttl = cm.HopLimit
+			}
+			continue
+		}
+		// Unlike ReadFrom, ReadBatch leaves the IPv4 header in front of the ICMP message
+		if len(p.b) > 0 {
+			p.b = p.b[min(int(p.b[0]&0x0f)<<2, len(p.b)):]
+		}
+		var cm ipv4.ControlMessage
+		if cm.Parse(m.OOB[:m.NN]) == nil {
+			p.ttl = cm.TTL
+		}
+	}
+	return n, nil
+}
+
+// writeToTTL sends b to dst with TTL, like a batch of one, see ttl.go
+func (c *rawConn) writeToTTL(b []byte, dst net.Addr, TTL int) (int, error) {
+	return c.write(b, dst, ttlControl(c.family, TTL))
+}
+
+// ttlControl returns the control message that sends a packet of family with TTL (hop limit)
+func ttlControl(family ipFamily, TTL int) []byte {
+	oob := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level, h.Type = unix.IPPROTO_IP, unix.IP_TTL
+	if family.protocol == familyIPv6.protocol {
+		h.Level, h.Type = unix.IPPROTO_IPV6, unix.IPV6_HOPLIMIT
+	}
+	h.SetLen(unix.CmsgLen(4))
+	binary.NativeEndian.PutUint32(oob[unix.CmsgLen(0):], uint32(TTL))
+	return oob
+}
@@ -0,0 +1,38 @@
+package traceroute
+
+import "sync"
+
+/*
+Receive buffers
+
+Every message read needs a buffer, and a raw socket reads every ICMP message arriving at the
+host, most of them not ours. Rather than allocating a new one for each, probes and the
+goroutines reading shared sockets (probeDemux, Session) take their buffers from a pool and put
+them back once the message was parsed, queued to a probe and copied, or dropped:
+
+	socket ── read into a pooled buffer ──> parsed ──> Reply (no part of the buffer in it)
+	                                            └────> back to the pool
+
+A trace running for days (-listen, -report, -hop) keeps reusing the same few buffers. Nothing
+taken out of a message may point into its buffer once it went back: what a Reply keeps of it
+(ICMP extension objects, Record Route addresses, notes) is copied.
+*/
+
+// packetBufferLen is the size of receive buffers, more than any ICMP message we care about
+const packetBufferLen = 1500
+
+type packetBuffer [packetBufferLen]byte
+
+var packetBuffers = sync.Pool{New: func() any { return new(packetBuffer) }}
+
+// getPacketBuffer returns a receive buffer, its content is left over from whoever used it last
+func getPacketBuffer() *packetBuffer {
+	return packetBuffers.Get().(*packetBuffer)
+}
+
+// putPacketBuffer hands buf back for reuse, nil is ignored
+func putPacketBuffer(buf *packetBuffer) {
+	if buf != nil {
+		packetBuffers.Put(buf)
+	}
+}
@@ -0,0 +1,123 @@
+package traceroute
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+The capture is a packet socket (AF_PACKET) of type SOCK_DGRAM for all protocols
+(ETH_P_ALL): it sees every packet going out or coming in on any interface, with the link
+layer header already removed, so IPv4 and IPv6 packets start right at their IP header.
+SO_TIMESTAMPNS has the kernel attach the time each packet was seen to it.
+
+Packets on the loopback interface are seen twice, going out and coming in again, only the
+incoming copy is kept.
+*/
+
+// capture records the packets of a trace, see pcap.go
+type capture struct {
+	file      *os.File
+	w         *PCAPWriter
+	dst       net.IP
+	loopbacks map[int]bool // indexes of loopback interfaces
+	done      chan struct{}
+}
+
+// htons converts a 16 bit value to network byte order, as packet sockets want the protocol
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// startCapture starts recording the packets of a trace to dst into w, until close
+func startCapture(w *PCAPWriter, dst net.IP) (*capture, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, permissionError(os.NewSyscallError("socket", err))
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	c := &capture{
+		file:      os.NewFile(uintptr(fd), "capture"), // non-blocking, so reads go through the poller
+		w:         w,
+		dst:       dst,
+		loopbacks: make(map[int]bool),
+		done:      make(chan struct{}),
+	}
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				c.loopbacks[iface.Index] = true
+			}
+		}
+	}
+	go c.read()
+	return c, nil
+}
+
+// read records packets until the read deadline set by close passes, then the ones still
+// waiting in the socket
+func (c *capture) read() {
+	defer close(c.done)
+	rawConn, err := c.file.SyscallConn()
+	if err != nil {
+		return
+	}
+	buf := make([]byte, pcapSnapLen)
+	oob := make([]byte, unix.CmsgSpace(16)) // struct timespec
+
+	// recv records one packet, it returns false once there is none waiting
+	recv := func(fd uintptr) bool {
+		n, oobn, flags, from, err := unix.Recvmsg(int(fd), buf, oob, unix.MSG_TRUNC)
+		if err != nil {
+			return false
+		}
+		if n > len(buf) || flags&unix.MSG_TRUNC != 0 {
+			n = len(buf) // cut at the snap length, the original length is lost then
+		}
+		if sll, ok := from.(*unix.SockaddrLinklayer); ok && sll.Pkttype == unix.PACKET_OUTGOING && c.loopbacks[sll.Ifindex] {
+			return true // seen again coming in
+		}
+		if capturedPacket(buf[:n], c.dst) {
+			c.w.WritePacket(packetTime(oob[:oobn]), buf[:n])
+		}
+		return true
+	}
+
+	for {
+		err := rawConn.Read(func(fd uintptr) bool {
+			for recv(fd) {
+			}
+			return false // wait for the next packet
+		})
+		if err != nil {
+			break // the deadline set by close passed
+		}
+	}
+	rawConn.Control(func(fd uintptr) {
+		for recv(fd) {
+		}
+	})
+}
+
+// packetTime returns the time in the SO_TIMESTAMPNS control message of a packet, or now if
+// there is none
+func packetTime(oob []byte) time.Time {
+	if t := controlTimes(oob).kernel; !t.IsZero() {
+		return t
+	}
+	return time.Now()
+}
+
+// close stops recording, after the packets that already arrived were
+func (c *capture) close() error {
+	c.file.SetReadDeadline(time.Now()) // wakes read up
+	<-c.done
+	return c.file.Close()
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package traceroute
+
+import (
+	"errors"
+	"net"
+)
+
+// capture records the packets of a trace, see pcap.go
+type capture struct{}
+
+func startCapture(w *PCAPWriter, dst net.IP) (*capture, error) {
+	return nil, errors.New("capturing packets is only supported on Linux")
+}
+
+func (c *capture) close() error {
+	return nil
+}
@@ -0,0 +1,45 @@
+package traceroute
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the time probes are timed with: their RTTs are measured with Now, and the wait
+// for their answers ends when After fires. Replacing it lets tests simulate RTTs and
+// timeouts without waiting for them.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the real time, the Clock used unless Tracer.Clock says otherwise
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// expire calls expired once wait passed on clock or ctx is done, whichever comes first,
+// unless stop is called before. Probes end their wait that way, expired moves the read
+// deadline of their sockets to now. Once stop returns, expired isn't running and won't
+// be called anymore, so it can't cut the wait of the next probe short.
+func expire(ctx context.Context, clock Clock, wait time.Duration, expired func()) (stop func()) {
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-clock.After(wait):
+			expired()
+		case <-ctx.Done():
+			expired()
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+		<-done
+	}
+}
@@ -0,0 +1,139 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// manualClock is a Clock whose time only moves when Advance says so
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []manualTimer
+	waits  chan time.Duration // every wait handed to After
+}
+
+type manualTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), waits: make(chan time.Duration, 16)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := manualTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	select {
+	case c.waits <- d:
+	default:
+	}
+	return timer.c
+}
+
+// Advance moves the time on by d, firing the timers due by then
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// clockTracer returns a Tracer sending ICMP probes on network, timed with clock
+func clockTracer(network *fakeNetwork, clock Clock) *Tracer {
+	prober := &ICMPProber{conn: network, id: 7, family: familyIPv4, payload: func(TTL, seq int) []byte { return defaultPayload }}
+	return &Tracer{Prober: prober, Clock: clock, Queries: 1, MaxTTL: 1, Wait: 5 * time.Second, Numeric: true}
+}
+
+func TestClockTimeout(t *testing.T) {
+	clock := newManualClock()
+	network := newFakeNetwork()
+	network.silent = true
+	tracer := clockTracer(network, clock)
+
+	type traced struct {
+		result *Result
+		err    error
+	}
+	done := make(chan traced, 1)
+	start := time.Now()
+	go func() {
+		result, err := tracer.Trace(context.Background(), "192.0.2.1")
+		done <- traced{result, err}
+	}()
+
+	if wait := <-clock.waits; wait != tracer.Wait {
+		t.Fatalf("probe waits %v, want %v", wait, tracer.Wait)
+	}
+	clock.Advance(tracer.Wait - time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("probe gave up before its wait passed on the clock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	got := <-done
+
+	if !errors.Is(got.err, ErrMaxTTLExceeded) {
+		t.Errorf("trace ended with %v, want %v", got.err, ErrMaxTTLExceeded)
+	}
+	if got.result == nil || len(got.result.Hops) != 1 || len(got.result.Hops[0].Probes) != 1 {
+		t.Fatalf("trace found %+v, want one hop with one probe", got.result)
+	}
+	probe := got.result.Hops[0].Probes[0]
+	if !errors.Is(probe.Err, ErrTimeout) || probe.Addr != nil {
+		t.Errorf("probe answered by %v with error %v, want %v", probe.Addr, probe.Err, ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed >= tracer.Wait {
+		t.Errorf("trace took %v, the wait should pass on the clock only", elapsed)
+	}
+}
+
+func TestClockRTT(t *testing.T) {
+	clock := newManualClock()
+	sent := clock.Now()
+	network := newFakeNetwork()
+	network.clock, network.delay = clock, 42*time.Millisecond
+
+	result, err := clockTracer(network, clock).Trace(context.Background(), "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Reached || len(result.Hops) != 1 || len(result.Hops[0].Probes) != 1 {
+		t.Fatalf("trace found %+v, want the destination answering at hop 1", result)
+	}
+	probe := result.Hops[0].Probes[0]
+	if probe.RTT != network.delay {
+		t.Errorf("RTT %v, want %v", probe.RTT, network.delay)
+	}
+	if !probe.Sent.Equal(sent) {
+		t.Errorf("sent at %v, want %v", probe.Sent, sent)
+	}
+	if probe.TimestampSource != TimestampSourceUser {
+		t.Errorf("RTT measured by %q, want %q", probe.TimestampSource, TimestampSourceUser)
+	}
+}
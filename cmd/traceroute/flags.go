@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yildiz-fatih/traceroute"
+)
+
+// stringList collects a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// duration is a flag taking a time.Duration like 300ms or, as it always did, a plain number of unit
+type duration struct {
+	d    time.Duration
+	unit time.Duration
+}
+
+func (d *duration) String() string {
+	if d.d == 0 {
+		return ""
+	}
+	return d.d.String()
+}
+
+func (d *duration) Set(value string) error {
+	v, err := time.ParseDuration(value)
+	if n, numErr := strconv.ParseFloat(value, 64); numErr == nil {
+		v, err = time.Duration(n*float64(d.unit)), nil
+	}
+	if err != nil {
+		unit := "seconds"
+		if d.unit == time.Millisecond {
+			unit = "milliseconds"
+		}
+		return fmt.Errorf("want a duration like 300ms or 2s, or a number of %s", unit)
+	}
+	if v < 0 {
+		return errors.New("must not be negative")
+	}
+	d.d = v
+	return nil
+}
+
+// waitTimes is the -w flag: the wait, optionally followed by the factors of the adaptive wait,
+// MAX,HERE,NEAR like traceroute takes them
+type waitTimes struct {
+	max        duration
+	here, near float64
+}
+
+func (w *waitTimes) String() string {
+	if w.here == 0 && w.near == 0 {
+		return w.max.String()
+	}
+	return fmt.Sprintf("%s,%g,%g", w.max.String(), w.here, w.near)
+}
+
+func (w *waitTimes) Set(value string) error {
+	parts := strings.Split(value, ",")
+	if len(parts) != 1 && len(parts) != 3 {
+		return errors.New("want MAX or MAX,HERE,NEAR")
+	}
+	if err := w.max.Set(parts[0]); err != nil {
+		return err
+	}
+	w.here, w.near = 0, 0
+	if len(parts) == 3 {
+		var err error
+		if w.here, err = strconv.ParseFloat(parts[1], 64); err != nil || w.here < 0 {
+			return fmt.Errorf("HERE %q is not a factor like 3", parts[1])
+		}
+		if w.near, err = strconv.ParseFloat(parts[2], 64); err != nil || w.near < 0 {
+			return fmt.Errorf("NEAR %q is not a factor like 10", parts[2])
+		}
+	}
+	return nil
+}
+
+// gatewayList collects the repeatable -g flag
+type gatewayList []net.IP
+
+func (g *gatewayList) String() string {
+	var names []string
+	for _, ip := range *g {
+		names = append(names, ip.String())
+	}
+	return strings.Join(names, ",")
+}
+
+func (g *gatewayList) Set(value string) error {
+	addr, err := net.ResolveIPAddr("ip4", value)
+	if err != nil {
+		return err
+	}
+	if len(*g) == traceroute.MaxGateways {
+		return fmt.Errorf("at most %d gateways fit into the IP header", traceroute.MaxGateways)
+	}
+	*g = append(*g, addr.IP.To4())
+	return nil
+}
+
+// traceFlags are the flags of a trace that rule each other out or need one another, see check
+type traceFlags struct {
+	given map[string]bool // the flags on the command line
+	args  int             // destination and packet size
+
+	scheduler   string
+	sendWait    time.Duration
+	concurrency int
+	maxPPS      float64
+
+	output, format, color, timestamps string
+	method                            string
+	replyTTL                          bool
+
+	report, allAddresses, tui, monitor, quiet, wide, nagios, multipath, numeric bool
+	hop, cycles, window                                                         int
+	listen, schedule, otlp                                                      string
+	interval                                                                    time.Duration // 0 unless given
+
+	geoip, nagiosThresholds          bool
+	statsd, syslog, webhook, history bool
+	pathAlert                        bool
+	pathEvents                       string
+	dnsCache                         bool
+	tos                              int
+	dscp, data, dataFile, udpPayload string
+}
+
+// repeat reports whether -c was given on its own, to repeat the printed trace
+func (f *traceFlags) repeat() bool {
+	return f.given["c"] && !f.report && f.hop == 0
+}
+
+// check returns what's wrong with the flags, nil if they go together
+func (f *traceFlags) check() error {
+	if f.schedule != "" {
+		if f.listen == "" {
+			return errors.New("-schedule is for the traces of -listen")
+		}
+		if f.args > 0 {
+			return errors.New("-schedule traces the targets of its file, not a destination")
+		}
+	}
+	switch f.scheduler {
+	case "sequential", "paced":
+	case "parallel":
+		if f.sendWait != 0 {
+			return errors.New("-z paces probes one after the other, it doesn't go together with -scheduler parallel")
+		}
+	default:
+		return fmt.Errorf("unknown scheduler %q (want sequential, paced or parallel)", f.scheduler)
+	}
+	if f.concurrency > 1 && (f.scheduler != "sequential" || f.sendWait != 0) {
+		return errors.New("-N sends the probes itself, it doesn't go together with -scheduler and -z")
+	}
+	if f.maxPPS < 0 {
+		return errors.New("-max-pps must not be negative")
+	}
+
+	text := f.output == "text" && f.format == "" // the text output, of which the others are variants
+	switch f.output {
+	case "text", "json", "jsonl", "csv", "gnu", "dot", "html", "influx", "warts", "atlas", "pb":
+	default:
+		return fmt.Errorf("unknown output format %q (want text, json, jsonl, csv, influx, gnu, dot, html, warts, atlas or pb)", f.output)
+	}
+	if f.format != "" && f.output != "text" {
+		return fmt.Errorf("-format and -o %s don't go together", f.output)
+	}
+	switch f.color {
+	case "auto", "always", "never":
+	default:
+		return fmt.Errorf("unknown -color %q (want auto, always or never)", f.color)
+	}
+	if (f.output == "warts" || f.output == "atlas") && (f.method == traceroute.MethodSCTP || f.method == traceroute.MethodDCCP || f.method == traceroute.MethodXEcho) {
+		return fmt.Errorf("-o %s has no trace type for -M %s, only for icmp, udp, quic and tcp", f.output, f.method)
+	}
+	switch traceroute.TimestampFormat(f.timestamps) {
+	case traceroute.TimestampNone, traceroute.TimestampRFC3339, traceroute.TimestampEpochMillis:
+	default:
+		return fmt.Errorf("unknown -timestamps %q (want rfc3339 or epoch-ms)", f.timestamps)
+	}
+	if f.timestamps != "" && !text {
+		return fmt.Errorf("-timestamps is for the text output, -o %s has the send time of every probe anyway (-format: {{.Sent}})", f.output)
+	}
+	if f.replyTTL && !text {
+		return errors.New("-ttl is for the text output (-format: {{.ReplyTTL}} and {{.ReturnHops}})")
+	}
+
+	if f.report && !text {
+		return errors.New("-report prints a table of its own, it doesn't go together with -o and -format")
+	}
+	if f.hop != 0 {
+		if !text || f.report || f.multipath {
+			return errors.New("-hop prints the answers and statistics of one hop, it doesn't go together with -o, -format, -report and -mda")
+		}
+		if f.given["f"] || f.given["m"] {
+			return errors.New("-hop probes one hop, it doesn't go together with -f and -m")
+		}
+		if f.hop < 1 || f.hop > 255 {
+			return errors.New("-hop must be between 1 and 255")
+		}
+	}
+	if f.cycles < 1 {
+		return errors.New("-c must be at least 1")
+	}
+	if f.repeat() && (f.output != "text" && f.output != "gnu" || f.format != "" || f.allAddresses || f.multipath) {
+		return errors.New("-c prints a table of statistics after the traces, it only goes together with the text output and -o gnu, not with -o, -format, -all-addresses and -mda")
+	}
+	if f.allAddresses && (f.output != "text" && f.output != "gnu" || f.format != "" || f.listen != "" || f.otlp != "" || f.tui || f.nagios) {
+		return errors.New("-all-addresses labels every trace with a line, it only goes together with the text output and -o gnu, not with -o, -format, -listen, -otlp, -tui and -nagios")
+	}
+	if f.listen != "" {
+		if !text || f.report || f.hop != 0 || f.multipath {
+			return errors.New("-listen serves metrics instead of printing, it doesn't go together with -o, -format, -report, -hop and -mda")
+		}
+		if f.interval != 0 && f.interval < time.Second {
+			return errors.New("-interval must be at least 1 second with -listen")
+		}
+	}
+	if f.otlp != "" && (!text || f.report || f.hop != 0 || f.listen != "" || f.multipath) {
+		return errors.New("-otlp only goes together with the text output, not with -o, -format, -report, -hop, -listen and -mda")
+	}
+	if f.tui {
+		if !text || f.report || f.hop != 0 || f.listen != "" || f.otlp != "" || f.multipath {
+			return errors.New("-tui draws a table of its own, it doesn't go together with -o, -format, -report, -hop, -listen, -otlp and -mda")
+		}
+		if !isTerminal(os.Stdout) {
+			return errors.New("-tui needs a terminal")
+		}
+	}
+	if f.monitor {
+		if !text || f.report || f.hop != 0 || f.listen != "" || f.otlp != "" || f.tui || f.allAddresses || f.multipath {
+			return errors.New("-monitor draws a table of its own, it doesn't go together with -o, -format, -report, -hop, -listen, -otlp, -tui, -all-addresses and -mda")
+		}
+		if !isTerminal(os.Stdout) {
+			return errors.New("-monitor needs a terminal")
+		}
+		if f.window < 0 {
+			return errors.New("-window must not be negative")
+		}
+	}
+	if f.quiet && (!text || f.report || f.hop != 0 || f.listen != "" || f.otlp != "" || f.tui || f.monitor || f.multipath) {
+		return errors.New("-quiet prints a summary of its own, it doesn't go together with -o, -format, -report, -hop, -listen, -otlp, -tui and -mda")
+	}
+	if f.repeat() && (f.listen != "" || f.otlp != "" || f.tui || f.monitor || f.quiet || f.nagios) {
+		return errors.New("-c on its own repeats the printed trace, it doesn't go together with -listen, -otlp, -tui, -monitor, -quiet and -nagios")
+	}
+	if f.wide && (!text || f.report || f.listen != "" || f.tui || f.quiet || f.multipath) {
+		return errors.New("-wide adds to the text output, it doesn't go together with -o, -format, -report, -listen, -tui, -quiet and -mda")
+	}
+	if f.geoip && !f.wide {
+		return errors.New("-geoip is for -wide")
+	}
+	if f.nagios && (!text || f.report || f.hop != 0 || f.listen != "" || f.otlp != "" || f.tui || f.quiet || f.wide || f.multipath) {
+		return errors.New("-nagios prints a status line of its own, it doesn't go together with -o, -format, -report, -hop, -listen, -otlp, -tui, -quiet, -wide and -mda")
+	}
+	if f.nagiosThresholds && !f.nagios {
+		return errors.New("-nagios-rtt, -nagios-loss and -nagios-hops are for -nagios")
+	}
+
+	// The sinks every trace goes to once it is over
+	printed := text && f.otlp == "" && !f.tui && !f.quiet && !f.nagios && !f.multipath
+	if f.statsd && !printed {
+		return errors.New("-statsd goes together with the text output, -wide, -report, -hop and -listen, not with -o, -format, -otlp, -tui, -quiet, -nagios and -mda")
+	}
+	if f.syslog && !printed {
+		return errors.New("-syslog goes together with the text output, -wide, -report, -hop and -listen, not with -o, -format, -otlp, -tui, -quiet, -nagios and -mda")
+	}
+	if f.webhook && !printed {
+		return errors.New("-webhook goes together with the text output, -wide, -c, -report, -hop, -listen and -monitor, not with -o, -format, -otlp, -tui, -quiet, -nagios and -mda")
+	}
+	if f.history && !printed {
+		return errors.New("-history goes together with the text output, -wide, -c, -report, -hop, -listen and -monitor, not with -o, -format, -otlp, -tui, -quiet, -nagios and -mda")
+	}
+	if f.pathAlert || f.pathEvents != "" {
+		if !f.monitor && !f.repeat() && !f.report && f.listen == "" {
+			return errors.New("-path-alert and -path-events watch repeated traces, they need -monitor, -c, -report or -listen")
+		}
+		if f.pathEvents == "-" && f.monitor {
+			return errors.New("-monitor draws on stdout, -path-events needs a file")
+		}
+	}
+	if f.dnsCache && f.numeric {
+		return errors.New("-dns-cache keeps the hop names, -n doesn't look any up")
+	}
+
+	if f.dscp != "" && f.tos != 0 {
+		return errors.New("-tos and -dscp don't go together, -dscp sets the upper 6 bits of the TOS")
+	}
+	if f.data != "" || f.dataFile != "" {
+		switch {
+		case f.data != "" && f.dataFile != "":
+			return errors.New("-data and -data-file don't go together")
+		case f.method != traceroute.MethodICMP && f.method != traceroute.MethodUDP:
+			return fmt.Errorf("-data is for ICMP Echo and UDP probes, -M %s probes carry no data", f.method)
+		case f.udpPayload != "":
+			return errors.New("-data and -udp-payload don't go together, the request is the data")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,632 @@
+// Command traceroute prints the route packets take to a network host.
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/template"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yildiz-fatih/traceroute"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		if err := decode(os.Args[2:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scan" {
+		if err := scan(os.Args[2:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := serve(os.Args[2:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		if err := agent(os.Args[2:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	var tracer traceroute.Tracer
+	wait := waitTimes{max: duration{d: 5 * time.Second, unit: time.Second}}
+	var ipOptions string
+	var dccpServiceCode uint
+	var gateways gatewayList
+	var scheduler string
+	sendWait := duration{unit: time.Millisecond}
+	var maxPPS float64
+	var output string
+	var format string
+	var color string
+	var warnRTT, critRTT int
+	var report bool
+	var hop int
+	var allAddresses bool
+	var cycles int
+	var listen string
+	var otlpEndpoint string
+	interval := duration{unit: time.Second}
+	var pcapFile string
+	var dnsCacheFile string
+	var data, dataFile string
+	var dscp string
+	var source string
+	var tui bool
+	var monitor bool
+	var window int
+	var quiet bool
+	var wide bool
+	var replyTTL bool
+	var showSummary bool
+	var timestamps string
+	var geoipFiles stringList
+	var nagios bool
+	var statsdAddr string
+	var pathAlert bool
+	var pathEvents string
+	var webhookURL, webhookEvents string
+	var webhookLoss float64
+	var historyFile string
+	var scheduleFile string
+	var syslogTarget, syslogFacility, syslogSeverity, syslogChangeSeverity string
+	var nagiosRTT, nagiosLoss, nagiosHops string
+	var verbose, debug bool
+	flag.IntVar(&tracer.Queries, "q", 3, "Number of probes per hop")
+	flag.Var(&wait, "w", "Time to wait for a response to a probe, e.g. 300ms or 2s (a plain number is seconds); MAX,HERE,NEAR like 5s,3,10 waits at most HERE times an RTT seen at the same hop, or NEAR times one seen at the nearest hop below, up to MAX")
+	flag.IntVar(&tracer.MaxTTL, "m", 64, "Max time-to-live (max number of hops)")
+	flag.IntVar(&tracer.Retries, "retries", 0, "Send a probe nobody answered again up to this many times, each time with a sequence number of its own, before it counts as lost (*)")
+	flag.IntVar(&tracer.Concurrency, "N", 1, "Keep up to this many probes in flight at once, also of the hops ahead, instead of waiting for every hop before probing the next; the hops are still printed in order")
+	flag.BoolVar(&tracer.Shuffle, "shuffle", false, "Probe the hops in random order, so transient loss doesn't always hit the first hops; they are still printed in order")
+	flag.BoolVar(&tracer.Fast, "fast", false, "Find the path length by a binary search over the TTLs first (probe 32, then 16 or 48, ...), then probe the hops up to the destination only, so -N and -shuffle don't waste probes beyond it")
+	flag.IntVar(&tracer.GapLimit, "gaplimit", 5, "Give up after this many hops in a row without any answer, before the max TTL (0: never)")
+	flag.IntVar(&tracer.FirstTTL, "f", 1, "Time-to-live of the first hop probed, skipping the hops before it (e.g. your own network)")
+	flag.BoolVar(&tracer.Numeric, "n", false, "Print hop addresses numerically (skip address-to-name lookup)")
+	flag.StringVar(&dnsCacheFile, "dns-cache", "", "Keep the hop names looked up in this file, read before the first trace and written after every trace, so the next run doesn't look them up again (names are kept for an hour, addresses without one for five minutes)")
+	flag.BoolVar(&tracer.IPv4, "4", false, "Use IPv4 only")
+	flag.BoolVar(&tracer.IPv6, "6", false, "Use IPv6 only")
+	flag.BoolVar(&tracer.Paris, "paris", false, "Keep the flow identifier constant across probes (Paris traceroute)")
+	flag.BoolVar(&tracer.Multipath, "mda", false, "Discover all load balanced paths (Multipath Detection Algorithm)")
+	flag.BoolVar(&tracer.ShowExtensions, "e", false, "Show ICMP extensions (e.g. MPLS label stacks)")
+	flag.StringVar(&tracer.Socket, "socket", traceroute.SocketAuto, "Socket type: raw (needs root), dgram (unprivileged), hdrincl (raw, we build the IPv4 header) or auto")
+	flag.StringVar(&source, "s", "", "Local address to send the probes from, e.g. on multihomed hosts (default: whatever the routing table says)")
+	flag.StringVar(&tracer.Interface, "i", "", "Network interface to send probes on, bound with SO_BINDTODEVICE on Linux and to its address elsewhere (default: whatever the routing table says)")
+	flag.IntVar(&tracer.IPID, "ip-id", 0, "IP Identification of the probes, 0 lets the kernel choose (needs -socket hdrincl)")
+	flag.StringVar(&ipOptions, "ip-options", "", "Raw IP options in hex, e.g. 0x01010100 (needs -socket hdrincl)")
+	flag.Var(&gateways, "g", "Loose source route through this gateway, repeat for up to 8 gateways (IPv4 only)")
+	flag.BoolVar(&tracer.RecordRoute, "R", false, "Record Route: show the addresses recorded in the IP Record Route option (IPv4 ICMP only, uses -socket hdrincl)")
+	flag.IntVar(&tracer.FlowLabel, "flow-label", 0, "IPv6 flow label of the probes, 0 leaves it to the kernel (ICMP only)")
+	flag.BoolVar(&tracer.FlowLabelSweep, "flow-label-sweep", false, "Give every probe of a hop a different IPv6 flow label, starting at -flow-label, to expose load balanced paths (ICMP only)")
+	flag.StringVar(&tracer.Method, "M", traceroute.MethodICMP, "Probe method: icmp, udp, xecho, sctp, dccp, tcp or quic")
+	flag.UintVar(&dccpServiceCode, "dccp-service", traceroute.DCCPDefaultServiceCode, "Service Code of DCCP probes (-M dccp)")
+	flag.IntVar(&tracer.TOS, "tos", 0, "TOS byte (IPv4) or Traffic Class (IPv6) of the probes, e.g. 0xb8 (DSCP EF)")
+	flag.StringVar(&dscp, "dscp", "", "DSCP of the probes, to trace the path of QoS-marked traffic: a number (0-63) or ef, af11 to af43, cs0 to cs7, va, le or be")
+	flag.BoolVar(&tracer.DontFragment, "df", false, "Set the Don't Fragment bit on the probes, so packets too large for a link on the path are lost instead of fragmented (Linux only)")
+	flag.BoolVar(&tracer.HardwareTimestamps, "hw-timestamps", false, "Measure RTTs with the NIC's clock where it timestamps packets in hardware (SO_TIMESTAMPING, receive filter switched on e.g. by a PTP daemon), else with the kernel's; the output formats tell which (Linux only)")
+	flag.StringVar(&data, "data", "", "Data of ICMP Echo and UDP probes in hex, e.g. 0xdeadbeef, instead of \"hello\" (padded to the packet size by repeating it)")
+	flag.StringVar(&dataFile, "data-file", "", "Read the data of ICMP Echo and UDP probes from this file instead, as is")
+	flag.StringVar(&tracer.UDPPayload, "udp-payload", "", "Send a real request in UDP probes (-M udp) to make the destination answer: dns, ntp or quic")
+	flag.StringVar(&tracer.UDPPorts, "udp-ports", "", "Destination ports of UDP probes (-M udp): increment (one more per probe, like classic traceroute) or fixed (-p for every probe, from one source port, so load balancers keep them on one path) (default: increment)")
+	flag.StringVar(&tracer.TCPFlags, "tcp-flags", "syn", "Flags of TCP probes (-M tcp): syn, ack, fin or syn+ece")
+	flag.IntVar(&tracer.SourcePort, "sport", 0, "Fixed source port of UDP, TCP, SCTP, DCCP and QUIC probes, for NAT and policy routing keyed on it and a flow load balancers keep on one path (default: one per probe)")
+	flag.IntVar(&tracer.Port, "p", 0, "Destination port of UDP, TCP, SCTP, DCCP and QUIC probes, e.g. 53, 443 or 3478; the first of the incrementing ports of plain UDP probes (default: 33434 for udp and dccp, 80 for tcp and sctp, 443 for quic, the service's port with -udp-payload)")
+	flag.StringVar(&scheduler, "scheduler", "sequential", "When probes are sent: sequential (one after the other), paced (at most one every -z) or parallel (all probes of a hop at once)")
+	flag.Float64Var(&maxPPS, "max-pps", 0, "Send at most this many probes per second, counting every probe of the run (all cycles, addresses and probes in flight), in bursts of up to -N probes, so big runs can't flood a link or trip an ICMP policer (0: no limit)")
+	flag.Var(&sendWait, "z", "Minimum time between probes, e.g. 100ms or 1s (a plain number is milliseconds), against routers rate limiting their ICMP errors; paces the probes like -scheduler paced (default: none, 50ms with -scheduler paced)")
+	flag.StringVar(&output, "o", "text", "Output format: text, json (the whole trace as one JSON object, once it is over), jsonl (one JSON object per probe, as soon as it is done), csv (one row per probe, as soon as it is done), influx (one line of InfluxDB line protocol per probe, as soon as it is done), gnu (one line per hop like GNU traceroute, for scripts parsing its output), dot (a Graphviz graph of the hops, also of the paths found with -mda, once the trace is over), warts (a binary scamper warts file, once the trace is over), atlas (a RIPE Atlas traceroute result, once the trace is over), pb (a length-delimited protobuf record of the trace, once it is over, see traceroute.proto; read with traceroute decode) or html (a self-contained report page with a table of the hops, once the trace is over)")
+	flag.StringVar(&format, "format", "", "Print every probe through this Go template instead, e.g. '{{.TTL}} {{.Addr}} {{.RTT}}' (fields of traceroute.HopResult)")
+	flag.StringVar(&color, "color", "auto", "Color RTTs by latency (green, yellow, red) and unanswered probes (dim) in the text output: auto (when printing to a terminal and NO_COLOR isn't set), always or never")
+	flag.IntVar(&warnRTT, "warn-rtt", 50, "RTT (in milliseconds) from which on -color prints it yellow")
+	flag.IntVar(&critRTT, "crit-rtt", 150, "RTT (in milliseconds) from which on -color prints it red")
+	flag.BoolVar(&report, "report", false, "Trace -c times and print one table of loss and RTT statistics per hop at the end, like mtr --report (one probe per hop and trace unless -q is given)")
+	flag.BoolVar(&allAddresses, "all-addresses", false, "Trace every address the destination resolves to (of the family -4, -6 or -s ask for) one after the other instead of only one, each under a line naming it, e.g. for CDN hostnames with an address per POP")
+	flag.IntVar(&hop, "hop", 0, "Probe only the hop with this TTL, -c times a second apart, printing every answer as it arrives and the loss and RTT statistics of the hop at the end, to keep an eye on one router of the path")
+	flag.IntVar(&cycles, "c", 10, "Number of traces (cycles) with -report, rounds of probes with -hop; given without them, trace this many times -interval apart, printing every trace, and then one table of loss and RTT statistics per hop over all of them")
+	flag.StringVar(&listen, "listen", "", "Trace every -interval and serve Prometheus metrics (per-hop RTT, loss, path length) on /metrics at this address, e.g. :9115, and a dashboard page on / (hop table, RTT and loss over time, path changes), filled from -history at the start")
+	flag.Var(&interval, "interval", "Time between the traces of -c, -report, -hop and -monitor (default 1s) and of -listen (default 60s), e.g. 500ms or 5m (a plain number is seconds)")
+	flag.StringVar(&otlpEndpoint, "otlp", "", "Also send the trace to an OpenTelemetry collector once it is over, one span per hop, to this OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces")
+	flag.BoolVar(&monitor, "monitor", false, "Trace over and over until Ctrl-C, like mtr: a full-screen table of loss and RTT statistics per hop, updated as the probes return, a trace a second (one probe per hop and trace unless -q is given; needs a terminal)")
+	flag.IntVar(&window, "window", 0, "With -monitor, keep the statistics of the last this many probes of every hop only, so they roll (0: of all probes since the start)")
+	flag.BoolVar(&tui, "tui", false, "Draw the hops full-screen as a table that fills in as the probes return, with a spinner for every probe in flight and a status bar (needs a terminal)")
+	flag.BoolVar(&quiet, "quiet", false, "Print no hops, only one summary line once the trace is over: whether the destination was reached, the hop count, the last responder and the min/avg/max RTT of the destination, for scripts and cron jobs")
+	flag.StringVar(&timestamps, "timestamps", "", "Print the wall-clock time every probe was sent in front of it in the text output: rfc3339 (UTC, with microseconds) or epoch-ms")
+	flag.BoolVar(&showSummary, "summary", true, "Print statistics below the hops of the text output: hops, probes sent and answered, loss, the time the trace took, and the min/avg/max/stddev RTT of the destination (-summary=false leaves them out)")
+	flag.BoolVar(&replyTTL, "ttl", false, "Add the TTL every answer arrived with and how many hops it took back, inferred from it (ttl=59 back=6), to the text output")
+	flag.BoolVar(&wide, "wide", false, "Add the AS number and name, country and city of every responder (looked up with Team Cymru's DNS service and -geoip) and the TTL its answer arrived with to the text output")
+	flag.Var(&geoipFiles, "geoip", "MaxMind DB file (e.g. GeoLite2-City.mmdb or GeoLite2-ASN.mmdb) to look up -wide's AS, country and city in first, repeat for several")
+	flag.BoolVar(&pathAlert, "path-alert", false, "Compare the path of every trace of -monitor, -c, -report and -listen with the previous one, and log every change (hop inserted or removed, other responders, other length) to stderr with a diff of the old and new path; with -monitor once it is stopped")
+	flag.StringVar(&pathEvents, "path-events", "", "Append every path change (see -path-alert) to this file as a line of JSON, - for stdout")
+	flag.StringVar(&webhookURL, "webhook", "", "POST an event as JSON to this URL after every trace, also after every cycle of -c, -report, -hop, -listen and -monitor: trace_completed, destination_unreachable, loss_above_threshold (see -webhook-loss) and path_change (of repeated traces, see -path-alert); every event has a text field for Slack")
+	flag.StringVar(&webhookEvents, "webhook-events", "all", "Comma-separated events -webhook posts: trace_completed, destination_unreachable, loss_above_threshold and path_change, or all")
+	flag.Float64Var(&webhookLoss, "webhook-loss", 20, "Percentage of the probes of its hop the destination must lose for -webhook to post loss_above_threshold")
+	flag.StringVar(&scheduleFile, "schedule", "", "With -listen, trace the targets of this file on their schedules instead of a destination every -interval: a line per target with its schedule (every 5m, or like cron: 0,30 * * * * or @hourly), the target and options like method=tcp port=443 queries=5; the traces go to /metrics, the dashboard, -history, -webhook, -statsd and -syslog alike (see cron.go)")
+	flag.StringVar(&historyFile, "history", "", "Store every trace, also every cycle of -monitor, -c, -report, -hop and -listen, with its hops and probes in this SQLite database (tables runs, hops and probes, created unless they exist), to query the path history with sqlite3 later")
+	flag.StringVar(&statsdAddr, "statsd", "", "Send per-hop RTT timers and sent/lost probe counters to statsd at this host:port (UDP) after every trace, also after every cycle of -report, -hop and -listen")
+	flag.StringVar(&syslogTarget, "syslog", "", "Log every hop, and path changes since the previous trace, to syslog: local for the local syslog daemon, or udp://host[:port] or tcp://host[:port] for a remote one (port 514 unless given); after every trace, also after every cycle of -report, -hop and -listen")
+	flag.StringVar(&syslogFacility, "syslog-facility", "daemon", "Facility of -syslog's messages: kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv, ftp or local0 to local7")
+	flag.StringVar(&syslogSeverity, "syslog-severity", "info", "Severity of -syslog's hop messages: emerg, alert, crit, err, warning, notice, info or debug")
+	flag.StringVar(&syslogChangeSeverity, "syslog-change-severity", "notice", "Severity of -syslog's path change messages")
+	flag.BoolVar(&nagios, "nagios", false, "Run as a Nagios/Icinga check plugin: print no hops, only one OK/WARNING/CRITICAL/UNKNOWN line with performance data once the trace is over, and exit with the status (0-3); an unreached destination is CRITICAL")
+	flag.StringVar(&nagiosRTT, "nagios-rtt", "", "Warning and critical threshold of the destination's average RTT (in milliseconds) for -nagios, e.g. 100,200")
+	flag.StringVar(&nagiosLoss, "nagios-loss", "", "Warning and critical threshold of the destination's loss (in percent of the last hop's probes) for -nagios, e.g. 20,50")
+	flag.StringVar(&nagiosHops, "nagios-hops", "", "Warning and critical threshold of the hop count for -nagios, e.g. 20,30")
+	flag.StringVar(&pcapFile, "pcap", "", "Record every probe sent and every ICMP message received, with kernel timestamps, to this pcap file for Wireshark (Linux only)")
+	flag.StringVar(&tracer.XEchoInterface, "xecho-if", "", "Interface (name, index or address) to ask the destination about with -M xecho (default: the destination address)")
+	flag.BoolVar(&verbose, "v", false, "Log diagnostics to stderr: the sockets opened and closed, and the destination's address")
+	flag.BoolVar(&debug, "vv", false, "Log more diagnostics to stderr than -v: also every probe sent and every packet read, and whether (or why not) it was taken for the answer to a probe")
+
+	flag.Parse()
+
+	remainingArgs := flag.Args()
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	flags := traceFlags{
+		given: given, args: len(remainingArgs),
+		scheduler: scheduler, sendWait: sendWait.d, concurrency: tracer.Concurrency, maxPPS: maxPPS,
+		output: output, format: format, color: color, timestamps: timestamps, method: tracer.Method, replyTTL: replyTTL,
+		report: report, allAddresses: allAddresses, tui: tui, monitor: monitor, quiet: quiet, wide: wide, nagios: nagios,
+		multipath: tracer.Multipath, numeric: tracer.Numeric,
+		hop: hop, cycles: cycles, window: window, listen: listen, schedule: scheduleFile, otlp: otlpEndpoint, interval: interval.d,
+		geoip: len(geoipFiles) > 0, nagiosThresholds: nagiosRTT != "" || nagiosLoss != "" || nagiosHops != "",
+		statsd: statsdAddr != "", syslog: syslogTarget != "", webhook: webhookURL != "", history: historyFile != "",
+		pathAlert: pathAlert, pathEvents: pathEvents, dnsCache: dnsCacheFile != "",
+		tos: tracer.TOS, dscp: dscp, data: data, dataFile: dataFile, udpPayload: tracer.UDPPayload,
+	}
+	if err := flags.check(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	if scheduleFile != "" {
+		remainingArgs = []string{""}
+	}
+	if len(remainingArgs) < 1 || len(remainingArgs) > 2 {
+		fmt.Println("Usage: traceroute [-4|-6] <destination> [packet size]")
+		fmt.Println("       traceroute -listen addr -schedule file")
+		fmt.Println("       traceroute decode [file.pb ...]")
+		os.Exit(1)
+	}
+	destination := remainingArgs[0]
+	if len(remainingArgs) == 2 {
+		// Like classic traceroute: the size of the probes, IP header included
+		size, err := strconv.Atoi(remainingArgs[1])
+		if err != nil || size <= 0 {
+			log.Fatalf("Error: invalid packet size %q", remainingArgs[1])
+		}
+		tracer.PacketSize = size
+	}
+
+	// Diagnostics go to stderr, stdout only gets the trace. Errors ending the program stay
+	// the log lines they were, log.Fatalf doesn't go through slog.
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags) // SetDefault cleared them
+	if verbose || debug {
+		tracer.Logger = slog.Default()
+	}
+
+	tracer.Wait, tracer.WaitHere, tracer.WaitNear = wait.max.d, wait.here, wait.near
+	tracer.DCCPServiceCode = uint32(dccpServiceCode)
+	tracer.Gateways = gateways
+	switch {
+	case scheduler == "parallel":
+		tracer.Scheduler = traceroute.Parallel{}
+	case scheduler == "sequential" && sendWait.d == 0:
+		tracer.Scheduler = traceroute.Sequential{}
+	default:
+		tracer.Scheduler = &traceroute.Paced{Interval: cmp.Or(sendWait.d, 50*time.Millisecond)}
+	}
+	if maxPPS > 0 {
+		tracer.RateLimit = traceroute.NewRateLimiter(maxPPS, tracer.Concurrency)
+	}
+	var tmpl *template.Template
+	if format != "" {
+		var err error
+		tmpl, err = template.New("format").Parse(format)
+		if err != nil {
+			log.Fatalf("Error parsing -format: %v", err)
+		}
+	}
+	text := traceroute.TextRenderer{
+		ShowExtensions: tracer.ShowExtensions,
+		ShowFlowLabel:  tracer.FlowLabelSweep,
+		Timestamps:     traceroute.TimestampFormat(timestamps),
+		ShowReplyTTL:   replyTTL,
+	}
+	if color == "always" || color == "auto" && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout) {
+		text.Colors = &traceroute.Colors{Warn: time.Duration(warnRTT) * time.Millisecond, Crit: time.Duration(critRTT) * time.Millisecond}
+	}
+	if text.Colors != nil || text.Timestamps != traceroute.TimestampNone || text.ShowReplyTTL {
+		tracer.Renderer = &text
+	}
+	if (report || monitor) && !given["q"] {
+		tracer.Queries = 1 // like mtr, every cycle sends one probe per hop
+	}
+	if hop != 0 {
+		tracer.FirstTTL, tracer.MaxTTL = hop, hop
+	}
+	repeat := flags.repeat() // -c on its own
+	if listen != "" && interval.d == 0 {
+		interval.d = time.Minute
+	}
+	if interval.d == 0 {
+		interval.d = time.Second
+	}
+	if wide {
+		renderer := &traceroute.WideRenderer{TextRenderer: traceroute.TextRenderer{ShowExtensions: tracer.ShowExtensions, ShowFlowLabel: tracer.FlowLabelSweep}}
+		if r, ok := tracer.Renderer.(*traceroute.TextRenderer); ok {
+			renderer.TextRenderer = *r // colored by -color
+		}
+		for _, path := range geoipFiles {
+			db, err := traceroute.OpenGeoIP(path)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			renderer.Sources = append(renderer.Sources, db)
+		}
+		renderer.Sources = append(renderer.Sources, &traceroute.CymruSource{})
+		tracer.Renderer = renderer
+	}
+	check := traceroute.NagiosCheck{MaxTTL: tracer.MaxTTL}
+	if nagios {
+		for _, threshold := range []struct {
+			name  string
+			value string
+			to    *traceroute.NagiosThreshold
+		}{{"-nagios-rtt", nagiosRTT, &check.RTT}, {"-nagios-loss", nagiosLoss, &check.Loss}, {"-nagios-hops", nagiosHops, &check.Hops}} {
+			if threshold.value == "" {
+				continue
+			}
+			var err error
+			if *threshold.to, err = traceroute.ParseNagiosThreshold(threshold.value); err != nil {
+				log.Fatalf("Error parsing %s: %v", threshold.name, err)
+			}
+		}
+	}
+	var statsd *traceroute.StatsdExporter
+	if statsdAddr != "" {
+		statsd = &traceroute.StatsdExporter{Addr: statsdAddr}
+		defer statsd.Close()
+	}
+	var syslogger *traceroute.SyslogLogger
+	if syslogTarget != "" {
+		var err error
+		syslogger, err = newSyslogLogger(syslogTarget, syslogFacility, syslogSeverity, syslogChangeSeverity)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer syslogger.Close()
+	}
+	// Events of every trace, see webhook.go
+	var webhook *traceroute.Webhook
+	if webhookURL != "" {
+		events, err := traceroute.ParseWebhookEvents(webhookEvents)
+		if err != nil {
+			log.Fatalf("Error parsing -webhook-events: %v", err)
+		}
+		webhook = &traceroute.Webhook{URL: webhookURL, Events: events, LossThreshold: webhookLoss}
+	}
+	// Every trace of the run in a SQLite database, see history.go
+	var history *traceroute.History
+	if historyFile != "" {
+		// WAL lets sqlite3 query the database while traces are stored
+		db, err := sql.Open("sqlite3", "file:"+historyFile+"?_journal_mode=WAL&_busy_timeout=5000")
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer db.Close()
+		history, err = traceroute.OpenHistory(context.Background(), db)
+		if err != nil {
+			log.Fatalf("Error opening %s: %v", historyFile, err)
+		}
+	}
+	// notify posts to the webhook, a webhook down for a while must not stop long runs
+	notify := func(post func(ctx context.Context) error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := post(ctx); err != nil {
+			slog.Warn("posting to the webhook failed", "err", err) // the next event is posted anyway
+		}
+	}
+	// Path changes between the traces of the run, see pathchange.go
+	var paths *traceroute.PathWatcher
+	var heldChanges []traceroute.PathChange // logged once -monitor has left the screen
+	if pathAlert || pathEvents != "" || webhook != nil && (monitor || repeat || report || listen != "") {
+		var events *json.Encoder
+		switch pathEvents {
+		case "":
+		case "-":
+			events = json.NewEncoder(os.Stdout)
+		default:
+			f, err := os.OpenFile(pathEvents, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			defer f.Close()
+			events = json.NewEncoder(f)
+		}
+		paths = &traceroute.PathWatcher{OnChange: func(change traceroute.PathChange) {
+			switch {
+			case pathAlert && monitor:
+				heldChanges = append(heldChanges, change)
+			case pathAlert:
+				log.Print(change)
+			}
+			if events != nil {
+				if err := events.Encode(change); err != nil {
+					slog.Warn("writing the path change failed", "err", err)
+				}
+			}
+			if webhook != nil {
+				notify(func(ctx context.Context) error { return webhook.PathChanged(ctx, change) })
+			}
+		}}
+	}
+	// Names are looked up once an hour at most, by all traces of the run (see dnscache.go)
+	var dnsCache *traceroute.CachingResolver
+	if !tracer.Numeric {
+		dnsCache = traceroute.NewCachingResolver(tracer.Resolver, 0)
+		tracer.Resolver = dnsCache
+	}
+	if dnsCacheFile != "" {
+		if err := dnsCache.LoadFile(dnsCacheFile); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	saveCache := func() {
+		if dnsCacheFile != "" {
+			if err := dnsCache.SaveFile(dnsCacheFile); err != nil {
+				slog.Warn("saving the DNS cache failed", "err", err) // the next run looks the names up again
+			}
+		}
+	}
+
+	// Every trace goes to the webhook and the history once it is over: of -report, -hop and
+	// -listen through afterTrace, of -monitor through Monitor.OnTrace, the others through the
+	// wrapper of trace below
+	eachTrace := func(result *traceroute.Result) {
+		if webhook != nil {
+			notify(func(ctx context.Context) error { return webhook.TraceDone(ctx, result.Summary()) })
+		}
+		if history != nil {
+			if _, err := history.Save(context.Background(), result); err != nil {
+				slog.Warn("storing the trace failed", "err", err) // the next one is stored anyway
+			}
+		}
+	}
+	// Every trace of -report, -hop and -listen goes to statsd and syslog once it is over
+	afterTrace := func(result *traceroute.Result) {
+		saveCache()
+		if paths != nil {
+			paths.Observe(result)
+		}
+		eachTrace(result)
+		if statsd != nil {
+			if err := statsd.Export(result); err != nil {
+				slog.Warn("sending to statsd failed", "err", err) // a statsd server down for a while must not stop long runs
+			}
+		}
+		if syslogger != nil {
+			if err := syslogger.Log(result); err != nil {
+				slog.Warn("logging to syslog failed", "err", err)
+			}
+		}
+	}
+	tracer.ShowSummary = showSummary && output == "text" // only the hop lines of the text output, -o gnu must look like GNU traceroute
+	if source != "" {
+		tracer.Source = net.ParseIP(source)
+		if tracer.Source == nil {
+			log.Fatalf("Error: -s takes an IP address, not %q", source)
+		}
+	}
+	if dscp != "" {
+		value, err := traceroute.ParseDSCP(dscp)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		tracer.TOS = value << 2
+	}
+	if data != "" || dataFile != "" {
+		var err error
+		if data != "" {
+			tracer.Payload, err = traceroute.ParsePayload(data)
+		} else {
+			tracer.Payload, err = os.ReadFile(dataFile)
+		}
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if tracer.Payload == nil {
+			tracer.Payload = []byte{} // empty, not the default
+		}
+	}
+	if ipOptions != "" {
+		var err error
+		tracer.IPOptions, err = traceroute.ParseIPOptions(ipOptions)
+		if err != nil {
+			log.Fatalf("Error parsing -ip-options: %v", err)
+		}
+	}
+	if pcapFile != "" {
+		// Unbuffered, every packet is in the file as soon as it was captured, also when
+		// the trace fails
+		f, err := os.Create(pcapFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer f.Close()
+		tracer.Capture, err = traceroute.NewPCAPWriter(f)
+		if err != nil {
+			log.Fatalf("Error writing %s: %v", pcapFile, err)
+		}
+	}
+
+	// Ctrl-C stops the trace mid-hop, keeping the hops printed so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	trace := func(tracer *traceroute.Tracer) error {
+		switch {
+		case listen != "":
+			jobs := []traceroute.PeriodicJob{{Schedule: traceroute.Every(interval.d), Target: destination, Tracer: tracer}}
+			if scheduleFile != "" {
+				var err error
+				if jobs, err = readSchedule(scheduleFile, tracer); err != nil {
+					return err
+				}
+			}
+			return serveMetrics(ctx, jobs, listen, loadDashboard(ctx, history, jobs), afterTrace)
+		case otlpEndpoint != "":
+			return exportOTLP(ctx, tracer, destination, otlpEndpoint)
+		case tui:
+			view := &traceroute.LiveView{}
+			if r, ok := tracer.Renderer.(*traceroute.TextRenderer); ok {
+				view.Colors = r.Colors // set by -color
+			}
+			return view.Run(ctx, tracer, destination)
+		case monitor:
+			m := &traceroute.Monitor{Window: window, Interval: interval.d, Paths: paths, OnTrace: eachTrace}
+			if r, ok := tracer.Renderer.(*traceroute.TextRenderer); ok {
+				m.Colors = r.Colors // set by -color
+			}
+			return m.Run(ctx, tracer, destination)
+		case quiet:
+			return printSummary(ctx, tracer, destination)
+		case report:
+			return printReport(ctx, tracer, destination, cycles, interval.d, afterTrace)
+		case hop != 0:
+			return printHop(ctx, tracer, destination, cycles, interval.d, afterTrace)
+		case statsd != nil || syslogger != nil:
+			return runExported(ctx, tracer, destination, statsd, syslogger)
+		case tmpl != nil:
+			return printTemplate(ctx, tracer, destination, tmpl)
+		case output == "json":
+			return printJSON(ctx, tracer, destination)
+		case output == "jsonl":
+			return printJSONLines(ctx, tracer, destination)
+		case output == "csv":
+			return printCSV(ctx, tracer, destination)
+		case output == "influx":
+			return printInflux(ctx, tracer, destination)
+		case output == "html":
+			return printHTML(ctx, tracer, destination)
+		case output == "dot":
+			return printDOT(ctx, tracer, destination)
+		case output == "warts":
+			return printWarts(ctx, tracer, destination)
+		case output == "atlas":
+			return printAtlas(ctx, tracer, destination)
+		case output == "pb":
+			return printProtobuf(ctx, tracer, destination)
+		case output == "gnu":
+			tracer.Renderer = &traceroute.GNURenderer{Numeric: tracer.Numeric}
+			err := tracer.Run(ctx, destination)
+			if notReached(err) {
+				return nil // GNU traceroute doesn't fail on it either, scripts may rely on that
+			}
+			return err
+		default:
+			return tracer.Run(ctx, destination)
+		}
+	}
+	if (webhook != nil || history != nil) && listen == "" && !monitor && !report && hop == 0 {
+		// Plain traces, and every cycle of -c
+		run := trace
+		trace = func(tracer *traceroute.Tracer) error {
+			result := traceroute.Result{Target: destination, Start: time.Now()}
+			counted := *tracer
+			hook := tracer.Hooks.OnProbeReply
+			counted.Hooks.OnProbeReply = func(probe traceroute.HopResult) {
+				result.Target = probe.Target
+				result.AddProbe(probe)
+				if hook != nil {
+					hook(probe)
+				}
+			}
+			err := run(&counted)
+			result.End = time.Now()
+			if (err == nil || notReached(err)) && len(result.Hops) > 0 {
+				eachTrace(&result)
+			}
+			return err
+		}
+	}
+	var err error
+	switch {
+	case nagios:
+		status := printNagios(ctx, &tracer, destination, check)
+		saveCache()
+		os.Exit(int(status))
+	case allAddresses:
+		err = traceAllAddresses(ctx, &tracer, destination, trace)
+	case repeat:
+		err = traceCycles(ctx, &tracer, cycles, interval.d, paths, trace)
+	default:
+		err = trace(&tracer)
+	}
+	for _, change := range heldChanges {
+		log.Print(change)
+	}
+	saveCache()
+	if errors.Is(err, context.Canceled) {
+		os.Exit(130) // like a shell reports a process killed by SIGINT
+	}
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// newSyslogLogger returns the SyslogLogger of the -syslog flags
+func newSyslogLogger(target, facility, severity, changeSeverity string) (*traceroute.SyslogLogger, error) {
+	logger := &traceroute.SyslogLogger{}
+	var err error
+	if logger.Network, logger.Addr, err = traceroute.ParseSyslogTarget(target); err != nil {
+		return nil, err
+	}
+	if logger.Facility, err = traceroute.ParseSyslogFacility(facility); err != nil {
+		return nil, err
+	}
+	if logger.Severity, err = traceroute.ParseSyslogSeverity(severity); err != nil {
+		return nil, err
+	}
+	if logger.ChangeSeverity, err = traceroute.ParseSyslogSeverity(changeSeverity); err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// notReached reports whether err only says that the trace ended without reaching the destination
+func notReached(err error) bool {
+	return errors.Is(err, traceroute.ErrMaxTTLExceeded) || errors.Is(err, traceroute.ErrGapLimit)
+}
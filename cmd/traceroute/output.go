@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/yildiz-fatih/traceroute"
+)
+
+// traceAllAddresses runs trace once for every address destination resolves to, under a line
+// naming the address. A trace failing doesn't keep the other addresses from being traced,
+// Ctrl-C does.
+func traceAllAddresses(ctx context.Context, tracer *traceroute.Tracer, destination string, trace func(*traceroute.Tracer) error) error {
+	addrs, err := tracer.LookupDestination(ctx, destination)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, addr := range addrs {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("=== %s, address %d of %d: %s ===\n", destination, i+1, len(addrs), addr.String())
+		pinned := *tracer
+		pinned.Resolver = traceroute.PinnedResolver{Resolver: tracer.Resolver, Host: destination, Addr: addr}
+		err := trace(&pinned)
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr.String(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// printJSON traces the route to destination and prints the result as one JSON object, also
+// when the trace ended early
+func printJSON(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	result, err := tracer.Trace(ctx, destination)
+	if result != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// printHTML traces the route to destination and prints it as a self-contained HTML page, with
+// the command line as its options, also when the trace ended early
+func printHTML(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	start := time.Now()
+	result, err := tracer.Trace(ctx, destination)
+	if result != nil {
+		info := traceroute.HTMLInfo{Started: start, Duration: time.Since(start), Options: strings.Join(os.Args[1:], " ")}
+		if err := result.WriteHTML(os.Stdout, info); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// printDOT traces the route to destination, or all load balanced paths to it with -mda, and
+// prints the hops as a Graphviz DOT graph, also when the trace ended early
+func printDOT(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	if tracer.Multipath {
+		result, err := tracer.TraceMultipath(ctx, destination)
+		if result != nil {
+			if err := result.WriteDOT(os.Stdout); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+
+	result, err := tracer.Trace(ctx, destination)
+	if result != nil {
+		if err := result.WriteDOT(os.Stdout); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// printWarts traces the route to destination and writes it as a scamper warts file, also
+// when the trace ended early
+func printWarts(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	result, err := tracer.Trace(ctx, destination)
+	if result != nil {
+		if err := result.WriteWarts(os.Stdout, tracer); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// printAtlas traces the route to destination and prints it as a RIPE Atlas traceroute
+// result, also when the trace ended early
+func printAtlas(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	result, err := tracer.Trace(ctx, destination)
+	if result != nil {
+		if err := result.WriteAtlas(os.Stdout, tracer); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// printProtobuf traces the route to destination and writes it as a protobuf record, also
+// when the trace ended early
+func printProtobuf(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	result, err := tracer.Trace(ctx, destination)
+	if result != nil {
+		if err := result.WriteProtobuf(os.Stdout); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// decode prints the protobuf records of -o pb in files, or on stdin without any, as one line
+// of JSON each (the format of -o json)
+func decode(files []string) error {
+	if len(files) == 0 {
+		return decodeFile(os.Stdin)
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = decodeFile(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func decodeFile(f *os.File) error {
+	r := bufio.NewReader(f)
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		result, err := traceroute.ReadProtobuf(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	}
+}
+
+// printJSONLines traces the route to destination and prints every probe as a line of JSON
+// as soon as it is done. Stdout isn't buffered, so every line is out right away.
+func printJSONLines(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	encoder := json.NewEncoder(os.Stdout)
+	tracer.Hooks.OnProbeReply = func(result traceroute.HopResult) {
+		encoder.Encode(result)
+	}
+	_, err := tracer.Trace(ctx, destination)
+	return err
+}
+
+// printCSV traces the route to destination and prints every probe as a CSV row as soon as
+// it is done, after a header row
+func printCSV(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	writer := csv.NewWriter(os.Stdout)
+	writer.Write(traceroute.CSVHeader())
+	writer.Flush()
+	tracer.Hooks.OnProbeReply = func(result traceroute.HopResult) {
+		writer.Write(result.CSVRecord())
+		writer.Flush()
+	}
+	_, err := tracer.Trace(ctx, destination)
+	if err == nil {
+		err = writer.Error()
+	}
+	return err
+}
+
+// printInflux traces the route to destination and prints every probe as a line of InfluxDB
+// line protocol as soon as it is done
+func printInflux(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	tracer.Hooks.OnProbeReply = func(result traceroute.HopResult) {
+		fmt.Println(result.InfluxLine())
+	}
+	_, err := tracer.Trace(ctx, destination)
+	return err
+}
+
+// printTemplate traces the route to destination and prints every probe through tmpl as
+// soon as it is done, each on a line of its own. The trace stops at the first probe tmpl fails on.
+func printTemplate(ctx context.Context, tracer *traceroute.Tracer, destination string, tmpl *template.Template) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var tmplErr error
+	tracer.Hooks.OnProbeReply = func(result traceroute.HopResult) {
+		if tmplErr != nil {
+			return
+		}
+		tmplErr = tmpl.Execute(os.Stdout, result)
+		fmt.Println()
+		if tmplErr != nil {
+			cancel()
+		}
+	}
+	_, err := tracer.Trace(ctx, destination)
+	if tmplErr != nil {
+		return fmt.Errorf("executing -format: %w", tmplErr)
+	}
+	return err
+}
+
+// exportOTLP traces the route to destination, printing the hops like Run does, and sends
+// the trace to the OpenTelemetry collector at endpoint once it is over, also when it ended early
+func exportOTLP(ctx context.Context, tracer *traceroute.Tracer, destination, endpoint string) error {
+	renderer := tracer.Renderer
+	if renderer == nil {
+		renderer = &traceroute.TextRenderer{ShowExtensions: tracer.ShowExtensions, ShowFlowLabel: tracer.FlowLabelSweep}
+	}
+	tracer.Hooks.OnProbeReply = func(result traceroute.HopResult) {
+		renderer.Render(os.Stdout, result)
+	}
+	result, err := tracer.Trace(ctx, destination)
+	if result == nil {
+		return err
+	}
+
+	// Ctrl-C ends the trace, not the export of what was found
+	exportCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	exporter := &traceroute.OTLPExporter{Endpoint: endpoint}
+	if exportErr := exporter.Export(exportCtx, result); exportErr != nil {
+		return errors.Join(err, fmt.Errorf("exporting the trace: %w", exportErr))
+	}
+	return err
+}
+
+// runExported traces the route to destination, printing the hops like Run does. Every hop
+// is logged to syslog as soon as it is done, the probes are sent to statsd once the trace is
+// over, also when it ended early. Either may be nil.
+func runExported(ctx context.Context, tracer *traceroute.Tracer, destination string, statsd *traceroute.StatsdExporter, syslogger *traceroute.SyslogLogger) error {
+	var exportErr error
+	if statsd != nil {
+		hook := tracer.Hooks.OnProbeReply
+		tracer.Hooks.OnProbeReply = func(result traceroute.HopResult) {
+			statsd.Add(result)
+			if hook != nil {
+				hook(result)
+			}
+		}
+	}
+	if syslogger != nil {
+		tracer.Hooks.OnHopComplete = func(TTL int, results []traceroute.HopResult) error {
+			if err := syslogger.LogHop(TTL, results); err != nil && exportErr == nil {
+				exportErr = fmt.Errorf("logging to syslog: %w", err) // the trace goes on
+			}
+			return nil
+		}
+	}
+	err := tracer.Run(ctx, destination)
+	if statsd != nil {
+		if flushErr := statsd.Flush(); flushErr != nil {
+			exportErr = errors.Join(exportErr, fmt.Errorf("sending to statsd: %w", flushErr))
+		}
+	}
+	return errors.Join(err, exportErr)
+}
+
+// printReport traces the route to destination cycles times, interval apart, and prints the
+// statistics of every hop at the end like mtr --report. When ctx is done, the cycles done so
+// far are printed. Every cycle is handed to afterTrace too.
+func printReport(ctx context.Context, tracer *traceroute.Tracer, destination string, cycles int, interval time.Duration, afterTrace func(*traceroute.Result)) error {
+	start := time.Now()
+	var report traceroute.Report
+	var err error
+	for cycle := range cycles {
+		if cycle > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+			if err = ctx.Err(); err != nil {
+				break
+			}
+		}
+		var result *traceroute.Result
+		result, err = tracer.Trace(ctx, destination)
+		if result == nil {
+			return err // not traced at all
+		}
+		report.Add(result)
+		afterTrace(result)
+		if err != nil && !notReached(err) {
+			break // a destination that doesn't answer is part of the report
+		}
+		err = nil
+	}
+
+	host, _ := os.Hostname()
+	fmt.Printf("Start: %s\n", start.Format(time.RFC3339))
+	report.Print(os.Stdout, host)
+	return err
+}
+
+// printHop probes the one hop tracer is set to cycles times, interval apart, printing every
+// probe as soon as it is done, and the statistics of the hop at the end like printReport. The
+// probes are numbered on across the cycles, so the hop's header is printed once.
+func printHop(ctx context.Context, tracer *traceroute.Tracer, destination string, cycles int, interval time.Duration, afterTrace func(*traceroute.Result)) error {
+	renderer := tracer.Renderer
+	if renderer == nil {
+		renderer = &traceroute.TextRenderer{ShowExtensions: tracer.ShowExtensions, ShowFlowLabel: tracer.FlowLabelSweep}
+	}
+	sent := 0
+	tracer.Hooks.OnProbeReply = func(result traceroute.HopResult) {
+		result.Probe += sent
+		renderer.Render(os.Stdout, result)
+	}
+	start := time.Now()
+	var report traceroute.Report
+	var err error
+	for cycle := range cycles {
+		if cycle > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+			if err = ctx.Err(); err != nil {
+				break
+			}
+		}
+		var result *traceroute.Result
+		result, err = tracer.Trace(ctx, destination)
+		if result == nil {
+			return err // not probed at all
+		}
+		report.Add(result)
+		afterTrace(result)
+		sent += tracer.Queries
+		if err != nil && !notReached(err) {
+			break // a hop short of the destination doesn't reach it
+		}
+		err = nil
+	}
+
+	host, _ := os.Hostname()
+	fmt.Printf("\nStart: %s\n", start.Format(time.RFC3339))
+	report.Print(os.Stdout, host)
+	return err
+}
+
+// traceCycles runs trace cycles times, interval apart, and prints the statistics of every
+// hop over all of them at the end like printReport. A destination that doesn't answer doesn't
+// stop the cycles, other errors and Ctrl-C do; the cycles done so far are printed then. Every
+// cycle is handed to paths too, unless it is nil.
+func traceCycles(ctx context.Context, tracer *traceroute.Tracer, cycles int, interval time.Duration, paths *traceroute.PathWatcher, trace func(*traceroute.Tracer) error) error {
+	start := time.Now()
+	var report traceroute.Report
+	var err error
+	for cycle := range cycles {
+		if cycle > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			fmt.Println()
+		}
+		counted := *tracer
+		hook := tracer.Hooks.OnProbeReply
+		var result traceroute.Result
+		counted.Hooks.OnProbeReply = func(probe traceroute.HopResult) {
+			report.AddProbe(probe)
+			result.Target = probe.Target
+			result.AddProbe(probe)
+			if hook != nil {
+				hook(probe)
+			}
+		}
+		err = trace(&counted)
+		if err != nil && !notReached(err) {
+			break
+		}
+		err = nil
+		if paths != nil && len(result.Hops) > 0 {
+			paths.Observe(&result)
+		}
+	}
+
+	host, _ := os.Hostname()
+	fmt.Printf("\nStart: %s\n", start.Format(time.RFC3339))
+	report.Print(os.Stdout, host)
+	return err
+}
+
+// printSummary traces the route to destination and prints only its summary, also of a
+// trace cut short
+func printSummary(ctx context.Context, tracer *traceroute.Tracer, destination string) error {
+	result, err := tracer.Trace(ctx, destination)
+	if result == nil {
+		return err // not traced at all
+	}
+	fmt.Println(result.Summary())
+	return err
+}
+
+// printNagios traces the route to destination and prints the status line of check, returning
+// its status. A trace that failed or was stopped is UNKNOWN, only reaching the max TTL or the
+// gap limit isn't a failure: the destination wasn't reached, that's CRITICAL.
+func printNagios(ctx context.Context, tracer *traceroute.Tracer, destination string, check traceroute.NagiosCheck) traceroute.NagiosStatus {
+	result, err := tracer.Trace(ctx, destination)
+	if result == nil || err != nil && !notReached(err) {
+		fmt.Println(traceroute.NagiosError(err))
+		return traceroute.NagiosUnknown
+	}
+	status, line := check.Check(result.Summary())
+	fmt.Println(line)
+	return status
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yildiz-fatih/traceroute"
+)
+
+// scan probes the targets given as arguments and in the file of -i at every TTL, statelessly
+// (see traceroute.Scanner), and prints every answer as it arrives
+func scan(args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	var scanner traceroute.Scanner
+	wait := duration{d: 5 * time.Second, unit: time.Second}
+	var input, output string
+	var verbose, debug bool
+	flags.IntVar(&scanner.FirstTTL, "f", 1, "Lowest TTL probed")
+	flags.IntVar(&scanner.MaxTTL, "m", 16, "Highest TTL probed, at most 255")
+	flags.Float64Var(&scanner.Rate, "rate", 1000, "Probes per second, of all targets and TTLs together")
+	flags.Var(&wait, "w", "Time to wait for answers after the last probe, e.g. 500ms or 5s (a plain number is seconds)")
+	flags.StringVar(&input, "i", "", "File with more targets, one IP address per line, - for stdin; # starts a comment")
+	flags.StringVar(&output, "o", "text", "Output format: text (target, TTL, responder, RTT and ICMP type of every answer, tab-separated) or jsonl (one JSON object per answer)")
+	flags.BoolVar(&verbose, "v", false, "Log diagnostics to stderr: the sockets opened and the progress of the scan")
+	flags.BoolVar(&debug, "vv", false, "Log more diagnostics to stderr than -v: also every probe that couldn't be sent")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: traceroute scan [flags] [address ...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	scanner.Wait = wait.d
+	if verbose || debug {
+		level := slog.LevelInfo
+		if debug {
+			level = slog.LevelDebug
+		}
+		scanner.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	}
+
+	targets, err := scanTargets(flags.Args(), input)
+	if err != nil {
+		return err
+	}
+	var found func(traceroute.ScanReply)
+	switch output {
+	case "text":
+		found = func(reply traceroute.ScanReply) {
+			fmt.Printf("%s\t%d\t%s\t%.3fms\t%v\n", reply.Target, reply.TTL, reply.Addr, float64(reply.RTT.Microseconds())/1000, reply.Type)
+		}
+	case "jsonl":
+		encoder := json.NewEncoder(os.Stdout)
+		found = func(reply traceroute.ScanReply) {
+			encoder.Encode(reply)
+		}
+	default:
+		return fmt.Errorf("unknown output format %q (want text or jsonl)", output)
+	}
+
+	// Ctrl-C ends the scan, keeping the answers printed so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stats, err := scanner.Scan(ctx, targets, found)
+	fmt.Fprintf(os.Stderr, "%d targets, %d probes sent, %d failed, %d answers\n", len(targets), stats.Sent, stats.Failed, stats.Replies)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// scanTargets parses the addresses in args and in the file input, if any
+func scanTargets(args []string, input string) ([]net.IP, error) {
+	var targets []net.IP
+	for _, arg := range args {
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid target %q, want an IP address", arg)
+		}
+		targets = append(targets, ip)
+	}
+	if input == "" {
+		return targets, nil
+	}
+	f := os.Stdin
+	if input != "-" {
+		var err error
+		if f, err = os.Open(input); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: invalid target %q, want an IP address", input, n, line)
+		}
+		targets = append(targets, ip)
+	}
+	return targets, scanner.Err()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/yildiz-fatih/traceroute"
+)
+
+// readSchedule reads the jobs of the -schedule file, traced with tracer unless a line asks
+// for other options
+func readSchedule(file string, tracer *traceroute.Tracer) ([]traceroute.PeriodicJob, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	jobs, err := traceroute.ReadSchedule(f, *tracer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return jobs, nil
+}
+
+// loadDashboard returns the dashboard of -listen, filled with the traces of every target of
+// jobs stored in history, unless it is nil
+func loadDashboard(ctx context.Context, history *traceroute.History, jobs []traceroute.PeriodicJob) *traceroute.Dashboard {
+	dashboard := &traceroute.Dashboard{}
+	if history == nil {
+		return dashboard
+	}
+	loaded := make(map[string]bool)
+	for _, job := range jobs {
+		if loaded[job.Target] {
+			continue // scheduled twice, with other options
+		}
+		loaded[job.Target] = true
+		if err := dashboard.Load(ctx, history, job.Target); err != nil {
+			slog.Warn("loading the history failed", "target", job.Target, "err", err) // the dashboard starts out empty
+		}
+	}
+	return dashboard
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yildiz-fatih/traceroute"
+)
+
+// serve runs traces requested over HTTP (see traceroute.APIServer) until Ctrl-C
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	var tracer traceroute.Tracer
+	wait := duration{d: 5 * time.Second, unit: time.Second}
+	var addr string
+	var maxRunning, maxQueued, history int
+	var verbose, debug bool
+	flags.StringVar(&addr, "listen", "localhost:8080", "Address to serve the API on; it has no authentication, so think twice before serving it beyond localhost")
+	flags.IntVar(&maxRunning, "max-running", 4, "Traces running at once, the others wait for them")
+	flags.IntVar(&maxQueued, "max-queued", 100, "Traces waiting to run, more are turned away")
+	flags.IntVar(&history, "history", 100, "Finished traces kept for GET /traces, the oldest are forgotten")
+	traceDefaults(flags, &tracer, &wait, &verbose, &debug)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: traceroute serve [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("serve takes no arguments, the targets come with the requests")
+	}
+	if maxRunning < 1 || maxQueued < 1 || history < 1 {
+		return errors.New("-max-running, -max-queued and -history must be at least 1")
+	}
+	tracer.Wait = wait.d
+	api := traceroute.NewAPIServer(tracer)
+	api.MaxRunning, api.MaxQueued, api.History = maxRunning, maxQueued, history
+	var handler http.Handler = api
+	if verbose || debug {
+		api.Tracer.Logger = serviceLogger(debug)
+		handler = logRequests(api.Tracer.Logger, api)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: handler}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Serve(listener) }()
+	slog.Info("serving the API", "url", fmt.Sprintf("http://%s/traces", listener.Addr()))
+
+	// Ctrl-C stops the traces running, which ends their streams, then the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErr:
+		api.Close()
+		return err
+	case <-ctx.Done():
+	}
+	api.Close()
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdown)
+}
+
+// agent runs traces a controller asks for over gRPC (see traceroute.Agent) until Ctrl-C
+func agent(args []string) error {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	var tracer traceroute.Tracer
+	wait := duration{d: 5 * time.Second, unit: time.Second}
+	var addr, certFile, keyFile string
+	var maxRunning int
+	var verbose, debug bool
+	flags.StringVar(&addr, "listen", "localhost:50051", "Address to serve the Agent service on; it has no authentication, so think twice before serving it beyond localhost without a proxy that has")
+	flags.StringVar(&certFile, "tls-cert", "", "Serve over TLS with this certificate (PEM), else in cleartext (h2c)")
+	flags.StringVar(&keyFile, "tls-key", "", "Private key (PEM) of -tls-cert")
+	flags.IntVar(&maxRunning, "max-running", 4, "Traces running at once, over all calls; the others wait for them")
+	traceDefaults(flags, &tracer, &wait, &verbose, &debug)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: traceroute agent [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("agent takes no arguments, the targets come with the calls")
+	}
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("-tls-cert and -tls-key go together")
+	}
+	if maxRunning < 1 {
+		return errors.New("-max-running must be at least 1")
+	}
+	tracer.Wait = wait.d
+	a := traceroute.NewAgent(tracer)
+	a.MaxRunning = maxRunning
+	var handler http.Handler = a
+	if verbose || debug {
+		a.Tracer.Logger = serviceLogger(debug)
+		handler = logRequests(a.Tracer.Logger, a)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: handler, Protocols: new(http.Protocols)}
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(true) // gRPC clients speak HTTP/2 right away without TLS
+	serverErr := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			serverErr <- server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			serverErr <- server.Serve(listener)
+		}
+	}()
+	slog.Info("serving the Agent service", "addr", listener.Addr().String(), "tls", certFile != "")
+
+	// Ctrl-C stops the traces running, which ends their calls, then the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErr:
+		a.Close()
+		return err
+	case <-ctx.Done():
+	}
+	a.Close()
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdown)
+}
+
+// traceDefaults adds the flags of serve and agent setting what their traces are based on,
+// and -v and -vv
+func traceDefaults(flags *flag.FlagSet, tracer *traceroute.Tracer, wait *duration, verbose, debug *bool) {
+	flags.StringVar(&tracer.Method, "M", traceroute.MethodICMP, "Probe method of traces that don't ask for one: icmp, udp, xecho, sctp, dccp, tcp or quic")
+	flags.IntVar(&tracer.Queries, "q", 3, "Probes per hop of traces that don't ask for a number")
+	flags.IntVar(&tracer.MaxTTL, "m", 30, "Max TTL of traces that don't ask for one")
+	flags.Var(wait, "w", "Time to wait for a response to a probe of traces that don't ask for one, e.g. 300ms or 2s (a plain number is seconds)")
+	flags.IntVar(&tracer.GapLimit, "gaplimit", 5, "Give up after this many hops in a row without any answer (0: never)")
+	flags.StringVar(&tracer.Socket, "socket", traceroute.SocketAuto, "Socket type: raw (needs root), dgram (unprivileged), hdrincl or auto")
+	flags.BoolVar(&tracer.Numeric, "n", false, "Don't look up the names of the hops")
+	flags.BoolVar(verbose, "v", false, "Log diagnostics to stderr: the requests and the sockets opened and closed")
+	flags.BoolVar(debug, "vv", false, "Log more diagnostics to stderr than -v: also every probe sent and every packet read")
+}
+
+// serviceLogger returns the logger of -v, or of -vv with debug
+func serviceLogger(debug bool) *slog.Logger {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+// logRequests logs every request before handler handles it
+func logRequests(logger *slog.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Info("request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serveMetrics traces the targets of jobs on their schedules and serves metrics about the
+// traces to Prometheus on addr, and dashboard, until ctx is done. Every trace is handed to
+// afterTrace too.
+func serveMetrics(ctx context.Context, jobs []traceroute.PeriodicJob, addr string, dashboard *traceroute.Dashboard, afterTrace func(*traceroute.Result)) error {
+	exporter := traceroute.NewPrometheusExporter()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	mux.Handle("/", dashboard)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Serve(listener) }()
+	defer server.Close()
+	slog.Info("serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+	slog.Info("serving the dashboard", "url", fmt.Sprintf("http://%s/", listener.Addr()))
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	periodic := &traceroute.Periodic{Jobs: jobs}
+	periodic.OnTrace = func(job traceroute.PeriodicJob, result *traceroute.Result, err error) {
+		switch {
+		case errors.Is(err, traceroute.ErrPermission):
+			cancel(err) // won't get better by trying again
+			return
+		case result != nil:
+			exporter.Observe(result)
+			dashboard.Observe(result)
+			afterTrace(result)
+		}
+		if err != nil && !notReached(err) {
+			slog.Error("trace failed", "target", job.Target, "err", err) // e.g. DNS failing for a while, try again next time
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		periodic.Run(ctx)
+	}()
+
+	select {
+	case err := <-serverErr:
+		cancel(err)
+		<-done
+		return err
+	case <-done:
+		return context.Cause(ctx) // Ctrl-C, or missing permissions
+	}
+}
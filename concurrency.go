@@ -0,0 +1,125 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+)
+
+/*
+Concurrent probing (-N)
+
+A Scheduler only ever sees the probes of one hop, so a trace waits for every hop before the
+next one is probed: a path with ten silent hops takes ten wait times and more. Like the
+traceroute command's -N, Tracer.Concurrency keeps up to that many probes in flight at once,
+of the hops ahead as well:
+
+	in flight:  TTL 1 #1  TTL 1 #2  TTL 1 #3  TTL 2 #1  ...  (Concurrency probes, a new one
+	                                                          sent as soon as one is done)
+	emitted:    TTL 1 #1  TTL 1 #2  TTL 1 #3  TTL 2 #1  ...  (in order, each as soon as it
+	                                                          and all probes before it are done)
+
+The probes go out hop by hop (in random order with Shuffle), and the results are still emitted
+in order, so renderers, hooks and Result don't notice. As with the Parallel scheduler, every
+probe in flight needs a socket of its own: ICMP probes get an Echo Identifier of their own on
+a Session, UDP and QUIC probes a socket of their own; SCTP, DCCP and TCP probes share one
+socket and don't work with it. The probes of a hop keep the sequence numbers they would have
+one at a time, (TTL-FirstTTL)×Queries+1 and on.
+
+Hops beyond the destination are sent to before it answered, at most Concurrency probes' worth,
+and their results are dropped. Once the trace is over (the destination answered, GapLimit hops
+in a row were silent or OnHopComplete stopped it), the probes still in flight are cancelled.
+*/
+
+// concurrentProbes reports whether probes of tr are in flight at the same time, so every one
+// of them needs a socket (or Echo Identifier) of its own
+func (tr *trace) concurrentProbes() bool {
+	return tr.concurrency > 1 || concurrent(tr.scheduler)
+}
+
+// runConcurrent is run with up to tr.concurrency probes in flight at once, see above
+func (tr *trace) runConcurrent(ctx context.Context, emit func(HopResult)) error {
+	var wg sync.WaitGroup
+	defer wg.Wait() // after the cancel below, so the probes in flight stop waiting for answers
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hops := tr.maxTTL - tr.firstTTL + 1
+	results := make([][]HopResult, hops)
+	done := make([][]chan struct{}, hops)
+	for i := range hops {
+		results[i] = make([]HopResult, tr.queries)
+		done[i] = make([]chan struct{}, tr.queries)
+		for probe := range done[i] {
+			done[i][probe] = make(chan struct{})
+		}
+	}
+
+	order := make([]int, hops)
+	for i := range order {
+		order[i] = i
+	}
+	if tr.shuffle {
+		order = rand.Perm(hops)
+	}
+
+	var mu sync.Mutex
+	reachedTTL := tr.maxTTL + 1 // lowest TTL the destination answered at, under mu
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		inFlight := make(chan struct{}, tr.concurrency)
+		for _, i := range order {
+			TTL := tr.firstTTL + i
+			for probe := range tr.queries {
+				select {
+				case inFlight <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				mu.Lock()
+				beyond := TTL > reachedTTL
+				mu.Unlock()
+				if beyond {
+					<-inFlight
+					break // the destination would answer it too
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					result := tr.probe(ctx, TTL, probe, i*tr.queries+probe+1)
+					if result.Reached {
+						mu.Lock()
+						reachedTTL = min(reachedTTL, TTL)
+						mu.Unlock()
+					}
+					results[i][probe] = result
+					close(done[i][probe])
+					<-inFlight
+				}()
+			}
+		}
+	}()
+
+	gap := 0 // hops in a row without any answer
+	for i := range hops {
+		TTL := tr.firstTTL + i
+		for probe := range tr.queries {
+			select {
+			case <-done[i][probe]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if err := ctx.Err(); err != nil {
+				return err // cancelled mid-hop, everything up to here was emitted
+			}
+			tr.emitProbe(results[i][probe], emit)
+		}
+		if over, err := tr.completeHop(TTL, results[i], &gap); over {
+			return err
+		}
+	}
+	return fmt.Errorf("%w (%d hops)", ErrMaxTTLExceeded, tr.maxTTL)
+}
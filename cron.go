@@ -0,0 +1,374 @@
+package traceroute
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Scheduled traces (-listen -schedule)
+
+Periodic traces targets on schedules, each with a Tracer of its own, and hands every trace to
+OnTrace, so one daemon can measure many paths, each as often as it needs. A schedule is
+
+	every 5m                right away, then 5 minutes after every trace ended (a time.Duration)
+	0,30 8-18 * * mon-fri   like cron: minute, hour, day of month, month, day of week
+	@hourly                 cron's shorthands: @yearly, @monthly, @weekly, @daily and @hourly
+
+The cron fields take *, numbers, ranges (1-5), steps (0-30/5, or * with /10 for every 10th),
+lists of them (1,15,30) and the names of months and days (jan, mon); Sunday is 0 or 7. Like
+cron, a day matches when the day of month or the day of week does, unless one of them is *.
+The times are local. A cron schedule traces at the start of every minute it matches, but
+never twice at once: a trace still running then skips it.
+
+A schedule file has a line per target: its schedule, the target, and options as POST /traces
+takes them (see api.go), key=value or the name alone for true. The other options are those of
+the Tracer it is read with, e.g. the command line flags:
+
+	# schedule       target        options
+	every 5m         example.com
+	0 * * * *        192.0.2.7     method=tcp port=443
+	@daily           2001:db8::1   queries=5 max_ttl=20 paris
+*/
+
+// Schedule tells when to trace, see above
+type Schedule struct {
+	spec  string
+	every time.Duration // of "every", 0 for a cron schedule
+
+	// Of a cron schedule: bit n is set when n matches
+	minute, hour, day, month, weekday uint64
+	anyDay, anyWeekday                bool // the field is *
+}
+
+// cronFields are the fields of a cron schedule: their ranges and the names of their values
+var cronFields = []struct {
+	name     string
+	min, max int
+	names    []string // of min, min+1, ...
+}{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat", "sun"}},
+}
+
+// cronShorthands are the @ schedules of cron
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Every returns the schedule "every d"
+func Every(d time.Duration) Schedule {
+	return Schedule{spec: "every " + d.String(), every: d}
+}
+
+// ParseSchedule parses a schedule, see above
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.Join(strings.Fields(spec), " ")
+	if rest, ok := strings.CutPrefix(spec, "every "); ok {
+		d, err := time.ParseDuration(rest)
+		if err != nil || d <= 0 {
+			return Schedule{}, fmt.Errorf("schedule %q: want a duration like 5m after every", spec)
+		}
+		return Schedule{spec: spec, every: d}, nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) == 1 && strings.HasPrefix(spec, "@") {
+		expanded, ok := cronShorthands[strings.ToLower(spec)]
+		if !ok {
+			return Schedule{}, fmt.Errorf("schedule %q: unknown, want @yearly, @monthly, @weekly, @daily or @hourly", spec)
+		}
+		fields = strings.Fields(expanded)
+	}
+	if len(fields) != len(cronFields) {
+		return Schedule{}, fmt.Errorf("schedule %q: want every and a duration, or 5 cron fields (minute, hour, day of month, month, day of week)", spec)
+	}
+	s := Schedule{spec: spec}
+	bits := []*uint64{&s.minute, &s.hour, &s.day, &s.month, &s.weekday}
+	for i, field := range fields {
+		var err error
+		if *bits[i], err = parseCronField(field, i); err != nil {
+			return Schedule{}, fmt.Errorf("schedule %q: %s: %v", spec, cronFields[i].name, err)
+		}
+	}
+	if s.weekday&(1<<7) != 0 {
+		s.weekday |= 1 // Sunday is 7 too
+	}
+	s.anyDay, s.anyWeekday = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	if s.Next(time.Now()).IsZero() {
+		return Schedule{}, fmt.Errorf("schedule %q: never matches", spec)
+	}
+	return s, nil
+}
+
+// parseCronField returns the bits of the values field i of a cron schedule matches
+func parseCronField(field string, i int) (uint64, error) {
+	f := cronFields[i]
+	// value parses a number or name, the first name of at least atLeast: sun ends fri-sun as 7
+	value := func(s string, atLeast int) (int, error) {
+		for n, name := range f.names {
+			if strings.EqualFold(s, name) && f.min+n >= atLeast {
+				return f.min + n, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < f.min || n > f.max {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, f.min, f.max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("step %q is not a positive number", stepPart)
+			}
+		}
+		lo, hi := f.min, f.max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = value(from, f.min); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to, lo); err != nil {
+					return 0, err
+				}
+			} else if stepped {
+				hi = f.max // 5/15 is 5-59/15
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range %q runs backwards", rangePart)
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << n
+		}
+	}
+	return bits, nil
+}
+
+// String returns the schedule as it was written
+func (s Schedule) String() string {
+	return s.spec
+}
+
+// Next returns when to trace after t: for "every d" d after it, for a cron schedule the
+// first minute it matches after it; zero when there is none within 5 years (February 30th)
+func (s Schedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay reports whether the day of t matches, see above
+func (s Schedule) matchesDay(t time.Time) bool {
+	day := s.day&(1<<t.Day()) != 0
+	weekday := s.weekday&(1<<t.Weekday()) != 0
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+// PeriodicJob is a target Periodic traces on a schedule
+type PeriodicJob struct {
+	Schedule Schedule
+	Target   string
+	Tracer   *Tracer
+}
+
+// Periodic traces the targets of Jobs on their schedules, see above
+type Periodic struct {
+	Jobs       []PeriodicJob
+	MaxRunning int                                              // traces running at once, 0 means 4; the others wait
+	OnTrace    func(job PeriodicJob, result *Result, err error) // called with every trace, one at a time, as Trace returned it
+}
+
+// Run traces until ctx is done, and returns ctx.Err() then
+func (p *Periodic) Run(ctx context.Context) error {
+	slots := make(chan struct{}, cmp.Or(p.MaxRunning, 4))
+	var mu sync.Mutex // OnTrace is called one at a time
+	var wg sync.WaitGroup
+	for _, job := range p.Jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			next := time.Now()
+			if job.Schedule.every == 0 {
+				next = job.Schedule.Next(next)
+			}
+			for !next.IsZero() {
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				result, err := job.Tracer.Trace(ctx, job.Target)
+				<-slots
+				if ctx.Err() != nil {
+					return
+				}
+				if p.OnTrace != nil {
+					mu.Lock()
+					p.OnTrace(job, result, err)
+					mu.Unlock()
+				}
+				next = job.Schedule.Next(time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// ReadSchedule reads a schedule file, see above, basing the Tracer of every job on base
+func ReadSchedule(r io.Reader, base Tracer) ([]PeriodicJob, error) {
+	var jobs []PeriodicJob
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		// The schedule is 2 fields (every 5m), 1 (@hourly) or 5 (cron)
+		n := len(cronFields)
+		switch {
+		case fields[0] == "every":
+			n = 2
+		case strings.HasPrefix(fields[0], "@"):
+			n = 1
+		}
+		if len(fields) <= n {
+			return nil, fmt.Errorf("line %d: want a schedule and a target", line)
+		}
+		schedule, err := ParseSchedule(strings.Join(fields[:n], " "))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		request := apiRequest{Target: fields[n]}
+		for _, option := range fields[n+1:] {
+			if err := request.set(option); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		tracer, err := request.tracer(base)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		jobs = append(jobs, PeriodicJob{Schedule: schedule, Target: request.Target, Tracer: tracer})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, errors.New("no targets scheduled")
+	}
+	return jobs, nil
+}
+
+// set sets an option of a schedule file line, key=value or the name of a bool alone
+func (request *apiRequest) set(option string) error {
+	key, value, hasValue := strings.Cut(option, "=")
+	var err error
+	number := func() int {
+		var n int
+		n, err = strconv.Atoi(value)
+		return n
+	}
+	flag := func() bool {
+		if !hasValue {
+			return true
+		}
+		var b bool
+		b, err = strconv.ParseBool(value)
+		return b
+	}
+	switch key {
+	case "ipv4", "ipv6", "paris":
+	case "method", "port", "first_ttl", "max_ttl", "queries", "wait_ms":
+		if !hasValue {
+			return fmt.Errorf("option %s needs a value, %s=...", key, key)
+		}
+	default:
+		return fmt.Errorf("unknown option %q (want method, port, first_ttl, max_ttl, queries, wait_ms, ipv4, ipv6 or paris)", key)
+	}
+	switch key {
+	case "method":
+		request.Method = value
+	case "port":
+		request.Port = number()
+	case "first_ttl":
+		request.FirstTTL = number()
+	case "max_ttl":
+		request.MaxTTL = number()
+	case "queries":
+		request.Queries = number()
+	case "wait_ms":
+		request.WaitMS, err = strconv.ParseFloat(value, 64)
+	case "ipv4":
+		request.IPv4 = flag()
+	case "ipv6":
+		request.IPv6 = flag()
+	case "paris":
+		request.Paris = flag()
+	}
+	if err != nil {
+		return fmt.Errorf("option %s: %q is not a valid value", key, value)
+	}
+	return nil
+}
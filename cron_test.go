@@ -0,0 +1,157 @@
+package traceroute
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// cronBits returns the bits of values
+func cronBits(values ...int) uint64 {
+	var bits uint64
+	for _, n := range values {
+		bits |= 1 << n
+	}
+	return bits
+}
+
+func TestParseCronField(t *testing.T) {
+	const (
+		minute = iota
+		hour
+		day
+		month
+		weekday
+	)
+	for _, test := range []struct {
+		field string
+		i     int
+		want  uint64
+		err   string
+	}{
+		{field: "*", i: minute, want: 1<<60 - 1},
+		{field: "*", i: day, want: 1<<32 - 2},
+		{field: "*/15", i: minute, want: cronBits(0, 15, 30, 45)},
+		{field: "5/15", i: minute, want: cronBits(5, 20, 35, 50)},
+		{field: "1-5", i: hour, want: cronBits(1, 2, 3, 4, 5)},
+		{field: "8-18/5", i: hour, want: cronBits(8, 13, 18)},
+		{field: "1,15,30", i: day, want: cronBits(1, 15, 30)},
+		{field: "1-3,20-22/2", i: day, want: cronBits(1, 2, 3, 20, 22)},
+		{field: "jan-mar", i: month, want: cronBits(1, 2, 3)},
+		{field: "JUN,dec", i: month, want: cronBits(6, 12)},
+		{field: "mon-fri", i: weekday, want: cronBits(1, 2, 3, 4, 5)},
+		{field: "sun", i: weekday, want: cronBits(0)},
+		{field: "7", i: weekday, want: cronBits(7)},
+		{field: "*/2", i: weekday, want: cronBits(0, 2, 4, 6)},
+		{field: "fri-sun", i: weekday, want: cronBits(5, 6, 7)},
+
+		{field: "60", i: minute, err: `"60" is not between 0 and 59`},
+		{field: "24", i: hour, err: `"24" is not between 0 and 23`},
+		{field: "0", i: day, err: `"0" is not between 1 and 31`},
+		{field: "13", i: month, err: `"13" is not between 1 and 12`},
+		{field: "8", i: weekday, err: `"8" is not between 0 and 7`},
+		{field: "-1", i: minute, err: `"" is not between 0 and 59`},
+		{field: "mon", i: month, err: `"mon" is not between 1 and 12`},
+		{field: "5-1", i: hour, err: `range "5-1" runs backwards`},
+		{field: "*/0", i: minute, err: `step "0" is not a positive number`},
+		{field: "*/x", i: minute, err: `step "x" is not a positive number`},
+		{field: "1,,2", i: minute, err: `"" is not between 0 and 59`},
+	} {
+		got, err := parseCronField(test.field, test.i)
+		switch {
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s %q: error %v, want %s", cronFields[test.i].name, test.field, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("%s %q: %v", cronFields[test.i].name, test.field, err)
+		case got != test.want:
+			t.Errorf("%s %q: bits %b, want %b", cronFields[test.i].name, test.field, got, test.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, test := range []struct {
+		spec string
+		err  string
+	}{
+		{"every 0s", "want a duration like 5m after every"},
+		{"every -5m", "want a duration like 5m after every"},
+		{"every often", "want a duration like 5m after every"},
+		{"@fortnightly", "unknown, want @yearly"},
+		{"* * * *", "want every and a duration, or 5 cron fields"},
+		{"* * * * * *", "want every and a duration, or 5 cron fields"},
+		{"61 * * * *", `minute: "61" is not between 0 and 59`},
+		{"* * * 0 *", `month: "0" is not between 1 and 12`},
+		{"* * * * 8", `day of week: "8" is not between 0 and 7`},
+		{"0 0 30 2 *", "never matches"},
+		{"0 0 31 4,6,9,11 *", "never matches"},
+	} {
+		_, err := ParseSchedule(test.spec)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: error %v, want one saying %s", test.spec, err, test.err)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// A Friday
+	from := time.Date(2026, 10, 16, 12, 0, 30, 0, time.UTC)
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	for _, test := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"every 5m", from.Add(5 * time.Minute)},
+		{"* * * * *", at(10, 16, 12, 1)},
+		{"*/15 * * * *", at(10, 16, 12, 15)},
+		{"0,30 8-18 * * mon-fri", at(10, 16, 12, 30)},
+		{"0 9 * * mon-fri", at(10, 19, 9, 0)},
+		{"0 12 16 oct *", time.Date(2027, 10, 16, 12, 0, 0, 0, time.UTC)}, // not the minute it is in
+		{"  0   9 *  * *  ", at(10, 17, 9, 0)},
+
+		// Sunday is 0 and 7
+		{"0 0 * * 0", at(10, 18, 0, 0)},
+		{"0 0 * * 7", at(10, 18, 0, 0)},
+		{"0 0 * * sun", at(10, 18, 0, 0)},
+		{"0 0 * * fri-sun", at(10, 17, 0, 0)},
+
+		// The day of month or the day of week, unless one of them is *
+		{"0 0 17 * mon", at(10, 17, 0, 0)},
+		{"0 0 30 * mon", at(10, 19, 0, 0)},
+		{"0 0 30 * *", at(10, 30, 0, 0)},
+		{"0 0 * * mon", at(10, 19, 0, 0)},
+		{"0 0 */10 * mon", at(10, 19, 0, 0)}, // */10 counts as *, like cron's
+		{"0 0 1 * mon", at(10, 19, 0, 0)},
+
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", at(10, 31, 0, 0)},
+		{"0 0 31 11,12 *", at(12, 31, 0, 0)},
+
+		{"@hourly", at(10, 16, 13, 0)},
+		{"@daily", at(10, 17, 0, 0)},
+		{"@midnight", at(10, 17, 0, 0)},
+		{"@weekly", at(10, 18, 0, 0)},
+		{"@monthly", at(11, 1, 0, 0)},
+		{"@YEARLY", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		s, err := ParseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(test.want) {
+			t.Errorf("%q: next after %v is %v, want %v", test.spec, from, got, test.want)
+		}
+	}
+
+	// Not within 5 years: ParseSchedule refuses it, Next gives up
+	never := Schedule{spec: "0 0 30 2 *", minute: cronBits(0), hour: cronBits(0), day: cronBits(30), month: cronBits(2), weekday: 1<<8 - 1, anyWeekday: true}
+	if got := never.Next(from); !got.IsZero() {
+		t.Errorf("February 30th is at %v", got)
+	}
+}
@@ -0,0 +1,51 @@
+package traceroute
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+CSV encoding of HopResult (-o csv)
+
+One row per probe, under the header returned by CSVHeader:
+
+	timestamp,target,ttl,probe,responder_ip,rdns,rtt_ms,icmp_type,error
+	2026-10-16T00:31:07.123456Z,example.com,1,1,192.0.2.1,router.lan.,0.412,time exceeded,
+	2026-10-16T00:31:12.127001Z,example.com,2,1,,,,,no answer within the wait time: ...
+
+The timestamp is when the probe was sent, in UTC. Columns without a value are left empty.
+*/
+
+// CSVHeader returns the column names of the CSV rows returned by HopResult.CSVRecord
+func CSVHeader() []string {
+	return []string{"timestamp", "target", "ttl", "probe", "responder_ip", "rdns", "rtt_ms", "icmp_type", "error"}
+}
+
+// CSVRecord returns the probe as a CSV row, see CSVHeader
+func (r HopResult) CSVRecord() []string {
+	probe := r.probe()
+	record := []string{
+		r.Sent.UTC().Format(time.RFC3339Nano),
+		r.Target,
+		strconv.Itoa(r.TTL),
+		strconv.Itoa(r.Probe),
+		"", // responder_ip
+		probe.Name,
+		"", // rtt_ms
+		"", // icmp_type
+		"", // error
+	}
+	if probe.Addr != nil {
+		record[4] = probe.Addr.String()
+		record[6] = strconv.FormatFloat(float64(probe.RTT.Microseconds())/1000, 'f', 3, 64)
+	}
+	if probe.Type != nil {
+		record[7] = fmt.Sprint(probe.Type)
+	}
+	if probe.Err != nil {
+		record[8] = probe.Err.Error()
+	}
+	return record
+}
@@ -0,0 +1,398 @@
+package traceroute
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Web dashboard (-listen)
+
+A Dashboard is handed every trace of a run that traces over and over (Observe), and serves a
+page about the last of them for people watching a path without a terminal, e.g. in a NOC. Like
+-o html it is one page without external resources or scripts (inline SVG); it reloads itself
+every Refresh. For every target:
+
+	example.com (93.184.216.34)
+	Last trace  2026-10-16 09:41:07 UTC: reached in 12 hops, rtt min/avg/max = 9.8/10.2/10.9 ms
+	Path        3f2a9c1b5d7e0a46 since 2026-10-16 08:12:40 UTC, 2 changes
+	Traces      360 since 2026-10-16 08:41:07 UTC
+
+	Hop  Host                      Loss   Snt  Last  Avg   Best  Worst  RTTs (ms)
+	1    router.lan (192.168.1.1)  0.0%  1080  0.4   0.4   0.3   0.6    [sparkline]
+	...
+
+	RTT to the destination (ms)     [chart of the average RTT of every trace over time]
+	Loss at the destination (%)     [chart of the share of probes of its hop it didn't answer]
+	Path                            [a strip with a color per path fingerprint, trace by trace]
+	                                the changes, newest first, with their diffs (see pathchange.go)
+
+The statistics are those of the traces kept, the last Traces of every target; the sparkline
+of a hop shows the RTTs of its last probes. Load fills a Dashboard with the last traces stored
+in a History, so it doesn't start out empty after a restart.
+*/
+
+// Size of the charts over time, in pixels
+const (
+	chartWidth  = 720
+	chartHeight = 120
+	chartMargin = 48 // left, for the axis labels
+)
+
+// Dashboard serves a page about the traces it observed, see above. It is an http.Handler for
+// the page at /, and safe for concurrent use.
+type Dashboard struct {
+	Traces  int           // traces kept per target, 0 means 360
+	Refresh time.Duration // time between reloads of the page, 0 means 10 seconds
+
+	mu      sync.Mutex
+	targets map[string]*dashTarget
+	paths   PathWatcher
+}
+
+// dashTarget holds the traces of one target
+type dashTarget struct {
+	traces  []*Result    // oldest first
+	changes []PathChange // oldest first, the last Traces of them
+}
+
+// Observe adds the trace result to the dashboard; it must not change afterwards
+func (d *Dashboard) Observe(result *Result) {
+	keep := cmp.Or(d.Traces, 360)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	change := d.paths.Observe(result)
+	if change != nil && !result.End.IsZero() {
+		change.Time = result.End // also of traces loaded from a History
+	}
+	if d.targets == nil {
+		d.targets = make(map[string]*dashTarget)
+	}
+	t := d.targets[result.Target]
+	if t == nil {
+		t = &dashTarget{}
+		d.targets[result.Target] = t
+	}
+	t.traces = append(t.traces, result)
+	if len(t.traces) > keep {
+		t.traces = slices.Delete(t.traces, 0, len(t.traces)-keep)
+	}
+	if change != nil {
+		t.changes = append(t.changes, *change)
+		if len(t.changes) > keep {
+			t.changes = slices.Delete(t.changes, 0, len(t.changes)-keep)
+		}
+	}
+}
+
+// Load observes the last traces to target stored in history, as many as the dashboard keeps
+func (d *Dashboard) Load(ctx context.Context, history *History, target string) error {
+	results, err := history.Recent(ctx, target, cmp.Or(d.Traces, 360))
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		d.Observe(result)
+	}
+	return nil
+}
+
+// dashTargetPage is a target on the page
+type dashTargetPage struct {
+	Target, Addr           string
+	Last, Status           string
+	Fingerprint, PathSince string
+	Changes                []dashChange
+	Traces                 int
+	First                  string
+	Hops                   []dashHop
+	RTTChart, LossChart    template.HTML
+	PathStrip              template.HTML
+}
+
+// dashHop is a row of the hop table
+type dashHop struct {
+	TTL                    int
+	Hosts                  []string
+	Loss                   float64
+	Sent                   int
+	Answered               bool
+	Last, Avg, Best, Worst string
+	Sparkline              template.HTML
+}
+
+// dashChange is a path change on the page
+type dashChange struct {
+	Time, Kinds, Diff string
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>traceroute dashboard</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.2em; margin-top: 2em; border-bottom: 1px solid #888; }
+h3 { font-size: 1em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.25em 0.8em; text-align: left; }
+.hops th { border-bottom: 2px solid #888; }
+.hops td { border-bottom: 1px solid #ddd; font-variant-numeric: tabular-nums; }
+.hops td.num { text-align: right; }
+.meta th { color: #666; font-weight: normal; }
+.lost { color: #c00; }
+.updated { color: #666; }
+pre { background: #f4f4f4; padding: 0.5em; }
+</style>
+</head>
+<body>
+<h1>traceroute dashboard</h1>
+<p class="updated">Updated {{.Updated}}, reloads every {{.Refresh}}s</p>
+{{- range .Targets}}
+<h2>{{.Target}}{{with .Addr}} ({{.}}){{end}}</h2>
+<table class="meta">
+<tr><th>Last trace</th><td>{{.Last}}: {{.Status}}</td></tr>
+<tr><th>Path</th><td><code>{{.Fingerprint}}</code>{{with .PathSince}} since {{.}}{{end}}, {{len .Changes}} change{{if ne (len .Changes) 1}}s{{end}}</td></tr>
+<tr><th>Traces</th><td>{{.Traces}} since {{.First}}</td></tr>
+</table>
+<h3>Hops</h3>
+<table class="hops">
+<tr><th>Hop</th><th>Host</th><th>Loss</th><th>Snt</th><th>Last</th><th>Avg</th><th>Best</th><th>Worst</th><th>RTTs (ms)</th></tr>
+{{- range .Hops}}
+<tr>
+<td class="num">{{.TTL}}</td>
+<td>{{range $i, $host := .Hosts}}{{if $i}}<br>{{end}}{{$host}}{{else}}*{{end}}</td>
+<td class="num{{if .Loss}} lost{{end}}">{{printf "%.1f" .Loss}}%</td>
+<td class="num">{{.Sent}}</td>
+{{- if .Answered}}
+<td class="num">{{.Last}}</td><td class="num">{{.Avg}}</td><td class="num">{{.Best}}</td><td class="num">{{.Worst}}</td>
+{{- else}}
+<td></td><td></td><td></td><td></td>
+{{- end}}
+<td>{{.Sparkline}}</td>
+</tr>
+{{- end}}
+</table>
+<h3>RTT to the destination (ms)</h3>
+{{.RTTChart}}
+<h3>Loss at the destination (%)</h3>
+{{.LossChart}}
+<h3>Path</h3>
+{{.PathStrip}}
+{{- range .Changes}}
+<p>{{.Time}}: {{.Kinds}}</p>
+<pre>{{.Diff}}</pre>
+{{- end}}
+{{- else}}
+<p>No traces yet.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// ServeHTTP serves the page, see above
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	refresh := d.Refresh
+	if refresh == 0 {
+		refresh = 10 * time.Second
+	}
+	page := struct {
+		Updated string
+		Refresh int
+		Targets []dashTargetPage
+	}{Updated: dashTime(time.Now()), Refresh: max(1, int(refresh.Seconds()))}
+
+	d.mu.Lock()
+	names := make([]string, 0, len(d.targets))
+	for name := range d.targets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		page.Targets = append(page.Targets, d.targets[name].page(name))
+	}
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// page returns the part of the page about the target
+func (t *dashTarget) page(name string) dashTargetPage {
+	last := t.traces[len(t.traces)-1]
+	summary := last.Summary()
+	p := dashTargetPage{
+		Target: name,
+		Last:   dashTime(last.End),
+		Status: strings.TrimPrefix(summary.String(), summary.name()+" "),
+		Traces: len(t.traces),
+		First:  dashTime(t.traces[0].Start),
+	}
+	if last.Addr != nil {
+		p.Addr = last.Addr.IP.String()
+	}
+	p.Fingerprint = NewPath(last).Fingerprint()
+	if len(t.changes) > 0 {
+		p.PathSince = dashTime(t.changes[len(t.changes)-1].Time)
+	}
+	for i := len(t.changes) - 1; i >= 0; i-- {
+		change := t.changes[i]
+		_, diff, _ := strings.Cut(change.String(), "\n") // the lines below the first
+		p.Changes = append(p.Changes, dashChange{
+			Time:  dashTime(change.Time),
+			Kinds: fmt.Sprintf("%s (%s -> %s)", strings.Join(change.Kinds, ", "), change.Old.Fingerprint(), change.New.Fingerprint()),
+			Diff:  diff,
+		})
+	}
+
+	// The hop table, and the sparklines of the last probes of every hop
+	var report Report
+	probes := make(map[int][]Probe)
+	var maxRTT time.Duration
+	for _, result := range t.traces {
+		report.Add(result)
+		for _, hop := range result.Hops {
+			probes[hop.TTL] = append(probes[hop.TTL], hop.Probes...)
+		}
+	}
+	for TTL, all := range probes {
+		all = all[max(0, len(all)-sparklineWidth/2):]
+		probes[TTL] = all
+		for _, probe := range all {
+			if probe.Addr != nil {
+				maxRTT = max(maxRTT, probe.RTT)
+			}
+		}
+	}
+	for _, hop := range report.Hops {
+		row := dashHop{TTL: hop.TTL, Hosts: hop.Hosts, Loss: hop.Loss(), Sent: hop.Sent, Answered: hop.Received > 0}
+		ms := func(d time.Duration) string { return fmt.Sprintf("%.1f", milliseconds(d)) }
+		row.Last, row.Avg, row.Best, row.Worst = ms(hop.Last), ms(hop.Avg()), ms(hop.Best), ms(hop.Worst)
+		row.Sparkline = sparkline(probes[hop.TTL], maxRTT)
+		p.Hops = append(p.Hops, row)
+	}
+
+	// The charts over time, and the path strip
+	times := make([]time.Time, len(t.traces))
+	rtts := make([]float64, len(t.traces))
+	losses := make([]float64, len(t.traces))
+	fingerprints := make([]string, len(t.traces))
+	for i, result := range t.traces {
+		s := result.Summary()
+		times[i] = result.Start
+		rtts[i] = math.NaN()
+		if s.Reached {
+			rtts[i] = milliseconds(s.Avg)
+		}
+		losses[i] = s.DestinationLoss()
+		fingerprints[i] = NewPath(result).Fingerprint()
+	}
+	p.RTTChart = timeChart(times, rtts, 0)
+	p.LossChart = timeChart(times, losses, 100)
+	p.PathStrip = pathStrip(times, fingerprints)
+	return p
+}
+
+// dashTime formats t for the page
+func dashTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05 MST")
+}
+
+// timeChart returns an inline SVG plotting values over times, from 0 up to top, or up to the
+// largest value for 0. NaN values are gaps. Like sparkline, it only contains numbers of our
+// own.
+func timeChart(times []time.Time, values []float64, top float64) template.HTML {
+	if top == 0 {
+		for _, v := range values {
+			if !math.IsNaN(v) {
+				top = max(top, v)
+			}
+		}
+		if top == 0 {
+			top = 1
+		}
+	}
+	const plotWidth = chartWidth - chartMargin
+	first, last := times[0], times[len(times)-1]
+	x := func(t time.Time) float64 {
+		if !last.After(first) {
+			return chartMargin + plotWidth/2
+		}
+		return chartMargin + float64(t.Sub(first))/float64(last.Sub(first))*(plotWidth-4) + 2
+	}
+	y := func(v float64) float64 {
+		return chartHeight - 16 - min(v, top)/top*(chartHeight-24)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg width="%d" height="%d" viewBox="0 0 %d %d" font-size="10" font-family="sans-serif">`, chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<rect x="%d" y="8" width="%d" height="%d" fill="#fafafa" stroke="#ddd"/>`, chartMargin, plotWidth-1, chartHeight-24)
+	fmt.Fprintf(&b, `<text x="%d" y="12" text-anchor="end">%s</text>`, chartMargin-4, strconv.FormatFloat(top, 'g', 4, 64))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">0</text>`, chartMargin-4, chartHeight-14)
+	fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, chartMargin, chartHeight-2, first.UTC().Format("15:04:05"))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartWidth-1, chartHeight-2, last.UTC().Format("15:04:05 MST"))
+	// A line through the values between gaps, a dot for a value alone; gaps are red dots at
+	// the bottom
+	var points []string
+	line := func() {
+		if len(points) > 1 {
+			fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#36c" stroke-width="1.5"/>`, strings.Join(points, " "))
+		}
+		points = points[:0]
+	}
+	for i, v := range values {
+		if math.IsNaN(v) {
+			line()
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%d" r="2" fill="#c00"/>`, x(times[i]), chartHeight-16)
+			continue
+		}
+		alone := (i == 0 || math.IsNaN(values[i-1])) && (i == len(values)-1 || math.IsNaN(values[i+1]))
+		if alone {
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2" fill="#36c"/>`, x(times[i]), y(v))
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x(times[i]), y(v)))
+	}
+	line()
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
+
+// pathStrip returns an inline SVG with a bar for every trace, colored by the fingerprint of
+// its path, so changes and flapping show at a glance
+func pathStrip(times []time.Time, fingerprints []string) template.HTML {
+	const plotWidth = chartWidth - chartMargin
+	width := float64(plotWidth) / float64(len(fingerprints))
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg width="%d" height="24" viewBox="0 0 %d 24">`, chartWidth, chartWidth)
+	for i, fingerprint := range fingerprints {
+		hue, _ := strconv.ParseUint(fingerprint[:4], 16, 16)
+		fmt.Fprintf(&b, `<rect x="%.2f" y="2" width="%.2f" height="20" fill="hsl(%d,55%%,55%%)"><title>%s %s</title></rect>`,
+			chartMargin+float64(i)*width, width+0.5, hue%360, times[i].UTC().Format("15:04:05"), fingerprint)
+	}
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
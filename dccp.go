@@ -0,0 +1,108 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+/*
+DCCP Request probes (-M dccp), like GNU traceroute -D
+
+	DCCP generic header, with extended (48 bit) sequence numbers - 16 bytes
+		Source Port (2) | Destination Port (2)
+		Data Offset (1, in 32 bit words) | CCVal (4 bits) | CsCov (4 bits)
+		Checksum (2)                   - Internet checksum with pseudo header, CsCov 0 = whole packet
+		Res (3 bits) | Type (4 bits) | X = 1 (1 bit) | Reserved (1)
+		Sequence Number (6)
+	DCCP-Request                       - 4 bytes
+		Service Code (4)               - which application the connection is for
+
+ICMP errors quote at least the ports, which tell our probes apart. The destination answers
+with DCCP-Response when something listens, or DCCP-Reset when nothing does. Both carry an
+Acknowledgement Number, which is the Sequence Number of our Request.
+*/
+
+const (
+	dccpDefaultPort        = 33434
+	DCCPDefaultServiceCode = 0x70747263 // "ptrc", what GNU traceroute uses
+
+	dccpGenericHeaderLen = 16
+	dccpTypeRequest      = 0
+	dccpTypeResponse     = 1
+	dccpTypeReset        = 7
+)
+
+type dccpProtocol struct {
+	id          int    // goes into the upper bits of the Sequence Number
+	serviceCode uint32 // -dccp-service
+}
+
+func (p dccpProtocol) protocolNumber() int { return 33 }
+func (p dccpProtocol) defaultPort() int    { return dccpDefaultPort }
+
+// sequenceNumber is the 48 bit Sequence Number of a probe
+func (p dccpProtocol) sequenceNumber(seqNum int) uint64 {
+	return uint64(p.id)<<16 | uint64(seqNum&0xffff)
+}
+
+func (p dccpProtocol) packet(src, dst net.IP, srcPort, dstPort, seqNum int) []byte {
+	b := make([]byte, dccpGenericHeaderLen+4)
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	b[4] = byte(len(b) / 4) // Data Offset: the whole packet is header
+	// b[5] CCVal = 0, CsCov = 0; b[6:8] Checksum, filled below
+	b[8] = dccpTypeRequest<<1 | 1 // X = 1
+	putUint48(b[10:16], p.sequenceNumber(seqNum))
+	binary.BigEndian.PutUint32(b[16:20], p.serviceCode)
+
+	binary.BigEndian.PutUint16(b[6:8], pseudoHeaderChecksum(src, dst, p.protocolNumber(), b))
+	return b
+}
+
+func (p dccpProtocol) matchQuoted(quoted []byte, srcPort, dstPort, seqNum int) bool {
+	return int(binary.BigEndian.Uint16(quoted[0:2])) == srcPort && int(binary.BigEndian.Uint16(quoted[2:4])) == dstPort
+}
+
+func (p dccpProtocol) matchAnswer(packet []byte, srcPort, dstPort, seqNum int) (string, bool) {
+	// Generic header + Acknowledgement Number subheader: Reserved (2) | Acknowledgement Number (6)
+	if len(packet) < dccpGenericHeaderLen+8 {
+		return "", false
+	}
+	if int(binary.BigEndian.Uint16(packet[0:2])) != dstPort || int(binary.BigEndian.Uint16(packet[2:4])) != srcPort {
+		return "", false
+	}
+	if packet[8]&1 == 0 {
+		return "", false // short sequence numbers, not an answer to our Request
+	}
+	if uint48(packet[dccpGenericHeaderLen+2:dccpGenericHeaderLen+8]) != p.sequenceNumber(seqNum) {
+		return "", false
+	}
+
+	switch packetType := (packet[8] >> 1) & 0x0f; packetType {
+	case dccpTypeResponse:
+		return " [Response]", true
+	case dccpTypeReset:
+		// Reset Code is right after the Acknowledgement Number
+		if len(packet) > dccpGenericHeaderLen+8 {
+			return fmt.Sprintf(" [Reset code %d]", packet[dccpGenericHeaderLen+8]), true
+		}
+		return " [Reset]", true
+	}
+	return "", false
+}
+
+func putUint48(b []byte, v uint64) {
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+}
+
+func uint48(b []byte) uint64 {
+	var v uint64
+	for _, c := range b[:6] {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
@@ -0,0 +1,214 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"golang.org/x/net/icmp"
+)
+
+/*
+Reply demultiplexing
+
+The ICMP socket of a trace sees more than the answers to its probes: a raw socket gets every
+ICMP message arriving at the host, and any socket gets the answers to probes that already
+timed out. Rather than every probe reading the socket and throwing away what isn't its own,
+a probeDemux owns the reading: one goroutine reads the socket for the whole trace, and hands
+every message to the probe waiting for it, by the Identifier and Sequence Number of the Echo
+Request it answers or quotes:
+
+	Echo Reply, Extended Echo Reply:   Identifier and Sequence Number of the reply itself
+	Time Exceeded, ... (ICMP errors):  Identifier and Sequence Number of the Echo Request quoted in it
+
+	socket ── read ──> probeDemux ──┬──> demuxConn of seq 7  ──> probe()
+	                                └──> demuxConn of seq 8  ──> probe()
+
+Messages with another Identifier are dropped there, those for a Sequence Number no probe waits
+for any more are late answers (see late.go). Every probe opens a demuxConn for its Sequence Number before it is sent, which
+reads like the socket, but only the probe's own messages. Extended Echo Requests carry only 8
+bits of the Sequence Number, their probes are told apart by those.
+
+The sessions of the Parallel scheduler (see session.go) hand out the messages of a socket the
+same way, by Identifier only, each probe there has an Identifier of its own. Multipath traces
+read their socket themselves, their probes are sent one at a time.
+*/
+
+// demuxQueueLen is how many messages a probe may have waiting before more are dropped
+const demuxQueueLen = 4
+
+// echoKey returns the Identifier and Sequence Number of the Echo Request the ICMP message msg
+// answers or quotes, only the 8 bits on the wire of Extended Echo Requests
+func echoKey(family ipFamily, msg []byte) (id, seq int, ok bool) {
+	if len(msg) < 8 {
+		return 0, 0, false
+	}
+	switch family.icmpType(msg[0]) {
+	case family.echoReply:
+		return int(binary.BigEndian.Uint16(msg[4:6])), int(binary.BigEndian.Uint16(msg[6:8])), true
+	case family.extendedEchoReply:
+		return int(binary.BigEndian.Uint16(msg[4:6])), int(msg[6]), true
+	case family.echoRequest, family.extendedEchoRequest:
+		return 0, 0, false // our own probes to the local host
+	}
+
+	// The quoted Echo Request has its Identifier 4 bytes into the ICMP header, the Sequence
+	// Number after it, see probe()
+	errorBody, err := parseICMPError(family.protocol, msg)
+	if err != nil {
+		return 0, 0, false
+	}
+	quoted := errorBody.originalDatagram
+	offset := family.quotedHeaderLen(quoted)
+	if len(quoted) < offset+8 {
+		return 0, 0, false
+	}
+	id = int(binary.BigEndian.Uint16(quoted[offset+4 : offset+6]))
+	if family.icmpType(quoted[offset]) == family.extendedEchoRequest {
+		return id, int(quoted[offset+6]), true
+	}
+	return id, int(binary.BigEndian.Uint16(quoted[offset+6 : offset+8])), true
+}
+
+// probeDemux reads the ICMP socket of a trace and hands the messages to the probes they are
+// for, see above
+type probeDemux struct {
+	conn     packetConn
+	family   ipFamily
+	echoID   int  // Identifier on the wire of the trace's probes
+	extended bool // Extended Echo Requests, with 8-bit sequence numbers
+
+	writer *packetWriter // sends the probes, with their TTLs
+	reader *packetReader
+
+	mu     sync.Mutex
+	probes map[int]*demuxConn // by Sequence Number
+
+	done chan struct{} // closed once the socket is
+
+	late func(seq int, reply *Reply) // gets the answers nobody waits for any more, nil drops them
+}
+
+// newProbeDemux starts reading conn, until it is closed
+func newProbeDemux(conn packetConn, family ipFamily, id int, extended bool) *probeDemux {
+	d := &probeDemux{
+		conn:     conn,
+		family:   family,
+		echoID:   conn.EchoID(id & 0xffff),
+		extended: extended,
+		probes:   make(map[int]*demuxConn),
+		done:     make(chan struct{}),
+	}
+	d.writer = newPacketWriter(conn, d.done)
+	d.reader = newPacketReader(conn)
+	go d.read()
+	return d
+}
+
+// open returns the socket the probe with sequence number seq reads its answers from
+func (d *probeDemux) open(seq int) *demuxConn {
+	if d.extended {
+		seq &= 0xff
+	}
+	c := &demuxConn{
+		packetQueue: newPacketQueue(demuxQueueLen, d.done, net.ErrClosed),
+		demux:       d,
+		seq:         seq,
+	}
+	d.mu.Lock()
+	d.probes[seq] = c
+	d.mu.Unlock()
+	return c
+}
+
+// read hands every message arriving on the socket to the probe it is for, until the socket
+// is closed
+func (d *probeDemux) read() {
+	defer close(d.done)
+	for {
+		p, err := d.reader.readFrom()
+		if err != nil {
+			return // closed with the prober
+		}
+		id, seq, ok := echoKey(d.family, p.b)
+		if !ok || id != d.echoID {
+			putPacketBuffer(p.buf)
+			continue // not an answer to one of our probes
+		}
+
+		d.mu.Lock()
+		c := d.probes[seq]
+		d.mu.Unlock()
+		if c == nil {
+			if reply := d.lateReply(p.b, p.addr, p.ttl); reply != nil && d.late != nil {
+				d.late(seq, reply) // timed out already, see late.go
+			}
+			putPacketBuffer(p.buf)
+			continue
+		}
+		p.route = replyRecordRoute(d.conn)
+		c.queue(p)
+	}
+}
+
+// lateReply returns the answer the ICMP message msg is, nil if probe() wouldn't take it for one
+func (d *probeDemux) lateReply(msg []byte, addr net.Addr, TTL int) *Reply {
+	m, err := icmp.ParseMessage(d.family.protocol, msg)
+	if err != nil {
+		return nil
+	}
+	reply := &Reply{Addr: addr, Type: m.Type, Code: m.Code, TTL: TTL}
+	switch m.Type {
+	case d.family.echoReply, d.family.extendedEchoReply:
+		reply.Reached = true
+	case d.family.timeExceeded:
+	default:
+		return nil
+	}
+	return reply
+}
+
+// demuxConn is the packetConn of one probe on a probeDemux, it reads the probe's messages only
+type demuxConn struct {
+	*packetQueue
+	demux *probeDemux
+	seq   int
+	ttl   int
+	sent  sendTimes // when the probe went out, see packetWriter
+}
+
+func (c *demuxConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	return c.writeToTTL(b, dst, c.ttl)
+}
+
+func (c *demuxConn) writeToTTL(b []byte, dst net.Addr, TTL int) (n int, err error) {
+	n, c.sent, err = c.demux.writer.writeTo(b, dst, TTL)
+	return n, err
+}
+
+func (c *demuxConn) lastSent() sendTimes {
+	return c.sent
+}
+
+func (c *demuxConn) SetTTL(TTL int) error {
+	c.ttl = TTL // goes out with the probe, see packetWriter
+	return nil
+}
+
+func (c *demuxConn) SetFlowLabel(label int, dst net.IP) error {
+	return c.demux.conn.SetFlowLabel(label, dst)
+}
+
+func (c *demuxConn) EchoID(id int) int {
+	return c.demux.echoID
+}
+
+func (c *demuxConn) Close() error {
+	c.demux.mu.Lock()
+	if c.demux.probes[c.seq] == c {
+		delete(c.demux.probes, c.seq)
+	}
+	c.demux.mu.Unlock()
+	c.close()
+	return nil
+}
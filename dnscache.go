@@ -0,0 +1,215 @@
+package traceroute
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Reverse DNS cache (-dns-cache)
+
+A trace looks every address up once (see rdns.go), but the next trace starts over: the cycles
+of -report, -hop and -listen, and every address of -all-addresses, look the same routers up
+again and again, hammering the DNS server with the same PTR queries for days. A
+CachingResolver wraps the Resolver and remembers the names it looked up:
+
+	LookupAddr 192.0.2.1 ──> cached, not expired? ──yes──> names
+	                                   │no
+	                                   v
+	                         Resolver.LookupAddr ──> cached for TTL (names)
+	                                                 or NegativeTTL (no name)
+
+net.Resolver doesn't tell the TTL of the records it returns, so how long names are kept is a
+setting: TTL, an hour unless set. Addresses without a name are kept for NegativeTTL, five
+minutes unless set. Failed lookups (timeouts, SERVFAIL) are not kept, they are tried again
+with the next trace. Destinations (LookupIPAddr) are not cached.
+
+Save writes the names not expired yet as JSON, Load reads them back, so a cache can outlive
+the process: -dns-cache FILE loads it before the first trace and saves it after every trace,
+through LoadFile and SaveFile.
+
+	{
+	  "192.0.2.1": {
+	    "names": ["router.example.net."],
+	    "expires": "2026-10-16T03:12:00Z"
+	  },
+	  "192.0.2.9": {
+	    "expires": "2026-10-16T02:17:00Z"       (no name)
+	  }
+	}
+*/
+
+// Default times names are cached for, see above
+const (
+	defaultNameTTL         = time.Hour
+	defaultNegativeNameTTL = 5 * time.Minute
+)
+
+// cachePruneLen is how many names a CachingResolver holds before it drops the expired ones
+const cachePruneLen = 4096
+
+// CachingResolver is a Resolver that remembers the names of addresses it looked up, see
+// above. It is safe for concurrent use, and meant to be shared by Tracers.
+type CachingResolver struct {
+	Resolver    Resolver      // looks up what isn't cached, nil means net.DefaultResolver
+	TTL         time.Duration // how long names are kept, 0 means an hour
+	NegativeTTL time.Duration // how long addresses without a name are kept, 0 means five minutes
+	Clock       Clock         // nil means SystemClock
+
+	mu    sync.Mutex
+	names map[string]cachedName // by address
+}
+
+// cachedName is a cached answer to LookupAddr, also as saved to JSON
+type cachedName struct {
+	Names   []string  `json:"names,omitempty"` // none when the address has no name
+	Expires time.Time `json:"expires"`
+}
+
+// NewCachingResolver returns a CachingResolver looking up with resolver (nil means
+// net.DefaultResolver), keeping names for TTL (0 means an hour)
+func NewCachingResolver(resolver Resolver, TTL time.Duration) *CachingResolver {
+	return &CachingResolver{Resolver: resolver, TTL: TTL}
+}
+
+func (r *CachingResolver) resolver() Resolver {
+	if r.Resolver != nil {
+		return r.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (r *CachingResolver) now() time.Time {
+	if r.Clock != nil {
+		return r.Clock.Now()
+	}
+	return SystemClock.Now()
+}
+
+// LookupIPAddr looks host up with the Resolver, destinations are not cached
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r.resolver().LookupIPAddr(ctx, host)
+}
+
+// LookupAddr returns the cached names of addr, looking them up with the Resolver when
+// they aren't cached or expired
+func (r *CachingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	now := r.now()
+	r.mu.Lock()
+	cached, ok := r.names[addr]
+	r.mu.Unlock()
+	if ok && now.Before(cached.Expires) {
+		return cached.Names, nil
+	}
+
+	names, err := r.resolver().LookupAddr(ctx, addr)
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil && len(names) > 0:
+		r.add(addr, cachedName{Names: names, Expires: now.Add(cmp.Or(r.TTL, defaultNameTTL))})
+	case err == nil || errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		r.add(addr, cachedName{Expires: now.Add(cmp.Or(r.NegativeTTL, defaultNegativeNameTTL))})
+	}
+	return names, err
+}
+
+// add caches name for addr
+func (r *CachingResolver) add(addr string, name cachedName) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names == nil {
+		r.names = make(map[string]cachedName)
+	}
+	if len(r.names) >= cachePruneLen {
+		r.prune()
+	}
+	r.names[addr] = name
+}
+
+// prune drops the expired names, r.mu must be held
+func (r *CachingResolver) prune() {
+	now := r.now()
+	for addr, name := range r.names {
+		if !now.Before(name.Expires) {
+			delete(r.names, addr)
+		}
+	}
+}
+
+// Save writes the names not expired yet to w as JSON, see above
+func (r *CachingResolver) Save(w io.Writer) error {
+	r.mu.Lock()
+	r.prune()
+	data, err := json.MarshalIndent(r.names, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Load reads names written by Save from rd and caches those not expired yet, over what is
+// cached already
+func (r *CachingResolver) Load(rd io.Reader) error {
+	var names map[string]cachedName
+	if err := json.NewDecoder(rd).Decode(&names); err != nil {
+		return fmt.Errorf("reading the DNS cache: %w", err)
+	}
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names == nil {
+		r.names = make(map[string]cachedName)
+	}
+	for addr, name := range names {
+		if now.Before(name.Expires) {
+			r.names[addr] = name
+		}
+	}
+	return nil
+}
+
+// LoadFile loads the names saved in file, a file that doesn't exist yet is an empty cache
+func (r *CachingResolver) LoadFile(file string) error {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := r.Load(f); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+// SaveFile saves the names to file, replacing it at once so a process stopped while saving
+// doesn't leave half a file behind
+func (r *CachingResolver) SaveFile(file string) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := r.Save(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,186 @@
+package traceroute
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+/*
+Graphviz DOT output (-o dot)
+
+A list of hops hides the structure of a path once more than one host answers at a hop. As
+a graph, every responder is a node and every pair of responders at consecutive hops an edge,
+starting at the source of the probes:
+
+	digraph traceroute {
+		label="traceroute to example.com (93.184.216.34)";
+		labelloc=t;
+		node [shape=box];
+		"source" [shape=ellipse];
+		"192.168.1.1" [label="router.lan\n192.168.1.1"];
+		"hop 2" [label="*", shape=plaintext];
+		"93.184.216.34" [label="93.184.216.34", peripheries=2];
+		"source" -> "192.168.1.1";
+		"192.168.1.1" -> "hop 2";
+		"hop 2" -> "93.184.216.34";
+	}
+
+A hop nobody answered at is a "*" node of its own, the destination has a double border.
+Responders are keyed by address, so one showing up at several hops (a routing loop) is one
+node with an edge back. Render it with e.g. `dot -Tsvg -o trace.svg`.
+
+Result.WriteDOT links every responder of a hop to every responder of the next one, the
+probes of a classic trace don't tell which of them are really connected. Multipath traces do:
+MultipathResult.WriteDOT draws the links the flows took, and links interfaces whose flows
+weren't traced at the previous hop to all of it, with dashed edges.
+*/
+
+// dotSource is the node the probes start from
+const dotSource = "source"
+
+// dotGraph collects the nodes and edges of a DOT graph, each once, in the order they were added
+type dotGraph struct {
+	nodes []string // node statements
+	seen  map[string]bool
+	edges []string // edge statements
+}
+
+func newDOTGraph() *dotGraph {
+	g := &dotGraph{seen: make(map[string]bool)}
+	g.node(dotSource, "shape=ellipse")
+	return g
+}
+
+// node adds the node id with attrs, unless it was already added
+func (g *dotGraph) node(id string, attrs string) {
+	if g.seen[id] {
+		return
+	}
+	g.seen[id] = true
+	stmt := fmt.Sprintf("%q", id)
+	if attrs != "" {
+		stmt += " [" + attrs + "]"
+	}
+	g.nodes = append(g.nodes, stmt)
+}
+
+// responder adds the node of a responder and returns its id
+func (g *dotGraph) responder(addr net.Addr, name string, reached bool, extra string) string {
+	id := addrString(addr)
+	label := id
+	if name = strings.TrimSuffix(name, "."); name != "" {
+		label = name + "\n" + id
+	}
+	if extra != "" {
+		label += "\n" + extra
+	}
+	attrs := fmt.Sprintf("label=%q", label) // %q turns the line breaks into \n, which DOT reads as such
+	if reached {
+		attrs += ", peripheries=2"
+	}
+	g.node(id, attrs)
+	return id
+}
+
+// silent adds the node of a hop nobody answered at and returns its id
+func (g *dotGraph) silent(TTL int) string {
+	id := fmt.Sprintf("hop %d", TTL)
+	g.node(id, `label="*", shape=plaintext`)
+	return id
+}
+
+// edge adds an edge between the nodes from and to with attrs, unless it was already added
+func (g *dotGraph) edge(from, to string, attrs string) {
+	key := "edge " + from + " " + to
+	if g.seen[key] {
+		return
+	}
+	g.seen[key] = true
+	stmt := fmt.Sprintf("%q -> %q", from, to)
+	if attrs != "" {
+		stmt += " [" + attrs + "]"
+	}
+	g.edges = append(g.edges, stmt)
+}
+
+// write writes the graph with a title to w
+func (g *dotGraph) write(w io.Writer, title string) error {
+	var b strings.Builder
+	b.WriteString("digraph traceroute {\n")
+	fmt.Fprintf(&b, "\tlabel=%q;\n\tlabelloc=t;\n\tnode [shape=box];\n", title)
+	for _, stmt := range g.nodes {
+		fmt.Fprintf(&b, "\t%s;\n", stmt)
+	}
+	for _, stmt := range g.edges {
+		fmt.Fprintf(&b, "\t%s;\n", stmt)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteDOT writes the hops of r to w as a Graphviz DOT graph, see dot.go
+func (r *Result) WriteDOT(w io.Writer) error {
+	g := newDOTGraph()
+	previous := []string{dotSource}
+	for _, hop := range r.Hops {
+		var current []string
+		for _, probe := range hop.Probes {
+			if probe.Addr != nil {
+				current = append(current, g.responder(probe.Addr, probe.Name, probe.Reached, ""))
+			}
+		}
+		if len(current) == 0 {
+			current = append(current, g.silent(hop.TTL))
+		}
+		for _, from := range previous {
+			for _, to := range current {
+				g.edge(from, to, "")
+			}
+		}
+		previous = current
+	}
+	return g.write(w, fmt.Sprintf("traceroute to %s (%s)", r.Target, r.Addr))
+}
+
+// WriteDOT writes the load balanced paths of r to w as a Graphviz DOT graph, see dot.go
+func (r *MultipathResult) WriteDOT(w io.Writer) error {
+	g := newDOTGraph()
+	previous := []string{dotSource}
+	for _, hop := range r.Hops {
+		inferred := "style=dashed" // links no flow was traced along
+		if previous[0] == dotSource {
+			inferred = "" // every flow starts at the source
+		}
+		var current []string
+		for _, iface := range hop.Interfaces {
+			flows := "1 flow"
+			if iface.Flows != 1 {
+				flows = fmt.Sprintf("%d flows", iface.Flows)
+			}
+			id := g.responder(iface.Addr, iface.Name, iface.Reached, flows)
+			current = append(current, id)
+
+			if len(iface.Previous) == 0 {
+				for _, from := range previous {
+					g.edge(from, id, inferred)
+				}
+				continue
+			}
+			for _, prev := range iface.Previous {
+				g.node(prev.IP.String(), "") // found by a flow traced back after its hop was done
+				g.edge(prev.IP.String(), id, "")
+			}
+		}
+		if len(current) == 0 {
+			current = append(current, g.silent(hop.TTL))
+			for _, from := range previous {
+				g.edge(from, current[0], inferred)
+			}
+		}
+		previous = current
+	}
+	return g.write(w, fmt.Sprintf("multipath traceroute to %s (%s)", r.Target, r.Addr))
+}
@@ -0,0 +1,50 @@
+package traceroute
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// The errors a trace fails with, wrapped together with the error that caused them, so
+// callers can tell them apart with errors.Is:
+//
+//	if errors.Is(err, traceroute.ErrPermission) {
+//		// ask for root, or fall back to SocketDgram
+//	}
+var (
+	// ErrPermission: a socket couldn't be opened for lack of privileges. Raw sockets
+	// need root or CAP_NET_RAW on Linux.
+	ErrPermission = errors.New("not permitted to open the sockets (raw sockets need root or CAP_NET_RAW)")
+
+	// ErrResolve: the destination couldn't be resolved to an address
+	ErrResolve = errors.New("cannot resolve the destination")
+
+	// ErrTimeout: nobody answered a probe within the wait time. It is not returned by
+	// Run or Trace, only found in HopResult.Err and Probe.Err.
+	ErrTimeout = errors.New("no answer within the wait time")
+
+	// ErrMaxTTLExceeded: the trace reached MaxTTL without the destination answering.
+	// Trace returns it together with the hops found.
+	ErrMaxTTLExceeded = errors.New("destination not reached within the max TTL")
+
+	// ErrGapLimit: GapLimit hops in a row didn't answer a single probe, so the trace gave
+	// up before MaxTTL. Trace returns it together with the hops found.
+	ErrGapLimit = errors.New("gave up after hops in a row without an answer")
+)
+
+// permissionError wraps err in ErrPermission if it was caused by missing privileges
+func permissionError(err error) error {
+	if errors.Is(err, os.ErrPermission) { // EPERM or EACCES
+		return fmt.Errorf("%w: %w", ErrPermission, err)
+	}
+	return err
+}
+
+// timeoutError wraps err in ErrTimeout if the read deadline of a probe passed
+func timeoutError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+package traceroute
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+/*
+ICMP multipart messages (RFC 4884)
+
+ICMP error messages (Time Exceeded, Destination Unreachable, ...) quote the original
+datagram that caused them. RFC 4884 allows routers to append extension objects after it:
+
+	ICMP Header                      - 4 bytes: Type, Code, Checksum
+	Unused | Length | Unused         - 4 bytes: for ICMPv4 "Length" is byte 5 and counts 32 bit words,
+	                                            for ICMPv6 it is byte 4 and counts 64 bit words
+	Original Datagram                - "Length" words, zero padded, at least 128 bytes
+	Extension Header                 - 4 bytes: Version (4 bits, must be 2) | Reserved | Checksum
+	Extension Objects, each:
+		Length (2 bytes, includes this 4 byte header) | Class-Num (1 byte) | C-Type (1 byte)
+		Object payload
+
+Lots of routers predate RFC 4884 and leave "Length" at 0 but still put the extensions
+right after the first 128 bytes of the original datagram, so that layout is accepted too.
+
+ICMP extensions in the wild are mostly MPLS label stacks (RFC 4950): a router inside an
+MPLS network tells us which labels the expired packet carried, so we can see the LSP
+the probe traveled through. Each label stack entry is 4 bytes:
+	Label (20 bits) | Exp/Traffic Class (3 bits) | S, bottom of stack (1 bit) | TTL (8 bits)
+
+With -e the output mimics `traceroute -e`: <MPLS:L=24001,E=0,S=1,T=1>
+*/
+
+const (
+	icmpErrorHeaderLen       = 8   // Type, Code, Checksum + the 4 bytes holding the length field
+	rfc4884CompatDatagramLen = 128 // where non-compliant routers put the extensions
+	extensionHeaderLen       = 4
+	extensionObjectHeaderLen = 4
+	extensionVersion         = 2
+
+	extensionClassMPLS      = 1 // RFC 4950
+	extensionClassInterface = 2 // RFC 5837
+)
+
+// icmpErrorBody is the parsed body of an ICMP error message
+type icmpErrorBody struct {
+	originalDatagram    []byte            // the quoted datagram, padding included
+	originalDatagramLen int               // value of the length field in bytes, 0 when the sender doesn't set it
+	extensions          []extensionObject // nil when there is no (valid) extension structure
+}
+
+// extensionObject is one RFC 4884 extension object
+type extensionObject struct {
+	class   int    // Class-Num, e.g. 1 for MPLS label stacks
+	cType   int    // C-Type, meaning depends on the class
+	payload []byte // everything after the 4 byte object header
+}
+
+// parseICMPError parses an ICMP error message (header included), separating the original
+// datagram from the extension objects following it
+func parseICMPError(protocol int, msg []byte) (icmpErrorBody, error) {
+	if len(msg) < icmpErrorHeaderLen {
+		return icmpErrorBody{}, fmt.Errorf("ICMP error message too short: %d bytes", len(msg))
+	}
+
+	var body icmpErrorBody
+	if protocol == familyIPv6.protocol {
+		body.originalDatagramLen = int(msg[4]) * 8
+	} else {
+		body.originalDatagramLen = int(msg[5]) * 4
+	}
+	rest := msg[icmpErrorHeaderLen:]
+
+	// Where do the extensions start? Trust the length field if it makes sense,
+	// otherwise try the pre-RFC 4884 layout
+	extensionsOffset := -1
+	switch {
+	case body.originalDatagramLen >= rfc4884CompatDatagramLen && validExtensionHeader(rest, body.originalDatagramLen):
+		extensionsOffset = body.originalDatagramLen
+	case validExtensionHeader(rest, rfc4884CompatDatagramLen):
+		extensionsOffset = rfc4884CompatDatagramLen
+	}
+
+	if extensionsOffset < 0 {
+		body.originalDatagram = rest
+		return body, nil
+	}
+
+	body.originalDatagram = rest[:extensionsOffset]
+	extensionsBytes := rest[extensionsOffset:]
+
+	// A checksum of 0 means the sender didn't compute one, otherwise a bad checksum
+	// means the extension structure can't be trusted and is ignored
+	if binary.BigEndian.Uint16(extensionsBytes[2:4]) != 0 && checksum(extensionsBytes) != 0 {
+		return body, nil
+	}
+
+	objects := extensionsBytes[extensionHeaderLen:]
+	for len(objects) >= extensionObjectHeaderLen {
+		objectLen := int(binary.BigEndian.Uint16(objects[0:2]))
+		if objectLen < extensionObjectHeaderLen || objectLen > len(objects) {
+			break // malformed, keep what we have so far
+		}
+		body.extensions = append(body.extensions, extensionObject{
+			class:   int(objects[2]),
+			cType:   int(objects[3]),
+			payload: bytes.Clone(objects[extensionObjectHeaderLen:objectLen]), // msg may be a pooled buffer, see buffers.go
+		})
+		objects = objects[objectLen:]
+	}
+	return body, nil
+}
+
+// validExtensionHeader reports whether b holds an extension header (followed by at least one object header) at offset
+func validExtensionHeader(b []byte, offset int) bool {
+	if offset+extensionHeaderLen+extensionObjectHeaderLen > len(b) {
+		return false
+	}
+	return b[offset]>>4 == extensionVersion
+}
+
+// checksum computes the Internet checksum (RFC 1071) of b
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// formatExtensions renders the extension objects of a reply, ready to be appended to a hop line
+func formatExtensions(extensions []extensionObject) string {
+	var sb strings.Builder
+	for _, ext := range extensions {
+		switch ext.class {
+		case extensionClassMPLS:
+			for entry := ext.payload; len(entry) >= 4; entry = entry[4:] {
+				word := binary.BigEndian.Uint32(entry)
+				label := word >> 12
+				exp := (word >> 9) & 0x7
+				bottomOfStack := (word >> 8) & 0x1
+				ttl := word & 0xff
+				fmt.Fprintf(&sb, " <MPLS:L=%d,E=%d,S=%d,T=%d>", label, exp, bottomOfStack, ttl)
+			}
+		default:
+			// Unknown to us, show it raw so nothing is lost
+			fmt.Fprintf(&sb, " <%d/%d:%x>", ext.class, ext.cType, ext.payload)
+		}
+	}
+	return sb.String()
+}
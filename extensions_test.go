@@ -0,0 +1,207 @@
+package traceroute
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// icmpError builds an ICMP error message of family: Time Exceeded quoting datagram, padded
+// to pad bytes, with the RFC 4884 length field set to length bytes (0: unset) and ext after
+func icmpError(family ipFamily, length, pad int, datagram, ext []byte) []byte {
+	msg := []byte{11, 0, 0, 0, 0, 0, 0, 0}
+	if family.protocol == familyIPv6.protocol {
+		msg[0], msg[4] = 3, byte(length/8)
+	} else {
+		msg[5] = byte(length / 4)
+	}
+	msg = append(msg, datagram...)
+	msg = append(msg, make([]byte, max(pad-len(datagram), 0))...)
+	return append(msg, ext...)
+}
+
+// extensionStructure builds an RFC 4884 extension structure of objects, its checksum
+// computed unless sum is given
+func extensionStructure(sum *uint16, objects ...[]byte) []byte {
+	ext := []byte{extensionVersion << 4, 0, 0, 0}
+	for _, object := range objects {
+		ext = append(ext, object...)
+	}
+	if sum != nil {
+		binary.BigEndian.PutUint16(ext[2:], *sum)
+	} else {
+		binary.BigEndian.PutUint16(ext[2:], checksum(ext))
+	}
+	return ext
+}
+
+// extensionObjectBytes builds an extension object, its length field set to length (0: its
+// actual length)
+func extensionObjectBytes(length, class, cType int, payload []byte) []byte {
+	if length == 0 {
+		length = extensionObjectHeaderLen + len(payload)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(length)), append([]byte{byte(class), byte(cType)}, payload...)...)
+}
+
+// quotedProbe is the start of an ICMP Echo Request probe as a router quotes it: its IPv4
+// header, with options, and its ICMP header (ID 0x1234, sequence 7)
+func quotedProbe(options []byte) []byte {
+	ihl := (20 + len(options)) / 4
+	header := []byte{0x40 | byte(ihl), 0, 0, 84, 0, 0, 0, 0, 1, 1, 0, 0, 192, 0, 2, 254, 198, 51, 100, 1}
+	header = append(header, options...)
+	return append(header, 8, 0, 0, 0, 0x12, 0x34, 0, 7)
+}
+
+func TestParseICMPError(t *testing.T) {
+	probe := quotedProbe(nil)
+	label := []byte{0x05, 0xdc, 0x11, 0x01} // L=24001, E=0, S=1, T=1
+	mpls := extensionObjectBytes(0, extensionClassMPLS, 1, label)
+	other := extensionObjectBytes(0, 9, 2, []byte{0xde, 0xad, 0xbe, 0xef})
+	zero, bad := uint16(0), uint16(0xbeef)
+
+	for _, test := range []struct {
+		name        string
+		ipv6        bool
+		msg         []byte
+		datagramLen int      // of originalDatagram
+		lengthField int      // originalDatagramLen
+		extensions  []string // formatExtensions of every object
+	}{
+		{
+			name:        "no extensions",
+			msg:         icmpError(familyIPv4, 0, 0, probe, nil),
+			datagramLen: len(probe),
+		},
+		{
+			name:        "length field",
+			msg:         icmpError(familyIPv4, 132, 132, probe, extensionStructure(nil, mpls)),
+			datagramLen: 132, lengthField: 132,
+			extensions: []string{" <MPLS:L=24001,E=0,S=1,T=1>"},
+		},
+		{
+			name:        "length field of ICMPv6, in 64 bit words",
+			ipv6:        true,
+			msg:         icmpError(familyIPv6, 136, 136, probe, extensionStructure(nil, mpls, other)),
+			datagramLen: 136, lengthField: 136,
+			extensions: []string{" <MPLS:L=24001,E=0,S=1,T=1>", " <9/2:deadbeef>"},
+		},
+		{
+			name:        "compat layout, no length field",
+			msg:         icmpError(familyIPv4, 0, rfc4884CompatDatagramLen, probe, extensionStructure(nil, mpls)),
+			datagramLen: rfc4884CompatDatagramLen,
+			extensions:  []string{" <MPLS:L=24001,E=0,S=1,T=1>"},
+		},
+		{
+			name:        "compat layout, length field beyond the message",
+			msg:         icmpError(familyIPv4, 1020, rfc4884CompatDatagramLen, probe, extensionStructure(nil, mpls)),
+			datagramLen: rfc4884CompatDatagramLen, lengthField: 1020,
+			extensions: []string{" <MPLS:L=24001,E=0,S=1,T=1>"},
+		},
+		{
+			name:        "length field below 128 bytes",
+			msg:         icmpError(familyIPv4, 64, 64, probe, extensionStructure(nil, mpls)),
+			datagramLen: 64 + extensionHeaderLen + len(mpls), lengthField: 64,
+		},
+		{
+			name:        "no checksum",
+			msg:         icmpError(familyIPv4, 0, rfc4884CompatDatagramLen, probe, extensionStructure(&zero, mpls)),
+			datagramLen: rfc4884CompatDatagramLen,
+			extensions:  []string{" <MPLS:L=24001,E=0,S=1,T=1>"},
+		},
+		{
+			name:        "bad checksum",
+			msg:         icmpError(familyIPv4, 0, rfc4884CompatDatagramLen, probe, extensionStructure(&bad, mpls)),
+			datagramLen: rfc4884CompatDatagramLen,
+		},
+		{
+			name:        "object longer than the message",
+			msg:         icmpError(familyIPv4, 0, rfc4884CompatDatagramLen, probe, extensionStructure(nil, mpls, extensionObjectBytes(64, 9, 2, []byte{1, 2, 3, 4}))),
+			datagramLen: rfc4884CompatDatagramLen,
+			extensions:  []string{" <MPLS:L=24001,E=0,S=1,T=1>"},
+		},
+		{
+			name:        "object shorter than its header",
+			msg:         icmpError(familyIPv4, 0, rfc4884CompatDatagramLen, probe, extensionStructure(nil, extensionObjectBytes(2, 9, 2, nil), mpls)),
+			datagramLen: rfc4884CompatDatagramLen,
+		},
+		{
+			name:        "object truncated after its header",
+			msg:         icmpError(familyIPv4, 0, rfc4884CompatDatagramLen, probe, extensionStructure(nil, mpls, []byte{0, 8, 9})),
+			datagramLen: rfc4884CompatDatagramLen,
+			extensions:  []string{" <MPLS:L=24001,E=0,S=1,T=1>"},
+		},
+	} {
+		protocol := familyIPv4.protocol
+		if test.ipv6 {
+			protocol = familyIPv6.protocol
+		}
+		body, err := parseICMPError(protocol, test.msg)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(body.originalDatagram) != test.datagramLen || body.originalDatagramLen != test.lengthField {
+			t.Errorf("%s: datagram of %d bytes, length field %d, want %d and %d", test.name, len(body.originalDatagram), body.originalDatagramLen, test.datagramLen, test.lengthField)
+		}
+		if !bytes.HasPrefix(body.originalDatagram, probe) {
+			t.Errorf("%s: datagram % x doesn't start with the probe", test.name, body.originalDatagram)
+		}
+		if len(body.extensions) != len(test.extensions) {
+			t.Errorf("%s: %d extension objects, want %d", test.name, len(body.extensions), len(test.extensions))
+			continue
+		}
+		for i, ext := range body.extensions {
+			if got := formatExtensions([]extensionObject{ext}); got != test.extensions[i] {
+				t.Errorf("%s: object %d is %q, want %q", test.name, i, got, test.extensions[i])
+			}
+		}
+	}
+
+	if _, err := parseICMPError(familyIPv4.protocol, []byte{11, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Error("parsed an ICMP error of 7 bytes")
+	}
+}
+
+func TestQuotedHeaderWithOptions(t *testing.T) {
+	// Loose source route through 192.0.2.7 (-g), padded with End of Options List
+	lsrr := []byte{0x83, 7, 4, 192, 0, 2, 7, 0}
+	mpls := extensionObjectBytes(0, extensionClassMPLS, 1, []byte{0x05, 0xdc, 0x11, 0x01})
+
+	for _, test := range []struct {
+		name      string
+		datagram  []byte
+		headerLen int
+	}{
+		{"no options", quotedProbe(nil), 20},
+		{"options", quotedProbe(lsrr), 28},
+		{"IHL unset by a datagram socket", append([]byte{0x40}, quotedProbe(nil)[1:]...), 20},
+	} {
+		for _, layout := range []struct {
+			name string
+			msg  []byte
+		}{
+			{"plain", icmpError(familyIPv4, 0, 0, test.datagram, nil)},
+			{"length field", icmpError(familyIPv4, 132, 132, test.datagram, extensionStructure(nil, mpls))},
+			{"compat", icmpError(familyIPv4, 0, rfc4884CompatDatagramLen, test.datagram, extensionStructure(nil, mpls))},
+		} {
+			body, err := parseICMPError(familyIPv4.protocol, layout.msg)
+			if err != nil {
+				t.Errorf("%s, %s: %v", test.name, layout.name, err)
+				continue
+			}
+			if layout.name != "plain" && len(body.extensions) != 1 {
+				t.Errorf("%s, %s: %d extension objects, want 1", test.name, layout.name, len(body.extensions))
+			}
+			headerLen := familyIPv4.quotedHeaderLen(body.originalDatagram)
+			if headerLen != test.headerLen {
+				t.Errorf("%s, %s: quoted header of %d bytes, want %d", test.name, layout.name, headerLen, test.headerLen)
+				continue
+			}
+			echo := body.originalDatagram[headerLen:]
+			if echo[0] != 8 || binary.BigEndian.Uint16(echo[4:]) != 0x1234 || binary.BigEndian.Uint16(echo[6:]) != 7 {
+				t.Errorf("%s, %s: quoted Echo Request % x, want type 8, ID 0x1234, sequence 7", test.name, layout.name, echo[:8])
+			}
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ipFamily holds everything that differs between tracing over IPv4 and IPv6
+type ipFamily struct {
+	name                string    // "IPv4" or "IPv6", used in messages
+	listenNetwork       string    // network passed to icmp.ListenPacket
+	listenAddr          string    // wildcard address to listen on
+	protocol            int       // IANA protocol number, needed by icmp.ParseMessage
+	echoRequest         icmp.Type // type of the probes we send
+	echoReply           icmp.Type // type the destination answers with
+	extendedEchoRequest icmp.Type // RFC 8335, see xecho.go
+	extendedEchoReply   icmp.Type
+	timeExceeded        icmp.Type // type routers answer with when the TTL/hop limit hits 0
+	unreachable         icmp.Type // Destination Unreachable
+	portUnreachable     int       // Destination Unreachable code the destination answers UDP probes with
+	innerHeaderLen      int       // length of the (option-less) IP header quoted inside ICMP errors, see quotedHeaderLen
+}
+
+var familyIPv4 = ipFamily{
+	name:                "IPv4",
+	listenNetwork:       "ip4:icmp",
+	listenAddr:          "0.0.0.0",
+	protocol:            1, // ICMP
+	echoRequest:         ipv4.ICMPTypeEcho,
+	echoReply:           ipv4.ICMPTypeEchoReply,
+	extendedEchoRequest: ipv4.ICMPTypeExtendedEchoRequest,
+	extendedEchoReply:   ipv4.ICMPTypeExtendedEchoReply,
+	timeExceeded:        ipv4.ICMPTypeTimeExceeded,
+	unreachable:         ipv4.ICMPTypeDestinationUnreachable,
+	portUnreachable:     3,
+	innerHeaderLen:      ipv4.HeaderLen, // 20 bytes
+}
+
+var familyIPv6 = ipFamily{
+	name:                "IPv6",
+	listenNetwork:       "ip6:ipv6-icmp",
+	listenAddr:          "::",
+	protocol:            58, // ICMPv6
+	echoRequest:         ipv6.ICMPTypeEchoRequest,
+	echoReply:           ipv6.ICMPTypeEchoReply,
+	extendedEchoRequest: ipv6.ICMPTypeExtendedEchoRequest,
+	extendedEchoReply:   ipv6.ICMPTypeExtendedEchoReply,
+	timeExceeded:        ipv6.ICMPTypeTimeExceeded,
+	unreachable:         ipv6.ICMPTypeDestinationUnreachable,
+	portUnreachable:     4,
+	innerHeaderLen:      ipv6.HeaderLen, // 40 bytes, the IPv6 header has a fixed size
+}
+
+// quotedHeaderLen returns the length of the IP header at the start of an original datagram
+// quoted by an ICMP error. IPv4 headers grow with options (e.g. -g), so their length comes
+// from the IHL field, unless it is unset as in the headers rebuilt for datagram sockets.
+func (f ipFamily) quotedHeaderLen(datagram []byte) int {
+	if f.protocol == familyIPv6.protocol || len(datagram) == 0 {
+		return f.innerHeaderLen
+	}
+	if ihl := int(datagram[0]&0x0f) * 4; ihl >= ipv4.HeaderLen {
+		return ihl
+	}
+	return f.innerHeaderLen
+}
+
+// icmpType turns a raw ICMP type number into the family's icmp.Type
+func (f ipFamily) icmpType(t byte) icmp.Type {
+	if f.protocol == familyIPv6.protocol {
+		return ipv6.ICMPType(t)
+	}
+	return ipv4.ICMPType(t)
+}
+
+// familyOf returns the family an IP address belongs to
+func familyOf(ip net.IP) ipFamily {
+	if ip.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+// resolveDestination turns the destination of a trace into a single address, looking
+// hostnames up with resolver.
+//
+// With forceV4 or forceV6 only that family is considered. Otherwise every address the
+// hostname resolves to is collected and a family is picked automatically:
+// IPv6 is preferred (like most operating systems do, see RFC 6724) but only if this
+// host actually has a route to the IPv6 address from the sockets the probes are sent on
+// (through their interface), otherwise IPv4 is used.
+func resolveDestination(ctx context.Context, resolver Resolver, destination string, forceV4, forceV6 bool, sockets socketConfig) (*net.IPAddr, error) {
+	if forceV4 && forceV6 {
+		return nil, errors.New("IPv4 only and IPv6 only cannot be used together")
+	}
+
+	addrs, err := resolver.LookupIPAddr(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	v4Addrs, v6Addrs := splitFamilies(addrs)
+	if forceV4 || forceV6 {
+		candidates, err := forcedFamily(destination, v4Addrs, v6Addrs, forceV6)
+		if err != nil {
+			return nil, err
+		}
+		return &candidates[0], nil
+	}
+
+	// Prefer IPv6, then IPv4, but only families we can actually reach
+	for _, candidates := range [][]net.IPAddr{v6Addrs, v4Addrs} {
+		for _, addr := range candidates {
+			if hasRouteTo(addr, sockets) {
+				return &addr, nil
+			}
+		}
+	}
+
+	// No family looks reachable, fall back to whatever came first and let the probes tell
+	if len(addrs) > 0 {
+		return &addrs[0], nil
+	}
+	return nil, &net.DNSError{Err: "no addresses found", Name: destination, IsNotFound: true}
+}
+
+// resolveAllDestinations turns the destination of a trace into every address it resolves
+// to, in the order of resolver. With forceV4 or forceV6 only that family is returned.
+func resolveAllDestinations(ctx context.Context, resolver Resolver, destination string, forceV4, forceV6 bool) ([]net.IPAddr, error) {
+	if forceV4 && forceV6 {
+		return nil, errors.New("IPv4 only and IPv6 only cannot be used together")
+	}
+
+	addrs, err := resolver.LookupIPAddr(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	if forceV4 || forceV6 {
+		v4Addrs, v6Addrs := splitFamilies(addrs)
+		return forcedFamily(destination, v4Addrs, v6Addrs, forceV6)
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses found", Name: destination, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// splitFamilies splits addrs into the IPv4 and the IPv6 ones, keeping their order
+func splitFamilies(addrs []net.IPAddr) (v4Addrs, v6Addrs []net.IPAddr) {
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4Addrs = append(v4Addrs, addr)
+		} else {
+			v6Addrs = append(v6Addrs, addr)
+		}
+	}
+	return v4Addrs, v6Addrs
+}
+
+// forcedFamily returns the addresses of the family forced by -4 (v6 false) or -6 (v6 true),
+// an error if destination has none
+func forcedFamily(destination string, v4Addrs, v6Addrs []net.IPAddr, v6 bool) ([]net.IPAddr, error) {
+	candidates, name := v4Addrs, "IPv4"
+	if v6 {
+		candidates, name = v6Addrs, "IPv6"
+	}
+	if len(candidates) == 0 {
+		return nil, &net.DNSError{Err: "no " + name + " address found", Name: destination, IsNotFound: true}
+	}
+	return candidates, nil
+}
+
+// interfaceAddr returns an address of family of the interface called name, a global one
+// rather than a link-local one
+func interfaceAddr(name string, family ipFamily) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var linkLocal net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || familyOf(ipNet.IP).protocol != family.protocol {
+			continue
+		}
+		if !ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP, nil
+		}
+		if linkLocal == nil {
+			linkLocal = ipNet.IP
+		}
+	}
+	if linkLocal == nil {
+		return nil, fmt.Errorf("interface %s has no %s address", name, family.name)
+	}
+	return linkLocal, nil
+}
+
+// freeUDPPort returns a local UDP port nobody uses right now, for sockets of family set up by
+// cfg to bind to one after the other
+func freeUDPPort(family ipFamily, cfg socketConfig) (int, error) {
+	network := "udp4"
+	if family.protocol == familyIPv6.protocol {
+		network = "udp6"
+	}
+	conn, err := net.ListenPacket(network, net.JoinHostPort(cfg.listenAddr(family), "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// hasRouteTo reports whether the local host has connectivity towards addr from sockets
+// set up by cfg, e.g. through its device
+func hasRouteTo(addr net.IPAddr, cfg socketConfig) bool {
+	_, err := sourceAddrFor(&addr, cfg)
+	return err == nil
+}
+
+// sourceAddrFor returns the local address packets to dst are sent from with the sockets set
+// up by cfg: its source, or the one the kernel picks for the route through its device.
+// Connecting a UDP socket sends no packets, it only asks the kernel to pick a route
+// and a source address, which fails when there is no route for that family.
+func sourceAddrFor(dst *net.IPAddr, cfg socketConfig) (net.IP, error) {
+	cfg, err := cfg.forFamily(familyOf(dst.IP))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.source != nil {
+		return cfg.source, nil
+	}
+	network := "udp4"
+	if dst.IP.To4() == nil {
+		network = "udp6"
+	}
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		return socketConfig{device: cfg.device}.apply(c, familyOf(dst.IP))
+	}}
+	dstUDPAddr := &net.UDPAddr{IP: dst.IP, Port: 33434, Zone: dst.Zone}
+	conn, err := dialer.Dial(network, dstUDPAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
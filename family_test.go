@@ -0,0 +1,29 @@
+package traceroute
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHasRouteTo(t *testing.T) {
+	loopback := net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if !hasRouteTo(loopback, socketConfig{}) {
+		t.Errorf("no route to %s", loopback.IP)
+	}
+	if hasRouteTo(loopback, socketConfig{device: "nonexistent0"}) {
+		t.Errorf("a route to %s through an interface that doesn't exist", loopback.IP)
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			if !hasRouteTo(loopback, socketConfig{device: ifi.Name}) {
+				t.Errorf("no route to %s through %s", loopback.IP, ifi.Name)
+			}
+			break
+		}
+	}
+}
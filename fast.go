@@ -0,0 +1,89 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+Fast path length discovery (-fast)
+
+Where the destination is doesn't show until it answered, so probing the hops ahead of time
+(Concurrency, the Parallel scheduler, Shuffle) sends probes beyond it, up to MaxTTL worth of
+them on a short path. With Tracer.Fast the trace first finds the length of the path, by a
+binary search with one probe per step: the destination answers every probe that reaches it,
+the routers before it answer with Time Exceeded, or not at all.
+
+	MaxTTL 64, destination at 12:
+	  TTL 32: reached  -> 12 is at most 32
+	  TTL 16: reached  -> at most 16
+	  TTL  8: router   -> more than 8
+	  TTL 12: reached  -> at most 12
+	  TTL 10: router   -> more than 10
+	  TTL 11: router   -> 12
+
+That's log2(MaxTTL) probes, six for 64. Then the hops are probed up to the path length only,
+as without Fast: in order, concurrently or shuffled. With many probes in flight, or
+shuffled, none are wasted beyond the destination any more: about half the probes of a trace
+whose path is much shorter than MaxTTL. Probed one hop after the other, the trace stops at the
+destination anyway, Fast only adds the probes of the search.
+
+A probe of the search nobody answered (lost, or a destination that doesn't answer at all)
+counts as not having reached the destination, it is sent again up to Retries times first.
+Loss can only make the path look longer than it is, then the trace stops at the destination
+as usual; a destination that never answered is traced up to MaxTTL. Should none of the
+probes of the destination's hop be answered later on, the trace ends there as at MaxTTL.
+
+The probes of the search go out like any other (the RateLimit counts them), but they aren't
+results: hooks, renderers and Result only see the hops.
+*/
+
+// findPathLength lowers tr.maxTTL to the TTL of the destination, found by the binary search
+// described above; it is left as it is when the destination never answered
+func (tr *trace) findPathLength(ctx context.Context) error {
+	lo, hi := tr.firstTTL, tr.maxTTL // the destination is at lo or beyond, at hi or before (if at all)
+	found := false
+	for lo < hi {
+		mid := (lo + hi) / 2
+		reached, err := tr.reaches(ctx, mid)
+		if err != nil {
+			return err
+		}
+		if reached {
+			hi, found = mid, true
+		} else {
+			lo = mid + 1
+		}
+	}
+	if !found {
+		tr.logger.Debug("path length unknown, the destination didn't answer", "max_ttl", tr.maxTTL)
+		return nil
+	}
+	tr.logger.Debug("found the path length", "ttl", hi)
+	tr.maxTTL = hi
+	return nil
+}
+
+// reaches sends a probe of the binary search with TTL and reports whether the destination
+// answered it, trying up to Retries more times when nobody does
+func (tr *trace) reaches(ctx context.Context, TTL int) (bool, error) {
+	for try := 0; try <= tr.retries; try++ {
+		if err := tr.rateLimit.wait(ctx); err != nil {
+			return false, err
+		}
+		seqNum := int(tr.retrySeqNum.Add(1)) // beyond those of the hops, like retries
+		reply, err := tr.send(withLogger(ctx, tr.logger), ProbeRequest{Dst: tr.dstAddr, TTL: TTL, Seq: seqNum, Wait: tr.wait, Clock: tr.clock})
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if err == nil {
+			tr.logger.Debug("path length probe answered", "ttl", TTL, "from", reply.Addr, "reached", reply.Reached)
+			return reply.Reached, nil
+		}
+		tr.logger.Debug("path length probe not answered", "ttl", TTL, "err", err)
+		if !errors.Is(timeoutError(err), ErrTimeout) {
+			return false, nil // e.g. unreachable, asking again won't help
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,83 @@
+package traceroute
+
+import (
+	"math"
+
+	"golang.org/x/net/bpf"
+)
+
+/*
+In-kernel packet filter
+
+A raw ICMP socket receives a copy of every ICMP message arriving at the host: the answers to
+our probes, but also those of other traces, pings, other tools' traffic, our own Echo Requests
+to the local host. Each of them is read, parsed and dropped in userspace (see echoKey), which
+on a busy host costs more than the trace itself. The socket of a trace gets a classic BPF
+filter (SO_ATTACH_FILTER) instead, so the kernel drops what can't be ours before it is queued:
+
+	Echo Reply, Extended Echo Reply:  Identifier (bytes 4-5 of the ICMP header) is the trace's
+	Time Exceeded:                    Identifier of the Echo Request it quotes is the trace's
+	anything else:                    dropped
+
+Raw IPv4 sockets see the packet from the IPv4 header on, whose length (IHL) is taken from
+the packet, as that of the quoted IPv4 header (IP options, -g); raw IPv6 sockets see it from
+the ICMPv6 header on, the quoted IPv6 header is 40 bytes:
+
+	IPv4:  [IPv4 header, IHL*4][ICMP header, 8][quoted IPv4 header, IHL*4][Echo Request: type, code, checksum, ID]
+	IPv6:                      [ICMP header, 8][quoted IPv6 header, 40   ][Echo Request: type, code, checksum, ID]
+
+The filter only spares the reading, the messages it lets through are matched as before.
+Where the kernel doesn't take filters (everywhere but Linux), or matches the Identifier itself
+(datagram sockets), the socket reads everything as before; so do the sockets of a Session,
+which are shared by traces of many Identifiers.
+*/
+
+// icmpFilter returns the filter above for the messages of family about Echo Requests with
+// Identifier echoID
+func icmpFilter(family ipFamily, echoID int) ([]bpf.RawInstruction, error) {
+	// X: where the ICMP message starts
+	start := bpf.Instruction(bpf.LoadConstant{Dst: bpf.RegX, Val: 0})
+	// X: where the quoted Echo Request starts, less the 8 bytes of the ICMP header before it
+	quoted := []bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegX, Val: uint32(family.innerHeaderLen)}}
+	if family.protocol == familyIPv4.protocol {
+		start = bpf.LoadMemShift{Off: 0}
+		quoted = []bpf.Instruction{
+			bpf.LoadIndirect{Off: 8, Size: 1}, // first byte of the quoted IPv4 header
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0f},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.TAX{},
+		}
+	}
+	prog := []bpf.Instruction{
+		start,
+		bpf.LoadIndirect{Off: 0, Size: 1}, // type
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(icmpTypeNumber(family.echoReply)), SkipTrue: 3},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(icmpTypeNumber(family.extendedEchoReply)), SkipTrue: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(icmpTypeNumber(family.timeExceeded)), SkipTrue: 3},
+		bpf.RetConstant{Val: 0},
+		bpf.LoadIndirect{Off: 4, Size: 2}, // Identifier of the reply
+		bpf.Jump{Skip: uint32(len(quoted)) + 1},
+	}
+	prog = append(prog, quoted...)
+	prog = append(prog,
+		bpf.LoadIndirect{Off: 8 + 4, Size: 2}, // Identifier of the quoted Echo Request
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(echoID), SkipFalse: 1},
+		bpf.RetConstant{Val: math.MaxUint32}, // all of it
+		bpf.RetConstant{Val: 0},
+	)
+	return bpf.Assemble(prog)
+}
+
+// filterEchoID attaches the filter above to conn, if it is a socket that takes one
+func filterEchoID(conn packetConn, family ipFamily, echoID int) error {
+	c, ok := conn.(bpf.Setter)
+	if !ok {
+		return nil
+	}
+	filter, err := icmpFilter(family, echoID)
+	if err != nil {
+		return err
+	}
+	return c.SetBPF(filter)
+}
@@ -0,0 +1,33 @@
+package traceroute
+
+import "errors"
+
+/*
+IPv6 flow labels (-flow-label, -flow-label-sweep), RFC 6437
+
+Every IPv6 header carries a 20 bit Flow Label:
+
+	Version (4 bits) | Traffic Class (8 bits) | Flow Label (20 bits)
+
+Load balancers hash it together with the addresses (and often instead of the ports) to pick
+one of several equal cost paths. Linux sets a label per socket on its own
+(net.ipv6.auto_flowlabels), so it is stable within one run, but a different path may be taken
+next time. Pinning the label keeps the path the same across runs, sweeping it makes every
+probe of a hop take the path of a different flow: probe i of every hop uses label base+i, so
+each column of the output follows one flow.
+
+Linux only sends labels that the socket leased with IPV6_FLOWLABEL_MGR, the label then goes
+with each packet as an IPV6_FLOWINFO control message (see flowlabel_linux.go).
+*/
+
+const MaxFlowLabel = 1<<20 - 1
+
+var errFlowLabelIPv6Only = errors.New("flow labels only exist in IPv6")
+
+// sweepFlowLabel returns the flow label of probe i (counting from 0) of a hop
+func sweepFlowLabel(base, i int) int {
+	if base == 0 {
+		base = 1 // 0 means no label
+	}
+	return (base+i-1)%MaxFlowLabel + 1
+}
@@ -0,0 +1,67 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/in6.h, golang.org/x/sys/unix doesn't have these
+const (
+	ipv6FlowInfo       = 11 // IPV6_FLOWINFO
+	ipv6FlowLabelMgr   = 32 // IPV6_FLOWLABEL_MGR
+	ipv6FlowLabelGet   = 0  // IPV6_FL_A_GET
+	ipv6FlowLabelNew   = 1  // IPV6_FL_F_CREATE
+	ipv6FlowLabelShare = 255
+	flowLabelReqLen    = 32 // sizeof(struct in6_flowlabel_req)
+)
+
+// leaseFlowLabel asks the kernel for permission to send label to dst on c
+func leaseFlowLabel(c syscall.Conn, label int, dst net.IP) error {
+	/*
+		struct in6_flowlabel_req {
+			struct in6_addr flr_dst;     // bytes 0-15
+			__be32          flr_label;   // bytes 16-19
+			__u8            flr_action;  // byte 20
+			__u8            flr_share;   // byte 21
+			__u16           flr_flags;   // bytes 22-23
+			__u16           flr_expires; // bytes 24-25
+			__u16           flr_linger;  // bytes 26-27
+			__u32           __flr_pad;   // bytes 28-31
+		};
+	*/
+	req := make([]byte, flowLabelReqLen)
+	copy(req[0:16], dst.To16())
+	binary.BigEndian.PutUint32(req[16:20], uint32(label))
+	req[20] = ipv6FlowLabelGet
+	req[21] = ipv6FlowLabelShare // IPV6_FL_S_ANY, other traceroutes may use the same label
+	binary.NativeEndian.PutUint16(req[22:24], ipv6FlowLabelNew)
+
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockoptErr = unix.SetsockoptString(int(fd), unix.IPPROTO_IPV6, ipv6FlowLabelMgr, string(req))
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", sockoptErr)
+}
+
+// flowLabelControl is the control message sending a packet with label
+func flowLabelControl(label int) []byte {
+	oob := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_IPV6
+	h.Type = ipv6FlowInfo
+	h.SetLen(unix.CmsgLen(4))
+	binary.BigEndian.PutUint32(oob[unix.CmsgLen(0):], uint32(label))
+	return oob
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package traceroute
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errFlowLabelUnsupported = errors.New("setting the flow label is only supported on Linux")
+
+func leaseFlowLabel(c syscall.Conn, label int, dst net.IP) error {
+	return errFlowLabelUnsupported
+}
+
+func flowLabelControl(label int) []byte {
+	return nil
+}
@@ -0,0 +1,66 @@
+package traceroute
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+GNU traceroute output
+
+The traceroute command of most Linux distributions prints a header and then one line per
+hop, which plenty of scripts parse:
+
+	traceroute to example.com (93.184.216.34), 64 hops max, 33 byte packets
+	 1  router.lan (192.168.1.1)  1.234 ms  1.101 ms  1.187 ms
+	 2  * * *
+	 3  10.0.0.1 (10.0.0.1)  9.876 ms 10.0.0.2 (10.0.0.2)  10.123 ms  9.954 ms
+
+The hop number is right-aligned in two columns. A responder is printed as "name (address)",
+with the address as its name when it has none, or as a bare address with -n, and only when
+it differs from the responder of the previous probe of the hop. Every answered probe adds
+its RTT in milliseconds with three decimals, every unanswered one a "*".
+*/
+
+// GNURenderer prints probes like GNU traceroute does, see above. It keeps track of the hop
+// line being printed, so it must not be shared by traces running at the same time.
+type GNURenderer struct {
+	Numeric bool // print bare addresses, like traceroute -n
+
+	lastAddr string // responder printed last on the current line, "" for none
+}
+
+func (r *GNURenderer) RenderHeader(out io.Writer, info TraceInfo) {
+	fmt.Fprintf(out, "traceroute to %s (%s), %d hops max, %d byte packets\n", info.Target, info.Addr.IP, info.MaxTTL, info.PacketSize)
+}
+
+func (r *GNURenderer) Render(out io.Writer, result HopResult) {
+	if result.Probe == 1 {
+		fmt.Fprintf(out, "%2d ", result.TTL)
+		r.lastAddr = ""
+	}
+
+	if result.Addr == nil {
+		fmt.Fprint(out, " *")
+	} else {
+		addr := addrString(result.Addr)
+		if addr != r.lastAddr {
+			name := strings.TrimSuffix(result.Name, ".") // reverse lookups return FQDNs
+			switch {
+			case r.Numeric:
+				fmt.Fprintf(out, " %s", addr)
+			case name == "":
+				fmt.Fprintf(out, " %s (%s)", addr, addr)
+			default:
+				fmt.Fprintf(out, " %s (%s)", name, addr)
+			}
+			r.lastAddr = addr
+		}
+		fmt.Fprintf(out, "  %.3f ms", milliseconds(result.RTT))
+	}
+
+	if result.Last {
+		fmt.Fprintln(out)
+	}
+}
@@ -4,4 +4,6 @@ go 1.24.5
 
 require golang.org/x/net v0.49.0
 
-require golang.org/x/sys v0.40.0 // indirect
+require golang.org/x/sys v0.40.0
+
+require github.com/mattn/go-sqlite3 v1.14.52
@@ -0,0 +1,150 @@
+package traceroute
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+)
+
+/*
+IP_HDRINCL sockets (-socket hdrincl)
+
+Normally the kernel builds the IPv4 header for us and only lets us change a few fields
+(TTL, TOS) through socket options. With IP_HDRINCL we hand the kernel the complete packet,
+header included, so every field is ours: the IP ID, flags, and any IP options.
+
+Linux still fills in the header checksum and total length for us, and picks an IP ID when
+we leave it at 0. Replies are read from the same socket, so they go through the exact same
+parsing as with the plain raw socket.
+
+IPv6 has no equivalent, this is IPv4 only.
+*/
+
+// ipHeader holds the IPv4 header fields the user asked to control (-ip-id, -ip-options, -g, -tos)
+type ipHeader struct {
+	id       int      // IP Identification, 0 lets the kernel choose
+	tos      int      // TOS byte, see tos.go
+	dontFrag bool     // set the Don't Fragment flag
+	src      net.IP   // source address, nil lets the kernel fill it in
+	options  []byte   // raw IP options, already padded to a multiple of 4 bytes
+	gateways []net.IP // loose source route (see lsrr.go)
+}
+
+// ParseIPOptions decodes the -ip-options hex string, padding it with End of Option List
+// bytes (0) so the header length stays a multiple of 4 bytes
+func ParseIPOptions(s string) ([]byte, error) {
+	options, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP options %q: %v", s, err)
+	}
+	for len(options)%4 != 0 {
+		options = append(options, 0)
+	}
+	if len(options) > 40 { // the IHL field allows at most 60 bytes of header
+		return nil, fmt.Errorf("IP options can be at most 40 bytes, got %d", len(options))
+	}
+	return options, nil
+}
+
+// flags returns the flags field of the header
+func (h ipHeader) flags() ipv4.HeaderFlags {
+	if h.dontFrag {
+		return ipv4.DontFragment
+	}
+	return 0
+}
+
+// hdrinclConn is a raw ICMP socket with IP_HDRINCL set, we build the IPv4 header ourselves
+type hdrinclConn struct {
+	*ipv4.RawConn
+	TTL    int
+	header ipHeader
+
+	lastOptions []byte // IP options of the last packet read, for -R
+}
+
+func listenHdrincl(family ipFamily, header ipHeader, addr string) (*hdrinclConn, error) {
+	if family.protocol != familyIPv4.protocol {
+		return nil, errors.New("-socket hdrincl only supports IPv4")
+	}
+
+	conn, err := net.ListenPacket(family.listenNetwork, addr)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := ipv4.NewRawConn(conn) // sets IP_HDRINCL
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &hdrinclConn{RawConn: rawConn, TTL: 64, header: header}, nil
+}
+
+func (c *hdrinclConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	return c.writeToTTL(b, dst, c.TTL)
+}
+
+// writeToTTL sends b to dst with a header of TTL, see ttl.go
+func (c *hdrinclConn) writeToTTL(b []byte, dst net.Addr, TTL int) (int, error) {
+	dstIP := dst.(*net.IPAddr).IP.To4()
+	options := c.header.options
+	if len(c.header.gateways) > 0 {
+		// On the wire the packet goes to the first gateway, the option lists the rest
+		route := append(append([]net.IP{}, c.header.gateways[1:]...), dstIP)
+		options = append(lsrrOption(route), c.header.options...)
+		dstIP = c.header.gateways[0]
+	}
+	h := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen + len(options),
+		TOS:      c.header.tos,
+		Flags:    c.header.flags(),
+		TotalLen: ipv4.HeaderLen + len(options) + len(b),
+		ID:       c.header.id,
+		TTL:      TTL,
+		Protocol: familyIPv4.protocol,
+		Src:      c.header.src,
+		Dst:      dstIP,
+		Options:  options,
+	}
+	if err := c.RawConn.WriteTo(h, b, nil); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *hdrinclConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, _, err := c.readFromTTL(b)
+	return n, from, err
+}
+
+func (c *hdrinclConn) readFromTTL(b []byte) (int, net.Addr, int, error) {
+	h, payload, _, err := c.RawConn.ReadFrom(b)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	// Hand back only the ICMP message, like the other sockets do
+	c.lastOptions = h.Options
+	n := copy(b, payload)
+	return n, &net.IPAddr{IP: h.Src}, h.TTL, nil
+}
+
+func (c *hdrinclConn) SetTTL(TTL int) error {
+	c.TTL = TTL // goes into the header of the next packet
+	return nil
+}
+
+func (c *hdrinclConn) SetFlowLabel(label int, dst net.IP) error {
+	if label == 0 {
+		return nil
+	}
+	return errFlowLabelIPv6Only
+}
+
+func (c *hdrinclConn) EchoID(id int) int {
+	return id
+}
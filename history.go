@@ -0,0 +1,262 @@
+package traceroute
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+History storage (-history)
+
+A History stores every trace it is handed in a SQL database, so the path to a target can be
+looked up after an incident instead of scrolled back to. It speaks database/sql, the driver is
+up to the caller; the CLI uses SQLite, a file anybody can query with the sqlite3 shell. The
+tables, created unless they exist:
+
+	runs    one row per trace: id, target, address, started, ended (RFC 3339, UTC), reached,
+	        hops (the number probed) and path, the fingerprint of the path (see pathchange.go)
+	hops    one row per hop of a run: id, run_id, ttl, sent, answered, and responders, the
+	        addresses that answered, comma-separated
+	probes  one row per probe of a hop: hop_id, probe (1 for the first), sent, address, name,
+	        rtt_ms, type, reached, note, retries and error, like -o json (NULL for none)
+
+Which path was taken when, and when it changed:
+
+	SELECT started, path, reached FROM runs WHERE target = 'example.com' ORDER BY started;
+
+Probes sent and answered and the average RTT per hop during an incident:
+
+	SELECT h.ttl, COUNT(*) AS sent, COUNT(p.address) AS answered, AVG(p.rtt_ms) AS avg_ms
+	FROM runs r JOIN hops h ON h.run_id = r.id JOIN probes p ON p.hop_id = h.id
+	WHERE r.target = 'example.com' AND r.started BETWEEN '2026-10-16T02:00:00Z' AND '2026-10-16T03:00:00Z'
+	GROUP BY h.ttl ORDER BY h.ttl;
+
+Every trace is stored in one transaction, a run is there with all of its hops or not at all.
+Recent reads the last runs to a target back as Results, e.g. for the dashboard (see
+dashboard.go); the types of the answers are not stored, their Probe.Type is nil.
+*/
+
+// historySchema creates the tables of a History, see above
+var historySchema = []string{
+	`CREATE TABLE IF NOT EXISTS runs (
+		id INTEGER PRIMARY KEY,
+		target TEXT NOT NULL,
+		address TEXT,
+		started TEXT NOT NULL,
+		ended TEXT NOT NULL,
+		reached INTEGER NOT NULL,
+		hops INTEGER NOT NULL,
+		path TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS runs_target_started ON runs (target, started)`,
+	`CREATE TABLE IF NOT EXISTS hops (
+		id INTEGER PRIMARY KEY,
+		run_id INTEGER NOT NULL REFERENCES runs (id),
+		ttl INTEGER NOT NULL,
+		sent INTEGER NOT NULL,
+		answered INTEGER NOT NULL,
+		responders TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS hops_run_id ON hops (run_id)`,
+	`CREATE TABLE IF NOT EXISTS probes (
+		hop_id INTEGER NOT NULL REFERENCES hops (id),
+		probe INTEGER NOT NULL,
+		sent TEXT,
+		address TEXT,
+		name TEXT,
+		rtt_ms REAL,
+		type TEXT,
+		reached INTEGER NOT NULL,
+		note TEXT,
+		retries INTEGER NOT NULL,
+		error TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS probes_hop_id ON probes (hop_id)`,
+}
+
+// History stores traces in a SQL database, see above. It is safe for concurrent use.
+type History struct {
+	db *sql.DB
+}
+
+// OpenHistory returns a History storing traces in db, creating its tables unless they exist
+func OpenHistory(ctx context.Context, db *sql.DB) (*History, error) {
+	for _, stmt := range historySchema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &History{db: db}, nil
+}
+
+// Save stores result as a run with its hops and probes, and returns the id of the run
+func (h *History) Save(ctx context.Context, result *Result) (int64, error) {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // a no-op once committed
+
+	path := NewPath(result)
+	var address any
+	if result.Addr != nil {
+		address = result.Addr.IP.String()
+	}
+	run, err := tx.ExecContext(ctx,
+		`INSERT INTO runs (target, address, started, ended, reached, hops, path) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		result.Target, address, historyTime(result.Start), historyTime(result.End), result.Reached, result.lastTTL(), path.Fingerprint())
+	if err != nil {
+		return 0, err
+	}
+	runID, err := run.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	responders := make(map[int][]string, len(path.Hops))
+	for _, hop := range path.Hops {
+		responders[hop.TTL] = hop.Responders
+	}
+	for _, hop := range result.Hops {
+		answered := 0
+		for _, probe := range hop.Probes {
+			if probe.Addr != nil {
+				answered++
+			}
+		}
+		row, err := tx.ExecContext(ctx,
+			`INSERT INTO hops (run_id, ttl, sent, answered, responders) VALUES (?, ?, ?, ?, ?)`,
+			runID, hop.TTL, len(hop.Probes), answered, strings.Join(responders[hop.TTL], ","))
+		if err != nil {
+			return 0, err
+		}
+		hopID, err := row.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		for i, probe := range hop.Probes {
+			p := probe.jsonProbe()
+			var rtt any
+			if p.RTT != nil {
+				rtt = *p.RTT
+			}
+			_, err := tx.ExecContext(ctx,
+				`INSERT INTO probes (hop_id, probe, sent, address, name, rtt_ms, type, reached, note, retries, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				hopID, i+1, historyNull(p.Sent), historyAddr(probe.Addr), historyNull(p.Name), rtt,
+				historyNull(p.Type), p.Reached, historyNull(p.Note), p.Retries, historyNull(p.Error))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return runID, tx.Commit()
+}
+
+// Recent returns the last n runs to target stored, oldest first, see above
+func (h *History) Recent(ctx context.Context, target string, n int) ([]*Result, error) {
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT id, address, started, ended, reached FROM runs WHERE target = ? ORDER BY started DESC LIMIT ?`, target, n)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	var results []*Result
+	for rows.Next() {
+		var id int64
+		var address sql.NullString
+		var started, ended string
+		result := &Result{Target: target}
+		if err := rows.Scan(&id, &address, &started, &ended, &result.Reached); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if address.Valid {
+			result.Addr, _ = net.ResolveIPAddr("ip", address.String) // an address, nothing to look up
+		}
+		result.Start, _ = time.Parse(time.RFC3339Nano, started)
+		result.End, _ = time.Parse(time.RFC3339Nano, ended)
+		ids = append(ids, id)
+		results = append(results, result)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(ids)
+	slices.Reverse(results)
+
+	for i, id := range ids {
+		if err := h.readHops(ctx, id, results[i]); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// readHops reads the hops and probes of run id into result
+func (h *History) readHops(ctx context.Context, id int64, result *Result) error {
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT h.ttl, p.sent, p.address, p.name, p.rtt_ms, p.reached, p.note, p.retries, p.error
+		FROM hops h JOIN probes p ON p.hop_id = h.id WHERE h.run_id = ? ORDER BY h.ttl, p.probe`, id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var TTL int
+		var sent, address, name, note, errText sql.NullString
+		var rtt sql.NullFloat64
+		var probe Probe
+		if err := rows.Scan(&TTL, &sent, &address, &name, &rtt, &probe.Reached, &note, &probe.Retries, &errText); err != nil {
+			return err
+		}
+		if sent.Valid {
+			probe.Sent, _ = time.Parse(time.RFC3339Nano, sent.String)
+		}
+		if address.Valid {
+			if addr, err := net.ResolveIPAddr("ip", address.String); err == nil {
+				probe.Addr = addr // not a nil *net.IPAddr, Addr != nil means answered
+			}
+		}
+		probe.Name = name.String
+		probe.RTT = time.Duration(rtt.Float64 * float64(time.Millisecond))
+		if note.Valid {
+			probe.Note = " [" + note.String + "]" // as the prober made it, see Probe.jsonProbe
+		}
+		if errText.Valid {
+			probe.Err = errors.New(errText.String)
+		}
+		if len(result.Hops) == 0 || result.Hops[len(result.Hops)-1].TTL != TTL {
+			result.Hops = append(result.Hops, Hop{TTL: TTL})
+		}
+		hop := &result.Hops[len(result.Hops)-1]
+		hop.Probes = append(hop.Probes, probe)
+	}
+	return rows.Err()
+}
+
+// historyTime formats t for the runs table, so its times sort and compare as text
+func historyTime(t time.Time) string {
+	return TimestampRFC3339.Format(t)
+}
+
+// historyAddr returns the address column of a probe, NULL when nobody answered
+func historyAddr(addr net.Addr) any {
+	if addr == nil {
+		return nil
+	}
+	return addrString(addr)
+}
+
+// historyNull returns s, NULL for ""
+func historyNull(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,31 @@
+package traceroute
+
+import "errors"
+
+// Hooks are functions a Tracer calls while a trace runs, to log, meter or stop it without
+// touching the output. OnProbeReply and OnHopComplete are called one at a time, in probe
+// order, from the goroutine of the trace handing out its results once their names are in
+// (see rdns.go), not from the one that called Run, Trace or Stream. OnProbeSent is called
+// from the goroutine sending the probe: more than one with schedulers sending probes at once
+// (Parallel) and Tracer.Concurrency. OnLateReply is called from the goroutine reading the
+// socket. Every hook has returned before Run and Trace return and before Stream closes its
+// channel, so what the hooks captured can be read then without further locking. Any of them
+// may be nil. Multipath traces don't call them.
+type Hooks struct {
+	// OnProbeSent is called right after probe number probe of hop TTL went out
+	OnProbeSent func(TTL, probe int)
+	// OnProbeReply is called once the outcome of a probe is known, also when nobody answered
+	// (result.Err is set then)
+	OnProbeReply func(result HopResult)
+	// OnHopComplete is called after the last probe of a hop, with the results of all of them.
+	// Returning an error ends the trace: Run returns it (nil for StopTrace), Stream closes its
+	// channel.
+	OnHopComplete func(TTL int, results []HopResult) error
+	// OnLateReply is called when an answer to a probe arrives after its wait was over, with
+	// the probe's result, the answer filled in and Late set (ICMP probes only, see late.go).
+	// It is called from the goroutine reading the socket, while the trace goes on.
+	OnLateReply func(result HopResult)
+}
+
+// StopTrace can be returned by Hooks.OnHopComplete to end a trace early without an error
+var StopTrace = errors.New("stop trace")
@@ -0,0 +1,195 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Hop information (--wide)
+
+Who runs a hop and where it is, beyond its host name: the autonomous system (AS) announcing
+its address, and the country and city it is in. A HopInfoSource looks them up, two come
+with the package:
+
+	CymruSource   Team Cymru's IP to ASN mapping over DNS (https://www.team-cymru.com/ip-asn-mapping),
+	              AS number, AS name and the country the prefix is registered in, no city
+	GeoIPDatabase a MaxMind DB file (GeoLite2/GeoIP2 City, Country or ASN, see mmdb.go),
+	              whatever of the above it holds, offline
+
+Cymru answers TXT queries for the reversed address under origin.asn.cymru.com (IPv4, one
+label per octet) or origin6.asn.cymru.com (IPv6, one label per nibble), and for the AS name
+under AS<number>.asn.cymru.com:
+
+	8.8.8.8.origin.asn.cymru.com   "15169 | 8.8.8.0/24 | US | arin | 2023-12-28"
+	AS15169.asn.cymru.com          "15169 | US | arin | 2000-03-30 | GOOGLE, US"
+
+Private and otherwise unannounced addresses have no entry, their HopInfo stays empty.
+*/
+
+// HopInfo is what is known about the network a hop's address is in
+type HopInfo struct {
+	ASN     int    // number of the autonomous system announcing the address, 0 when unknown
+	ASName  string // its name, e.g. "GOOGLE"
+	Country string // ISO 3166-1 country code, e.g. "US"
+	City    string // English city name
+}
+
+// merge fills the fields of info that are still empty from other
+func (info *HopInfo) merge(other HopInfo) {
+	if info.ASN == 0 {
+		info.ASN, info.ASName = other.ASN, other.ASName
+	}
+	if info.Country == "" {
+		info.Country = other.Country
+	}
+	if info.City == "" {
+		info.City = other.City
+	}
+}
+
+// String formats info as "AS15169 GOOGLE US Mountain View", with "AS?" for an unknown AS
+// and without what else is unknown
+func (info HopInfo) String() string {
+	fields := []string{"AS?"}
+	if info.ASN != 0 {
+		fields[0] = fmt.Sprintf("AS%d", info.ASN)
+	}
+	for _, field := range []string{info.ASName, info.Country, info.City} {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// HopInfoSource looks up the HopInfo of an address. An address it knows nothing about is
+// not an error, its HopInfo is just empty.
+type HopInfoSource interface {
+	LookupHopInfo(ctx context.Context, ip net.IP) (HopInfo, error)
+}
+
+// CymruSource looks HopInfo up with Team Cymru's DNS service, see above. It caches the
+// answers, and is safe for concurrent use.
+type CymruSource struct {
+	Resolver *net.Resolver // nil means net.DefaultResolver
+
+	mu      sync.Mutex
+	asNames map[int]string
+}
+
+func (s *CymruSource) LookupHopInfo(ctx context.Context, ip net.IP) (HopInfo, error) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	records, err := resolver.LookupTXT(ctx, cymruOriginName(ip))
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return HopInfo{}, nil // not announced
+	}
+	if err != nil || len(records) == 0 {
+		return HopInfo{}, err
+	}
+	fields := cymruFields(records[0])
+	if len(fields) < 3 {
+		return HopInfo{}, fmt.Errorf("unexpected answer from Team Cymru: %q", records[0])
+	}
+	var info HopInfo
+	// Addresses announced by more than one AS list all of them
+	asn, _, _ := strings.Cut(fields[0], " ")
+	info.ASN, _ = strconv.Atoi(asn)
+	info.Country = fields[2]
+	if info.ASN != 0 {
+		info.ASName = s.asName(ctx, resolver, info.ASN)
+	}
+	return info, nil
+}
+
+// asName returns the name of AS asn, "" when Cymru doesn't know it
+func (s *CymruSource) asName(ctx context.Context, resolver *net.Resolver, asn int) string {
+	s.mu.Lock()
+	name, ok := s.asNames[asn]
+	s.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	records, err := resolver.LookupTXT(ctx, fmt.Sprintf("AS%d.asn.cymru.com", asn))
+	if err == nil && len(records) > 0 {
+		if fields := cymruFields(records[0]); len(fields) >= 5 {
+			// "GOOGLE, US": the country is already known from the prefix
+			name, _, _ = strings.Cut(fields[4], ",")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.asNames == nil {
+		s.asNames = make(map[int]string)
+	}
+	if err == nil {
+		s.asNames[asn] = name // errors are retried with the next address of the AS
+	}
+	return name
+}
+
+// cymruOriginName returns the name to look the origin AS of ip up under
+func cymruOriginName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.origin.asn.cymru.com", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var b strings.Builder
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip16[i]&0x0f, ip16[i]>>4)
+	}
+	b.WriteString("origin6.asn.cymru.com")
+	return b.String()
+}
+
+// cymruFields splits a Cymru TXT record at its "|" separators
+func cymruFields(record string) []string {
+	fields := strings.Split(record, "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+// hopInfoCache looks addresses up in a list of HopInfoSources once, the first source's
+// answer winning over the later ones field by field
+type hopInfoCache struct {
+	sources []HopInfoSource
+
+	mu    sync.Mutex
+	infos map[string]HopInfo
+}
+
+// lookup returns what the sources know about ip, errors leave fields empty
+func (c *hopInfoCache) lookup(ctx context.Context, ip net.IP) HopInfo {
+	key := ip.String()
+	c.mu.Lock()
+	info, ok := c.infos[key]
+	c.mu.Unlock()
+	if ok {
+		return info
+	}
+
+	for _, source := range c.sources {
+		found, err := source.LookupHopInfo(ctx, ip)
+		if err == nil {
+			info.merge(found)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.infos == nil {
+		c.infos = make(map[string]HopInfo)
+	}
+	c.infos[key] = info
+	return info
+}
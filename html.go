@@ -0,0 +1,214 @@
+package traceroute
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+/*
+HTML report (-o html)
+
+A single page without external resources (styles inline, sparklines as inline SVG), so it
+can be attached to a ticket or mailed and still opens anywhere:
+
+	traceroute to example.com (93.184.216.34)
+	Started   2026-10-16 09:41:07 UTC (4.2s)
+	Reached   yes
+	Options   -M tcp -q 5
+
+	Hop  Host                         Loss   Best   Avg    Worst  RTTs
+	1    router.lan (192.168.1.1)     0%     0.3    0.4    0.6    [sparkline]
+	2    *                            100%
+	...
+
+RTTs are in milliseconds. The sparkline of a hop shows the RTTs of its probes in the order
+they were sent, on the same scale for all hops so they can be compared at a glance; probes
+nobody answered are red dots at the bottom.
+*/
+
+// HTMLInfo is what WriteHTML shows about how a trace was run
+type HTMLInfo struct {
+	Started  time.Time     // when the trace started, left out when zero
+	Duration time.Duration // how long it took, left out when zero
+	Options  string        // how it was run, e.g. the command line flags, left out when empty
+}
+
+// Size of the sparklines, in pixels
+const (
+	sparklineWidth  = 120
+	sparklineHeight = 24
+)
+
+// htmlHop is a row of the hop table
+type htmlHop struct {
+	TTL              int
+	Hosts            []string
+	Loss             float64 // in percent
+	Answered         bool
+	Best, Avg, Worst string // in milliseconds
+	Sparkline        template.HTML
+	Reached          bool
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>traceroute to {{.Target}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.25em 0.8em; text-align: left; }
+.hops th { border-bottom: 2px solid #888; }
+.hops td { border-bottom: 1px solid #ddd; font-variant-numeric: tabular-nums; }
+.hops td.num { text-align: right; }
+.meta th { color: #666; font-weight: normal; }
+.lost { color: #c00; }
+.reached { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>traceroute to {{.Target}}{{with .Addr}} ({{.}}){{end}}</h1>
+<table class="meta">
+{{- with .Started}}
+<tr><th>Started</th><td>{{.}}{{with $.Duration}} ({{.}}){{end}}</td></tr>
+{{- end}}
+<tr><th>Reached</th><td>{{if .Reached}}yes{{else}}no{{end}}</td></tr>
+{{- with .Options}}
+<tr><th>Options</th><td><code>{{.}}</code></td></tr>
+{{- end}}
+</table>
+<h2>Hops</h2>
+<table class="hops">
+<tr><th>Hop</th><th>Host</th><th>Loss</th><th>Best</th><th>Avg</th><th>Worst</th><th>RTTs (ms)</th></tr>
+{{- range .Hops}}
+<tr{{if .Reached}} class="reached"{{end}}>
+<td class="num">{{.TTL}}</td>
+<td>{{range $i, $host := .Hosts}}{{if $i}}<br>{{end}}{{$host}}{{else}}*{{end}}</td>
+<td class="num{{if .Loss}} lost{{end}}">{{printf "%.0f" .Loss}}%</td>
+{{- if .Answered}}
+<td class="num">{{.Best}}</td><td class="num">{{.Avg}}</td><td class="num">{{.Worst}}</td>
+{{- else}}
+<td></td><td></td><td></td>
+{{- end}}
+<td>{{.Sparkline}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes r to w as a self-contained HTML page, see html.go
+func (r *Result) WriteHTML(w io.Writer, info HTMLInfo) error {
+	var maxRTT time.Duration
+	for _, hop := range r.Hops {
+		for _, probe := range hop.Probes {
+			if probe.Addr != nil {
+				maxRTT = max(maxRTT, probe.RTT)
+			}
+		}
+	}
+
+	page := struct {
+		Target, Addr, Started, Duration, Options string
+		Reached                                  bool
+		Hops                                     []htmlHop
+	}{
+		Target:  r.Target,
+		Options: info.Options,
+		Reached: r.Reached,
+	}
+	if !info.Started.IsZero() {
+		page.Started = info.Started.UTC().Format("2006-01-02 15:04:05 MST")
+	}
+	if r.Addr != nil {
+		page.Addr = r.Addr.String()
+	}
+	if info.Duration > 0 {
+		page.Duration = info.Duration.Round(100 * time.Millisecond).String()
+	}
+
+	for _, hop := range r.Hops {
+		row := htmlHop{TTL: hop.TTL}
+		var answered []time.Duration
+		for _, probe := range hop.Probes {
+			row.Reached = row.Reached || probe.Reached
+			if probe.Addr == nil {
+				continue
+			}
+			answered = append(answered, probe.RTT)
+			host := formatName(strings.TrimSuffix(probe.Name, "."), probe.Addr)
+			known := false
+			for _, h := range row.Hosts {
+				known = known || h == host
+			}
+			if !known {
+				row.Hosts = append(row.Hosts, host)
+			}
+		}
+		if len(hop.Probes) > 0 {
+			row.Loss = float64(len(hop.Probes)-len(answered)) / float64(len(hop.Probes)) * 100
+		}
+		if len(answered) > 0 {
+			row.Answered = true
+			best, worst, sum := answered[0], answered[0], time.Duration(0)
+			for _, rtt := range answered {
+				best, worst, sum = min(best, rtt), max(worst, rtt), sum+rtt
+			}
+			row.Best = fmt.Sprintf("%.1f", milliseconds(best))
+			row.Avg = fmt.Sprintf("%.1f", milliseconds(sum/time.Duration(len(answered))))
+			row.Worst = fmt.Sprintf("%.1f", milliseconds(worst))
+		}
+		row.Sparkline = sparkline(hop.Probes, maxRTT)
+		page.Hops = append(page.Hops, row)
+	}
+	return htmlTemplate.Execute(w, page)
+}
+
+// sparkline returns an inline SVG drawing the RTTs of probes, scaled to maxRTT, with the
+// probes nobody answered as red dots at the bottom. It only contains numbers of our own, so
+// it is safe to put into the page as is.
+func sparkline(probes []Probe, maxRTT time.Duration) template.HTML {
+	if len(probes) == 0 {
+		return ""
+	}
+	const margin = 3 // room for the dots at the edges
+	x := func(i int) float64 {
+		if len(probes) == 1 {
+			return sparklineWidth / 2
+		}
+		return margin + float64(i)*(sparklineWidth-2*margin)/float64(len(probes)-1)
+	}
+	y := func(rtt time.Duration) float64 {
+		if maxRTT <= 0 {
+			return sparklineHeight - margin
+		}
+		return sparklineHeight - margin - float64(rtt)/float64(maxRTT)*(sparklineHeight-2*margin)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg width="%d" height="%d" viewBox="0 0 %d %d">`, sparklineWidth, sparklineHeight, sparklineWidth, sparklineHeight)
+	var points []string
+	for i, probe := range probes {
+		if probe.Addr != nil {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(i), y(probe.RTT)))
+		}
+	}
+	if len(points) > 1 {
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#36c" stroke-width="1.5"/>`, strings.Join(points, " "))
+	}
+	for i, probe := range probes {
+		if probe.Addr != nil {
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2" fill="#36c"/>`, x(i), y(probe.RTT))
+		} else {
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%d" r="2" fill="#c00"/>`, x(i), sparklineHeight-margin)
+		}
+	}
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
@@ -0,0 +1,228 @@
+package traceroute
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// ICMPProber sends ICMP Echo probes (MethodICMP), or Extended Echo probes (MethodXEcho),
+// on one ICMP socket. Tracer creates it from its settings.
+type ICMPProber struct {
+	conn    packetConn
+	session *Session    // if set, every probe gets a socket of its own on it instead of conn
+	demux   *probeDemux // if set, reads conn and hands every probe its own answers, see demux.go
+	id      int         // Echo Identifier of the probes, unless the socket picks one
+	family  ipFamily
+	paris   bool            // constant flow identifier, see paris.go
+	payload PayloadFunc     // Echo payload
+	query   *interfaceQuery // send Extended Echo Requests asking about this interface instead
+}
+
+// Probe sends one Echo (or Extended Echo) Request and waits for the answer to it
+func (p *ICMPProber) Probe(ctx context.Context, req ProbeRequest) (*Reply, error) {
+	conn := p.conn
+	if p.session != nil {
+		c, err := p.session.open(p.family)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		conn = c
+	} else if p.demux != nil {
+		c := p.demux.open(req.Seq)
+		defer c.Close()
+		conn = c
+	}
+	return probe(ctx, conn, p.id, p.family, req.Dst, req.TTL, req.Seq, req.Wait, req.clock(), p.paris, defaultFlowID, p.payload(req.TTL, req.Seq), p.query, req.Sent)
+}
+
+// Close closes the ICMP socket, once it returns no late answer is handed out anymore
+func (p *ICMPProber) Close() error {
+	if p.conn == nil {
+		return nil // the sockets of the probes are closed already
+	}
+	err := p.conn.Close()
+	if p.demux != nil {
+		<-p.demux.done // the reading goroutine may be calling Hooks.OnLateReply
+	}
+	return err
+}
+
+// probe sends one ICMP probe and waits for the answer to it, until waitTime passed on clock or ctx is done.
+// sent, if not nil, is called once the probe went out.
+func probe(ctx context.Context, conn packetConn, id int, family ipFamily, dstAddr *net.IPAddr, TTL int, seqNum int, waitTime time.Duration, clock Clock, paris bool, flowID uint16, data []byte, query *interfaceQuery, sent func()) (*Reply, error) {
+	logger := loggerFrom(ctx)
+
+	// The wait ends when clock says waitTime passed, or right away when ctx is cancelled,
+	// by moving the deadline of the socket to now. Until then there is none.
+	err := conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	stop := expire(ctx, clock, waitTime, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	icmpEchoIDMask := 0xffff      // ICMP Echo Identifier fields are exactly 16 bits wide, 0xffff is 16 1's in binary
+	echoID := id & icmpEchoIDMask // Mask the trace ID with 0xffff to fit it into 16 bits
+	echoID = conn.EchoID(echoID)  // unprivileged sockets get their ID from the kernel
+
+	if paris {
+		data = parisPayload(seqNum, flowID, data)
+	}
+
+	msg := icmp.Message{
+		Type:     family.echoRequest,
+		Code:     0, // Description: No Code
+		Checksum: 0, // has not been calculated yet, put 0 for now
+		Body: &icmp.Echo{
+			ID:   echoID, // uniquely identifies this trace
+			Seq:  seqNum, // start at 1 for now, increment later
+			Data: data,
+		},
+	}
+	if query != nil {
+		msg.Type = family.extendedEchoRequest
+		msg.Body = &icmp.ExtendedEchoRequest{
+			ID:         echoID,
+			Seq:        seqNum, // only the low 8 bits make it onto the wire
+			Local:      query.local,
+			Extensions: []icmp.Extension{query.ident},
+		}
+	}
+
+	msgBytes, err := msg.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := clock.Now() // as close to the write as it gets, see timestamps.go
+	if _, err := writeTTL(conn, msgBytes, dstAddr, TTL); err != nil {
+		logger.Debug("sending ICMP probe failed", "ttl", TTL, "seq", seqNum, "err", err)
+	} else {
+		logger.Debug("sent ICMP probe", "ttl", TTL, "type", msg.Type, "id", echoID, "seq", seqNum, "bytes", len(msgBytes))
+		if sent != nil {
+			sent()
+		}
+	}
+
+	// --- wait for response ---
+	buf := getPacketBuffer()
+	defer putPacketBuffer(buf)
+	responseBytes := buf[:]
+	for {
+		responseLen, responderAddr, replyTTL, received, err := readStamped(conn, responseBytes)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil { // timeout or other error
+			return nil, err
+		}
+
+		elapsedTime, source := rtt(clock, conn, startTime, received)
+
+		responseMsg, err := icmp.ParseMessage(family.protocol, responseBytes[:responseLen])
+		if err != nil {
+			logger.Debug("ignoring packet: not ICMP", "from", responderAddr, "bytes", responseLen, "err", err)
+			continue // ignore packet, keep listening
+		}
+
+		// --- check incoming packets ---
+		switch responseMsg.Type {
+		case family.echoReply:
+			// check if the packet belong to this program
+			body := responseMsg.Body.(*icmp.Echo)
+			if body.ID == echoID && body.Seq == seqNum {
+				logger.Debug("matched Echo Reply", "from", responderAddr, "seq", seqNum)
+				return &Reply{Addr: responderAddr, RTT: elapsedTime, TimestampSource: source, Type: family.echoReply, Code: responseMsg.Code, Reached: true, TTL: replyTTL, route: replyRecordRoute(conn)}, nil
+			}
+			logger.Debug("ignoring Echo Reply: not this probe's", "from", responderAddr, "id", body.ID, "seq", body.Seq, "want_id", echoID, "want_seq", seqNum)
+		case family.extendedEchoReply:
+			body := responseMsg.Body.(*icmp.ExtendedEchoReply)
+			if query != nil && body.ID == echoID && body.Seq == seqNum&0xff {
+				logger.Debug("matched Extended Echo Reply", "from", responderAddr, "seq", seqNum)
+				return &Reply{
+					Addr:            responderAddr,
+					RTT:             elapsedTime,
+					TimestampSource: source,
+					Type:            family.extendedEchoReply,
+					Code:            responseMsg.Code,
+					Reached:         true,
+					TTL:             replyTTL,
+					Note:            formatExtendedEchoReply(query, responseMsg.Code, body),
+				}, nil
+			}
+			logger.Debug("ignoring Extended Echo Reply: not this probe's", "from", responderAddr, "id", body.ID, "seq", body.Seq, "want_id", echoID, "want_seq", seqNum&0xff)
+		case family.timeExceeded:
+			// check if the packet belong to this program
+
+			/*
+			   ICMP Time Exceeded packet layout:
+			   	Outer IPv4 Header  								- bytes 0–19 	- 20 bytes (Gets this packet back to you)
+			   	Outer ICMP Header (Time Exceeded)				- bytes 20–27	- 8 bytes:
+			   	Inner Payload (Original packet that expired):
+			   		Inner IPv4 Header 							- bytes 28–47	- 20 bytes
+			   		Inner ICMP Header (first 8 bytes only) 		- bytes 48-55	- 8 bytes
+			   			- Bytes 48: Type (Echo = 8)
+			   			- Bytes 49: Code (0)
+			   			- Bytes 50-51: Checksum
+			   			- Bytes 52-53: ID 						<--- TARGET
+			   			- Bytes 54-55: Sequence Number
+			*/
+			// responseBytes[0:8] == bytes 20-27, the outer IPv4 header is already stripped
+			// parseICMPError splits off any RFC 4884 extensions after the original datagram, so:
+			//   errorBody.originalDatagram[0]		== byte 28
+			//   errorBody.originalDatagram[24] 	== byte 52
+			//   errorBody.originalDatagram[24:26]	== original ICMP ID
+			// ICMPv6 looks the same, except the inner IPv6 header is 40 bytes instead of 20
+			// With IP options (-g) the inner IPv4 header is longer, its IHL field tells by how much
+
+			errorBody, err := parseICMPError(family.protocol, responseBytes[:responseLen])
+			if err != nil {
+				logger.Debug("ignoring Time Exceeded: unparseable", "from", responderAddr, "err", err)
+				continue
+			}
+			originalDatagram := errorBody.originalDatagram
+
+			const (
+				icmpEchoIDLen  = 2
+				icmpEchoSeqLen = 2
+			)
+			icmpEchoIDOffset := family.quotedHeaderLen(originalDatagram) + 4
+			icmpEchoSeqOffset := icmpEchoIDOffset + icmpEchoIDLen
+
+			if len(originalDatagram) < icmpEchoSeqOffset+icmpEchoSeqLen {
+				logger.Debug("ignoring Time Exceeded: quotes too little of the probe", "from", responderAddr, "bytes", len(originalDatagram))
+				continue // too short to be one of ours
+			}
+
+			quotedSeq := int(binary.BigEndian.Uint16(originalDatagram[icmpEchoSeqOffset : icmpEchoSeqOffset+icmpEchoSeqLen]))
+			if query != nil {
+				quotedSeq = int(originalDatagram[icmpEchoSeqOffset]) // Extended Echo has an 8 bit sequence number
+				seqNum &= 0xff
+			}
+
+			quotedID := int(binary.BigEndian.Uint16(originalDatagram[icmpEchoIDOffset : icmpEchoIDOffset+icmpEchoIDLen]))
+			if quotedID != echoID || quotedSeq != seqNum {
+				logger.Debug("ignoring Time Exceeded: not this probe's", "from", responderAddr, "id", quotedID, "seq", quotedSeq, "want_id", echoID, "want_seq", seqNum)
+				continue
+			}
+			logger.Debug("matched Time Exceeded", "from", responderAddr, "seq", seqNum)
+			return &Reply{
+				Addr:            responderAddr,
+				RTT:             elapsedTime,
+				TimestampSource: source,
+				Type:            family.timeExceeded,
+				Code:            responseMsg.Code,
+				TTL:             replyTTL,
+				extensions:      errorBody.extensions,
+				route:           quotedRecordRoute(family, originalDatagram),
+			}, nil
+		default:
+			logger.Debug("ignoring ICMP message", "from", responderAddr, "type", responseMsg.Type, "code", responseMsg.Code)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package traceroute
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+InfluxDB line protocol encoding of HopResult (-o influx)
+
+One line per probe, for piping continuous runs into Telegraf or InfluxDB
+(https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/):
+
+	traceroute,target=example.com,ttl=1,probe=1,responder=192.0.2.1 answered=true,reached=false,rtt_ms=0.412,name="router.lan.",icmp_type="time exceeded" 1760573467123456000
+	traceroute,target=example.com,ttl=2,probe=1 answered=false,reached=false 1760573467124001000
+
+The tags say which probe it was and who answered it, the fields what came back. Fields
+without a value (no answer, no host name, no ICMP type) are left out. The timestamp is when
+the probe was sent, in nanoseconds since the Unix epoch.
+*/
+
+// influxMeasurement is the name of the measurement the probes are written to
+const influxMeasurement = "traceroute"
+
+// influxTagEscaper escapes tag keys and values, influxStringEscaper string field values
+var (
+	influxTagEscaper    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// InfluxLine returns the probe as a line of InfluxDB line protocol, without the line break
+func (r HopResult) InfluxLine() string {
+	probe := r.probe()
+
+	var b strings.Builder
+	b.WriteString(influxMeasurement)
+	fmt.Fprintf(&b, ",target=%s,ttl=%d,probe=%d", influxTagEscaper.Replace(r.Target), r.TTL, r.Probe)
+	if probe.Addr != nil {
+		fmt.Fprintf(&b, ",responder=%s", influxTagEscaper.Replace(probe.Addr.String()))
+	}
+
+	fmt.Fprintf(&b, " answered=%t,reached=%t", probe.Addr != nil, probe.Reached)
+	if probe.Addr != nil {
+		fmt.Fprintf(&b, ",rtt_ms=%s", strconv.FormatFloat(float64(probe.RTT.Microseconds())/1000, 'f', 3, 64))
+	}
+	if probe.Name != "" {
+		fmt.Fprintf(&b, `,name="%s"`, influxStringEscaper.Replace(probe.Name))
+	}
+	if probe.Type != nil {
+		fmt.Fprintf(&b, `,icmp_type="%s"`, influxStringEscaper.Replace(fmt.Sprint(probe.Type)))
+	}
+
+	if !r.Sent.IsZero() {
+		fmt.Fprintf(&b, " %d", r.Sent.UnixNano())
+	}
+	return b.String()
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package traceroute
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setIPOptions(c syscall.RawConn, options []byte) error {
+	return errors.New("IP options are not supported on this platform")
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package traceroute
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setIPOptions sets the IPv4 options (IP_OPTIONS) the kernel puts into every packet sent on c
+func setIPOptions(c syscall.RawConn, options []byte) error {
+	var sockoptErr error
+	err := c.Control(func(fd uintptr) {
+		sockoptErr = unix.SetsockoptString(int(fd), unix.IPPROTO_IP, unix.IP_OPTIONS, string(options))
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", sockoptErr)
+}
@@ -0,0 +1,128 @@
+package traceroute
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+/*
+JSON encoding of Result (-o json)
+
+	{
+	  "target": "example.com",
+	  "address": "93.184.215.14",
+	  "reached": true,
+	  "hops": [
+	    {
+	      "ttl": 1,
+	      "probes": [
+	        {"sent": "2026-10-16T00:31:07.123456Z", "address": "192.0.2.1", "name": "router.lan.", "rtt_ms": 0.412, "type": "time exceeded", "timestamp_source": "kernel"},
+	        {"sent": "2026-10-16T00:31:07.124001Z", "error": "no answer within the wait time: read ip4 0.0.0.0: i/o timeout"},
+	        ...
+
+Fields without a value (no answer, no host name, no ICMP type) are left out. "retries" counts
+how many times a probe was sent again before it was answered or given up on (-retries).
+"late_address" and "late_rtt_ms" are an answer that arrived after the wait (see late.go). "sent" is the
+wall-clock time the probe was sent, in RFC 3339 format in UTC. RTTs are in milliseconds, as
+floating point numbers; "timestamp_source" tells how the RTT was measured: "user", "kernel" or
+"hardware" (see timestamps.go).
+*/
+
+type jsonResult struct {
+	Target  string `json:"target"`
+	Address string `json:"address"`
+	Reached bool   `json:"reached"`
+	Hops    []Hop  `json:"hops"`
+}
+
+// MarshalJSON encodes the Result as described above
+func (r *Result) MarshalJSON() ([]byte, error) {
+	res := jsonResult{Target: r.Target, Reached: r.Reached, Hops: r.Hops}
+	if r.Addr != nil {
+		res.Address = r.Addr.String()
+	}
+	if res.Hops == nil {
+		res.Hops = []Hop{} // [], not null
+	}
+	return json.Marshal(res)
+}
+
+type jsonHop struct {
+	TTL    int     `json:"ttl"`
+	Probes []Probe `json:"probes"`
+}
+
+// MarshalJSON encodes the Hop as described above
+func (h Hop) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonHop{TTL: h.TTL, Probes: h.Probes})
+}
+
+type jsonProbe struct {
+	Sent        string   `json:"sent,omitempty"`
+	Address     string   `json:"address,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	RTT         *float64 `json:"rtt_ms,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Reached     bool     `json:"reached,omitempty"`
+	Note        string   `json:"note,omitempty"`
+	Retries     int      `json:"retries,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	LateAddress string   `json:"late_address,omitempty"`
+	LateRTT     *float64 `json:"late_rtt_ms,omitempty"`
+
+	TimestampSource string `json:"timestamp_source,omitempty"`
+}
+
+// MarshalJSON encodes the Probe as described above
+func (p Probe) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.jsonProbe())
+}
+
+func (p Probe) jsonProbe() jsonProbe {
+	probe := jsonProbe{Name: p.Name, Reached: p.Reached, Retries: p.Retries, TimestampSource: string(p.TimestampSource)}
+	if !p.Sent.IsZero() {
+		probe.Sent = TimestampRFC3339.Format(p.Sent)
+	}
+	// Notes are made for the text output, " [SYN-ACK]" becomes "SYN-ACK"
+	probe.Note = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(p.Note), "["), "]")
+	if p.Addr != nil {
+		probe.Address = p.Addr.String()
+		rtt := float64(p.RTT.Microseconds()) / 1000
+		probe.RTT = &rtt
+	}
+	if p.Type != nil {
+		probe.Type = fmt.Sprint(p.Type)
+	}
+	if p.Err != nil {
+		probe.Error = p.Err.Error()
+	}
+	if p.LateAddr != nil {
+		probe.LateAddress = p.LateAddr.String()
+		rtt := float64(p.LateRTT.Microseconds()) / 1000
+		probe.LateRTT = &rtt
+	}
+	return probe
+}
+
+/*
+JSON encoding of HopResult (-o jsonl)
+
+The fields of a probe in a Result, preceded by the trace and where in it the probe was sent.
+"last" marks the last probe of a hop:
+
+	{"target": "example.com", "ttl": 1, "probe": 3, "last": true, "sent": "2026-10-16T00:31:07.125012Z", "address": "192.0.2.1", "rtt_ms": 0.398, "type": "time exceeded", "timestamp_source": "kernel"}
+*/
+
+type jsonHopResult struct {
+	Target string `json:"target"`
+	TTL    int    `json:"ttl"`
+	Probe  int    `json:"probe"`
+	Last   bool   `json:"last,omitempty"`
+	jsonProbe
+}
+
+// MarshalJSON encodes the HopResult as described above
+func (r HopResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonHopResult{Target: r.Target, TTL: r.TTL, Probe: r.Probe, Last: r.Last, jsonProbe: r.probe().jsonProbe()})
+}
@@ -0,0 +1,105 @@
+package traceroute
+
+import (
+	"io"
+	"sync"
+)
+
+/*
+Late answers
+
+A probe whose wait passed counts as lost, but its answer may still be on the way: a router
+slow to send its ICMP errors, or a link with a queue longer than the wait time. As long as
+the trace runs, the probeDemux (see demux.go) reading its ICMP socket sees such answers, and
+instead of dropping them, they are handed to the probe they answer, by its Sequence Number:
+
+	Hop 3:
+	  *                                 <- the wait of 5s passed
+	...
+	Late answer to hop 3, probe 1: 10.0.0.7  late 6.112s   (printed by Run after the last hop)
+
+Hooks.OnLateReply gets every late answer as the HopResult of the probe, with the answer
+filled in and Late set, as soon as it arrives. Trace adds them to the Probes of its Result
+(LateAddr, LateRTT), Run has a LateRenderer print them after the last hop. Only the first
+answer to a probe counts, and only answers that would have counted in time: Echo Replies and
+Time Exceeded messages. Answers arriving after the trace is over go unnoticed, and so do late
+answers to the probes of other methods, read by sockets of their own.
+*/
+
+// LateRenderer is a Renderer that also prints the answers that arrived after the wait of
+// their probe was over, see above. Run has it print them after the last hop.
+type LateRenderer interface {
+	Renderer
+	RenderLate(w io.Writer, result HopResult)
+}
+
+// printLate has renderer print the late answers, if it is a LateRenderer
+func printLate(out io.Writer, renderer Renderer, late []HopResult) {
+	if r, ok := renderer.(LateRenderer); ok {
+		for _, result := range late {
+			r.RenderLate(out, result)
+		}
+	}
+}
+
+// lateAnswers attributes answers arriving after the wait to the probes of a trace that timed
+// out. It is safe for concurrent use, the probeDemux calls answer from its goroutine.
+type lateAnswers struct {
+	clock Clock
+	hook  func(HopResult) // Hooks.OnLateReply, nil if not set
+
+	mu       sync.Mutex
+	timedOut map[int]HopResult // probes without an answer yet, by sequence number
+	answers  []HopResult       // the late answers so far, in the order they arrived
+}
+
+func newLateAnswers(clock Clock, hook func(HopResult)) *lateAnswers {
+	return &lateAnswers{clock: clock, hook: hook, timedOut: make(map[int]HopResult)}
+}
+
+// expired notes that the probe with sequence number seq timed out, result is the probe's
+func (l *lateAnswers) expired(seq int, result HopResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.timedOut[seq] = result
+}
+
+// answer hands over an answer to the probe with sequence number seq that arrived now, after
+// nobody was waiting for it any more
+func (l *lateAnswers) answer(seq int, reply *Reply) {
+	l.mu.Lock()
+	result, ok := l.timedOut[seq]
+	if !ok {
+		l.mu.Unlock()
+		return // answered in time, a duplicate, or not even sent yet
+	}
+	delete(l.timedOut, seq)
+	result.Addr, result.RTT, result.Reached, result.reply = reply.Addr, l.clock.Now().Sub(result.Sent), reply.Reached, reply
+	result.Err, result.Late = nil, true
+	l.answers = append(l.answers, result)
+	l.mu.Unlock()
+
+	if l.hook != nil {
+		l.hook(result)
+	}
+}
+
+// all returns the late answers so far
+func (l *lateAnswers) all() []HopResult {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]HopResult(nil), l.answers...)
+}
+
+// addLate records the late answer late at its probe, if r has it
+func (r *Result) addLate(late HopResult) {
+	for i := range r.Hops {
+		if r.Hops[i].TTL == late.TTL && late.Probe <= len(r.Hops[i].Probes) {
+			probe := &r.Hops[i].Probes[late.Probe-1]
+			probe.LateAddr, probe.LateRTT = late.Addr, late.RTT
+		}
+	}
+}
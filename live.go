@@ -0,0 +1,256 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Live view (-tui)
+
+A LiveView runs a trace full-screen: it draws the hop table right away and redraws it
+several times a second while the probes are out, instead of printing line by line:
+
+	traceroute to example.com (93.184.216.34), 64 hops max
+
+	 TTL  Host                                         1          2          3
+	   1  router.lan (192.168.1.1)                0.412 ms   0.398 ms   0.405 ms
+	   2  10.0.0.1                                 9.812 ms          *   ⠹
+	   3
+
+	 2.3s elapsed   hop 2 of at most 64   5 probes sent, 4 answered   Ctrl-C stops
+
+A probe that is out waiting for its answer shows a spinner, one not sent yet nothing, one
+nobody answered a star. A hop lists the host that answered first, and how many others did
+("+1"). The last line is a status bar, in reverse video.
+
+The table is drawn on the terminal's alternate screen, which is left once the trace is over
+(or stopped): the final table is printed to the normal screen then, so it stays in the
+scrollback like the text output would. The drawing uses ANSI escape sequences, whoever runs
+a LiveView decides whether the output is a terminal that understands them.
+*/
+
+// LiveView draws a trace as a full-screen table that fills in as the probes return, see Run
+type LiveView struct {
+	Output  io.Writer     // the terminal, nil means os.Stdout
+	Colors  *Colors       // color the RTTs, nil leaves them plain
+	Refresh time.Duration // time between redraws, 0 means 100 milliseconds
+}
+
+// ANSI escape sequences for drawing the screen
+const (
+	ansiAltScreen   = "\x1b[?1049h" // switch to the alternate screen
+	ansiMainScreen  = "\x1b[?1049l" // and back
+	ansiHideCursor  = "\x1b[?25l"
+	ansiShowCursor  = "\x1b[?25h"
+	ansiHome        = "\x1b[H"  // cursor to the top left corner
+	ansiClearLine   = "\x1b[K"  // erase to the end of the line
+	ansiClearScreen = "\x1b[J"  // erase to the end of the screen
+	ansiReverse     = "\x1b[7m" // swap foreground and background
+)
+
+// liveSpinner are the frames of the spinner shown for probes waiting for their answer
+var liveSpinner = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// liveScreen is what a LiveView draws, updated by the trace's hooks and renderer
+type liveScreen struct {
+	mu      sync.Mutex
+	info    TraceInfo
+	queries int
+	start   time.Time
+	first   int        // TTL of the first hop probed
+	hops    []*liveHop // by TTL-first
+}
+
+// liveHop is a row of the table
+type liveHop struct {
+	sent    []time.Time  // when every probe was sent, zero when it wasn't yet
+	results []*HopResult // outcome of every probe, nil while it isn't known
+}
+
+// Run traces the route to dest with t like t.Run does, drawing the table instead of
+// printing the probes. t's Output and Renderer are not used, its Hooks are still called.
+// Multipath is not supported, its hops are sets of load balanced paths.
+func (v *LiveView) Run(ctx context.Context, t *Tracer, dest string) error {
+	if t.Multipath {
+		return errors.New("the live view doesn't support Multipath")
+	}
+	out := v.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	refresh := v.Refresh
+	if refresh == 0 {
+		refresh = 100 * time.Millisecond
+	}
+	queries := t.Queries
+	if queries == 0 {
+		queries = 3
+	}
+
+	screen := &liveScreen{info: TraceInfo{Target: dest, MaxTTL: t.MaxTTL}, queries: queries, first: max(t.FirstTTL, 1), start: time.Now()}
+	if screen.info.MaxTTL == 0 {
+		screen.info.MaxTTL = 64
+	}
+	tracer := *t
+	tracer.Output = io.Discard
+	tracer.Renderer = (*liveRenderer)(screen)
+	tracer.Hooks.OnProbeSent = func(TTL, probe int) {
+		screen.sent(TTL, probe)
+		if t.Hooks.OnProbeSent != nil {
+			t.Hooks.OnProbeSent(TTL, probe)
+		}
+	}
+
+	io.WriteString(out, ansiAltScreen+ansiHideCursor)
+	stopped := make(chan struct{})
+	drawn := make(chan struct{})
+	go func() {
+		defer close(drawn)
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			io.WriteString(out, ansiHome+screen.draw(v.Colors, true)+ansiClearScreen)
+			select {
+			case <-ticker.C:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	err := tracer.Run(ctx, dest)
+
+	close(stopped)
+	<-drawn
+	io.WriteString(out, ansiMainScreen+ansiShowCursor+screen.draw(v.Colors, false))
+	return err
+}
+
+// sent marks probe number probe of hop TTL as waiting for its answer
+func (s *liveScreen) sent(TTL, probe int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hop(TTL).sent[probe-1] = time.Now()
+}
+
+// hop returns the row of hop TTL, adding the rows up to it. s.mu must be held.
+func (s *liveScreen) hop(TTL int) *liveHop {
+	for len(s.hops) <= TTL-s.first {
+		s.hops = append(s.hops, &liveHop{sent: make([]time.Time, s.queries), results: make([]*HopResult, s.queries)})
+	}
+	return s.hops[TTL-s.first]
+}
+
+// liveRenderer hands the probes Run prints to the screen
+type liveRenderer liveScreen
+
+func (r *liveRenderer) RenderHeader(w io.Writer, info TraceInfo) {
+	s := (*liveScreen)(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info = info
+}
+
+func (r *liveRenderer) Render(w io.Writer, result HopResult) {
+	s := (*liveScreen)(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result.Probe <= s.queries {
+		s.hop(result.TTL).results[result.Probe-1] = &result
+	}
+}
+
+// draw returns the screen as text, the status bar included while live
+func (s *liveScreen) draw(colors *Colors, live bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eol := "\n"
+	if live {
+		eol = ansiClearLine + "\n" // what was drawn before may have been longer
+	}
+	var b strings.Builder
+	b.WriteString("traceroute to " + s.info.Target)
+	if s.info.Addr != nil {
+		fmt.Fprintf(&b, " (%s)", s.info.Addr.IP)
+	}
+	fmt.Fprintf(&b, ", %d hops max%s%s", s.info.MaxTTL, eol, eol)
+
+	fmt.Fprintf(&b, " TTL  %-38s", "Host")
+	for i := range s.queries {
+		fmt.Fprintf(&b, " %10d", i+1)
+	}
+	b.WriteString(eol)
+
+	sent, answered := 0, 0
+	for i, hop := range s.hops {
+		fmt.Fprintf(&b, " %3d  %-38s", s.first+i, hop.host())
+		for probe, result := range hop.results {
+			cell := ""
+			switch {
+			case result != nil && result.Addr != nil:
+				cell = colors.paint(colors.rtt(result.RTT), fmt.Sprintf("%10s", fmt.Sprintf("%.3f ms", milliseconds(result.RTT))))
+				answered++
+			case result != nil:
+				cell = colors.paint(ansiDim, fmt.Sprintf("%10s", "*"))
+			case !hop.sent[probe].IsZero() && live:
+				frame := int(time.Since(hop.sent[probe]) / (100 * time.Millisecond))
+				cell = "   " + liveSpinner[frame%len(liveSpinner)] + strings.Repeat(" ", 6)
+			default:
+				cell = strings.Repeat(" ", 10)
+			}
+			if !hop.sent[probe].IsZero() || result != nil {
+				sent++
+			}
+			b.WriteString(" " + cell)
+		}
+		b.WriteString(eol)
+	}
+
+	if live {
+		status := fmt.Sprintf(" %.1fs elapsed   hop %d of at most %d   %d probes sent, %d answered   Ctrl-C stops ",
+			time.Since(s.start).Seconds(), s.first+len(s.hops)-1, s.info.MaxTTL, sent, answered)
+		b.WriteString(eol + ansiReverse + status + ansiReset + ansiClearLine)
+	}
+	return b.String()
+}
+
+// host returns who answered the hop for the Host column: the first of them, with the
+// number of the others
+func (h *liveHop) host() string {
+	var hosts []string
+	for _, result := range h.results {
+		if result == nil || result.Addr == nil {
+			continue
+		}
+		host := addrString(result.Addr)
+		if result.Name != "" {
+			host = fmt.Sprintf("%s (%s)", strings.TrimSuffix(result.Name, "."), host)
+		}
+		known := false
+		for _, h := range hosts {
+			known = known || h == host
+		}
+		if !known {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return ""
+	}
+	host := hosts[0]
+	if len(hosts) > 1 {
+		host += fmt.Sprintf(" +%d", len(hosts)-1)
+	}
+	if len(host) > 38 {
+		host = host[:35] + "..."
+	}
+	return host
+}
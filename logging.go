@@ -0,0 +1,56 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+/*
+Diagnostics (-v, -vv)
+
+With Tracer.Logger set, a trace tells what it does below the hops, for finding out why
+probes go unanswered or answers go unmatched. The output of Run stays the same, the logger
+writes wherever its handler does (the command writes to stderr):
+
+	Info   sockets opened and closed (which kind, for which protocol), the destination's address
+	Debug  every probe sent, every packet read and what became of it: not parseable, not an
+	       answer to this trace (and why: ID, sequence number or ports don't match), or the
+	       answer to the probe
+
+The built-in probers find the logger in the context they are called with, see loggerFrom.
+*/
+
+type loggerKey struct{}
+
+// discardLogger logs nothing, for traces without a Logger
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// withLogger returns ctx carrying logger for the probers
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger of the trace ctx belongs to, one that discards everything
+// when it has none
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return discardLogger
+}
+
+// socketKind names the kind of ICMP socket conn is, for the log
+func socketKind(conn packetConn) string {
+	switch conn.(type) {
+	case *rawConn:
+		return SocketRaw
+	case *datagramConn:
+		return SocketDgram
+	case *hdrinclConn:
+		return SocketHdrincl
+	case *sessionConn:
+		return "raw, shared by a Session"
+	}
+	return fmt.Sprintf("%T", conn)
+}
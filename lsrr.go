@@ -0,0 +1,49 @@
+package traceroute
+
+import "net"
+
+/*
+Loose source routing (-g), RFC 791 3.1
+
+The Loose Source and Record Route (LSRR) IPv4 option makes a packet visit a list of
+gateways on its way to the destination, taking any route between them:
+
+	NOP (1) - pads the option to a 4 byte boundary
+	Type = 131 (1) | Length (1) | Pointer (1) - offset of the next address to visit, starts at 4
+	Route Data: one 4 byte address per remaining gateway, then the final destination
+
+The packet is first sent to the first gateway. Each gateway in the list replaces its
+address in the route data with its own outgoing address, moves the pointer along, and
+sends the packet on to the next address.
+
+How the option is handed over depends on the socket:
+	- kernel built headers (IP_OPTIONS socket option): list only the gateways, the kernel
+	  sends to the first one, shifts the others forward and writes the destination into the
+	  freed last slot.
+	- -socket hdrincl: we build exactly what goes on the wire, the header's destination is
+	  the first gateway and the option lists the rest.
+
+The option makes the IP header (and so the one quoted in Time Exceeded messages) longer than
+20 bytes, which is why quoted headers are always parsed using their header length field.
+*/
+
+const (
+	ipOptNOP  = 1
+	ipOptLSRR = 131
+
+	MaxGateways = 8 // as in classic traceroute, NOP + option header + 8 addresses fit into the 40 bytes of IP options
+)
+
+// lsrrOption builds a NOP padded LSRR option visiting route in order
+func lsrrOption(route []net.IP) []byte {
+	option := []byte{ipOptNOP, ipOptLSRR, byte(3 + 4*len(route)), 4}
+	for _, ip := range route {
+		option = append(option, ip.To4()...)
+	}
+	return option
+}
+
+// lsrrSocketOption is the IP_OPTIONS value routing via gateways, for kernel built headers
+func lsrrSocketOption(gateways []net.IP) []byte {
+	return lsrrOption(gateways)
+}
@@ -0,0 +1,271 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+Multipath Detection Algorithm (MDA)
+Augustin et al., "Multipath tracing with Paris traceroute" (E2EMON 2007)
+Veitch et al., "Failure Control in Multipath Route Tracing" (INFOCOM 2009)
+
+A per-flow load balancer sends every flow down one of its next hops. By sending probes
+with many different flow identifiers (see paris.go) we can find all of them, the question
+is only how many flows are enough.
+
+If we have seen k interfaces at a hop so far, we keep sending new flows until we have sent
+n_k of them, where n_k is the number of probes needed to be 95% sure that there is not a
+(k+1)th interface we keep missing. Each new interface raises k, and so the number of probes.
+
+To know which interface at hop h-1 leads to an interface at hop h, every flow is also
+probed at the previous hop. Since a flow always follows the same path, the two answers are
+connected by a link. All links together make up the DAG of the paths to the destination.
+*/
+
+const (
+	mdaConfidence   = 0.95 // how sure we want to be that no interface was missed at a hop
+	mdaMaxFlowsHop  = 128  // safety limit on the number of flows probed at a single hop
+	mdaUnresponsive = ""   // key used for flows that got no answer
+)
+
+// mdaStoppingPoint returns n_k: the number of flows that have to be probed at a hop
+// where k interfaces were found, to rule out a (k+1)th interface with mdaConfidence.
+func mdaStoppingPoint(k int) int {
+	if k < 1 {
+		k = 1
+	}
+	// Assume k+1 equally likely next hops. The probability that n probes miss at least one
+	// of them is (inclusion-exclusion):
+	//   sum_{i=1..k} (-1)^(i+1) * C(k+1, i) * ((k+1-i)/(k+1))^n
+	// n_k is the smallest n where that probability drops below 1 - mdaConfidence.
+	hops := float64(k + 1)
+	for n := 1; ; n++ {
+		missProbability := 0.0
+		binomial := 1.0
+		for i := 1; i <= k; i++ {
+			binomial = binomial * (hops - float64(i) + 1) / float64(i)
+			term := binomial * math.Pow((hops-float64(i))/hops, float64(n))
+			if i%2 == 1 {
+				missProbability += term
+			} else {
+				missProbability -= term
+			}
+		}
+		if missProbability <= 1-mdaConfidence {
+			return n
+		}
+	}
+}
+
+// mdaHop holds what was discovered at one TTL
+type mdaHop struct {
+	flows      map[uint16]string          // flow identifier -> responding interface
+	interfaces []string                   // distinct interfaces in the order they were found
+	links      map[string]map[string]bool // interface -> set of interfaces at the previous hop that lead to it
+	reached    map[string]bool            // interfaces that answered with an Echo Reply
+}
+
+func newMDAHop() *mdaHop {
+	return &mdaHop{
+		flows:   make(map[uint16]string),
+		links:   make(map[string]map[string]bool),
+		reached: make(map[string]bool),
+	}
+}
+
+// MultipathResult is the outcome of a whole multipath trace, as returned by TraceMultipath
+type MultipathResult struct {
+	Target  string         // destination as given to TraceMultipath, a host name or IP address
+	Addr    *net.IPAddr    // address Target resolved to, the one the probes were sent to
+	Hops    []MultipathHop // every hop probed, in TTL order
+	Reached bool           // every flow that got an answer at the last hop reached the destination
+}
+
+// MultipathHop is what the MDA found at one TTL
+type MultipathHop struct {
+	TTL        int
+	Interfaces []MultipathInterface // in the order they were found, none when no flow got an answer
+}
+
+// MultipathInterface is one interface found at a hop
+type MultipathInterface struct {
+	Addr     *net.IPAddr
+	Name     string        // host name of Addr, unless Tracer.Numeric is set or it has none
+	Flows    int           // number of flows that went through it
+	Reached  bool          // it is the destination
+	Previous []*net.IPAddr // interfaces at the previous hop leading to it, sorted
+}
+
+// TraceMultipath discovers all load balanced paths to dest like Run does with Multipath
+// set, but returns the hops instead of printing them. When ctx is done or MaxTTL was
+// reached without an answer, it returns what was found so far together with ctx.Err() or
+// ErrMaxTTLExceeded. Multipath must be set.
+func (t *Tracer) TraceMultipath(ctx context.Context, dest string) (*MultipathResult, error) {
+	if !t.Multipath {
+		return nil, errors.New("TraceMultipath needs Multipath")
+	}
+
+	tr, err := t.start(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.close()
+
+	result := &MultipathResult{Target: dest, Addr: tr.dstAddr}
+	err = tr.runMultipath(ctx, func(hop MultipathHop) {
+		result.Hops = append(result.Hops, hop)
+		result.Reached = len(hop.Interfaces) > 0
+		for _, iface := range hop.Interfaces {
+			result.Reached = result.Reached && iface.Reached
+		}
+	})
+	return result, err
+}
+
+// runMultipath runs the MDA, see traceMultipath
+func (tr *trace) runMultipath(ctx context.Context, emit func(MultipathHop)) error {
+	return traceMultipath(withLogger(ctx, tr.logger), tr.conn, tr.id, tr.family, tr.dstAddr, tr.firstTTL, tr.maxTTL, tr.gapLimit, tr.wait, tr.clock, tr.rateLimit, tr.payload, tr.names, emit)
+}
+
+// traceMultipath runs the MDA hop by hop and hands the interfaces found at each TTL to emit,
+// together with the interfaces of the previous hop they are linked to. It returns
+// ErrMaxTTLExceeded when no flow reached the destination within maxTTL, or ErrGapLimit after
+// gapLimit hops in a row without an answer (0 never gives up), and stops early, returning
+// ctx.Err(), when ctx is done.
+func traceMultipath(ctx context.Context, conn packetConn, id int, family ipFamily, dstAddr *net.IPAddr, firstTTL, maxTTL, gapLimit int, wait time.Duration, clock Clock, limit *RateLimiter, payload PayloadFunc, names Resolver, emit func(MultipathHop)) error {
+	seqNum := 1
+	gap := 0 // hops in a row without any answer
+	var previous *mdaHop
+
+	// probeFlow sends one probe for flowID at TTL and returns the responding interface
+	probeFlow := func(TTL int, flowID uint16) (string, bool) {
+		if limit.wait(ctx) != nil {
+			return mdaUnresponsive, false // cancelled, the loops below stop
+		}
+		reply, err := probe(ctx, conn, id, family, dstAddr, TTL, seqNum, wait, clock, true, flowID, payload(TTL, seqNum), nil, nil)
+		seqNum += 1
+		if err != nil {
+			return mdaUnresponsive, false
+		}
+		return reply.Addr.String(), reply.Reached
+	}
+
+	for TTL := firstTTL; TTL <= maxTTL; TTL++ {
+		hop := newMDAHop()
+		nextFlowID := uint16(0)
+
+		// Keep probing new flows until the stopping rule says we have seen every interface
+		for len(hop.flows) < mdaStoppingPoint(len(hop.interfaces)) && len(hop.flows) < mdaMaxFlowsHop && ctx.Err() == nil {
+			// Flow identifiers start from 0 at every hop, so the first ones were already
+			// probed at the previous hop and their predecessor is known
+			flowID := nextFlowID
+			nextFlowID += 1
+
+			iface, reached := probeFlow(TTL, flowID)
+			hop.flows[flowID] = iface
+			if iface == mdaUnresponsive {
+				continue
+			}
+			if !slices.Contains(hop.interfaces, iface) {
+				hop.interfaces = append(hop.interfaces, iface)
+				hop.links[iface] = make(map[string]bool)
+			}
+			if reached {
+				hop.reached[iface] = true
+			}
+
+			// Find out where this flow came from
+			if previous != nil {
+				prevIface, seen := previous.flows[flowID]
+				if !seen {
+					prevIface, _ = probeFlow(TTL-1, flowID)
+					previous.flows[flowID] = prevIface
+				}
+				if prevIface != mdaUnresponsive {
+					hop.links[iface][prevIface] = true
+				}
+			}
+		}
+
+		emit(hop.result(ctx, TTL, names)) // what was found so far, even when cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Done once every flow that got an answer hit the destination
+		if len(hop.interfaces) > 0 && len(hop.reached) == len(hop.interfaces) {
+			return nil
+		}
+		if gap++; len(hop.interfaces) > 0 {
+			gap = 0
+		}
+		if gapLimit > 0 && gap >= gapLimit && TTL < maxTTL {
+			return fmt.Errorf("%w (hops %d to %d)", ErrGapLimit, TTL-gap+1, TTL)
+		}
+		previous = hop
+	}
+	return fmt.Errorf("%w (%d hops)", ErrMaxTTLExceeded, maxTTL)
+}
+
+// result returns what was found at the hop, looking up the names of the interfaces with
+// names (nil for numeric output)
+func (hop *mdaHop) result(ctx context.Context, TTL int, names Resolver) MultipathHop {
+	result := MultipathHop{TTL: TTL}
+	for _, iface := range hop.interfaces {
+		addr := &net.IPAddr{IP: net.ParseIP(iface)}
+		flowCount := 0
+		for _, flowIface := range hop.flows {
+			if flowIface == iface {
+				flowCount += 1
+			}
+		}
+
+		var predecessors []string
+		for prevIface := range hop.links[iface] {
+			predecessors = append(predecessors, prevIface)
+		}
+		slices.Sort(predecessors)
+		var previous []*net.IPAddr
+		for _, prevIface := range predecessors {
+			previous = append(previous, &net.IPAddr{IP: net.ParseIP(prevIface)})
+		}
+
+		result.Interfaces = append(result.Interfaces, MultipathInterface{
+			Addr:     addr,
+			Name:     hostName(ctx, names, addr),
+			Flows:    flowCount,
+			Reached:  hop.reached[iface],
+			Previous: previous,
+		})
+	}
+	return result
+}
+
+// printMultipathHop prints the interfaces found at one hop the way the traceroute command does
+func printMultipathHop(w io.Writer, hop MultipathHop) {
+	fmt.Fprintf(w, "Hop %d:\n", hop.TTL)
+	if len(hop.Interfaces) == 0 {
+		fmt.Fprintf(w, "  *\n")
+		return
+	}
+
+	for _, iface := range hop.Interfaces {
+		line := fmt.Sprintf("  %-32s %d flows", formatName(iface.Name, iface.Addr), iface.Flows)
+		if len(iface.Previous) > 0 {
+			var predecessors []string
+			for _, prev := range iface.Previous {
+				predecessors = append(predecessors, prev.String())
+			}
+			line += "  <- " + strings.Join(predecessors, ", ")
+		}
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,39 @@
+package traceroute
+
+/*
+Probe methods (-M)
+
+icmp: ICMP Echo Requests, the destination answers with an Echo Reply (default)
+udp:  UDP datagrams to high, most likely unused ports, the destination answers with
+      ICMP Port Unreachable. Works without root on Linux (see udp_linux.go).
+xecho: ICMP Extended Echo Requests (RFC 8335), the destination answers with an Extended
+       Echo Reply describing one of its interfaces (see xecho.go). Needs a raw socket.
+sctp:  SCTP INIT chunks, the destination answers with INIT-ACK or ABORT (see sctp.go).
+       Needs raw sockets.
+dccp:  DCCP-Request packets, the destination answers with DCCP-Response or DCCP-Reset
+       (see dccp.go). Needs raw sockets.
+tcp:   TCP segments with selectable flags (SYN, ACK, FIN, SYN+ECE), the destination answers
+       with SYN-ACK or RST (see tcp.go). Needs raw sockets.
+quic:  UDP probes carrying a QUIC Initial to port 443, the destination answers with Version
+       Negotiation or Retry (see quic.go). Same as -M udp -udp-payload quic.
+
+Plain UDP probes go to the next port with every probe, like classic traceroute. Per-flow load
+balancers (ECMP) hash the ports, so every probe may take another path. With UDPPorts "fixed"
+(-udp-ports fixed) they all go to the same port, from the same source port (SourcePort, or one
+picked for the whole trace), and vary nothing the load balancers look at: each probe is told
+apart by its own connected socket (see udp_linux.go), not by its ports.
+*/
+
+const (
+	MethodICMP  = "icmp"
+	MethodUDP   = "udp"
+	MethodXEcho = "xecho"
+	MethodSCTP  = "sctp"
+	MethodDCCP  = "dccp"
+	MethodTCP   = "tcp"
+	MethodQUIC  = "quic"
+)
+
+// udpBasePort is the destination port of the first UDP probe, every following probe uses the
+// next port, so each probe can be told apart (same as classic traceroute), unless UDPPorts is "fixed"
+const udpBasePort = 33434
@@ -0,0 +1,23 @@
+package traceroute
+
+import "context"
+
+// ProbeFunc sends one probe and waits for the answer to it, like Prober.Probe
+type ProbeFunc func(ctx context.Context, req ProbeRequest) (*Reply, error)
+
+// Middleware wraps the sending of probes, like an http.RoundTripper wrapping another one:
+// it gets the next ProbeFunc in the chain and returns one that does something around it,
+// e.g. counting probes for metrics, starting a tracing span, or dropping and delaying
+// probes to inject faults. It may change the request, the reply and the error on the way.
+//
+// Tracer.Middleware are applied in order, the first one is the outermost and sees every
+// probe first. Multipath traces don't use them.
+type Middleware func(next ProbeFunc) ProbeFunc
+
+// chain wraps probe into middleware, the first one ending up outermost
+func chain(probe ProbeFunc, middleware []Middleware) ProbeFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		probe = middleware[i](probe)
+	}
+	return probe
+}
@@ -0,0 +1,329 @@
+package traceroute
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+/*
+MaxMind DB files (--geoip)
+
+A GeoIPDatabase answers HopInfo lookups from a MaxMind DB file
+(https://maxmind.github.io/MaxMind-DB/), like the free GeoLite2 City and ASN databases. The
+whole file is read into memory, lookups don't touch the disk or the network.
+
+	search tree    node_count nodes of two records (left: bit 0, right: bit 1) of
+	               record_size bits each, walked along the bits of the address
+	16 zero bytes
+	data section   the values the tree points at, in MaxMind's own encoding
+	metadata       "\xab\xcd\xefMaxMind.com" followed by a map: node_count, record_size,
+	               ip_version, database_type, ...
+
+A record below node_count is the next node, node_count itself means the address isn't in
+the database, anything above points into the data section. IPv4 addresses are looked up
+in IPv6 databases as ::a.b.c.d, below the node 96 zero bits deep.
+
+Values start with a control byte: its top 3 bits are the type (0 means the type is 7 plus
+the next byte), the low 5 bits the size (29, 30 and 31 mean the size continues in the next
+1, 2 or 3 bytes). The fields used are those of the GeoIP2/GeoLite2 databases:
+
+	country.iso_code                  "US"
+	city.names.en                     "Mountain View"
+	autonomous_system_number          15169
+	autonomous_system_organization    "GOOGLE"
+*/
+
+// mmdbMetadataMarker starts the metadata at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// MaxMind DB data types
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// GeoIPDatabase is a MaxMind DB file loaded into memory, see OpenGeoIP. It is a
+// HopInfoSource and safe for concurrent use.
+type GeoIPDatabase struct {
+	Type string // database_type of the file, e.g. "GeoLite2-City"
+
+	tree       []byte // the search tree
+	data       []byte // the data section
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint // node IPv4 addresses are looked up from
+}
+
+// OpenGeoIP loads the MaxMind DB file at path
+func OpenGeoIP(path string) (*GeoIPDatabase, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parseGeoIP(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// parseGeoIP finds the search tree and the data section in the MaxMind DB file
+func parseGeoIP(file []byte) (*GeoIPDatabase, error) {
+	start := bytes.LastIndex(file, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	metadata, _, err := (&mmdbDecoder{data: file[start+len(mmdbMetadataMarker):]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("reading the metadata: %w", err)
+	}
+	fields, ok := metadata.(map[string]any)
+	if !ok {
+		return nil, errors.New("reading the metadata: not a map")
+	}
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+	databaseType, _ := fields["database_type"].(string)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+	}
+
+	treeSize := nodeCount * recordSize / 4 // two records per node
+	if treeSize+16 > uint64(start) {
+		return nil, errors.New("the search tree is larger than the file")
+	}
+	db := &GeoIPDatabase{
+		Type:       databaseType,
+		tree:       file[:treeSize],
+		data:       file[treeSize+16 : start],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+	}
+	if ipVersion == 6 {
+		for range 96 {
+			if db.ipv4Start >= db.nodeCount {
+				break
+			}
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node
+func (db *GeoIPDatabase) record(node uint, bit byte) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		// The middle byte holds the top 4 bits of both records
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// lookup returns the value the database has for ip, nil when it has none
+func (db *GeoIPDatabase) lookup(ip net.IP) (any, error) {
+	node, bits := uint(0), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		node, bits = db.ipv4Start, ip4
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, bits[i/8]>>(7-i%8)&1)
+	}
+	if node <= db.nodeCount {
+		return nil, nil // not in the database
+	}
+	value, _, err := (&mmdbDecoder{data: db.data}).decode(node - db.nodeCount - 16)
+	return value, err
+}
+
+func (db *GeoIPDatabase) LookupHopInfo(ctx context.Context, ip net.IP) (HopInfo, error) {
+	value, err := db.lookup(ip)
+	if err != nil {
+		return HopInfo{}, err
+	}
+	var info HopInfo
+	if asn, ok := mmdbPath(value, "autonomous_system_number").(uint64); ok {
+		info.ASN = int(asn)
+	}
+	info.ASName, _ = mmdbPath(value, "autonomous_system_organization").(string)
+	info.Country, _ = mmdbPath(value, "country", "iso_code").(string)
+	if info.Country == "" {
+		info.Country, _ = mmdbPath(value, "registered_country", "iso_code").(string)
+	}
+	info.City, _ = mmdbPath(value, "city", "names", "en").(string)
+	return info, nil
+}
+
+// mmdbPath returns the value found under keys in nested maps, nil when there is none
+func mmdbPath(value any, keys ...string) any {
+	for _, key := range keys {
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = fields[key]
+	}
+	return value
+}
+
+// mmdbDecoder decodes values of the data section (or the metadata) data
+type mmdbDecoder struct {
+	data  []byte
+	depth int // of nested maps and arrays, to stop on malformed files
+}
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB data")
+
+// decode decodes the value at offset, returning it and the offset after it. Maps come back
+// as map[string]any, arrays as []any, numbers as uint64, int64 or float64.
+func (d *mmdbDecoder) decode(offset uint) (any, uint, error) {
+	if offset >= uint(len(d.data)) || d.depth > 32 {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := d.data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		// Pointers carry their own size in bits 3-4 of the control byte
+		size := uint(ctrl>>3&0x3) + 1
+		if offset+size > uint(len(d.data)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		target := uint(0)
+		if size < 4 {
+			target = uint(ctrl & 0x7)
+		}
+		for _, b := range d.data[offset : offset+size] {
+			target = target<<8 | uint(b)
+		}
+		target += [...]uint{0, 2048, 526336, 0}[size-1]
+		value, _, err := d.decode(target)
+		return value, offset + size, err
+	}
+
+	if typ == mmdbExtended {
+		if offset >= uint(len(d.data)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(d.data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.data)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		extra := uint(0)
+		for _, b := range d.data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		size = [...]uint{29, 285, 65821}[n-1] + extra
+	}
+
+	switch typ {
+	case mmdbMap:
+		d.depth++
+		defer func() { d.depth-- }()
+		fields := make(map[string]any, size)
+		for range size {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			fields[name], offset, err = d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return fields, offset, nil
+	case mmdbArray:
+		d.depth++
+		defer func() { d.depth-- }()
+		values := make([]any, size)
+		for i := range values {
+			var err error
+			values[i], offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return values, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d.data)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := d.data[offset : offset+size]
+	offset += size
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return bytes.Clone(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c) // uint128 values beyond 64 bits don't occur in the fields used
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(n)), offset, nil
+		}
+		return int64(n), offset, nil
+	}
+	return nil, 0, fmt.Errorf("%w: unknown type %d", errMMDBCorrupt, typ)
+}
@@ -0,0 +1,230 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Continuous monitoring (-monitor)
+
+Like mtr, a Monitor traces a route over and over until it is stopped, and shows the statistics
+of every hop (see Report) full-screen, redrawn several times a second as the probes return:
+
+	traceroute to example.com (93.184.216.34), cycle 42, last 100 probes per hop
+
+	 TTL  Host                             Loss%   Snt   Last    Avg   Best   Wrst  StDev
+	   1  router.lan                        0.0%   100    0.4    0.4    0.3    0.6    0.1
+	   2  10.0.0.1                          2.0%   100    9.8    9.9    9.6   10.4    0.3
+	   3  ???                             100.0%   100    0.0    0.0    0.0    0.0    0.0
+
+	 5m12s elapsed   4200 probes sent, 4105 answered   Ctrl-C stops
+
+Every probe counts as soon as it is done, the table doesn't wait for the trace to end. The
+next trace starts Interval after one ended. With a Window, the statistics roll: they cover
+the last Window probes of every hop (see Report.Window).
+
+With Paths set, every trace is checked for a change of the path (see pathchange.go), the last
+one shows in the status bar; OnTrace is handed every trace too (-webhook). A trace that fails
+(the destination doesn't resolve for a while, no route) shows there too, and the next one
+tries again; only missing permissions end the Monitor early. Once it is stopped it leaves
+the alternate screen (see live.go) and prints the final table like -report does, so it stays
+in the scrollback.
+*/
+
+// Monitor traces a route over and over and draws rolling statistics of its hops, see Run
+type Monitor struct {
+	Output   io.Writer     // the terminal, nil means os.Stdout
+	Colors   *Colors       // color the average RTTs, nil leaves them plain
+	Refresh  time.Duration // time between redraws, 0 means 100 milliseconds
+	Interval time.Duration // time between the end of a trace and the start of the next, 0 means 1 second
+	Window   int           // statistics of the last Window probes of every hop, 0 means of all of them
+	Paths    *PathWatcher  // observes every trace for path changes, nil doesn't
+	OnTrace  func(*Result) // called with every trace that didn't fail, may be nil
+}
+
+// monitorScreen is what a Monitor draws, updated by the traces' renderer
+type monitorScreen struct {
+	mu     sync.Mutex
+	info   TraceInfo
+	report Report
+	start  time.Time
+	cycle  int
+	err    error       // of the last trace, if it failed
+	trace  *Result     // probes of the current trace
+	change *PathChange // the last path change, if any
+}
+
+// Run traces the route to dest with t again and again, drawing the statistics of the hops,
+// until ctx is done; it returns ctx.Err() then. t's Output and Renderer are not used, its
+// Hooks are still called. Multipath is not supported, its hops are sets of load balanced
+// paths.
+func (m *Monitor) Run(ctx context.Context, t *Tracer, dest string) error {
+	if t.Multipath {
+		return errors.New("the monitor doesn't support Multipath")
+	}
+	out := m.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	refresh := m.Refresh
+	if refresh == 0 {
+		refresh = 100 * time.Millisecond
+	}
+	interval := m.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	screen := &monitorScreen{info: TraceInfo{Target: dest}, report: Report{Window: m.Window}, start: time.Now()}
+	tracer := *t
+	tracer.Output = io.Discard
+	tracer.Renderer = (*monitorRenderer)(screen)
+
+	io.WriteString(out, ansiAltScreen+ansiHideCursor)
+	stopped := make(chan struct{})
+	drawn := make(chan struct{})
+	go func() {
+		defer close(drawn)
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			io.WriteString(out, ansiHome+screen.draw(m.Colors)+ansiClearScreen)
+			select {
+			case <-ticker.C:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	var err error
+	for cycle := 1; ; cycle++ {
+		screen.mu.Lock()
+		screen.cycle = cycle
+		screen.trace = &Result{Target: dest, Start: time.Now()}
+		screen.mu.Unlock()
+		err = tracer.Run(ctx, dest)
+		screen.trace.End = time.Now()
+		if ctx.Err() != nil || errors.Is(err, ErrPermission) {
+			break // won't get better by trying again
+		}
+		if errors.Is(err, ErrMaxTTLExceeded) || errors.Is(err, ErrGapLimit) {
+			err = nil // a destination that doesn't answer is part of the statistics
+		}
+		var change *PathChange
+		if m.Paths != nil && err == nil {
+			change = m.Paths.Observe(screen.trace) // Run is over, nothing adds to it anymore
+		}
+		if m.OnTrace != nil && err == nil {
+			m.OnTrace(screen.trace)
+		}
+		screen.mu.Lock()
+		screen.err = err
+		if change != nil {
+			screen.change = change
+		}
+		screen.mu.Unlock()
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	close(stopped)
+	<-drawn
+	io.WriteString(out, ansiMainScreen+ansiShowCursor)
+	host, _ := os.Hostname()
+	fmt.Fprintf(out, "Start: %s\n", screen.start.Format(time.RFC3339))
+	screen.mu.Lock()
+	screen.report.Print(out, host)
+	screen.mu.Unlock()
+	return err
+}
+
+// monitorRenderer hands the probes of the traces to the screen
+type monitorRenderer monitorScreen
+
+func (r *monitorRenderer) RenderHeader(w io.Writer, info TraceInfo) {
+	s := (*monitorScreen)(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info = info
+	s.trace.Addr = info.Addr
+}
+
+func (r *monitorRenderer) Render(w io.Writer, result HopResult) {
+	s := (*monitorScreen)(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report.AddProbe(result)
+	s.trace.AddProbe(result)
+}
+
+// draw returns the screen as text
+func (s *monitorScreen) draw(colors *Colors) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eol := ansiClearLine + "\n" // what was drawn before may have been longer
+	var b strings.Builder
+	b.WriteString("traceroute to " + s.info.Target)
+	if s.info.Addr != nil {
+		fmt.Fprintf(&b, " (%s)", s.info.Addr.IP)
+	}
+	fmt.Fprintf(&b, ", cycle %d", s.cycle)
+	if s.report.Window > 0 {
+		fmt.Fprintf(&b, ", last %d probes per hop", s.report.Window)
+	}
+	b.WriteString(eol + eol)
+
+	fmt.Fprintf(&b, " TTL  %-30s  Loss%%   Snt   Last    Avg   Best   Wrst  StDev%s", "Host", eol)
+	sent, answered := 0, 0
+	for _, hop := range s.report.Hops {
+		name := "???"
+		if len(hop.Hosts) > 0 {
+			name = hop.Hosts[0]
+			if len(hop.Hosts) > 1 {
+				name += fmt.Sprintf(" +%d", len(hop.Hosts)-1)
+			}
+		}
+		if len(name) > 30 {
+			name = name[:27] + "..."
+		}
+		avg := fmt.Sprintf("%6.1f", milliseconds(hop.Avg()))
+		if colors != nil && hop.Received > 0 {
+			avg = colors.paint(colors.rtt(hop.Avg()), avg)
+		}
+		fmt.Fprintf(&b, " %3d  %-30s %5.1f%% %5d %6.1f %s %6.1f %6.1f %6.1f%s",
+			hop.TTL, name, hop.Loss(), hop.Sent,
+			milliseconds(hop.Last), avg, milliseconds(hop.Best), milliseconds(hop.Worst), milliseconds(hop.StdDev()), eol)
+		sent += hop.Sent
+		answered += hop.Received
+	}
+
+	status := fmt.Sprintf(" %s elapsed   %d probes sent, %d answered   Ctrl-C stops ", time.Since(s.start).Truncate(time.Second), sent, answered)
+	if s.report.Window > 0 {
+		status = fmt.Sprintf(" %s elapsed   %d probes sent, %d answered in the window   Ctrl-C stops ", time.Since(s.start).Truncate(time.Second), sent, answered)
+	}
+	if s.change != nil {
+		status += fmt.Sprintf("  path changed %s (%s) ", s.change.Time.Format(time.TimeOnly), strings.Join(s.change.Kinds, ", "))
+	}
+	if s.err != nil {
+		status += fmt.Sprintf("  last trace failed: %v ", s.err)
+	}
+	b.WriteString(eol + ansiReverse + status + ansiReset + ansiClearLine)
+	return b.String()
+}
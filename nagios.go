@@ -0,0 +1,160 @@
+package traceroute
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Nagios/Icinga checks (-nagios)
+
+A NagiosCheck turns the Summary of a trace into the output of a monitoring plugin
+(https://nagios-plugins.org/doc/guidelines.html): one line with the status, a message and
+performance data, and the status as the exit code.
+
+	TRACEROUTE OK - example.com (93.184.216.34) reached in 12 hops, rtt 10.204 ms, loss 0.0% | rtt=10.204ms;100;200;0 loss=0.0%;20;50;0;100 hops=12;20;30;0;64
+	TRACEROUTE WARNING - example.com (93.184.216.34) reached in 12 hops, rtt 180.412 ms, loss 0.0%: rtt above 100 ms | ...
+	TRACEROUTE CRITICAL - example.com (93.184.216.34) not reached in 64 hops, last responder 10.0.0.1 at hop 7 | rtt=U;100;200;0 ...
+
+	status     OK (0), WARNING (1), CRITICAL (2), UNKNOWN (3: the trace failed, see NagiosError)
+	rtt        average RTT of the destination's answers, in milliseconds
+	loss       share of the last hop's probes the destination didn't answer (Summary.DestinationLoss)
+	hops       hops to the destination
+
+Every value has a warning and a critical threshold, it is a problem once it is above them.
+A zero threshold isn't checked. A destination that wasn't reached is always CRITICAL.
+*/
+
+// NagiosStatus is the status of a check, its number is the plugin's exit code
+type NagiosStatus int
+
+const (
+	NagiosOK NagiosStatus = iota
+	NagiosWarning
+	NagiosCritical
+	NagiosUnknown
+)
+
+func (s NagiosStatus) String() string {
+	switch s {
+	case NagiosOK:
+		return "OK"
+	case NagiosWarning:
+		return "WARNING"
+	case NagiosCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// NagiosThreshold is the warning and critical threshold of a value, 0 means none
+type NagiosThreshold struct {
+	Warning, Critical float64
+}
+
+// ParseNagiosThreshold parses "warning,critical", e.g. "100,200"
+func ParseNagiosThreshold(s string) (NagiosThreshold, error) {
+	warning, critical, ok := strings.Cut(s, ",")
+	if !ok {
+		return NagiosThreshold{}, fmt.Errorf("threshold %q is not warning,critical", s)
+	}
+	var t NagiosThreshold
+	var err error
+	if t.Warning, err = strconv.ParseFloat(strings.TrimSpace(warning), 64); err != nil || t.Warning < 0 {
+		return NagiosThreshold{}, fmt.Errorf("invalid warning threshold %q", warning)
+	}
+	if t.Critical, err = strconv.ParseFloat(strings.TrimSpace(critical), 64); err != nil || t.Critical < 0 {
+		return NagiosThreshold{}, fmt.Errorf("invalid critical threshold %q", critical)
+	}
+	return t, nil
+}
+
+// status returns the status of value
+func (t NagiosThreshold) status(value float64) NagiosStatus {
+	switch {
+	case t.Critical > 0 && value > t.Critical:
+		return NagiosCritical
+	case t.Warning > 0 && value > t.Warning:
+		return NagiosWarning
+	}
+	return NagiosOK
+}
+
+// perfdata returns the warning and critical fields of a performance value
+func (t NagiosThreshold) perfdata() string {
+	field := func(v float64) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return field(t.Warning) + ";" + field(t.Critical)
+}
+
+// NagiosCheck checks a trace against thresholds, see above
+type NagiosCheck struct {
+	RTT    NagiosThreshold // average RTT of the destination, in milliseconds
+	Loss   NagiosThreshold // loss of the destination, in percent
+	Hops   NagiosThreshold // hops to the destination
+	MaxTTL int             // max TTL the trace ran with, the maximum of the hops performance value; 0 leaves it out
+}
+
+// Check returns the status of the trace s sums up and the plugin's output line
+func (c NagiosCheck) Check(s Summary) (NagiosStatus, string) {
+	rtt, loss := milliseconds(s.Avg), s.DestinationLoss()
+
+	status := NagiosOK
+	var problems []string
+	if !s.Reached {
+		status = NagiosCritical
+	} else {
+		for _, check := range []struct {
+			name, format string
+			value        float64
+			threshold    NagiosThreshold
+		}{
+			{"rtt", "%s above %g ms", rtt, c.RTT},
+			{"loss", "%s above %g%%", loss, c.Loss},
+			{"hops", "%s above %g", float64(s.Hops), c.Hops},
+		} {
+			valueStatus := check.threshold.status(check.value)
+			limit := check.threshold.Warning
+			if valueStatus == NagiosCritical {
+				limit = check.threshold.Critical
+			}
+			if valueStatus != NagiosOK {
+				problems = append(problems, fmt.Sprintf(check.format, check.name, limit))
+			}
+			status = max(status, valueStatus)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "TRACEROUTE %s - ", status)
+	if s.Reached {
+		fmt.Fprintf(&b, "%s reached in %s, rtt %.3f ms, loss %.1f%%", s.name(), hopCount(s.Hops), rtt, loss)
+	} else {
+		b.WriteString(s.String())
+	}
+	if len(problems) > 0 {
+		b.WriteString(": " + strings.Join(problems, ", "))
+	}
+
+	rttValue, maxHops := "U", "" // U: there is no RTT of a destination that didn't answer
+	if s.Reached {
+		rttValue = fmt.Sprintf("%.3fms", rtt)
+	}
+	if c.MaxTTL > 0 {
+		maxHops = strconv.Itoa(c.MaxTTL)
+	}
+	fmt.Fprintf(&b, " | rtt=%s;%s;0 loss=%.1f%%;%s;0;100 hops=%d;%s;0;%s",
+		rttValue, c.RTT.perfdata(), loss, c.Loss.perfdata(), s.Hops, c.Hops.perfdata(), maxHops)
+	return status, b.String()
+}
+
+// NagiosError returns the plugin's output line for a trace that failed, its status is
+// NagiosUnknown
+func NagiosError(err error) string {
+	return fmt.Sprintf("TRACEROUTE UNKNOWN - %v", err)
+}
@@ -0,0 +1,114 @@
+package traceroute
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNagiosCheck(t *testing.T) {
+	check := NagiosCheck{RTT: NagiosThreshold{100, 200}, Loss: NagiosThreshold{20, 50}, Hops: NagiosThreshold{20, 30}, MaxTTL: 64}
+	addr := &net.IPAddr{IP: net.ParseIP("93.184.216.34")}
+	reached := func(hops int, avg time.Duration, sent, replies int) Summary {
+		return Summary{Target: "example.com", Addr: addr, Reached: true, Hops: hops, Avg: avg, topSent: sent, topReplies: replies}
+	}
+
+	for _, test := range []struct {
+		name    string
+		check   NagiosCheck
+		summary Summary
+		status  NagiosStatus
+		line    string
+	}{
+		{
+			name: "ok", check: check, summary: reached(12, 10204*time.Microsecond, 3, 3),
+			status: NagiosOK,
+			line:   "TRACEROUTE OK - example.com (93.184.216.34) reached in 12 hops, rtt 10.204 ms, loss 0.0% | rtt=10.204ms;100;200;0 loss=0.0%;20;50;0;100 hops=12;20;30;0;64",
+		},
+		{
+			name: "at the thresholds", check: check, summary: reached(20, 100*time.Millisecond, 5, 4),
+			status: NagiosOK,
+			line:   "TRACEROUTE OK - example.com (93.184.216.34) reached in 20 hops, rtt 100.000 ms, loss 20.0% | rtt=100.000ms;100;200;0 loss=20.0%;20;50;0;100 hops=20;20;30;0;64",
+		},
+		{
+			name: "rtt warning", check: check, summary: reached(12, 180412*time.Microsecond, 3, 3),
+			status: NagiosWarning,
+			line:   "TRACEROUTE WARNING - example.com (93.184.216.34) reached in 12 hops, rtt 180.412 ms, loss 0.0%: rtt above 100 ms | rtt=180.412ms;100;200;0 loss=0.0%;20;50;0;100 hops=12;20;30;0;64",
+		},
+		{
+			name: "loss critical", check: check, summary: reached(12, 10*time.Millisecond, 3, 1),
+			status: NagiosCritical,
+			line:   "TRACEROUTE CRITICAL - example.com (93.184.216.34) reached in 12 hops, rtt 10.000 ms, loss 66.7%: loss above 50% | rtt=10.000ms;100;200;0 loss=66.7%;20;50;0;100 hops=12;20;30;0;64",
+		},
+		{
+			name: "rtt warning, hops critical", check: check, summary: reached(31, 150*time.Millisecond, 3, 3),
+			status: NagiosCritical,
+			line:   "TRACEROUTE CRITICAL - example.com (93.184.216.34) reached in 31 hops, rtt 150.000 ms, loss 0.0%: rtt above 100 ms, hops above 30 | rtt=150.000ms;100;200;0 loss=0.0%;20;50;0;100 hops=31;20;30;0;64",
+		},
+		{
+			name: "not reached", check: check,
+			summary: Summary{Target: "example.com", Addr: addr, Hops: 64, Last: &net.IPAddr{IP: net.ParseIP("10.0.0.1")}, LastTTL: 7, topSent: 3},
+			status:  NagiosCritical,
+			line:    "TRACEROUTE CRITICAL - example.com (93.184.216.34) not reached in 64 hops, last responder 10.0.0.1 at hop 7 | rtt=U;100;200;0 loss=100.0%;20;50;0;100 hops=64;20;30;0;64",
+		},
+		{
+			name: "not reached, no thresholds", summary: Summary{Target: "192.0.2.1", Addr: &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, Hops: 1},
+			status: NagiosCritical,
+			line:   "TRACEROUTE CRITICAL - 192.0.2.1 not reached in 1 hop, nobody answered | rtt=U;;;0 loss=100.0%;;;0;100 hops=1;;;0;",
+		},
+		{
+			name: "no thresholds", summary: reached(1, 5*time.Second, 3, 1),
+			status: NagiosOK,
+			line:   "TRACEROUTE OK - example.com (93.184.216.34) reached in 1 hop, rtt 5000.000 ms, loss 66.7% | rtt=5000.000ms;;;0 loss=66.7%;;;0;100 hops=1;;;0;",
+		},
+		{
+			name: "critical only", check: NagiosCheck{RTT: NagiosThreshold{Critical: 0.5}}, summary: reached(2, time.Millisecond, 3, 3),
+			status: NagiosCritical,
+			line:   "TRACEROUTE CRITICAL - example.com (93.184.216.34) reached in 2 hops, rtt 1.000 ms, loss 0.0%: rtt above 0.5 ms | rtt=1.000ms;;0.5;0 loss=0.0%;;;0;100 hops=2;;;0;",
+		},
+	} {
+		status, line := test.check.Check(test.summary)
+		if status != test.status || line != test.line {
+			t.Errorf("%s: %v\n%s\nwant %v\n%s", test.name, status, line, test.status, test.line)
+		}
+	}
+}
+
+func TestNagiosError(t *testing.T) {
+	if got, want := NagiosError(errors.New("lookup nope: no such host")), "TRACEROUTE UNKNOWN - lookup nope: no such host"; got != want {
+		t.Errorf("NagiosError: %q, want %q", got, want)
+	}
+	for status, want := range map[NagiosStatus]string{0: "OK", 1: "WARNING", 2: "CRITICAL", 3: "UNKNOWN"} {
+		if status.String() != want {
+			t.Errorf("exit code %d is %s, want %s", int(status), status, want)
+		}
+	}
+}
+
+func TestParseNagiosThreshold(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want NagiosThreshold
+		err  string
+	}{
+		{s: "100,200", want: NagiosThreshold{100, 200}},
+		{s: " 0.5 , 1.5 ", want: NagiosThreshold{0.5, 1.5}},
+		{s: "0,50", want: NagiosThreshold{0, 50}},
+		{s: "100", err: `threshold "100" is not warning,critical`},
+		{s: "x,200", err: `invalid warning threshold "x"`},
+		{s: "100,-1", err: `invalid critical threshold "-1"`},
+	} {
+		got, err := ParseNagiosThreshold(test.s)
+		switch {
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: error %v, want %s", test.s, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("%q: %v", test.s, err)
+		case got != test.want:
+			t.Errorf("%q: %+v, want %+v", test.s, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package traceroute
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Option changes one setting of a Tracer, see NewTracer
+type Option func(*Tracer)
+
+// NewTracer returns the zero Tracer changed by opts. Like the traceroute command without
+// flags, except for GapLimit and ShowSummary, see Tracer:
+//
+//	tracer := traceroute.NewTracer(traceroute.WithMethod(traceroute.MethodTCP), traceroute.WithMaxTTL(30))
+func NewTracer(opts ...Option) *Tracer {
+	t := &Tracer{}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// WithQueries sets the number of probes per hop
+func WithQueries(n int) Option {
+	return func(t *Tracer) { t.Queries = n }
+}
+
+// WithTimeout sets how long to wait for the answer to a probe
+func WithTimeout(d time.Duration) Option {
+	return func(t *Tracer) { t.Wait = d }
+}
+
+// WithMaxTTL sets the max time-to-live (max number of hops)
+func WithMaxTTL(n int) Option {
+	return func(t *Tracer) { t.MaxTTL = n }
+}
+
+// WithFirstTTL starts the trace at hop n, skipping the hops before it
+func WithFirstTTL(n int) Option {
+	return func(t *Tracer) { t.FirstTTL = n }
+}
+
+// WithAdaptiveWait bounds the wait for a probe to here times an RTT seen at its hop, or near
+// times one seen at the nearest hop below, like traceroute -w MAX,HERE,NEAR (see adaptive.go)
+func WithAdaptiveWait(here, near float64) Option {
+	return func(t *Tracer) { t.WaitHere, t.WaitNear = here, near }
+}
+
+// WithGapLimit gives up after n hops in a row without any answer (ErrGapLimit)
+func WithGapLimit(n int) Option {
+	return func(t *Tracer) { t.GapLimit = n }
+}
+
+// WithRetries sends a probe nobody answered again up to n times before it counts as lost
+func WithRetries(n int) Option {
+	return func(t *Tracer) { t.Retries = n }
+}
+
+// WithConcurrency keeps up to n probes of any hops in flight at once
+func WithConcurrency(n int) Option {
+	return func(t *Tracer) { t.Concurrency = n }
+}
+
+// WithFast finds the path length by a binary search before the hops are probed, see
+// Tracer.Fast
+func WithFast() Option {
+	return func(t *Tracer) { t.Fast = true }
+}
+
+// WithShuffle probes the hops in random order, the results still come in TTL order
+func WithShuffle() Option {
+	return func(t *Tracer) { t.Shuffle = true }
+}
+
+// WithTOS sets the TOS byte (IPv4) or Traffic Class (IPv6) of the probes, e.g. 46<<2 for DSCP EF
+func WithTOS(tos int) Option {
+	return func(t *Tracer) { t.TOS = tos }
+}
+
+// WithHardwareTimestamps times the probes with the NIC's clock where it can, see
+// Tracer.HardwareTimestamps
+func WithHardwareTimestamps() Option {
+	return func(t *Tracer) { t.HardwareTimestamps = true }
+}
+
+// WithDontFragment sets the Don't Fragment bit on the probes (Linux only)
+func WithDontFragment() Option {
+	return func(t *Tracer) { t.DontFragment = true }
+}
+
+// WithPort sends UDP, TCP, SCTP, DCCP and QUIC probes to port, the first of the incrementing
+// ports of classic UDP probes
+func WithPort(port int) Option {
+	return func(t *Tracer) { t.Port = port }
+}
+
+// WithSourcePort sends UDP, TCP, SCTP, DCCP and QUIC probes from port, so the flow stays the
+// same from probe to probe
+func WithSourcePort(port int) Option {
+	return func(t *Tracer) { t.SourcePort = port }
+}
+
+// WithSource sends the probes from the local address addr
+func WithSource(addr net.IP) Option {
+	return func(t *Tracer) { t.Source = addr }
+}
+
+// WithIPv4 makes the Tracer use IPv4 only
+func WithIPv4() Option {
+	return func(t *Tracer) { t.IPv4 = true }
+}
+
+// WithIPv6 makes the Tracer use IPv6 only
+func WithIPv6() Option {
+	return func(t *Tracer) { t.IPv6 = true }
+}
+
+// WithMethod sets the probe method, one of the Method* constants
+func WithMethod(method string) Option {
+	return func(t *Tracer) { t.Method = method }
+}
+
+// WithSocket sets the socket type of ICMP probes, one of the Socket* constants
+func WithSocket(socketType string) Option {
+	return func(t *Tracer) { t.Socket = socketType }
+}
+
+// WithInterface sends the probes through the network interface called name. Outside Linux the
+// probes are sent from its address instead, see Tracer.Interface.
+func WithInterface(name string) Option {
+	return func(t *Tracer) { t.Interface = name }
+}
+
+// WithPayload sets the data ICMP Echo and UDP probes carry
+func WithPayload(data []byte) Option {
+	return func(t *Tracer) { t.Payload = data }
+}
+
+// WithPacketSize pads the probes up to size bytes, IP header included
+func WithPacketSize(size int) Option {
+	return func(t *Tracer) { t.PacketSize = size }
+}
+
+// WithPayloadFunc sets the data of every single ICMP Echo and UDP probe
+func WithPayloadFunc(f PayloadFunc) Option {
+	return func(t *Tracer) { t.PayloadFunc = f }
+}
+
+// WithUDPPayload makes UDP probes carry a real request: "dns", "ntp" or "quic"
+func WithUDPPayload(name string) Option {
+	return func(t *Tracer) { t.UDPPayload = name }
+}
+
+// WithUDPPorts sets the destination ports of plain UDP probes: "increment" or "fixed"
+func WithUDPPorts(behavior string) Option {
+	return func(t *Tracer) { t.UDPPorts = behavior }
+}
+
+// WithTCPFlags sets the flags of TCP probes: "syn", "ack", "fin" or "syn+ece"
+func WithTCPFlags(flags string) Option {
+	return func(t *Tracer) { t.TCPFlags = flags }
+}
+
+// WithDCCPServiceCode sets the Service Code of DCCP probes
+func WithDCCPServiceCode(code uint32) Option {
+	return func(t *Tracer) { t.DCCPServiceCode = code }
+}
+
+// WithXEchoInterface sets the interface MethodXEcho probes ask the destination about
+func WithXEchoInterface(spec string) Option {
+	return func(t *Tracer) { t.XEchoInterface = spec }
+}
+
+// WithParis keeps the flow identifier constant across probes (Paris traceroute)
+func WithParis() Option {
+	return func(t *Tracer) { t.Paris = true }
+}
+
+// WithMultipath makes Run discover all load balanced paths (MDA)
+func WithMultipath() Option {
+	return func(t *Tracer) { t.Multipath = true }
+}
+
+// WithIPID sets the IP Identification of the probes (SocketHdrincl only)
+func WithIPID(id int) Option {
+	return func(t *Tracer) { t.IPID = id }
+}
+
+// WithIPOptions sets raw IP options, see ParseIPOptions (SocketHdrincl only)
+func WithIPOptions(options []byte) Option {
+	return func(t *Tracer) { t.IPOptions = options }
+}
+
+// WithGateways loose source routes the probes through gateways (IPv4 only)
+func WithGateways(gateways ...net.IP) Option {
+	return func(t *Tracer) { t.Gateways = gateways }
+}
+
+// WithRecordRoute sets the Record Route option on the probes (IPv4 ICMP only)
+func WithRecordRoute() Option {
+	return func(t *Tracer) { t.RecordRoute = true }
+}
+
+// WithFlowLabel sets the IPv6 flow label of the probes
+func WithFlowLabel(label int) Option {
+	return func(t *Tracer) { t.FlowLabel = label }
+}
+
+// WithFlowLabelSweep gives probe i of every hop the flow label FlowLabel+i
+func WithFlowLabelSweep() Option {
+	return func(t *Tracer) { t.FlowLabelSweep = true }
+}
+
+// WithHooks sets the functions called while a trace runs
+func WithHooks(hooks Hooks) Option {
+	return func(t *Tracer) { t.Hooks = hooks }
+}
+
+// WithResolver looks up the destination and the hop names with r
+func WithResolver(r Resolver) Option {
+	return func(t *Tracer) { t.Resolver = r }
+}
+
+// WithSession shares the ICMP sockets of s with the other traces using it
+func WithSession(s *Session) Option {
+	return func(t *Tracer) { t.Session = s }
+}
+
+// WithScheduler sends the probes of every hop when s says, see Sequential, Paced and Parallel
+func WithScheduler(s Scheduler) Option {
+	return func(t *Tracer) { t.Scheduler = s }
+}
+
+// WithRateLimit caps the probes at what l allows, together with those of all Tracers sharing it
+func WithRateLimit(l *RateLimiter) Option {
+	return func(t *Tracer) { t.RateLimit = l }
+}
+
+// WithMiddleware wraps the sending of every probe into m, after the middleware added before
+func WithMiddleware(m ...Middleware) Option {
+	return func(t *Tracer) { t.Middleware = append(t.Middleware, m...) }
+}
+
+// WithClock times the probes with c instead of SystemClock
+func WithClock(c Clock) Option {
+	return func(t *Tracer) { t.Clock = c }
+}
+
+// WithProber sends the probes with p instead of the prober the method picks. The
+// Tracer doesn't close p.
+func WithProber(p Prober) Option {
+	return func(t *Tracer) { t.Prober = p }
+}
+
+// WithNumeric makes Run print hop addresses without looking up their names
+func WithNumeric() Option {
+	return func(t *Tracer) { t.Numeric = true }
+}
+
+// WithExtensions makes Run print ICMP extensions such as MPLS label stacks
+func WithExtensions() Option {
+	return func(t *Tracer) { t.ShowExtensions = true }
+}
+
+// WithOutput sets where Run prints the hops
+func WithOutput(w io.Writer) Option {
+	return func(t *Tracer) { t.Output = w }
+}
+
+// WithRenderer sets how Run prints the probes
+func WithRenderer(r Renderer) Option {
+	return func(t *Tracer) { t.Renderer = r }
+}
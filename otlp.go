@@ -0,0 +1,285 @@
+package traceroute
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+OpenTelemetry export (-otlp)
+
+An OTLPExporter sends a Result to an OpenTelemetry collector as a trace of its own, so
+network paths land in the same backend as application traces. It speaks OTLP over HTTP
+with the JSON encoding (https://opentelemetry.io/docs/specs/otlp/#otlphttp), which needs
+nothing but net/http:
+
+	traceroute example.com                 root span: target, address, reached, hop count
+	├── hop 1                              one span per hop: TTL, responders, loss, RTTs
+	│     probe events                     one event per probe: responder, RTT or error
+	├── hop 2
+	...
+
+A hop's span starts when its first probe was sent and ends when the next hop's first probe
+was (the trace's end for the last hop), which is the time the trace spent on it. The root
+span has an error status when the destination wasn't reached.
+*/
+
+// OTLPExporter sends Results to an OpenTelemetry collector, see Export
+type OTLPExporter struct {
+	Endpoint    string       // URL of the OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces
+	ServiceName string       // service.name of the spans, "" means "traceroute"
+	Client      *http.Client // nil means http.DefaultClient
+}
+
+// OTLP span kinds and status codes, see opentelemetry-proto trace.proto
+const (
+	otlpSpanKindClient   = 3
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Events       []otlpEvent     `json:"events,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpEvent struct {
+	Time       string          `json:"timeUnixNano"`
+	Name       string          `json:"name"`
+	Attributes []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue, exactly one of its fields is set. 64 bit integers are strings
+// in the JSON encoding.
+type otlpValue struct {
+	String *string     `json:"stringValue,omitempty"`
+	Bool   *bool       `json:"boolValue,omitempty"`
+	Int    string      `json:"intValue,omitempty"`
+	Double *float64    `json:"doubleValue,omitempty"`
+	Array  *otlpValues `json:"arrayValue,omitempty"`
+}
+
+type otlpValues struct {
+	Values []otlpValue `json:"values"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{String: &value}}
+}
+
+func otlpBool(key string, value bool) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{Bool: &value}}
+}
+
+func otlpInt(key string, value int) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{Int: strconv.Itoa(value)}}
+}
+
+func otlpDouble(key string, value float64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{Double: &value}}
+}
+
+func otlpStrings(key string, values []string) otlpAttribute {
+	array := &otlpValues{}
+	for _, value := range values {
+		array.Values = append(array.Values, otlpValue{String: &value})
+	}
+	return otlpAttribute{Key: key, Value: otlpValue{Array: array}}
+}
+
+// otlpTime formats t as nanoseconds since the Unix epoch
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpID returns a random trace (16 bytes) or span (8 bytes) ID, hex encoded
+func otlpID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Export sends result to the collector as one trace, see above
+func (e *OTLPExporter) Export(ctx context.Context, result *Result) error {
+	body, err := json.Marshal(e.request(result))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OTLP export to %s: %s: %s", e.Endpoint, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// request returns the spans of result, as sent by Export
+func (e *OTLPExporter) request(result *Result) otlpRequest {
+	service := e.ServiceName
+	if service == "" {
+		service = "traceroute"
+	}
+	traceID := otlpID(16)
+
+	root := otlpSpan{
+		TraceID: traceID,
+		SpanID:  otlpID(8),
+		Name:    "traceroute " + result.Target,
+		Kind:    otlpSpanKindClient,
+		Start:   otlpTime(result.Start),
+		End:     otlpTime(result.End),
+		Attributes: []otlpAttribute{
+			otlpString("server.address", result.Target),
+			otlpBool("traceroute.reached", result.Reached),
+			otlpInt("traceroute.hops", result.lastTTL()),
+		},
+		Status: otlpStatus{Code: otlpStatusOK},
+	}
+	if result.Addr != nil {
+		root.Attributes = append(root.Attributes, otlpString("network.peer.address", result.Addr.IP.String()))
+	}
+	if !result.Reached {
+		root.Status = otlpStatus{Code: otlpStatusError, Message: "destination not reached"}
+	}
+	spans := []otlpSpan{root}
+
+	for i, hop := range result.Hops {
+		if len(hop.Probes) == 0 {
+			continue
+		}
+		start := hop.Probes[0].Sent
+		end := result.End
+		if i+1 < len(result.Hops) && len(result.Hops[i+1].Probes) > 0 {
+			end = result.Hops[i+1].Probes[0].Sent
+		}
+		span := otlpSpan{
+			TraceID:      traceID,
+			SpanID:       otlpID(8),
+			ParentSpanID: root.SpanID,
+			Name:         fmt.Sprintf("hop %d", hop.TTL),
+			Kind:         otlpSpanKindInternal,
+			Start:        otlpTime(start),
+			End:          otlpTime(end),
+			Status:       otlpStatus{Code: otlpStatusOK},
+		}
+
+		var responders []string
+		var best, worst, sum time.Duration
+		answered := 0
+		for _, probe := range hop.Probes {
+			event := otlpEvent{Time: otlpTime(probe.Sent), Name: "probe"}
+			if probe.Addr == nil {
+				if probe.Err != nil {
+					event.Attributes = append(event.Attributes, otlpString("error.message", probe.Err.Error()))
+				}
+				span.Events = append(span.Events, event)
+				continue
+			}
+
+			responder := addrString(probe.Addr)
+			event.Attributes = append(event.Attributes,
+				otlpString("network.peer.address", responder),
+				otlpDouble("traceroute.rtt_ms", milliseconds(probe.RTT)))
+			if probe.Name != "" {
+				event.Attributes = append(event.Attributes, otlpString("network.peer.name", probe.Name))
+			}
+			span.Events = append(span.Events, event)
+
+			known := false
+			for _, r := range responders {
+				known = known || r == responder
+			}
+			if !known {
+				responders = append(responders, responder)
+			}
+			if answered == 0 || probe.RTT < best {
+				best = probe.RTT
+			}
+			worst = max(worst, probe.RTT)
+			sum += probe.RTT
+			answered++
+		}
+
+		span.Attributes = []otlpAttribute{
+			otlpInt("traceroute.ttl", hop.TTL),
+			otlpInt("traceroute.probes", len(hop.Probes)),
+			otlpDouble("traceroute.loss_ratio", float64(len(hop.Probes)-answered)/float64(len(hop.Probes))),
+		}
+		if answered > 0 {
+			span.Attributes = append(span.Attributes,
+				otlpStrings("traceroute.responders", responders),
+				otlpDouble("traceroute.rtt_ms.min", milliseconds(best)),
+				otlpDouble("traceroute.rtt_ms.avg", milliseconds(sum/time.Duration(answered))),
+				otlpDouble("traceroute.rtt_ms.max", milliseconds(worst)))
+		}
+		spans = append(spans, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpString("service.name", service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/yildiz-fatih/traceroute"}, Spans: spans}},
+	}}}
+}
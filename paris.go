@@ -0,0 +1,43 @@
+package traceroute
+
+import "encoding/binary"
+
+/*
+Paris traceroute (https://paris-traceroute.net/)
+
+Routers doing per-flow load balancing (ECMP) hash a few header fields to pick the
+outgoing link. For ICMP that is usually the first 4 bytes after the IP header, where
+TCP/UDP would have their ports:
+
+	Type (1 byte) | Code (1 byte) | Checksum (2 bytes)
+
+Type and Code never change, but the checksum covers the sequence number, so every
+probe we send looks like a new flow and may take a different path. The hop list we print
+can then mix routers from different paths.
+
+In Paris mode we put a 2 byte "compensation" word in front of the payload, chosen so that
+the checksum stays the same no matter what the sequence number is. The Identifier never
+changes anyway, so the whole flow identifier is constant across all TTLs.
+*/
+
+// defaultFlowID is the flow identifier used by Paris mode
+const defaultFlowID = 0
+
+// parisPayload returns the Echo payload that keeps the ICMP checksum constant for the
+// given sequence number. Different flowIDs produce different (but still constant) checksums.
+func parisPayload(seqNum int, flowID uint16, data []byte) []byte {
+	// The checksum is the one's complement of the one's complement sum of all 16 bit words.
+	// seq + (0xffff - seq) is always 0xffff, so the sum over both words does not depend on seq.
+	// Adding flowID on top moves the sum (and so the checksum) to a different constant value.
+	compensation := onesComplementAdd(0xffff-uint16(seqNum), flowID)
+
+	payload := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(payload, compensation) // word aligned: right after the 8 byte ICMP header
+	return append(payload, data...)
+}
+
+// onesComplementAdd adds two 16 bit numbers with end-around carry, like the Internet checksum does
+func onesComplementAdd(a, b uint16) uint16 {
+	sum := uint32(a) + uint32(b)
+	return uint16(sum&0xffff + sum>>16)
+}
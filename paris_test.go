@@ -0,0 +1,100 @@
+package traceroute
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// echoChecksum returns the checksum of the Echo Request probe seq of a Paris trace with flowID
+func echoChecksum(t *testing.T, seq int, flowID uint16, data []byte) uint16 {
+	t.Helper()
+	msg := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 0x4242, Seq: seq, Data: parisPayload(seq, flowID, data)}}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint16(b[2:4])
+}
+
+func TestParisChecksum(t *testing.T) {
+	seqs := []int{1, 2, 3, 255, 256, 0x7fff, 0xfffe, 0xffff, 0x10000, 70000} // the sequence number wraps at 16 bits
+	for i := 4; i < 0xffff; i += 997 {
+		seqs = append(seqs, i)
+	}
+	checksums := make(map[uint16]uint16) // flow ID by checksum
+	for _, flowID := range []uint16{defaultFlowID, 1, 2, 0x1234, 0xfffe} {
+		for _, data := range [][]byte{defaultPayload, nil, {1, 2, 3}} {
+			want := echoChecksum(t, 1, flowID, data)
+			for _, seq := range seqs {
+				if got := echoChecksum(t, seq, flowID, data); got != want {
+					t.Errorf("flow %d, data %q: checksum of probe %d is %#04x, of probe 1 %#04x", flowID, data, seq, got, want)
+				}
+			}
+			if payload := parisPayload(7, flowID, data); !bytes.Equal(payload[2:], data) {
+				t.Errorf("flow %d: payload %q doesn't end with the data %q", flowID, payload, data)
+			}
+			if data == nil {
+				if other, ok := checksums[want]; ok {
+					t.Errorf("flows %d and %d have the same checksum %#04x", other, flowID, want)
+				}
+				checksums[want] = flowID
+			}
+		}
+	}
+}
+
+// checksumNetwork is a fakeNetwork keeping the checksums of the probes sent
+type checksumNetwork struct {
+	*fakeNetwork
+
+	mu        sync.Mutex
+	checksums map[uint16]int
+}
+
+func (n *checksumNetwork) WriteTo(b []byte, dst net.Addr) (int, error) {
+	n.mu.Lock()
+	n.checksums[binary.BigEndian.Uint16(b[2:4])]++
+	n.mu.Unlock()
+	return n.fakeNetwork.WriteTo(b, dst)
+}
+
+func TestParisProbes(t *testing.T) {
+	for _, paris := range []bool{true, false} {
+		network := &checksumNetwork{fakeNetwork: newFakeNetwork(), checksums: make(map[uint16]int)}
+		prober := &ICMPProber{conn: network, id: 7, family: familyIPv4, paris: paris, payload: func(TTL, seq int) []byte { return defaultPayload }}
+		result, err := (&Tracer{Prober: prober, Queries: 3, Numeric: true}).Trace(context.Background(), "192.0.2.5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPath(t, result, 5, 3)
+		switch {
+		case paris && len(network.checksums) != 1:
+			t.Errorf("Paris probes with %d checksums, want one: %v", len(network.checksums), network.checksums)
+		case !paris && len(network.checksums) != 15:
+			t.Errorf("15 probes with %d checksums, want one each", len(network.checksums))
+		}
+	}
+}
+
+func TestParisPayloadFunc(t *testing.T) {
+	for _, tracer := range []*Tracer{
+		{Prober: pathProber{}, Paris: true, PayloadFunc: PaddedPayload(32)},
+		{Prober: pathProber{}, Multipath: true, PayloadFunc: PaddedPayload(32)},
+	} {
+		_, err := tracer.Trace(context.Background(), "192.0.2.3")
+		if tracer.Multipath {
+			_, err = tracer.TraceMultipath(context.Background(), "192.0.2.3")
+		}
+		if err == nil || !strings.Contains(err.Error(), "PayloadFunc") {
+			t.Errorf("Paris %v, Multipath %v with a PayloadFunc: %v, want an error", tracer.Paris, tracer.Multipath, err)
+		}
+	}
+}
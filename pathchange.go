@@ -0,0 +1,318 @@
+package traceroute
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Path change detection (-path-alert, -path-events, -webhook)
+
+A PathWatcher is handed every trace of a run that traces over and over (Observe), and tells
+when the path to a target changed since the previous trace to it. A path is the hosts that
+answered at every hop, in TTL order, up to the last hop that answered; its fingerprint is a
+hash of them, equal for equal paths. The paths are lined up like diff lines up text, so it
+can tell the kinds of changes apart:
+
+	responder  a hop was answered by other hosts
+	inserted   a hop appeared, the hops after it moved one TTL further
+	removed    a hop disappeared
+	length     the path got longer or shorter
+
+and show them as a diff of the old and the new path:
+
+	path to example.com changed (responder, inserted): 3f2a9c1b5d7e0a46 -> 8d0e4471c2b9f315
+	     1  192.0.2.1
+	  -  2  10.0.0.1
+	  +  2  10.0.0.7
+	  +  3  10.0.0.9
+	     4  93.184.216.34
+
+Loss is not a change: a hop nobody answered (*) lines up with any hop, and a trace that went
+silent before reaching the destination is compared up to where it did. The path remembered
+for the next trace keeps the hosts of the previous one for hops lost this time. Hops of load
+balancers answered by different hosts from trace to trace do count as changes, -paris keeps
+the probes of ICMP traces on one path.
+
+A Webhook posts every change as a path_change event, see webhook.go.
+*/
+
+// Kinds of path changes, see above
+const (
+	PathResponder = "responder"
+	PathInserted  = "inserted"
+	PathRemoved   = "removed"
+	PathLength    = "length"
+)
+
+// Path is the hosts that answered along the way to a target, see above
+type Path struct {
+	Hops    []PathHop
+	Reached bool // the destination answered at the last hop
+}
+
+// PathHop is a hop of a Path
+type PathHop struct {
+	TTL        int
+	Responders []string // addresses that answered, sorted; none when nobody did
+}
+
+// PathChange is a change of the path to Target between two traces, see PathWatcher
+type PathChange struct {
+	Target string
+	Time   time.Time // when it was observed
+	Old    Path
+	New    Path
+	Kinds  []string   // PathResponder, PathInserted, PathRemoved and PathLength, those that apply
+	Diff   []PathDiff // the hops of both paths, lined up
+}
+
+// PathDiff is a line of the diff of two paths: a hop of both, or only of the old (-) or new
+// (+) one
+type PathDiff struct {
+	Op  string // " ", "-" or "+"
+	Hop PathHop
+}
+
+// PathWatcher detects path changes between the traces of every target, see above. It is safe
+// for concurrent use.
+type PathWatcher struct {
+	OnChange func(PathChange) // called by Observe for every change, may be nil
+
+	mu    sync.Mutex
+	paths map[string]Path // by target
+}
+
+// NewPath returns the path of result
+func NewPath(result *Result) Path {
+	path := Path{Reached: result.Reached}
+	last := 0 // hops up to the last answered one
+	for _, hop := range result.Hops {
+		h := PathHop{TTL: hop.TTL}
+		for _, probe := range hop.Probes {
+			if probe.Addr != nil && !slices.Contains(h.Responders, addrString(probe.Addr)) {
+				h.Responders = append(h.Responders, addrString(probe.Addr))
+			}
+		}
+		slices.Sort(h.Responders)
+		path.Hops = append(path.Hops, h)
+		if len(h.Responders) > 0 {
+			last = len(path.Hops)
+		}
+	}
+	path.Hops = path.Hops[:last]
+	return path
+}
+
+// Fingerprint returns a hash of the hops of p, the same for the same hops
+func (p Path) Fingerprint() string {
+	hash := sha256.New()
+	for _, hop := range p.Hops {
+		fmt.Fprintf(hash, "%d %s\n", hop.TTL, strings.Join(hop.Responders, ","))
+	}
+	fmt.Fprintf(hash, "reached=%t", p.Reached)
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// label returns the responders of h for the diff, * for none
+func (h PathHop) label() string {
+	if len(h.Responders) == 0 {
+		return "*"
+	}
+	return strings.Join(h.Responders, ", ")
+}
+
+// Observe compares the path of result with that of the previous trace to the same target,
+// and returns the change, nil for none or the first trace to the target; OnChange is called
+// with it too
+func (w *PathWatcher) Observe(result *Result) *PathChange {
+	path := NewPath(result)
+	w.mu.Lock()
+	if w.paths == nil {
+		w.paths = make(map[string]Path)
+	}
+	old := w.paths[result.Target]
+	diff := diffPaths(old, path)
+	w.paths[result.Target] = rememberedPath(old, path, diff)
+	w.mu.Unlock()
+	if len(old.Hops) == 0 {
+		return nil // nothing to compare with
+	}
+
+	change := &PathChange{Target: result.Target, Time: time.Now(), Old: old, New: path, Diff: diff}
+	var replaced, inserted, removed bool
+	for i, line := range diff {
+		switch {
+		case line.Op == "-" && i+1 < len(diff) && diff[i+1].Op == "+":
+			replaced = true
+		case line.Op == "+" && i > 0 && diff[i-1].Op == "-":
+		case line.Op == "+":
+			inserted = true
+		case line.Op == "-":
+			removed = true
+		}
+	}
+	if replaced {
+		change.Kinds = append(change.Kinds, PathResponder)
+	}
+	if inserted {
+		change.Kinds = append(change.Kinds, PathInserted)
+	}
+	if removed {
+		change.Kinds = append(change.Kinds, PathRemoved)
+	}
+	if (old.Reached && path.Reached) && len(old.Hops) != len(path.Hops) {
+		change.Kinds = append(change.Kinds, PathLength)
+	}
+	if len(change.Kinds) == 0 {
+		return nil
+	}
+	if w.OnChange != nil {
+		w.OnChange(*change)
+	}
+	return change
+}
+
+// diffPaths lines the hops of old and new up, by the longest common subsequence of them
+// where a hop nobody answered matches any hop. A new path that went silent before the
+// destination is compared up to where it did.
+func diffPaths(old, new Path) []PathDiff {
+	a, b := old.Hops, new.Hops
+	if !new.Reached && len(b) < len(a) {
+		a = a[:len(b)]
+	}
+	same := func(x, y PathHop) bool {
+		return len(x.Responders) == 0 || len(y.Responders) == 0 || slices.Equal(x.Responders, y.Responders)
+	}
+	// lcs[i][j]: length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if same(a[i], b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var diff []PathDiff
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && same(a[i], b[j]):
+			diff = append(diff, PathDiff{Op: " ", Hop: mergeHop(a[i], b[j])})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, PathDiff{Op: "-", Hop: a[i]})
+			i++
+		default:
+			diff = append(diff, PathDiff{Op: "+", Hop: b[j]})
+			j++
+		}
+	}
+	return diff
+}
+
+// mergeHop returns hop new of both paths, with the responders of old when nobody answered it
+// this time
+func mergeHop(old, new PathHop) PathHop {
+	if len(new.Responders) == 0 {
+		new.Responders = old.Responders
+	}
+	return new
+}
+
+// rememberedPath returns the path to compare the next trace with: new, its lost hops filled
+// in from old where they line up, and the hops of old beyond where new went silent
+func rememberedPath(old, new Path, diff []PathDiff) Path {
+	remembered := Path{Reached: new.Reached}
+	for _, line := range diff {
+		if line.Op != "-" {
+			remembered.Hops = append(remembered.Hops, line.Hop)
+		}
+	}
+	if !new.Reached && len(new.Hops) < len(old.Hops) {
+		remembered.Hops = append(remembered.Hops, old.Hops[len(new.Hops):]...)
+		remembered.Reached = old.Reached
+	}
+	return remembered
+}
+
+// String returns the change as shown above
+func (c PathChange) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "path to %s changed (%s): %s -> %s\n", c.Target, strings.Join(c.Kinds, ", "), c.Old.Fingerprint(), c.New.Fingerprint())
+	for _, line := range c.Diff {
+		fmt.Fprintf(&b, "  %s %2d  %s\n", line.Op, line.Hop.TTL, line.Hop.label())
+	}
+	return b.String()
+}
+
+type jsonPath struct {
+	Fingerprint string    `json:"fingerprint"`
+	Reached     bool      `json:"reached"`
+	Hops        []PathHop `json:"hops"`
+}
+
+type jsonPathHop struct {
+	TTL        int      `json:"ttl"`
+	Responders []string `json:"responders"`
+}
+
+type jsonPathDiff struct {
+	Op string `json:"op"`
+	jsonPathHop
+}
+
+// MarshalJSON encodes the hop as {"ttl": 2, "responders": ["10.0.0.1"]}
+func (h PathHop) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.json())
+}
+
+func (h PathHop) json() jsonPathHop {
+	hop := jsonPathHop{TTL: h.TTL, Responders: h.Responders}
+	if hop.Responders == nil {
+		hop.Responders = []string{} // [], not null
+	}
+	return hop
+}
+
+// MarshalJSON encodes the path with its fingerprint
+func (p Path) MarshalJSON() ([]byte, error) {
+	path := jsonPath{Fingerprint: p.Fingerprint(), Reached: p.Reached, Hops: p.Hops}
+	if path.Hops == nil {
+		path.Hops = []PathHop{}
+	}
+	return json.Marshal(path)
+}
+
+// MarshalJSON encodes the change as an event:
+//
+//	{"event": "path_change", "time": "...", "target": "example.com", "kinds": ["responder"],
+//	 "old": {"fingerprint": "3f2a9c1b5d7e0a46", "reached": true, "hops": [...]}, "new": {...},
+//	 "diff": [{"op": " ", "ttl": 1, "responders": ["192.0.2.1"]}, {"op": "-", "ttl": 2, ...}, ...]}
+func (c PathChange) MarshalJSON() ([]byte, error) {
+	diff := make([]jsonPathDiff, len(c.Diff))
+	for i, line := range c.Diff {
+		diff[i] = jsonPathDiff{Op: line.Op, jsonPathHop: line.Hop.json()}
+	}
+	return json.Marshal(struct {
+		Event  string         `json:"event"`
+		Time   string         `json:"time"`
+		Target string         `json:"target"`
+		Kinds  []string       `json:"kinds"`
+		Old    Path           `json:"old"`
+		New    Path           `json:"new"`
+		Diff   []jsonPathDiff `json:"diff"`
+	}{"path_change", TimestampRFC3339.Format(c.Time), c.Target, c.Kinds, c.Old, c.New, diff})
+}
@@ -0,0 +1,98 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Packet capture (-pcap)
+
+With Tracer.Capture set, a trace records the packets it exchanges on the wire, as seen by
+the network interfaces, in a pcap file for Wireshark or tcpdump -r:
+
+	- every packet to or from the destination: the probes, and the destination's answers
+	- every ICMP (ICMPv6) message: Time Exceeded from the routers on the way, and whatever
+	  else arrives meanwhile, also answers meant for other programs
+
+The packets are captured with a packet socket (Linux only, it needs root or CAP_NET_RAW just
+like raw sockets do) and timestamped by the kernel when they went out or came in. They are
+written as raw IP packets (link type LINKTYPE_RAW), without the link layer header, in the
+classic pcap format with nanosecond timestamps
+(https://www.ietf.org/archive/id/draft-ietf-opsawg-pcap-04.html):
+
+	file header:    magic 0xa1b23c4d, version 2.4, thiszone 0, sigfigs 0, snaplen, link type
+	packet header:  seconds, nanoseconds, captured length, original length
+	packet data:    the IP packet, cut at snaplen
+*/
+
+const (
+	pcapMagicNanoseconds = 0xa1b23c4d
+	pcapSnapLen          = 65535
+	pcapLinkTypeRaw      = 101 // the packets start with their IPv4 or IPv6 header
+)
+
+// PCAPWriter writes captured packets to a pcap file, see Tracer.Capture. It is safe for
+// concurrent use, traces sharing one all write into the same file.
+type PCAPWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewPCAPWriter writes the pcap file header to w and returns a PCAPWriter adding packets
+// after it
+func NewPCAPWriter(w io.Writer) (*PCAPWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagicNanoseconds)
+	binary.LittleEndian.PutUint16(header[4:6], 2) // version major
+	binary.LittleEndian.PutUint16(header[6:8], 4) // version minor
+	// thiszone and sigfigs stay 0
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PCAPWriter{w: w}, nil
+}
+
+// WritePacket adds an IP packet captured at ts to the file
+func (p *PCAPWriter) WritePacket(ts time.Time, packet []byte) error {
+	captured := packet[:min(len(packet), pcapSnapLen)]
+	record := make([]byte, 16, 16+len(captured))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(ts.Nanosecond()))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(packet)))
+	record = append(record, captured...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(record) // in one piece, so packets of concurrent traces don't mix
+	return err
+}
+
+// capturedPacket reports whether an IP packet seen on the wire is part of a trace to dst,
+// see above
+func capturedPacket(packet []byte, dst net.IP) bool {
+	if len(packet) == 0 {
+		return false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if dst.To4() == nil || len(packet) < 20 {
+			return false
+		}
+		src, to, protocol := net.IP(packet[12:16]), net.IP(packet[16:20]), packet[9]
+		return protocol == 1 || src.Equal(dst) || to.Equal(dst) // 1 is ICMP
+	case 6:
+		if dst.To4() != nil || len(packet) < 40 {
+			return false
+		}
+		src, to, nextHeader := net.IP(packet[8:24]), net.IP(packet[24:40]), packet[6]
+		return nextHeader == 58 || src.Equal(dst) || to.Equal(dst) // 58 is ICMPv6
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package traceroute
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// Prober sends TTL-limited probes and matches the answers to them. Tracer picks one of
+// ICMPProber, UDPProber or TransportProber by its Method, unless Tracer.Prober is set: that
+// way other kinds of probes (e.g. inside a tunnel encapsulation) can be traced without
+// touching the rest.
+type Prober interface {
+	// Probe sends one probe and waits for the answer to it, for at most req.Wait or until ctx
+	// is done. It returns an error when nobody answered.
+	Probe(ctx context.Context, req ProbeRequest) (*Reply, error)
+	Close() error
+}
+
+// ProbeRequest describes one probe for a Prober to send
+type ProbeRequest struct {
+	Dst   *net.IPAddr   // destination of the trace
+	TTL   int           // TTL (hop limit) to send the probe with
+	Seq   int           // number of the probe, counting from 1 over the whole trace
+	Wait  time.Duration // how long to wait for the answer
+	Clock Clock         // to measure the RTT and the wait with, nil means SystemClock
+	Sent  func()        // to be called right after the probe went out, may be nil
+}
+
+// Reply describes the answer to a probe
+type Reply struct {
+	Addr    net.Addr      // who answered
+	RTT     time.Duration // time between sending the probe and receiving the answer
+	Type    icmp.Type     // Echo Reply, Time Exceeded, ..., nil when the destination answered in the probe's own protocol
+	Code    int           // ICMP code of the answer, e.g. 3 (port unreachable) for a Destination Unreachable
+	Reached bool          // the destination itself answered
+	Note    string        // extra information shown after the RTT, e.g. what an Extended Echo Reply told us
+	TTL     int           // TTL (hop limit) the answer arrived with, 0 when the socket doesn't tell (datagram sockets outside Linux)
+
+	TimestampSource TimestampSource // how RTT was measured, "" means TimestampSourceUser (see timestamps.go)
+
+	extensions []extensionObject // ICMP extension objects attached to the answer, if any
+	route      []net.IP          // addresses recorded in the IP Record Route option (-R), if any
+}
+
+// clock returns the Clock to time the probe with
+func (req ProbeRequest) clock() Clock {
+	if req.Clock == nil {
+		return SystemClock
+	}
+	return req.Clock
+}
+
+// UDPProber sends UDP probes (MethodUDP, MethodQUIC), each on a socket of its own. Tracer
+// creates it from its settings.
+type UDPProber struct {
+	family  ipFamily
+	payload udpPayload
+	data    PayloadFunc // data of classic UDP probes, nil when payload is a real request
+	port    int         // destination port of the first classic probe, of every probe carrying a request
+	sockets socketConfig
+
+	fixedPort bool // send classic probes to port too (UDPPorts "fixed")
+}
+
+// Probe sends one UDP datagram and waits for the answer to it
+func (p *UDPProber) Probe(ctx context.Context, req ProbeRequest) (*Reply, error) {
+	port := p.port
+	if p.payload.port == 0 && !p.fixedPort {
+		port += (req.Seq - 1) % (0x10000 - p.port) // classic probes: the next port for every probe
+	}
+	payload := p.payload
+	if p.data != nil {
+		payload.build = func(int) []byte { return p.data(req.TTL, req.Seq) }
+	}
+	return probeUDP(ctx, p.family, req.Dst, port, req.TTL, req.Seq, req.Wait, req.clock(), payload, p.sockets, req.Sent)
+}
+
+// Close does nothing, the sockets only live as long as their probe
+func (p *UDPProber) Close() error {
+	return nil
+}
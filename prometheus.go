@@ -0,0 +1,229 @@
+package traceroute
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Prometheus metrics (-listen)
+
+A PrometheusExporter is handed the Result of every trace (Observe) and serves metrics about
+them in the Prometheus text format (https://prometheus.io/docs/instrumenting/exposition_formats/),
+so path health can be scraped without any glue:
+
+	traceroute_hop_rtt_seconds        histogram  RTTs of the answers, per target and TTL, since the start
+	traceroute_hop_probes_total       counter    probes sent, per target and TTL
+	traceroute_hop_probes_lost_total  counter    probes nobody answered, per target and TTL
+	traceroute_hop_loss_ratio         gauge      share of the probes of the last trace nobody answered
+	traceroute_hop_responder          gauge      1 for every host that answered in the last trace
+	traceroute_path_hops              gauge      hops of the last trace, the destination's TTL when it was reached
+	traceroute_reached                gauge      1 when the last trace reached the destination
+	traceroute_last_trace_timestamp_seconds  gauge  when the last trace was observed
+
+Labels are target (as given to Trace) and ttl, and responder for traceroute_hop_responder.
+Histograms and counters add up over all traces, e.g. rate(traceroute_hop_probes_lost_total[5m])
+/ rate(traceroute_hop_probes_total[5m]) is the loss over the last 5 minutes. The gauges only
+describe the last trace, hops it didn't get to disappear from them.
+*/
+
+// promRTTBuckets are the upper bounds of the RTT histogram buckets, in seconds: from LAN
+// sub-milliseconds to satellite links
+var promRTTBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// PrometheusExporter serves metrics of the traces it observed to Prometheus, see above. It is
+// an http.Handler for the /metrics endpoint, and safe for concurrent use.
+type PrometheusExporter struct {
+	mu      sync.Mutex
+	targets map[string]*promTarget
+}
+
+// promTarget holds the metrics of one target
+type promTarget struct {
+	hops      map[int]*promHop // since the start, by TTL
+	last      *Result          // last trace
+	lastTrace time.Time        // when it was observed
+}
+
+// promHop holds the histogram and counters of one hop
+type promHop struct {
+	buckets []uint64 // answers per bucket of promRTTBuckets, not cumulative
+	count   uint64   // answers
+	sum     float64  // their RTTs, in seconds
+	sent    uint64
+	lost    uint64
+}
+
+// NewPrometheusExporter returns a PrometheusExporter that didn't observe any trace yet
+func NewPrometheusExporter() *PrometheusExporter {
+	return &PrometheusExporter{targets: make(map[string]*promTarget)}
+}
+
+// Observe adds the outcome of a trace to the metrics, also of one cut short
+func (e *PrometheusExporter) Observe(result *Result) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	target := e.targets[result.Target]
+	if target == nil {
+		target = &promTarget{hops: make(map[int]*promHop)}
+		e.targets[result.Target] = target
+	}
+	target.last, target.lastTrace = result, time.Now()
+
+	for _, hop := range result.Hops {
+		h := target.hops[hop.TTL]
+		if h == nil {
+			h = &promHop{buckets: make([]uint64, len(promRTTBuckets))}
+			target.hops[hop.TTL] = h
+		}
+		for _, probe := range hop.Probes {
+			h.sent++
+			if probe.Addr == nil {
+				h.lost++
+				continue
+			}
+			rtt := probe.RTT.Seconds()
+			h.count++
+			h.sum += rtt
+			if i, _ := slices.BinarySearch(promRTTBuckets, rtt); i < len(promRTTBuckets) {
+				h.buckets[i]++
+			}
+		}
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w
+func (e *PrometheusExporter) WriteTo(w io.Writer) (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	targets := make([]string, 0, len(e.targets))
+	for name := range e.targets {
+		targets = append(targets, name)
+	}
+	slices.Sort(targets)
+
+	var b strings.Builder
+	family := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	// hops calls sample for every hop observed for every target, in order
+	hops := func(sample func(target string, TTL int, h *promHop)) {
+		for _, name := range targets {
+			t := e.targets[name]
+			ttls := make([]int, 0, len(t.hops))
+			for TTL := range t.hops {
+				ttls = append(ttls, TTL)
+			}
+			slices.Sort(ttls)
+			for _, TTL := range ttls {
+				sample(name, TTL, t.hops[TTL])
+			}
+		}
+	}
+
+	family("traceroute_hop_rtt_seconds", "histogram", "RTTs of the answers to the probes of a hop.")
+	hops(func(target string, TTL int, h *promHop) {
+		labels := promLabels("target", target, "ttl", strconv.Itoa(TTL))
+		cumulative := uint64(0)
+		for i, le := range promRTTBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(&b, "traceroute_hop_rtt_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&b, "traceroute_hop_rtt_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(&b, "traceroute_hop_rtt_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "traceroute_hop_rtt_seconds_count{%s} %d\n", labels, h.count)
+	})
+
+	family("traceroute_hop_probes_total", "counter", "Probes sent to a hop.")
+	hops(func(target string, TTL int, h *promHop) {
+		fmt.Fprintf(&b, "traceroute_hop_probes_total{%s} %d\n", promLabels("target", target, "ttl", strconv.Itoa(TTL)), h.sent)
+	})
+
+	family("traceroute_hop_probes_lost_total", "counter", "Probes sent to a hop that nobody answered.")
+	hops(func(target string, TTL int, h *promHop) {
+		fmt.Fprintf(&b, "traceroute_hop_probes_lost_total{%s} %d\n", promLabels("target", target, "ttl", strconv.Itoa(TTL)), h.lost)
+	})
+
+	family("traceroute_hop_loss_ratio", "gauge", "Share of the probes to a hop nobody answered in the last trace.")
+	for _, name := range targets {
+		for _, hop := range e.targets[name].last.Hops {
+			lost := 0
+			for _, probe := range hop.Probes {
+				if probe.Addr == nil {
+					lost++
+				}
+			}
+			if len(hop.Probes) > 0 {
+				fmt.Fprintf(&b, "traceroute_hop_loss_ratio{%s} %s\n", promLabels("target", name, "ttl", strconv.Itoa(hop.TTL)),
+					strconv.FormatFloat(float64(lost)/float64(len(hop.Probes)), 'g', -1, 64))
+			}
+		}
+	}
+
+	family("traceroute_hop_responder", "gauge", "Hosts that answered the probes to a hop in the last trace.")
+	for _, name := range targets {
+		for _, hop := range e.targets[name].last.Hops {
+			var responders []string
+			for _, probe := range hop.Probes {
+				if probe.Addr == nil {
+					continue
+				}
+				responder := addrString(probe.Addr)
+				if !slices.Contains(responders, responder) {
+					responders = append(responders, responder)
+				}
+			}
+			for _, responder := range responders {
+				fmt.Fprintf(&b, "traceroute_hop_responder{%s} 1\n", promLabels("target", name, "ttl", strconv.Itoa(hop.TTL), "responder", responder))
+			}
+		}
+	}
+
+	family("traceroute_path_hops", "gauge", "Hops of the last trace.")
+	for _, name := range targets {
+		fmt.Fprintf(&b, "traceroute_path_hops{%s} %d\n", promLabels("target", name), e.targets[name].last.lastTTL())
+	}
+
+	family("traceroute_reached", "gauge", "Whether the last trace reached the destination.")
+	for _, name := range targets {
+		reached := 0
+		if e.targets[name].last.Reached {
+			reached = 1
+		}
+		fmt.Fprintf(&b, "traceroute_reached{%s} %d\n", promLabels("target", name), reached)
+	}
+
+	family("traceroute_last_trace_timestamp_seconds", "gauge", "When the last trace was observed, in seconds since the Unix epoch.")
+	for _, name := range targets {
+		fmt.Fprintf(&b, "traceroute_last_trace_timestamp_seconds{%s} %d\n", promLabels("target", name), e.targets[name].lastTrace.Unix())
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// promLabelEscaper escapes label values
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels formats pairs of label names and values, without the braces
+func promLabels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", pairs[i], promLabelEscaper.Replace(pairs[i+1])))
+	}
+	return strings.Join(labels, ",")
+}
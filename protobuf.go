@@ -0,0 +1,329 @@
+package traceroute
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/*
+Protocol Buffers encoding of Result (-o pb)
+
+For scans of many destinations, where JSON is too bulky. WriteProtobuf writes a Result as one
+record: its length as a varint, then the Result message of traceroute.proto in the
+repository. Records can be appended to one file trace after trace, ReadProtobuf reads them
+back one by one (traceroute decode prints them as JSON):
+
+	message Result { string target = 1; bytes address = 2; bool reached = 3;
+	                 int64 start_unix_nano = 4; int64 end_unix_nano = 5; repeated Hop hops = 6; }
+	message Hop    { uint32 ttl = 1; repeated Probe probes = 2; }
+	message Probe  { int64 sent_unix_nano = 1; bytes address = 2; string name = 3; int64 rtt_nanos = 4;
+	                 optional uint32 icmp_type = 5; uint32 icmp_code = 6; bool reached = 7; string note = 8;
+	                 uint32 reply_ttl = 9; string error = 10; bool timeout = 11; uint32 retries = 12;
+	                 string timestamp_source = 13; }
+
+Addresses are 4 (IPv4) or 16 (IPv6) bytes. It's plain protobuf, protoc generates readers in
+any language from traceroute.proto. The messages are encoded and decoded here by hand, the
+wire format is simple enough not to need a protobuf library; fields of later versions are
+skipped when reading.
+*/
+
+// pbMaxRecord is the largest record ReadProtobuf accepts, against garbage lengths
+const pbMaxRecord = 64 << 20
+
+// Protobuf wire types
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// pbMessage builds a protobuf message field by field, leaving out zero values like proto3 does
+type pbMessage []byte
+
+func (m *pbMessage) tag(field, wireType int) {
+	*m = binary.AppendUvarint(*m, uint64(field)<<3|uint64(wireType))
+}
+
+func (m *pbMessage) varint(field int, v uint64) {
+	if v != 0 {
+		m.tag(field, pbVarint)
+		*m = binary.AppendUvarint(*m, v)
+	}
+}
+
+func (m *pbMessage) bool(field int, v bool) {
+	if v {
+		m.varint(field, 1)
+	}
+}
+
+func (m *pbMessage) bytes(field int, v []byte) {
+	if len(v) > 0 {
+		m.tag(field, pbBytes)
+		*m = binary.AppendUvarint(*m, uint64(len(v)))
+		*m = append(*m, v...)
+	}
+}
+
+func (m *pbMessage) string(field int, v string) {
+	m.bytes(field, []byte(v))
+}
+
+func (m *pbMessage) time(field int, t time.Time) {
+	if !t.IsZero() {
+		m.varint(field, uint64(t.UnixNano()))
+	}
+}
+
+// pbIP returns the 4 or 16 bytes of ip, nil for none
+func pbIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// WriteProtobuf writes r to w as one length-delimited protobuf record, see protobuf.go
+func (r *Result) WriteProtobuf(w io.Writer) error {
+	res := pbResult(r)
+	record := binary.AppendUvarint(nil, uint64(len(res)))
+	_, err := w.Write(append(record, res...))
+	return err
+}
+
+// pbResult encodes a Result message
+func pbResult(r *Result) pbMessage {
+	var res pbMessage
+	res.string(1, r.Target)
+	if r.Addr != nil {
+		res.bytes(2, pbIP(r.Addr.IP))
+	}
+	res.bool(3, r.Reached)
+	res.time(4, r.Start)
+	res.time(5, r.End)
+	for _, hop := range r.Hops {
+		var h pbMessage
+		h.varint(1, uint64(hop.TTL))
+		for _, probe := range hop.Probes {
+			h.bytes(2, pbProbe(probe))
+		}
+		res.tag(6, pbBytes) // also empty hops, the TTL is all there is to them
+		res = binary.AppendUvarint(res, uint64(len(h)))
+		res = append(res, h...)
+	}
+	return res
+}
+
+// pbProbe encodes a Probe message
+func pbProbe(probe Probe) pbMessage {
+	var p pbMessage
+	p.time(1, probe.Sent)
+	if ipAddr, ok := probe.Addr.(*net.IPAddr); ok {
+		p.bytes(2, pbIP(ipAddr.IP))
+	}
+	p.string(3, probe.Name)
+	p.varint(4, uint64(probe.RTT))
+	if probe.Type != nil {
+		p.tag(5, pbVarint) // optional: set even when it is 0 (Echo Reply)
+		p = binary.AppendUvarint(p, uint64(icmpTypeNumber(probe.Type)))
+	}
+	p.varint(6, uint64(probe.Code))
+	p.bool(7, probe.Reached)
+	p.string(8, probe.Note)
+	p.varint(9, uint64(probe.ReplyTTL))
+	if probe.Err != nil {
+		p.string(10, probe.Err.Error())
+		p.bool(11, errors.Is(probe.Err, ErrTimeout))
+	}
+	p.varint(12, uint64(probe.Retries))
+	p.string(13, string(probe.TimestampSource))
+	return p
+}
+
+// icmpTypeNumber returns the number of an ICMP type on the wire
+func icmpTypeNumber(t icmp.Type) int {
+	switch t := t.(type) {
+	case ipv4.ICMPType:
+		return int(t)
+	case ipv6.ICMPType:
+		return int(t)
+	}
+	return 0
+}
+
+// ReadProtobuf reads the next record written by WriteProtobuf from r. It returns io.EOF when
+// there are no more records.
+func ReadProtobuf(r *bufio.Reader) (*Result, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("reading record length: %w", err)
+	}
+	if length > pbMaxRecord {
+		return nil, fmt.Errorf("record of %d bytes is too large", length)
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(r, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // the length came without the record
+		}
+		return nil, fmt.Errorf("reading record: %w", err)
+	}
+
+	result := &Result{}
+	var hops [][]byte // decoded once the address family is known
+	err = pbFields(record, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			result.Target = string(data)
+		case 2:
+			result.Addr = &net.IPAddr{IP: net.IP(data)}
+		case 3:
+			result.Reached = v != 0
+		case 4:
+			result.Start = time.Unix(0, int64(v))
+		case 5:
+			result.End = time.Unix(0, int64(v))
+		case 6:
+			hops = append(hops, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range hops {
+		hop, err := pbHop(data, result.Addr)
+		if err != nil {
+			return nil, err
+		}
+		result.Hops = append(result.Hops, hop)
+	}
+	return result, nil
+}
+
+// pbHop decodes a Hop message of a trace to dst
+func pbHop(data []byte, dst *net.IPAddr) (Hop, error) {
+	var hop Hop
+	err := pbFields(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			hop.TTL = int(v)
+		case 2:
+			probe, err := pbReadProbe(data, dst)
+			if err != nil {
+				return err
+			}
+			hop.Probes = append(hop.Probes, probe)
+		}
+		return nil
+	})
+	return hop, err
+}
+
+// pbReadProbe decodes a Probe message of a trace to dst, whose family says which ICMP its
+// type is of
+func pbReadProbe(data []byte, dst *net.IPAddr) (Probe, error) {
+	var probe Probe
+	var errMsg string
+	var timeout bool
+	err := pbFields(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			probe.Sent = time.Unix(0, int64(v))
+		case 2:
+			probe.Addr = &net.IPAddr{IP: net.IP(data)}
+		case 3:
+			probe.Name = string(data)
+		case 4:
+			probe.RTT = time.Duration(v)
+		case 5:
+			if dst != nil && dst.IP.To4() == nil {
+				probe.Type = ipv6.ICMPType(v)
+			} else {
+				probe.Type = ipv4.ICMPType(v)
+			}
+		case 6:
+			probe.Code = int(v)
+		case 7:
+			probe.Reached = v != 0
+		case 8:
+			probe.Note = string(data)
+		case 9:
+			probe.ReplyTTL = int(v)
+		case 10:
+			errMsg = string(data)
+		case 11:
+			timeout = v != 0
+		case 12:
+			probe.Retries = int(v)
+		case 13:
+			probe.TimestampSource = TimestampSource(data)
+		}
+		return nil
+	})
+	switch {
+	case timeout:
+		probe.Err = fmt.Errorf("%w%s", ErrTimeout, strings.TrimPrefix(errMsg, ErrTimeout.Error()))
+	case errMsg != "":
+		probe.Err = errors.New(errMsg)
+	}
+	return probe, err
+}
+
+// pbFields hands every field of a message to fn: its number and either its value (varint and
+// fixed) or its data (length-delimited)
+func pbFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("malformed protobuf field key")
+		}
+		b = b[n:]
+		field, wireType := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch wireType {
+		case pbVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("malformed varint in field %d", field)
+			}
+			b = b[n:]
+		case pbFixed64:
+			if len(b) < 8 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case pbFixed32:
+			if len(b) < 4 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case pbBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			data, b = b[n:n+int(length)], b[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", wireType, field)
+		}
+		if err := fn(field, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package traceroute
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pbTestResult is a Result with every field of the format set, somewhere
+func pbTestResult() *Result {
+	dst := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	return &Result{
+		Target:  "a",
+		Addr:    dst,
+		Reached: true,
+		Start:   time.Unix(0, 1),
+		End:     time.Unix(0, 300),
+		Hops: []Hop{
+			{TTL: 1, Probes: []Probe{{Sent: time.Unix(0, 2), Addr: &net.IPAddr{IP: net.ParseIP("10.0.0.1")}, RTT: 5, Type: ipv4.ICMPTypeTimeExceeded, ReplyTTL: 64}}},
+			{TTL: 2, Probes: []Probe{{Sent: time.Unix(0, 3), Err: ErrTimeout}}},
+			{TTL: 3, Probes: []Probe{{Addr: dst, Name: "b", RTT: 7, Type: ipv4.ICMPTypeEchoReply, Code: 1, Reached: true, Note: "!", Retries: 2, TimestampSource: TimestampSourceKernel}}},
+			{TTL: 4},
+		},
+	}
+}
+
+func TestProtobufGolden(t *testing.T) {
+	timeout := []byte(ErrTimeout.Error())
+	probe1 := []byte{
+		0x08, 2, // 1 sent_unix_nano, varint
+		0x12, 4, 10, 0, 0, 1, // 2 address, bytes
+		0x20, 5, // 4 rtt_nanos, varint
+		0x28, 11, // 5 icmp_type, varint: Time Exceeded
+		0x48, 64, // 9 reply_ttl, varint
+	}
+	probe2 := append([]byte{
+		0x08, 3, // 1 sent_unix_nano
+		0x52, byte(len(timeout)), // 10 error, bytes
+	}, timeout...)
+	probe2 = append(probe2, 0x58, 1) // 11 timeout, varint
+	probe3 := []byte{
+		0x12, 4, 192, 0, 2, 1, // 2 address
+		0x1a, 1, 'b', // 3 name, bytes
+		0x20, 7, // 4 rtt_nanos
+		0x28, 0, // 5 icmp_type: Echo Reply, optional so also 0
+		0x30, 1, // 6 icmp_code, varint
+		0x38, 1, // 7 reached, varint
+		0x42, 1, '!', // 8 note, bytes
+		0x60, 2, // 12 retries, varint
+		0x6a, 6, 'k', 'e', 'r', 'n', 'e', 'l', // 13 timestamp_source, bytes
+	}
+	hop := func(ttl byte, probe []byte) []byte {
+		h := []byte{0x08, ttl} // 1 ttl, varint
+		if probe != nil {
+			h = append(h, 0x12, byte(len(probe))) // 2 probes, bytes
+			h = append(h, probe...)
+		}
+		return append([]byte{0x32, byte(len(h))}, h...) // 6 hops of the Result, bytes
+	}
+	want := []byte{
+		0x0a, 1, 'a', // 1 target, bytes
+		0x12, 4, 192, 0, 2, 1, // 2 address, bytes
+		0x18, 1, // 3 reached, varint
+		0x20, 1, // 4 start_unix_nano, varint
+		0x28, 0xac, 0x02, // 5 end_unix_nano, varint: 300
+	}
+	want = append(want, hop(1, probe1)...)
+	want = append(want, hop(2, probe2)...)
+	want = append(want, hop(3, probe3)...)
+	want = append(want, hop(4, nil)...) // empty hops are kept
+	want = append(binary.AppendUvarint(nil, uint64(len(want))), want...)
+
+	var got bytes.Buffer
+	if err := pbTestResult().WriteProtobuf(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("record\n% x\nwant\n% x", got.Bytes(), want)
+	}
+}
+
+// checkProbes checks that got decoded to the probes of want
+func checkProbes(t *testing.T, ttl int, got, want []Probe) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("hop %d: %d probes, want %d", ttl, len(got), len(want))
+		return
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		errText := func(err error) string {
+			if err == nil {
+				return ""
+			}
+			return err.Error()
+		}
+		if !g.Sent.Equal(w.Sent) || fmt.Sprint(g.Addr) != fmt.Sprint(w.Addr) || g.Name != w.Name || g.RTT != w.RTT ||
+			g.Type != w.Type || g.Code != w.Code || g.Reached != w.Reached || g.Note != w.Note || g.ReplyTTL != w.ReplyTTL ||
+			g.Retries != w.Retries || g.TimestampSource != w.TimestampSource ||
+			errText(g.Err) != errText(w.Err) || errors.Is(g.Err, ErrTimeout) != errors.Is(w.Err, ErrTimeout) {
+			t.Errorf("hop %d probe %d: %+v, want %+v", ttl, i+1, g, w)
+		}
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	v6 := &net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	results := []*Result{
+		pbTestResult(),
+		{
+			Target: "2001:db8::1", Addr: v6, Start: time.Unix(1760616000, 5), End: time.Unix(1760616001, 6),
+			Hops: []Hop{
+				{TTL: 1, Probes: []Probe{
+					{Sent: time.Unix(1760616000, 7), Addr: &net.IPAddr{IP: net.ParseIP("2001:db8:1::1")}, RTT: time.Millisecond, Type: ipv6.ICMPTypeTimeExceeded, ReplyTTL: 63},
+					{Sent: time.Unix(1760616000, 8), Err: fmt.Errorf("%w: after 3 retries", ErrTimeout), Retries: 3},
+					{Sent: time.Unix(1760616000, 9), Err: errors.New("sendto: network is unreachable")},
+				}},
+				{TTL: 2, Probes: []Probe{{Addr: v6, RTT: 2 * time.Millisecond, Type: ipv6.ICMPTypeDestinationUnreachable, Code: 4, Reached: true}}},
+			},
+		},
+		{Target: "empty"},
+	}
+
+	var records bytes.Buffer
+	for _, result := range results {
+		if err := result.WriteProtobuf(&records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(&records)
+	for _, want := range results {
+		got, err := ReadProtobuf(r)
+		if err != nil {
+			t.Fatalf("%s: %v", want.Target, err)
+		}
+		if got.Target != want.Target || fmt.Sprint(got.Addr) != fmt.Sprint(want.Addr) || got.Reached != want.Reached ||
+			!got.Start.Equal(want.Start) || !got.End.Equal(want.End) || len(got.Hops) != len(want.Hops) {
+			t.Errorf("%s: read %+v, want %+v", want.Target, got, want)
+			continue
+		}
+		for i, hop := range want.Hops {
+			if got.Hops[i].TTL != hop.TTL {
+				t.Errorf("%s: hop %d has TTL %d", want.Target, hop.TTL, got.Hops[i].TTL)
+			}
+			checkProbes(t, hop.TTL, got.Hops[i].Probes, hop.Probes)
+		}
+	}
+	if _, err := ReadProtobuf(r); err != io.EOF {
+		t.Errorf("after the last record: %v, want io.EOF", err)
+	}
+}
+
+// protoField is a field of a message of traceroute.proto
+type protoField struct {
+	name, typ string
+}
+
+// readProto returns the fields of the messages of traceroute.proto by number
+func readProto(t *testing.T) map[string]map[int]protoField {
+	t.Helper()
+	schema, err := os.ReadFile("traceroute.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(map[string]map[int]protoField)
+	message := regexp.MustCompile(`(?m)^message (\w+) \{$`)
+	field := regexp.MustCompile(`(?m)^\s+(?:optional |repeated )?(\w+) (\w+) = (\d+);`)
+	var fields map[int]protoField
+	for _, line := range bytes.Split(schema, []byte("\n")) {
+		if m := message.FindSubmatch(line); m != nil {
+			fields = make(map[int]protoField)
+			messages[string(m[1])] = fields
+		} else if m := field.FindSubmatch(line); m != nil && fields != nil {
+			n, _ := strconv.Atoi(string(m[3]))
+			fields[n] = protoField{name: string(m[2]), typ: string(m[1])}
+		} else if bytes.HasPrefix(line, []byte("}")) {
+			fields = nil
+		}
+	}
+	return messages
+}
+
+// checkWireTypes checks that every field of msg, a name message, has the number and wire type
+// traceroute.proto gives it, and records the fields seen as "message.field"
+func checkWireTypes(t *testing.T, messages map[string]map[int]protoField, name string, msg []byte, seen map[string]bool) {
+	t.Helper()
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			t.Errorf("%s: malformed key", name)
+			return
+		}
+		msg = msg[n:]
+		number, wireType := int(key>>3), int(key&7)
+		field, ok := messages[name][number]
+		if !ok {
+			t.Errorf("%s has no field %d", name, number)
+			return
+		}
+		seen[name+"."+field.name] = true
+		want := pbVarint
+		switch field.typ {
+		case "int64", "uint32", "bool":
+		case "string", "bytes":
+			want = pbBytes
+		default:
+			if messages[field.typ] == nil {
+				t.Errorf("%s.%s: unknown type %s", name, field.name, field.typ)
+				return
+			}
+			want = pbBytes
+		}
+		if wireType != want {
+			t.Errorf("%s.%s (%d): wire type %d, want %d for %s", name, field.name, number, wireType, want, field.typ)
+			return
+		}
+		var data []byte
+		if wireType == pbVarint {
+			_, n = binary.Uvarint(msg)
+			msg = msg[n:]
+			continue
+		}
+		length, n := binary.Uvarint(msg)
+		data, msg = msg[n:n+int(length)], msg[n+int(length):]
+		if messages[field.typ] != nil {
+			checkWireTypes(t, messages, field.typ, data, seen)
+		}
+	}
+}
+
+func TestProtobufSchema(t *testing.T) {
+	messages := readProto(t)
+	seen := make(map[string]bool)
+	result := pbTestResult()
+	checkWireTypes(t, messages, "Result", pbResult(result), seen)
+
+	probe := HopResult{Target: "a", TTL: 3, Probe: 2, Last: true, Addr: result.Hops[2].Probes[0].Addr, RTT: 7}
+	checkWireTypes(t, messages, "TraceEvent", pbTraceEvent("a", &probe, nil, nil), seen)
+	checkWireTypes(t, messages, "TraceEvent", pbTraceEvent("a", nil, result, errors.New("failed")), seen)
+
+	for _, name := range []string{"Result", "Hop", "Probe", "TraceEvent", "HopResult"} {
+		for _, field := range messages[name] {
+			if !seen[name+"."+field.name] {
+				t.Errorf("%s.%s is never written", name, field.name)
+			}
+		}
+	}
+
+	// The agent reads what the schema says it sends
+	var request pbMessage
+	request.string(1, "a")
+	request.string(2, "192.0.2.1")
+	request.string(3, MethodTCP)
+	for n := 4; n <= 8; n++ {
+		request.varint(n, uint64(n))
+	}
+	for n := 9; n <= 11; n++ {
+		request.bool(n, true)
+	}
+	checkWireTypes(t, messages, "TraceRequest", request, seen)
+	for _, field := range messages["TraceRequest"] {
+		if !seen["TraceRequest."+field.name] {
+			t.Errorf("TraceRequest.%s is never read", field.name)
+		}
+	}
+	id, got, err := pbReadTraceRequest(request)
+	want := apiRequest{Target: "192.0.2.1", Method: MethodTCP, Port: 4, FirstTTL: 5, MaxTTL: 6, Queries: 7, WaitMS: 8, IPv4: true, IPv6: true, Paris: true}
+	if err != nil || id != "a" || got != want {
+		t.Errorf("TraceRequest read as %q %+v (%v), want a %+v", id, got, err, want)
+	}
+}
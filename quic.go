@@ -0,0 +1,98 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+/*
+QUIC Initial probes (-M quic, same as -M udp -udp-payload quic)
+
+CDNs serve a lot of traffic over QUIC (UDP/443), and middleboxes often treat it differently
+from other UDP. These probes look like the first packet of a QUIC connection, the Initial
+(RFC 9000 17.2.2), so the path treats them like real QUIC traffic:
+
+	Header Form = 1 | Fixed Bit = 1 | Type = 0 (Initial) | Reserved = 0 | Packet Number Length - 1 = 0
+	Version (4)
+	Destination Connection ID Length (1) | Destination Connection ID (8)
+	Source Connection ID Length (1)      | Source Connection ID (8)
+	Token Length (varint) = 0
+	Length (varint)                      - of what follows: packet number and payload
+	Packet Number (1)
+	Payload                              - zero padding up to a 1200 byte datagram
+
+We don't do the TLS handshake (and so can't encrypt a real payload). Instead the Version
+is a reserved "greasing" version (RFC 9000 15), which no server supports: a server must
+answer a long enough Initial for an unknown version with Version Negotiation, listing the
+versions it does support. That, or a Retry, tells us we reached a QUIC server.
+
+Both Connection IDs carry the sequence number, Version Negotiation echoes them swapped.
+*/
+
+const (
+	quicPort          = 443
+	quicMinDatagram   = 1200       // servers ignore smaller Initials (RFC 9000 14.1)
+	quicGreaseVersion = 0x1a2a3a4a // matches the reserved 0x?a?a?a?a pattern
+	quicConnIDLen     = 8
+
+	quicLongHeader   = 0x80
+	quicFixedBit     = 0x40
+	quicTypeInitial  = 0x0
+	quicTypeRetry    = 0x3
+	quicVersionNegot = 0 // Version of Version Negotiation packets
+)
+
+func quicInitial(seqNum int) []byte {
+	dcid := quicConnectionID('D', seqNum)
+	scid := quicConnectionID('S', seqNum)
+
+	b := []byte{quicLongHeader | quicFixedBit | quicTypeInitial<<4}
+	b = binary.BigEndian.AppendUint32(b, quicGreaseVersion)
+	b = append(b, quicConnIDLen)
+	b = append(b, dcid...)
+	b = append(b, quicConnIDLen)
+	b = append(b, scid...)
+	b = append(b, 0) // Token Length
+
+	// Length is a 2 byte varint (prefix 01), covering packet number + padding
+	remaining := quicMinDatagram - len(b) - 2
+	b = binary.BigEndian.AppendUint16(b, 0x4000|uint16(remaining))
+	b = append(b, byte(seqNum)) // Packet Number
+	return append(b, make([]byte, quicMinDatagram-len(b))...)
+}
+
+// quicConnectionID builds a recognizable connection ID carrying the sequence number
+func quicConnectionID(kind byte, seqNum int) []byte {
+	id := []byte{'t', 'r', 'a', kind, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(id[4:], uint32(seqNum))
+	return id
+}
+
+func describeQUICAnswer(answer []byte) string {
+	if len(answer) < 5 || answer[0]&quicLongHeader == 0 {
+		return " [QUIC]"
+	}
+
+	version := binary.BigEndian.Uint32(answer[1:5])
+	if version == quicVersionNegot {
+		// After the header and both Connection IDs comes the list of supported versions
+		rest := answer[5:]
+		for range 2 { // Destination, then Source Connection ID
+			if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+				return " [QUIC Version Negotiation]"
+			}
+			rest = rest[1+int(rest[0]):]
+		}
+		var versions []string
+		for ; len(rest) >= 4; rest = rest[4:] {
+			versions = append(versions, fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(rest)))
+		}
+		return fmt.Sprintf(" [QUIC Version Negotiation: %s]", strings.Join(versions, " "))
+	}
+
+	if (answer[0]>>4)&0x3 == quicTypeRetry {
+		return " [QUIC Retry]"
+	}
+	return fmt.Sprintf(" [QUIC version 0x%08x]", version)
+}
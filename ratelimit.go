@@ -0,0 +1,81 @@
+package traceroute
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+Probe rate limit (-max-pps)
+
+Every trace paces only itself: Paced spaces the probes of the traces sharing it, Concurrency
+and the Parallel scheduler send as fast as answers come. Many traces at once, to many targets
+or with -N, add up to a rate no single one of them would send, enough to flood a small link
+or to trip an ICMP policer upstream that then drops the answers of every trace. A RateLimiter
+shared by all Tracers caps the probes of all of them together, as a token bucket:
+
+	tokens:  Burst at first, one more every 1/Rate, never more than Burst
+	probe:   takes a token before it goes out, waits for the next one when there is none
+
+	Rate 100, Burst 10:  10 probes at once, then one every 10ms, across all traces
+
+Every probe counts, retries and the probes of multipath traces too. A probe waits for its token
+before its send time is taken, so the wait doesn't add to its RTT, or to the time it waits
+for an answer.
+*/
+
+// RateLimiter caps the probes sent by all Tracers sharing it at Rate per second, see above.
+// It must not be copied after first use.
+type RateLimiter struct {
+	Rate  float64 // probes per second
+	Burst int     // probes that may go out at once after a quiet time, less than 1 means 1
+	Clock Clock   // nil means SystemClock
+
+	mu     sync.Mutex
+	tokens float64   // may go negative, by the probes waiting for a token
+	last   time.Time // when tokens was brought up to date, zero before the first probe
+}
+
+// NewRateLimiter returns a RateLimiter for rate probes per second, in bursts of up to burst
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst}
+}
+
+// wait returns once a probe may go out, or with ctx.Err() once ctx is done; a nil
+// RateLimiter never waits
+func (l *RateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	clock := l.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	burst := float64(max(l.Burst, 1))
+
+	l.mu.Lock()
+	now := clock.Now()
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*l.Rate)
+	}
+	l.last = now
+	l.tokens-- // taken now, even when it is only there in a while
+	wait := time.Duration(-l.tokens / l.Rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-clock.After(wait):
+		return ctx.Err()
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++ // not sent after all, the next probe may have it
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,161 @@
+package traceroute
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+)
+
+/*
+Reverse lookups
+
+Answers are printed with the name of who sent them, looked up by reverse DNS (PTR records).
+Looking them up between the probes, every answered probe held up the next one until its
+lookup was done: a slow DNS server, or one that doesn't answer for the addresses of a network,
+cost seconds per hop. The lookups run in the background instead, on a few workers per trace,
+while the probing goes on:
+
+	probe answered ──> lookup queued ──> worker ──> name
+	      │                                           │
+	next probe sent right away                        v
+	                           results emitted in order, each once the name of its answer is in
+
+The results still reach hooks, renderers and Result in order and with their names: a
+resultEmitter hands them on from a goroutine of its own, which waits for the names while the
+trace probes the hops ahead. An address is looked up once per trace, however many probes it
+answers. The trace isn't over before everything probed was emitted; once ctx is done the
+lookups still out are given up, and the results are emitted without their names.
+
+OnHopComplete gets the names too, and may end the trace: with it set, every hop waits for
+its names before the next hop is probed. Multipath traces look the names of a hop up once it
+was probed.
+*/
+
+// nameWorkers is how many reverse lookups of a trace run at once at most
+const nameWorkers = 4
+
+// nameLookups looks up the names of the answers of a trace in the background, see above
+type nameLookups struct {
+	resolver Resolver
+	ctx      context.Context // cancelled with the trace, lookups still out give up
+	cancel   context.CancelFunc
+
+	mu      sync.Mutex
+	names   map[string]*pendingName // by address, looked up or queued
+	queue   []*pendingName          // not looked up yet
+	workers int                     // running, started as lookups are queued
+}
+
+// pendingName is the name of an address, being looked up
+type pendingName struct {
+	addr net.Addr
+	done chan struct{} // closed once name is set
+	name string        // "" when it has none
+}
+
+// newNameLookups returns the lookups of a trace, nil when resolver is (numeric output)
+func newNameLookups(ctx context.Context, resolver Resolver) *nameLookups {
+	if resolver == nil {
+		return nil
+	}
+	l := &nameLookups{resolver: resolver, names: make(map[string]*pendingName)}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	return l
+}
+
+// start queues the lookup of the name of addr, unless it was already, and returns it.
+// On nil nameLookups, it returns nil.
+func (l *nameLookups) start(addr net.Addr) *pendingName {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := l.names[addr.String()]; n != nil {
+		return n
+	}
+	n := &pendingName{addr: addr, done: make(chan struct{})}
+	l.names[addr.String()] = n
+	l.queue = append(l.queue, n)
+	if l.workers < nameWorkers {
+		l.workers++
+		go l.work()
+	}
+	return n
+}
+
+// work looks up the queued names until there are none left
+func (l *nameLookups) work() {
+	for {
+		l.mu.Lock()
+		if len(l.queue) == 0 {
+			l.workers--
+			l.mu.Unlock()
+			return
+		}
+		n := l.queue[0]
+		l.queue = l.queue[1:]
+		l.mu.Unlock()
+
+		n.name = hostName(l.ctx, l.resolver, n.addr)
+		close(n.done)
+	}
+}
+
+// close gives up the lookups still out
+func (l *nameLookups) close() {
+	if l != nil {
+		l.cancel()
+	}
+}
+
+// wait returns the name once it was looked up, "" if ctx is done first or n is nil
+func (n *pendingName) wait(ctx context.Context) string {
+	if n == nil {
+		return ""
+	}
+	select {
+	case <-n.done:
+		return n.name
+	case <-ctx.Done():
+		return ""
+	}
+}
+
+// resultEmitter hands the results of a trace on in order, from a goroutine of its own that
+// waits for their names, see above
+type resultEmitter struct {
+	ctx   context.Context // the trace's, names aren't waited for once it is done
+	queue chan func()     // run in order
+	done  chan struct{}   // closed once everything queued was run
+}
+
+// newResultEmitter starts emitting, size is how much may be queued at most
+func newResultEmitter(ctx context.Context, size int) *resultEmitter {
+	e := &resultEmitter{ctx: ctx, queue: make(chan func(), size), done: make(chan struct{})}
+	go func() {
+		defer close(e.done)
+		for f := range e.queue {
+			f()
+		}
+	}()
+	return e
+}
+
+// named returns results with the names of their answers, waiting for them
+func (e *resultEmitter) named(results ...HopResult) []HopResult {
+	results = slices.Clone(results)
+	for i := range results {
+		if results[i].name != nil {
+			results[i].Name = results[i].name.wait(e.ctx)
+		}
+	}
+	return results
+}
+
+// close returns once everything queued was emitted
+func (e *resultEmitter) close() {
+	close(e.queue)
+	<-e.done
+}
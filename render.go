@@ -0,0 +1,166 @@
+package traceroute
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Renderer prints the probes of a trace for Run, which hands it every probe in order as soon
+// as it is done. Multipath traces print their own way and don't use it.
+type Renderer interface {
+	Render(w io.Writer, result HopResult)
+}
+
+// HeaderRenderer is a Renderer that also prints a header before the first probe, once the
+// destination is resolved
+type HeaderRenderer interface {
+	Renderer
+	RenderHeader(w io.Writer, info TraceInfo)
+}
+
+// TraceInfo describes a trace about to send its first probe
+type TraceInfo struct {
+	Target     string      // destination of the trace, as given to Run
+	Addr       *net.IPAddr // address of the destination
+	MaxTTL     int         // max time-to-live (max number of hops)
+	PacketSize int         // size of ICMP Echo and UDP probes, IP header included
+}
+
+// TextRenderer prints probes the way the traceroute command does, a line per hop followed
+// by a line per probe:
+//
+//	Hop 1:
+//	  router.lan (192.168.1.1)         1.234ms
+//	  *
+type TextRenderer struct {
+	ShowExtensions bool            // print ICMP extensions such as MPLS label stacks
+	ShowFlowLabel  bool            // print the flow label every probe was sent with (Tracer.FlowLabelSweep)
+	Colors         *Colors         // color the output for a terminal, nil prints plain text
+	Timestamps     TimestampFormat // print when every probe was sent in front of it, "" doesn't
+	ShowReplyTTL   bool            // print the TTL every answer arrived with and how many hops it took back (HopResult.ReturnHops)
+}
+
+// TimestampFormat is how the wall-clock time a probe was sent is printed, for correlating
+// the output with packet captures and incident timelines
+type TimestampFormat string
+
+const (
+	TimestampNone        TimestampFormat = ""         // not at all
+	TimestampRFC3339     TimestampFormat = "rfc3339"  // RFC 3339 in UTC, with microseconds: 2026-10-16T00:31:07.123456Z
+	TimestampEpochMillis TimestampFormat = "epoch-ms" // milliseconds since the Unix epoch: 1791851467123
+)
+
+// Format formats t, "" for TimestampNone or an unknown format
+func (f TimestampFormat) Format(t time.Time) string {
+	switch f {
+	case TimestampRFC3339:
+		return t.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	case TimestampEpochMillis:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return ""
+}
+
+// Colors are the ANSI colors of a TextRenderer: RTTs below Warn are green, below Crit yellow
+// and red from there on, unanswered probes are dim. Whoever sets them decides whether the
+// output is a terminal that understands them, and whether NO_COLOR (https://no-color.org)
+// is respected.
+type Colors struct {
+	Warn time.Duration // RTTs from here on are yellow
+	Crit time.Duration // RTTs from here on are red
+}
+
+// ANSI escape sequences (Select Graphic Rendition) used by Colors
+const (
+	ansiReset  = "\x1b[0m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+// paint wraps s in the escape sequence color, and the reset after it, unless c is nil
+func (c *Colors) paint(color, s string) string {
+	if c == nil {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+// rtt returns the color of an RTT
+func (c *Colors) rtt(rtt time.Duration) string {
+	switch {
+	case rtt >= c.Crit:
+		return ansiRed
+	case rtt >= c.Warn:
+		return ansiYellow
+	}
+	return ansiGreen
+}
+
+func (r *TextRenderer) Render(out io.Writer, result HopResult) {
+	if result.Probe == 1 {
+		fmt.Fprintf(out, "Hop %d:\n", result.TTL)
+	}
+	fmt.Fprintln(out, r.probeLine(result))
+}
+
+// RenderLate prints an answer that arrived after the wait of its probe was over, see late.go:
+//
+//	Late answer to hop 3, probe 1: 10.0.0.7  late 6.112s
+func (r *TextRenderer) RenderLate(out io.Writer, result HopResult) {
+	fmt.Fprintf(out, "Late answer to hop %d, probe %d: %s  late %s\n", result.TTL, result.Probe, formatName(result.Name, result.Addr), result.RTT)
+}
+
+// probeLine returns the line of a probe, without the line break
+func (r *TextRenderer) probeLine(result HopResult) string {
+	indent := "  "
+	if r.Timestamps != TimestampNone {
+		indent += r.Timestamps.Format(result.Sent) + "  "
+	}
+	if result.Addr == nil {
+		return indent + r.Colors.paint(ansiDim, "*")
+	}
+
+	displayName := formatName(result.Name, result.Addr)
+
+	rtt := result.RTT.String()
+	if r.Colors != nil {
+		rtt = r.Colors.paint(r.Colors.rtt(result.RTT), rtt)
+	}
+
+	extensions := ""
+	if r.ShowExtensions {
+		extensions = formatExtensions(result.reply.extensions)
+	}
+
+	label := ""
+	if r.ShowFlowLabel {
+		label = fmt.Sprintf(" [flow label %d]", result.flowLabel)
+	}
+
+	replyTTL := ""
+	if r.ShowReplyTTL {
+		replyTTL = formatReplyTTL(result)
+	}
+
+	retries := ""
+	if result.Retries > 0 {
+		retries = fmt.Sprintf(" [retries %d]", result.Retries)
+	}
+
+	return fmt.Sprintf("%s%-32s %s%s%s%s%s%s%s", indent, displayName, rtt, extensions, formatRecordRoute(result.reply.route), result.reply.Note, label, retries, replyTTL)
+}
+
+// formatReplyTTL returns the TTL an answer arrived with and the hops it took back, as
+// "  ttl=59 back=6", "" when the TTL isn't known
+func formatReplyTTL(result HopResult) string {
+	TTL := result.ReplyTTL()
+	if TTL == 0 {
+		return ""
+	}
+	return fmt.Sprintf("  ttl=%d back=%d", TTL, result.ReturnHops())
+}
@@ -0,0 +1,186 @@
+package traceroute
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+/*
+Reports (--report)
+
+Like mtr --report, a Report sums up repeated traces to one destination ("cycles") hop by hop,
+for a quick snapshot of the quality of a path:
+
+	HOST: myhost                        Loss%   Snt   Last    Avg   Best   Wrst  StDev
+	  1.|-- router.lan                   0.0%    10    0.4    0.4    0.3    0.6    0.1
+	  2.|-- 10.0.0.1                    10.0%    10    9.8    9.9    9.6   10.4    0.3
+	    |  `-- 10.0.0.2
+	  3.|-- ???                        100.0%    10    0.0    0.0    0.0    0.0    0.0
+
+Loss% is the share of probes nobody answered, Snt how many probes were sent, the rest are
+RTTs in milliseconds: of the last answer, their average, the best and worst of them, and
+their standard deviation. A hop answered by more than one host (load balancing, a changed
+route) lists the others below it.
+
+With a Window, every column but Last covers only the last Window probes of each hop: a
+rolling view of a path watched for a long time (-monitor), where loss an hour ago doesn't
+hide that the hop is fine now. Without one, they cover every probe since the first.
+*/
+
+// Report sums up the probes of repeated traces per hop, see Add
+type Report struct {
+	Hops   []*ReportHop // every hop probed in any of the traces, in TTL order
+	Window int          // sum up the last Window probes of every hop only, 0 sums up all of them
+}
+
+// ReportHop sums up the probes sent with one TTL
+type ReportHop struct {
+	TTL      int
+	Hosts    []string      // who answered, by host name or address, in the order they first did
+	Sent     int           // probes sent
+	Received int           // probes answered
+	Last     time.Duration // RTT of the last answer
+	Best     time.Duration // lowest RTT
+	Worst    time.Duration // highest RTT
+
+	mean, m2 float64  // running mean and sum of squared deviations of the RTTs, see Add
+	window   []*Probe // the last Report.Window probes, oldest first, nil for the ones not answered
+}
+
+// Add adds the probes of one trace to the report, also those of a trace cut short
+func (r *Report) Add(result *Result) {
+	for _, hop := range result.Hops {
+		h := r.hop(hop.TTL)
+		for _, probe := range hop.Probes {
+			h.add(probe, r.Window)
+		}
+	}
+}
+
+// AddProbe adds one probe to the report as soon as it is done, e.g. from
+// Hooks.OnProbeReply, instead of the whole trace once it is over
+func (r *Report) AddProbe(result HopResult) {
+	r.hop(result.TTL).add(result.probe(), r.Window)
+}
+
+// hop returns the row of hop TTL, adding the rows up to it: from the first hop probed
+// (Tracer.FirstTTL) on
+func (r *Report) hop(TTL int) *ReportHop {
+	if len(r.Hops) == 0 {
+		r.Hops = append(r.Hops, &ReportHop{TTL: TTL})
+	}
+	for r.Hops[len(r.Hops)-1].TTL < TTL {
+		r.Hops = append(r.Hops, &ReportHop{TTL: r.Hops[len(r.Hops)-1].TTL + 1})
+	}
+	return r.Hops[TTL-r.Hops[0].TTL]
+}
+
+// add counts one probe, keeping the mean and variance of the RTTs with Welford's algorithm
+// so they don't lose precision over long runs. With a window, the probe that falls out of it
+// is taken out again, and the statistics are those of the probes in it.
+func (h *ReportHop) add(probe Probe, window int) {
+	if window > 0 {
+		var answered *Probe
+		if probe.Addr != nil {
+			answered = &probe
+		}
+		h.window = append(h.window, answered)
+		if len(h.window) > window {
+			h.window = append(h.window[:0], h.window[len(h.window)-window:]...)
+		}
+		last := h.Last
+		*h = ReportHop{TTL: h.TTL, Hosts: h.Hosts, window: h.window}
+		for _, p := range h.window {
+			if p == nil {
+				h.count(Probe{})
+			} else {
+				h.count(*p)
+			}
+		}
+		if probe.Addr == nil {
+			h.Last = last // of the last answer, also one that left the window
+		}
+		return
+	}
+	h.count(probe)
+}
+
+// count counts one probe, see add
+func (h *ReportHop) count(probe Probe) {
+	h.Sent++
+	if probe.Addr == nil {
+		return
+	}
+
+	host := strings.TrimSuffix(probe.Name, ".") // reverse lookups return FQDNs
+	if host == "" {
+		host = addrString(probe.Addr)
+	}
+	known := false
+	for _, h := range h.Hosts {
+		known = known || h == host
+	}
+	if !known {
+		h.Hosts = append(h.Hosts, host)
+	}
+
+	h.Received++
+	h.Last = probe.RTT
+	if h.Received == 1 || probe.RTT < h.Best {
+		h.Best = probe.RTT
+	}
+	if probe.RTT > h.Worst {
+		h.Worst = probe.RTT
+	}
+	rtt := float64(probe.RTT)
+	delta := rtt - h.mean
+	h.mean += delta / float64(h.Received)
+	h.m2 += delta * (rtt - h.mean)
+}
+
+// Loss returns the share of probes nobody answered, in percent
+func (h *ReportHop) Loss() float64 {
+	if h.Sent == 0 {
+		return 0
+	}
+	return float64(h.Sent-h.Received) / float64(h.Sent) * 100
+}
+
+// Avg returns the average RTT of the answers
+func (h *ReportHop) Avg() time.Duration {
+	return time.Duration(h.mean)
+}
+
+// StdDev returns the (sample) standard deviation of the RTTs of the answers
+func (h *ReportHop) StdDev() time.Duration {
+	if h.Received < 2 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(h.m2 / float64(h.Received-1)))
+}
+
+// Print prints the report as a table like mtr --report does, see above, with host as the
+// name of the machine the probes were sent from
+func (r *Report) Print(out io.Writer, host string) {
+	fmt.Fprintf(out, "HOST: %-32s  Loss%%   Snt   Last    Avg   Best   Wrst  StDev\n", host)
+	for _, hop := range r.Hops {
+		name := "???"
+		if len(hop.Hosts) > 0 {
+			name = hop.Hosts[0]
+		}
+		fmt.Fprintf(out, "%3d.|-- %-30s %5.1f%% %5d %6.1f %6.1f %6.1f %6.1f %6.1f\n",
+			hop.TTL, name, hop.Loss(), hop.Sent,
+			milliseconds(hop.Last), milliseconds(hop.Avg()), milliseconds(hop.Best), milliseconds(hop.Worst), milliseconds(hop.StdDev()))
+		for _, other := range hop.Hosts[min(1, len(hop.Hosts)):] {
+			fmt.Fprintf(out, "    |  `-- %s\n", other)
+		}
+	}
+}
+
+// milliseconds returns d in (fractional) milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
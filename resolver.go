@@ -0,0 +1,113 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Resolver looks up the destination of a trace and the names of the hops on the way.
+// *net.Resolver implements it, net.DefaultResolver is used when Tracer.Resolver is nil.
+// Setting one allows caching lookups, going through a specific DNS server, or answering
+// from a fixed table in tests.
+type Resolver interface {
+	// LookupIPAddr returns the addresses of host
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	// LookupAddr returns the names of addr (reverse DNS, PTR records)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// resolver returns the Resolver the Tracer looks names up with
+func (t *Tracer) resolver() Resolver {
+	if t.Resolver != nil {
+		return t.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// LookupDestination returns every address dest resolves to, in the order of the Resolver:
+// only those of the family IPv4, IPv6 or Source ask for. A trace goes to one of them; to
+// trace another, set a PinnedResolver answering dest with only that one.
+func (t *Tracer) LookupDestination(ctx context.Context, dest string) ([]net.IPAddr, error) {
+	forceV4, forceV6 := t.forcedFamilies()
+	addrs, err := resolveAllDestinations(ctx, t.resolver(), dest, forceV4, forceV6)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", ErrResolve, dest, err)
+	}
+	return addrs, nil
+}
+
+// PinnedResolver resolves Host to Addr only, it looks everything else up with Resolver (nil
+// means net.DefaultResolver). It makes a trace go to one of the addresses LookupDestination
+// returned.
+type PinnedResolver struct {
+	Resolver Resolver
+	Host     string
+	Addr     net.IPAddr
+}
+
+func (r PinnedResolver) resolver() Resolver {
+	if r.Resolver != nil {
+		return r.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (r PinnedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host == r.Host {
+		return []net.IPAddr{r.Addr}, nil
+	}
+	return r.resolver().LookupIPAddr(ctx, host)
+}
+
+func (r PinnedResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.resolver().LookupAddr(ctx, addr)
+}
+
+// forcedFamilies returns whether only IPv4 or only IPv6 destinations can be traced
+func (t *Tracer) forcedFamilies() (forceV4, forceV6 bool) {
+	if t.Source != nil && !t.IPv4 && !t.IPv6 {
+		// Only addresses of the source's family can be reached from it
+		return t.Source.To4() != nil, t.Source.To4() == nil
+	}
+	return t.IPv4, t.IPv6
+}
+
+// hopNames returns the Resolver hop names are printed with, nil to print addresses only
+func (t *Tracer) hopNames() Resolver {
+	if t.Numeric {
+		return nil
+	}
+	return t.resolver()
+}
+
+// formatName formats a responder address and its hostname ("" if it has none) for printing
+func formatName(name string, responderAddr net.Addr) string {
+	if name != "" { // Hostname found
+		return fmt.Sprintf("%s (%s)", name, responderAddr.String()) // Format: "hostname (IP address)"
+	}
+	return responderAddr.String()
+}
+
+// addrString formats a responder address for output other than the traceroute command's,
+// without the zone of IPv6 link-local addresses
+func addrString(responderAddr net.Addr) string {
+	if ipAddr, ok := responderAddr.(*net.IPAddr); ok {
+		return ipAddr.IP.String()
+	}
+	return responderAddr.String()
+}
+
+// hostName returns the hostname of a responder address, "" if resolver is nil or has none
+func hostName(ctx context.Context, resolver Resolver, responderAddr net.Addr) string {
+	if resolver == nil {
+		return ""
+	}
+
+	// Reverse DNS Lookup
+	names, _ := resolver.LookupAddr(ctx, responderAddr.String()) // Look up the hostname for the IP address, ignore errors
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
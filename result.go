@@ -0,0 +1,187 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// Result is the outcome of a whole trace, as returned by Trace
+type Result struct {
+	Target  string      // destination as given to Trace, a host name or IP address
+	Addr    *net.IPAddr // address Target resolved to, the one the probes were sent to
+	Hops    []Hop       // every hop probed, in TTL order
+	Reached bool        // the destination answered at the last hop
+	Start   time.Time   // when the first probe was about to be sent, on Tracer.Clock
+	End     time.Time   // when the trace was over, on Tracer.Clock
+}
+
+// Hop is the outcome of all probes sent with one TTL
+type Hop struct {
+	TTL    int
+	Probes []Probe
+}
+
+// Probe is the outcome of one probe
+type Probe struct {
+	Sent     time.Time     // when the probe was sent, on Tracer.Clock
+	Addr     net.Addr      // who answered, nil when nobody did
+	Name     string        // host name of Addr, unless Tracer.Numeric is set or it has none
+	RTT      time.Duration // time between sending the probe and receiving the answer
+	Type     icmp.Type     // type of the answer, nil when nobody answered or the destination answered in the probe's own protocol
+	Code     int           // ICMP code of the answer
+	Reached  bool          // the destination itself answered
+	Note     string        // extra information about the answer, e.g. " [SYN-ACK]"
+	ReplyTTL int           // TTL (hop limit) the answer arrived with, 0 when unknown
+	Retries  int           // how many times the probe was sent again for lack of an answer
+	Err      error         // why nobody answered, e.g. the wait time passed
+	LateAddr net.Addr      // who answered after the wait was over, nil when nobody did (see late.go)
+	LateRTT  time.Duration // time between sending the probe and receiving that late answer
+
+	TimestampSource TimestampSource // how RTT was measured, "" when nobody answered (see timestamps.go)
+}
+
+// Trace traces the route to dest like Run, but returns the hops instead of printing them.
+// When ctx is done, MaxTTL was reached without an answer or the trace gave up after GapLimit
+// silent hops, Trace returns what was found so far together with ctx.Err(), ErrMaxTTLExceeded
+// or ErrGapLimit.
+// Multipath is not supported, its hops are sets of load balanced paths.
+func (t *Tracer) Trace(ctx context.Context, dest string) (*Result, error) {
+	if t.Multipath {
+		return nil, errors.New("Trace doesn't support Multipath")
+	}
+
+	tr, err := t.start(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.close()
+
+	result := &Result{Target: dest, Addr: tr.dstAddr, Start: tr.clock.Now()}
+	err = tr.run(ctx, result.AddProbe)
+	result.End = tr.clock.Now()
+	for _, late := range tr.late.all() {
+		result.addLate(late)
+	}
+	return result, err
+}
+
+// AddProbe adds one probe to r as soon as it is done, e.g. from Hooks.OnProbeReply, the way
+// Trace builds its Result. The probes must come in the order a trace hands them out.
+func (r *Result) AddProbe(result HopResult) {
+	if result.Probe == 1 || len(r.Hops) == 0 {
+		r.Hops = append(r.Hops, Hop{TTL: result.TTL})
+	}
+	hop := &r.Hops[len(r.Hops)-1]
+	hop.Probes = append(hop.Probes, result.probe())
+	if result.Reached {
+		r.Reached = true
+	}
+}
+
+// lastTTL returns the TTL of the last hop probed, the length of the path found; 0 when
+// there is none. Hops before Tracer.FirstTTL aren't in Hops, but count.
+func (r *Result) lastTTL() int {
+	if len(r.Hops) == 0 {
+		return 0
+	}
+	return r.Hops[len(r.Hops)-1].TTL
+}
+
+// answered reports whether anybody answered one of the probes of h
+func (h Hop) answered() bool {
+	for _, probe := range h.Probes {
+		if probe.Addr != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// silentHops returns the number of hops at the end of r that didn't answer any probe
+func (r *Result) silentHops() int {
+	n := 0
+	for i := len(r.Hops) - 1; i >= 0 && !r.Hops[i].answered(); i-- {
+		n++
+	}
+	return n
+}
+
+// probe returns the Probe a HopResult is part of a Result as
+func (r HopResult) probe() Probe {
+	return Probe{Sent: r.Sent, Addr: r.Addr, Name: r.Name, RTT: r.RTT, Type: r.Type(), Code: r.Code(), Reached: r.Reached, Note: r.Note(), ReplyTTL: r.ReplyTTL(), TimestampSource: r.TimestampSource(), Retries: r.Retries, Err: r.Err}
+}
+
+// Type returns the ICMP type of the answer, nil when nobody answered or the destination
+// answered in the probe's own protocol
+func (r HopResult) Type() icmp.Type {
+	if r.reply == nil {
+		return nil
+	}
+	return r.reply.Type
+}
+
+// Code returns the ICMP code of the answer, 0 when nobody answered or the destination
+// answered in the probe's own protocol
+func (r HopResult) Code() int {
+	if r.reply == nil {
+		return 0
+	}
+	return r.reply.Code
+}
+
+// Note returns extra information about the answer, e.g. " [SYN-ACK]", as printed after the RTT
+func (r HopResult) Note() string {
+	if r.reply == nil {
+		return ""
+	}
+	return r.reply.Note
+}
+
+// ReplyTTL returns the TTL (hop limit) the answer arrived with, 0 when nobody answered or
+// the socket doesn't tell (datagram sockets outside Linux). See ReturnHops for what it says
+// about the way back.
+func (r HopResult) ReplyTTL() int {
+	if r.reply == nil {
+		return 0
+	}
+	return r.reply.TTL
+}
+
+// TimestampSource returns how RTT was measured, "" when nobody answered (see timestamps.go)
+func (r HopResult) TimestampSource() TimestampSource {
+	switch {
+	case r.reply == nil:
+		return ""
+	case r.Late || r.reply.TimestampSource == "":
+		return TimestampSourceUser // late answers are timed on Tracer.Clock, see late.go
+	}
+	return r.reply.TimestampSource
+}
+
+// ReturnHops returns how many hops the answer took back, counted like TTL (the responder of
+// hop 5 on a symmetric path is 5 hops back), 0 when the reply TTL isn't known. See
+// returnHops.
+func (r HopResult) ReturnHops() int {
+	return returnHops(r.ReplyTTL())
+}
+
+// returnHops infers the length of the path an answer took back from the TTL it arrived with.
+// Responders start their answers with an initial TTL of 64 (Linux, macOS, most routers' ICMP
+// in IPv6), 128 (Windows) or 255 (many routers), rarely 32; the smallest of those the reply
+// TTL fits under is taken as the initial one. A return path much longer or shorter than the
+// hop number hints at an asymmetric route, which shows up in the RTTs of the hops beyond.
+func returnHops(replyTTL int) int {
+	if replyTTL <= 0 {
+		return 0
+	}
+	for _, initial := range []int{32, 64, 128, 255} {
+		if replyTTL <= initial {
+			return initial - replyTTL + 1
+		}
+	}
+	return 0
+}
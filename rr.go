@@ -0,0 +1,113 @@
+package traceroute
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+)
+
+/*
+Record Route (-R), RFC 791 3.1
+
+The Record Route IPv4 option has room for up to 9 addresses:
+
+	NOP (1) - pads the option to a 4 byte boundary
+	Type = 7 (1) | Length (1) | Pointer (1) - offset of the next free slot, starts at 4
+	Route Data: 4 byte slots, filled in by every router the packet passes
+
+Each router writes its outgoing address into the next free slot until the option is full.
+The option is carried in two places we see:
+	- Time Exceeded: the quoted header of our probe, with the forward path up to that hop
+	- Echo Reply: the destination copies the option of the request into its reply
+	  (RFC 1122 3.2.2.6), which goes on filling it on the way back. This is the part
+	  traceroute can't show otherwise: the return path.
+
+With at most 9 slots it is only useful on short paths, and many routers ignore or drop it.
+The reply's own IP header is needed to read the option, so this needs the hdrincl socket.
+*/
+
+const (
+	ipOptEOL = 0
+	ipOptRR  = 7
+
+	recordRouteSlots = 9
+)
+
+// recordRouteOption builds a NOP padded Record Route option taking at most space bytes,
+// or nil when not even one slot fits
+func recordRouteOption(space int) []byte {
+	slots := min((space-4)/4, recordRouteSlots)
+	if slots < 1 {
+		return nil
+	}
+	option := make([]byte, 4+4*slots)
+	option[0] = ipOptNOP
+	option[1] = ipOptRR
+	option[2] = byte(3 + 4*slots)
+	option[3] = 4
+	return option
+}
+
+// parseRecordRoute returns the addresses recorded in the Record Route option among options,
+// or nil when there is none
+func parseRecordRoute(options []byte) []net.IP {
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case ipOptEOL:
+			return nil
+		case ipOptNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return nil // malformed
+		}
+		option := options[i : i+int(options[i+1])]
+		if option[0] == ipOptRR && len(option) >= 3 {
+			// The pointer counts from 1 at the option type, recorded slots are the ones before it
+			end := min(int(option[2])-1, len(option))
+			var route []net.IP
+			for slot := 3; slot+4 <= end; slot += 4 {
+				route = append(route, net.IP(append([]byte{}, option[slot:slot+4]...)))
+			}
+			return route
+		}
+		i += len(option)
+	}
+	return nil
+}
+
+// quotedRecordRoute returns the route recorded in the IP header quoted by an ICMP error
+func quotedRecordRoute(family ipFamily, datagram []byte) []net.IP {
+	headerLen := family.quotedHeaderLen(datagram)
+	if family.protocol != familyIPv4.protocol || len(datagram) < headerLen {
+		return nil
+	}
+	return parseRecordRoute(datagram[ipv4.HeaderLen:headerLen])
+}
+
+// replyRecordRoute returns the route recorded in the last packet conn read,
+// only hdrincl sockets hand us the IP header it is in
+func replyRecordRoute(conn packetConn) []net.IP {
+	switch c := conn.(type) {
+	case *hdrinclConn:
+		return parseRecordRoute(c.lastOptions)
+	case *demuxConn:
+		return c.lastRoute() // parsed by the probeDemux when it read the packet
+	}
+	return nil
+}
+
+// formatRecordRoute formats recorded addresses for printing after the RTT
+func formatRecordRoute(route []net.IP) string {
+	if len(route) == 0 {
+		return ""
+	}
+	addrs := make([]string, len(route))
+	for i, ip := range route {
+		addrs[i] = ip.String()
+	}
+	return fmt.Sprintf(" [RR: %s]", strings.Join(addrs, " "))
+}
@@ -0,0 +1,449 @@
+package traceroute
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"log/slog"
+	"math/bits"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+/*
+Stateless scanning (traceroute scan)
+
+A trace probes one destination hop by hop and keeps every probe in memory until it is
+answered, that doesn't scale to the millions of targets of mapping the topology of the
+Internet. A Scanner probes like Yarrp does (Beverly, "Yarrp'ing the Internet", IMC 2016):
+every (target, TTL) pair gets one probe, in random order, at a fixed rate, and nothing is kept
+about the probes sent. What an answer needs to be told apart is in the probe itself, in the
+IP header and the first 8 bytes after it that every ICMP error quotes (RFC 792):
+
+	IP header:      destination = the target
+	Echo Request:   Type 8 | Code 0 | Checksum = hash(target) | Identifier = instance<<8 | TTL | Sequence Number = send time
+	payload:        compensation | hash(target)
+
+	target:  the destination of the quoted IP header; of an Echo Reply, who sent it
+	TTL:     the low byte of the Identifier, its high byte tells the probes of this scan apart
+	RTT:     the time the answer was received less the send time, in 100µs ticks since the
+	         scan started (a tick at most too long); answers 6.5s late or more are off by 6.5s
+	valid:   the checksum is a hash of the target keyed for this scan, made so by the
+	         compensation word (see paris.go); answers whose target doesn't fit it are dropped
+
+The checksum doesn't change with the TTL, so the probes of a target are one flow to routers
+balancing load per flow (see paris.go). ICMPv6 checksums cover a pseudo-header the kernel
+fills in, so IPv6 probes carry the hash in their payload only, which ICMPv6 errors quote
+(RFC 4443: as much of the probe as fits); so do Echo Replies.
+
+The order is a permutation of the pairs, i -> (a*i + b) mod n with a coprime to n close to n
+divided by the golden ratio, and a random b: consecutive probes are far apart, to other
+targets at other TTLs, so no router sees a burst of them, and there is no list of n pairs to
+keep in memory. Probes go out at Rate per second, in batches of what is due (sendmmsg where
+the socket can, see batch.go). Once they are all out, answers are waited for Wait longer.
+
+Every answer is handed to the callback of Scan as it arrives: unordered, possibly several
+for a target at a TTL (the destination answers every probe that reaches it). Putting the hops
+of a target in order is up to the caller.
+*/
+
+// Scan defaults
+const (
+	scanDefaultMaxTTL = 16
+	scanDefaultRate   = 1000
+	scanDefaultWait   = 5 * time.Second
+)
+
+// scanTick is the unit of the send times probes carry
+const scanTick = 100 * time.Microsecond
+
+// Scanner probes every TTL of many targets, statelessly, see above. The zero value probes
+// TTLs 1 to 16 at 1000 probes per second.
+type Scanner struct {
+	FirstTTL int           // lowest TTL probed, 0 means 1
+	MaxTTL   int           // highest TTL probed, 0 means 16, at most 255
+	Rate     float64       // probes per second, 0 means 1000
+	Wait     time.Duration // how long answers are waited for after the last probe, 0 means 5s
+	Logger   *slog.Logger  // nil logs nothing
+}
+
+// ScanReply is an answer to a probe of a scan, as decoded from the answer alone
+type ScanReply struct {
+	Target   net.IP        // destination of the probe
+	TTL      int           // TTL the probe was sent with
+	Addr     net.IP        // who answered
+	RTT      time.Duration // to a tick, see above
+	Type     icmp.Type     // Echo Reply, Time Exceeded or Destination Unreachable
+	Code     int
+	ReplyTTL int  // TTL (hop limit) the answer arrived with, 0 when unknown
+	Reached  bool // the target answered
+}
+
+// ScanStats counts the probes of a scan and their answers
+type ScanStats struct {
+	Sent    int // probes that went out
+	Failed  int // probes that couldn't be sent, e.g. to targets without a route
+	Replies int // answers handed to the callback of Scan
+}
+
+// Scan probes targets at every TTL from FirstTTL to MaxTTL and hands every answer to found,
+// one at a time, as it arrives. It returns once Wait passed after the last probe, or with
+// ctx.Err() when ctx is done first.
+func (s *Scanner) Scan(ctx context.Context, targets []net.IP, found func(ScanReply)) (ScanStats, error) {
+	firstTTL, maxTTL := cmp.Or(s.FirstTTL, 1), cmp.Or(s.MaxTTL, scanDefaultMaxTTL)
+	if firstTTL < 1 || firstTTL > maxTTL || maxTTL > 255 {
+		return ScanStats{}, fmt.Errorf("invalid TTLs %d to %d, want 1 <= first <= max <= 255", firstTTL, maxTTL)
+	}
+	rate := cmp.Or(s.Rate, scanDefaultRate)
+	if rate < 0 {
+		return ScanStats{}, fmt.Errorf("invalid rate %g, want more than 0 probes per second", rate)
+	}
+	if len(targets) == 0 {
+		return ScanStats{}, errors.New("no targets to scan")
+	}
+	sc := &scan{
+		instance: uint16(rand.N(256)),
+		seed:     maphash.MakeSeed(),
+		start:    time.Now(),
+		sockets:  make(map[int]*scanSocket),
+		found:    found,
+		logger:   cmp.Or(s.Logger, discardLogger),
+	}
+	defer sc.close()
+	for _, target := range targets {
+		family := familyOf(target)
+		if sc.sockets[family.protocol] != nil {
+			continue
+		}
+		conn, err := listen(family, SocketRaw, ipHeader{}, socketConfig{})
+		if err != nil {
+			return ScanStats{}, fmt.Errorf("listening for ICMP packets: %w", permissionError(err))
+		}
+		sock := &scanSocket{family: family, conn: conn, done: make(chan struct{})}
+		sock.batch, _ = conn.(batchConn)
+		sc.sockets[family.protocol] = sock
+		go sc.read(sock)
+		sc.logger.Info("opened socket", "family", family.name, "socket", socketKind(conn))
+	}
+
+	ttls := uint64(maxTTL - firstTTL + 1)
+	order := newScanOrder(uint64(len(targets)) * ttls)
+	interval := time.Duration(float64(time.Second) / rate)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for i := range order.n {
+		if i%batchLen == 0 && ctx.Err() != nil {
+			return sc.finish(ctx.Err())
+		}
+		if wait := time.Until(sc.start.Add(time.Duration(i) * interval)); wait > 0 {
+			sc.flush() // what is due went out, nothing more is until then
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return sc.finish(ctx.Err())
+			}
+		}
+		k := order.at(i)
+		sc.queue(targets[k/ttls], firstTTL+int(k%ttls))
+	}
+	sc.flush()
+	sc.logger.Info("sent all probes, waiting for answers", "probes", order.n, "wait", cmp.Or(s.Wait, scanDefaultWait))
+
+	timer.Reset(cmp.Or(s.Wait, scanDefaultWait))
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return sc.finish(ctx.Err())
+	}
+	return sc.finish(nil)
+}
+
+// scan is a running Scan
+type scan struct {
+	instance uint16              // high byte of the Identifier of its probes
+	seed     maphash.Seed        // keys the hash of the targets
+	start    time.Time           // send times count from here
+	sockets  map[int]*scanSocket // by protocol of the family
+	logger   *slog.Logger
+	closed   bool
+
+	mu      sync.Mutex // held while found runs, and for replies
+	found   func(ScanReply)
+	replies int
+}
+
+// scanSocket sends the probes of a scan to the targets of one family, and reads their answers
+type scanSocket struct {
+	family ipFamily
+	conn   packetConn
+	batch  batchConn // conn, if it sends batches
+
+	pending []batchPacket // probes queued, not sent yet
+	sent    int
+	failed  int
+
+	done chan struct{} // closed once the socket is read no more
+}
+
+// queue queues the probe of target at TTL, sending the batch once it is full
+func (sc *scan) queue(target net.IP, TTL int) {
+	sock := sc.sockets[familyOf(target).protocol]
+	b, err := sc.probe(sock.family, target, TTL)
+	if err != nil {
+		sc.logger.Debug("building probe failed", "target", target, "ttl", TTL, "err", err)
+		sock.failed++
+		return
+	}
+	sock.pending = append(sock.pending, batchPacket{b: b, addr: &net.IPAddr{IP: target}, ttl: TTL})
+	if len(sock.pending) == batchLen {
+		sock.flush(sc.logger)
+	}
+}
+
+// flush sends the probes queued
+func (sc *scan) flush() {
+	for _, sock := range sc.sockets {
+		sock.flush(sc.logger)
+	}
+}
+
+func (s *scanSocket) flush(logger *slog.Logger) {
+	packets := s.pending
+	for len(packets) > 0 {
+		var n int
+		var err error
+		if s.batch != nil {
+			n, err = s.batch.writeBatch(packets)
+		} else if _, err = writeTTL(s.conn, packets[0].b, packets[0].addr, packets[0].ttl); err == nil {
+			n = 1
+		}
+		s.sent += n
+		if err != nil {
+			logger.Debug("sending probe failed", "target", packets[n].addr, "ttl", packets[n].ttl, "err", err)
+			s.failed++
+			n++ // on with the ones after it
+		}
+		packets = packets[n:]
+	}
+	s.pending = s.pending[:0]
+}
+
+// probe returns the Echo Request to target with TTL, see above
+func (sc *scan) probe(family ipFamily, target net.IP, TTL int) ([]byte, error) {
+	tag := sc.tag(target)
+	payload := make([]byte, 4) // compensation | hash(target)
+	binary.BigEndian.PutUint16(payload[2:], tag)
+	msg := icmp.Message{
+		Type: family.echoRequest,
+		Body: &icmp.Echo{
+			ID:   int(sc.instance)<<8 | TTL,
+			Seq:  int(uint16(time.Since(sc.start) / scanTick)),
+			Data: payload,
+		},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+	if family.protocol == familyIPv4.protocol {
+		// Adding the compensation word to the sum moves the checksum from what it is to tag
+		compensation := onesComplementAdd(^tag, binary.BigEndian.Uint16(b[2:4]))
+		binary.BigEndian.PutUint16(b[8:10], compensation)
+		binary.BigEndian.PutUint16(b[2:4], tag)
+	}
+	return b, nil
+}
+
+// tag returns the hash of target, see above
+func (sc *scan) tag(target net.IP) uint16 {
+	if ip4 := target.To4(); ip4 != nil {
+		target = ip4
+	}
+	tag := uint16(maphash.Bytes(sc.seed, target))
+	if tag == 0 || tag == 0xffff {
+		tag = 1 // both are 0 in one's complement, a checksum of either may go out as the other
+	}
+	return tag
+}
+
+// read hands the answers arriving on sock to found, until sock is closed
+func (sc *scan) read(sock *scanSocket) {
+	defer close(sock.done)
+	reader := newPacketReader(sock.conn)
+	for {
+		p, err := reader.readFrom()
+		if err != nil {
+			return // closed with the scan
+		}
+		received := p.received.kernel
+		if received.IsZero() {
+			received = time.Now()
+		}
+		reply, ok := sc.decode(sock.family, p.b, p.addr, received)
+		putPacketBuffer(p.buf)
+		if !ok {
+			continue
+		}
+		reply.ReplyTTL = p.ttl
+		sc.mu.Lock()
+		sc.replies++
+		sc.found(reply)
+		sc.mu.Unlock()
+	}
+}
+
+// decode returns the answer the ICMP message msg from from is, false when it isn't one to a
+// probe of this scan
+func (sc *scan) decode(family ipFamily, msg []byte, from net.Addr, received time.Time) (ScanReply, bool) {
+	ipAddr, ok := from.(*net.IPAddr)
+	if !ok || len(msg) < 8 {
+		return ScanReply{}, false
+	}
+	reply := ScanReply{Addr: ipAddr.IP, Type: family.icmpType(msg[0]), Code: int(msg[1])}
+	var echo, payload []byte // the probe's Echo header, and what there is of its payload
+	switch reply.Type {
+	case family.echoReply:
+		reply.Target, reply.Reached = ipAddr.IP, true
+		echo, payload = msg[:8], msg[8:]
+	case family.timeExceeded, family.unreachable:
+		errorBody, err := parseICMPError(family.protocol, msg)
+		if err != nil {
+			return ScanReply{}, false
+		}
+		quoted := errorBody.originalDatagram
+		offset := family.quotedHeaderLen(quoted)
+		if len(quoted) < offset+8 || family.icmpType(quoted[offset]) != family.echoRequest {
+			return ScanReply{}, false
+		}
+		reply.Target = quotedDst(family, quoted)
+		reply.Reached = reply.Addr.Equal(reply.Target)
+		echo, payload = quoted[offset:offset+8], quoted[offset+8:]
+	default:
+		return ScanReply{}, false
+	}
+
+	id, seq := binary.BigEndian.Uint16(echo[4:6]), binary.BigEndian.Uint16(echo[6:8])
+	if id>>8 != sc.instance {
+		return ScanReply{}, false // another scan's, or a ping's
+	}
+	tag := sc.tag(reply.Target)
+	switch {
+	case family.protocol == familyIPv4.protocol && reply.Type != family.echoReply:
+		ok = binary.BigEndian.Uint16(echo[2:4]) == tag
+	case len(payload) >= 4:
+		ok = binary.BigEndian.Uint16(payload[2:4]) == tag
+	default:
+		ok = false // quotes too little of the probe to tell
+	}
+	if !ok {
+		return ScanReply{}, false
+	}
+	reply.TTL = int(id & 0xff)
+
+	// The send time is the last one before received that ends in seq
+	now := int64(received.Sub(sc.start) / scanTick)
+	sent := now - int64(uint16(now)-seq)
+	reply.RTT = received.Sub(sc.start.Add(time.Duration(sent) * scanTick))
+	return reply, true
+}
+
+// quotedDst returns the destination of the IP header at the start of quoted, long enough
+// for the whole header
+func quotedDst(family ipFamily, quoted []byte) net.IP {
+	if family.protocol == familyIPv6.protocol {
+		return net.IP(append([]byte(nil), quoted[24:40]...))
+	}
+	return net.IPv4(quoted[16], quoted[17], quoted[18], quoted[19])
+}
+
+// finish closes the scan and returns its stats with err
+func (sc *scan) finish(err error) (ScanStats, error) {
+	sc.close()
+	var stats ScanStats
+	for _, sock := range sc.sockets {
+		stats.Sent += sock.sent
+		stats.Failed += sock.failed
+	}
+	sc.mu.Lock()
+	stats.Replies = sc.replies
+	sc.mu.Unlock()
+	return stats, err
+}
+
+// close closes the sockets and waits until they are read no more, so found isn't called
+// any more; only the first call does
+func (sc *scan) close() {
+	if sc.closed {
+		return
+	}
+	sc.closed = true
+	for _, sock := range sc.sockets {
+		sock.conn.Close()
+		<-sock.done
+	}
+}
+
+// scanOrder is the order the n (target, TTL) pairs of a scan are probed in, see above
+type scanOrder struct {
+	n, a, b uint64
+}
+
+func newScanOrder(n uint64) scanOrder {
+	if n < 2 {
+		return scanOrder{n: n, a: 1}
+	}
+	a := uint64(float64(n) / 1.618033988749895)
+	for gcd(a, n) != 1 {
+		a++
+	}
+	return scanOrder{n: n, a: a, b: rand.Uint64N(n)}
+}
+
+// at returns the pair probed i-th, the index of its target times the TTLs plus its TTL's
+func (o scanOrder) at(i uint64) uint64 {
+	hi, lo := bits.Mul64(o.a, i)
+	return (bits.Rem64(hi, lo, o.n) + o.b) % o.n
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+type jsonScanReply struct {
+	Target   string  `json:"target"`
+	TTL      int     `json:"ttl"`
+	Address  string  `json:"address"`
+	RTT      float64 `json:"rtt_ms"`
+	Type     string  `json:"type"`
+	Code     int     `json:"code,omitempty"`
+	ReplyTTL int     `json:"reply_ttl,omitempty"`
+	Reached  bool    `json:"reached,omitempty"`
+}
+
+// MarshalJSON encodes the ScanReply as one object, like a probe of -o jsonl:
+//
+//	{"target": "198.51.100.7", "ttl": 3, "address": "192.0.2.1", "rtt_ms": 4.2, "type": "time exceeded", "reply_ttl": 62}
+func (r ScanReply) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonScanReply{
+		Target:   r.Target.String(),
+		TTL:      r.TTL,
+		Address:  r.Addr.String(),
+		RTT:      float64(r.RTT.Microseconds()) / 1000,
+		Type:     fmt.Sprint(r.Type),
+		Code:     r.Code,
+		ReplyTTL: r.ReplyTTL,
+		Reached:  r.Reached,
+	})
+}
@@ -0,0 +1,94 @@
+package traceroute
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Scheduler decides when the probes of a hop are sent. The Tracer hands it one hop at a
+// time and reports the results in probe order, whatever order they were sent in.
+type Scheduler interface {
+	// Schedule sends the n probes of a hop by calling probe(i) for every i from 0 to n-1,
+	// and returns once all calls returned. It may skip the remaining probes once ctx is done.
+	Schedule(ctx context.Context, n int, probe func(i int))
+}
+
+// Sequential sends a probe once the previous one was answered or timed out, like the
+// traceroute command always did. It is the default.
+type Sequential struct{}
+
+func (Sequential) Schedule(ctx context.Context, n int, probe func(i int)) {
+	for i := range n {
+		if ctx.Err() != nil {
+			return
+		}
+		probe(i)
+	}
+}
+
+// Paced sends probes one after the other like Sequential, but at most one every Interval,
+// for routers rate limiting their ICMP errors and for links that shouldn't be flooded. The
+// pace is kept across hops, and across all traces sharing the Paced, so it must not be copied
+// after first use.
+type Paced struct {
+	Interval time.Duration
+	Clock    Clock // nil means SystemClock
+
+	mu   sync.Mutex
+	next time.Time // when the next probe may go out
+}
+
+func (p *Paced) Schedule(ctx context.Context, n int, probe func(i int)) {
+	clock := p.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	for i := range n {
+		p.mu.Lock()
+		now := clock.Now()
+		wait := p.next.Sub(now)
+		p.next = now.Add(max(wait, 0) + p.Interval)
+		p.mu.Unlock()
+
+		if wait > 0 {
+			select {
+			case <-clock.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		probe(i)
+	}
+}
+
+// Parallel sends all probes of a hop at once and waits for their answers together, so a
+// hop takes one wait time at most instead of one per probe. ICMP probes each get an Echo
+// Identifier of their own on a Session (see session.go), so SocketHdrincl, IP header
+// settings and flow labels don't work with it, neither do SCTP, DCCP and TCP probes. A
+// custom Prober must be safe for concurrent use.
+type Parallel struct{}
+
+func (Parallel) Schedule(ctx context.Context, n int, probe func(i int)) {
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probe(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// concurrent reports whether s sends probes at the same time
+func concurrent(s Scheduler) bool {
+	switch s.(type) {
+	case Parallel, *Parallel:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+)
+
+/*
+SCTP INIT probes (-M sctp)
+
+	SCTP common header                        - 12 bytes
+		Source Port (2) | Destination Port (2)
+		Verification Tag (4)                  - always 0 in a packet carrying INIT
+		Checksum (4)                          - CRC32c over the whole packet
+	INIT chunk                                - 20 bytes
+		Type = 1 (1) | Flags (1) | Length (2)
+		Initiate Tag (4)                      - the tag the peer must use in its answers
+		Advertised Receiver Window Credit (4)
+		Number of Outbound Streams (2) | Number of Inbound Streams (2)
+		Initial TSN (4)
+
+ICMP errors quote at least the ports and the (zero) Verification Tag, so the source port
+identifies the probe. The destination answers with INIT-ACK when something listens on the
+port, or ABORT when nothing does. Both carry our Initiate Tag as their Verification Tag,
+which we set to the Echo ID and sequence number, like an ICMP probe would carry them.
+*/
+
+const (
+	sctpDefaultPort = 80
+
+	sctpCommonHeaderLen = 12
+	sctpChunkInit       = 1
+	sctpChunkInitAck    = 2
+	sctpChunkAbort      = 6
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type sctpProtocol struct {
+	id int // goes into the upper half of the Initiate Tag
+}
+
+func (p sctpProtocol) protocolNumber() int { return 132 }
+func (p sctpProtocol) defaultPort() int    { return sctpDefaultPort }
+
+// initiateTag must never be 0 (RFC 9260 5.1), the id in the upper half takes care of that
+func (p sctpProtocol) initiateTag(seqNum int) uint32 {
+	return uint32(p.id|0x8000)<<16 | uint32(seqNum&0xffff)
+}
+
+func (p sctpProtocol) packet(src, dst net.IP, srcPort, dstPort, seqNum int) []byte {
+	b := make([]byte, sctpCommonHeaderLen+20)
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	// b[4:8] Verification Tag = 0, b[8:12] Checksum, filled below
+
+	chunk := b[sctpCommonHeaderLen:]
+	chunk[0] = sctpChunkInit
+	binary.BigEndian.PutUint16(chunk[2:4], 20)
+	binary.BigEndian.PutUint32(chunk[4:8], p.initiateTag(seqNum))
+	binary.BigEndian.PutUint32(chunk[8:12], 65535) // a_rwnd
+	binary.BigEndian.PutUint16(chunk[12:14], 1)    // outbound streams
+	binary.BigEndian.PutUint16(chunk[14:16], 1)    // inbound streams
+	binary.BigEndian.PutUint32(chunk[16:20], p.initiateTag(seqNum))
+
+	// The CRC32c goes on the wire in little endian byte order (RFC 9260 Appendix A)
+	binary.LittleEndian.PutUint32(b[8:12], crc32.Checksum(b, crc32c))
+	return b
+}
+
+func (p sctpProtocol) matchQuoted(quoted []byte, srcPort, dstPort, seqNum int) bool {
+	return int(binary.BigEndian.Uint16(quoted[0:2])) == srcPort && int(binary.BigEndian.Uint16(quoted[2:4])) == dstPort
+}
+
+func (p sctpProtocol) matchAnswer(packet []byte, srcPort, dstPort, seqNum int) (string, bool) {
+	if len(packet) < sctpCommonHeaderLen+4 {
+		return "", false
+	}
+	// The answer goes from their port to ours, tagged with our Initiate Tag
+	if int(binary.BigEndian.Uint16(packet[0:2])) != dstPort || int(binary.BigEndian.Uint16(packet[2:4])) != srcPort {
+		return "", false
+	}
+	if binary.BigEndian.Uint32(packet[4:8]) != p.initiateTag(seqNum) {
+		return "", false
+	}
+
+	switch packet[sctpCommonHeaderLen] { // type of the first chunk
+	case sctpChunkInitAck:
+		return " [INIT-ACK]", true
+	case sctpChunkAbort:
+		return " [ABORT]", true
+	}
+	return "", false
+}
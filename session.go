@@ -0,0 +1,314 @@
+package traceroute
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Sessions
+
+A raw ICMP socket sees every ICMP packet arriving at the host, so one socket per family
+is enough for any number of traces running at the same time. A Session owns that socket
+and a goroutine reading from it, and hands every packet to the trace it belongs to:
+
+	Echo Reply, Extended Echo Reply:   Identifier of the reply itself
+	Time Exceeded, ... (ICMP errors):  Identifier of the Echo Request quoted in it
+
+Every trace gets an Echo Identifier of its own from the Session (see nextTraceID), so the
+Identifier alone tells the traces apart. Every probe goes out with its own TTL, as a control
+message of the packet (see ttl.go); where the socket can't do that, setting the shared
+socket's TTL and sending a probe happen under a lock so traces can't mix them up.
+*/
+
+// errSessionClosed is returned by traces whose Session was closed under them
+var errSessionClosed = errors.New("session closed")
+
+// sessionQueueLen is how many packets a trace may have waiting before more are dropped
+const sessionQueueLen = 16
+
+// Session shares ICMP sockets between traces, see Tracer.Session. Sockets are opened on
+// first use and stay open until Close. A Session is safe for concurrent use.
+type Session struct {
+	HardwareTimestamps bool // time the probes with the NIC's clock where it can, set before first use (see timestamps.go)
+
+	mu      sync.Mutex
+	sockets map[int]*sessionSocket // by family protocol
+	closed  bool
+}
+
+// NewSession returns a Session, its sockets are opened by the first trace of their family
+func NewSession() *Session {
+	return &Session{sockets: make(map[int]*sessionSocket)}
+}
+
+// Close closes the sockets of the Session, probes of traces still running fail
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, sock := range s.sockets {
+		sock.conn.Close() // ends the reading goroutine
+	}
+	return nil
+}
+
+// open returns the socket of one trace to family
+func (s *Session) open(family ipFamily) (*sessionConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errSessionClosed
+	}
+
+	sock := s.sockets[family.protocol]
+	if sock == nil {
+		conn, err := listen(family, SocketRaw, ipHeader{}, socketConfig{hardwareTimestamps: s.HardwareTimestamps})
+		if err != nil {
+			return nil, err
+		}
+		sock = newSessionSocket(conn, family)
+		s.sockets[family.protocol] = sock
+	}
+	return sock.register()
+}
+
+// newSessionSocket starts sharing conn, a socket of family, between traces
+func newSessionSocket(conn packetConn, family ipFamily) *sessionSocket {
+	sock := &sessionSocket{
+		conn:   conn,
+		family: family,
+		traces: make(map[int]*sessionConn),
+		done:   make(chan struct{}),
+	}
+	sock.writer = newPacketWriter(conn, sock.done)
+	sock.reader = newPacketReader(conn)
+	go sock.read()
+	return sock
+}
+
+// sessionSocket is the raw ICMP socket of one family, shared by the traces of a Session
+type sessionSocket struct {
+	conn   packetConn
+	family ipFamily
+
+	writer *packetWriter // sends the probes of all traces, with their TTLs
+	reader *packetReader
+
+	mu     sync.Mutex
+	traces map[int]*sessionConn // by Echo Identifier
+
+	done chan struct{} // closed once the socket is
+}
+
+// register hands out a socket with an Echo Identifier no other trace uses
+func (sock *sessionSocket) register() (*sessionConn, error) {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	if len(sock.traces) > 0xffff {
+		return nil, errors.New("all Echo Identifiers of the session are in use")
+	}
+	id := nextTraceID() // also unique among traces outside of the session
+	for sock.traces[id] != nil {
+		id = nextTraceID()
+	}
+	c := &sessionConn{
+		packetQueue: newPacketQueue(sessionQueueLen, sock.done, errSessionClosed),
+		sock:        sock,
+		id:          id,
+	}
+	sock.traces[c.id] = c
+	return c, nil
+}
+
+// read hands every packet arriving on the socket to the trace it belongs to, until the
+// socket is closed
+func (sock *sessionSocket) read() {
+	defer close(sock.done)
+	for {
+		p, err := sock.reader.readFrom()
+		if err != nil {
+			return // closed by Session.Close
+		}
+		id, _, ok := echoKey(sock.family, p.b)
+		var c *sessionConn
+		if ok {
+			sock.mu.Lock()
+			c = sock.traces[id]
+			sock.mu.Unlock()
+		}
+		if c == nil {
+			putPacketBuffer(p.buf)
+			continue // not one of ours, or the trace is over
+		}
+		c.queue(p) // dropped if the trace doesn't keep up, it will time out on it
+	}
+}
+
+// sessionPacket is one ICMP message read from a shared socket (a sessionSocket, or the
+// socket of a trace read by a probeDemux)
+type sessionPacket struct {
+	buf   *packetBuffer // b is in it, put back once read (see buffers.go)
+	b     []byte
+	addr  net.Addr
+	ttl   int      // TTL (hop limit) it arrived with, 0 when unknown
+	route []net.IP // addresses recorded in its Record Route option, see replyRecordRoute
+
+	received receiveTimes // when it was received, zero when unknown (see timestamps.go)
+}
+
+// packetQueue is the read side of a packetConn whose packets are read from a shared socket
+// by another goroutine and queued
+type packetQueue struct {
+	packets   chan sessionPacket
+	done      <-chan struct{} // closed once the shared socket is
+	closedErr error           // returned by reads once done is closed
+
+	mu       sync.Mutex
+	deadline time.Time
+	wake     chan struct{} // the deadline changed
+	closed   chan struct{} // closed by close
+	once     sync.Once
+	last     sessionPacket // the packet read last
+}
+
+func newPacketQueue(size int, done <-chan struct{}, closedErr error) *packetQueue {
+	return &packetQueue{
+		packets:   make(chan sessionPacket, size),
+		done:      done,
+		closedErr: closedErr,
+		wake:      make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+}
+
+// queue adds p to the packets to be read, unless the queue is full
+func (q *packetQueue) queue(p sessionPacket) bool {
+	select {
+	case q.packets <- p:
+		return true
+	default:
+		putPacketBuffer(p.buf)
+		return false
+	}
+}
+
+func (q *packetQueue) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, _, err := q.readFromTTL(b)
+	return n, addr, err
+}
+
+func (q *packetQueue) readFromTTL(b []byte) (int, net.Addr, int, error) {
+	n, addr, TTL, _, err := q.readFromStamp(b)
+	return n, addr, TTL, err
+}
+
+func (q *packetQueue) readFromStamp(b []byte) (int, net.Addr, int, receiveTimes, error) {
+	// One timer for all the deadlines this read waits for, reset when woken up with another
+	timer := time.NewTimer(0)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		q.mu.Lock()
+		deadline := q.deadline
+		q.mu.Unlock()
+
+		var expired <-chan time.Time
+		if deadline.IsZero() {
+			timer.Stop()
+		} else {
+			timer.Reset(time.Until(deadline)) // no stale expiry left in timer.C since Go 1.23
+			expired = timer.C
+		}
+
+		select {
+		case p := <-q.packets:
+			n := copy(b, p.b)
+			putPacketBuffer(p.buf)
+			q.mu.Lock()
+			q.last = sessionPacket{addr: p.addr, ttl: p.ttl, route: p.route} // without the buffer
+			q.mu.Unlock()
+			return n, p.addr, p.ttl, p.received, nil
+		case <-expired:
+			return 0, nil, 0, receiveTimes{}, os.ErrDeadlineExceeded
+		case <-q.done:
+			return 0, nil, 0, receiveTimes{}, q.closedErr
+		case <-q.closed:
+			return 0, nil, 0, receiveTimes{}, net.ErrClosed
+		case <-q.wake:
+			// wait again with the new deadline
+		}
+	}
+}
+
+func (q *packetQueue) SetReadDeadline(t time.Time) error {
+	q.mu.Lock()
+	q.deadline = t
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default: // already woken up
+	}
+	return nil
+}
+
+// lastRoute returns the Record Route addresses of the packet read last
+func (q *packetQueue) lastRoute() []net.IP {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.last.route
+}
+
+// close makes reads fail from now on
+func (q *packetQueue) close() {
+	q.once.Do(func() { close(q.closed) })
+}
+
+// sessionConn is the packetConn of one trace on a sessionSocket
+type sessionConn struct {
+	*packetQueue
+	sock *sessionSocket
+	id   int // Echo Identifier of the trace
+	ttl  int
+	sent sendTimes // when the last probe went out, see packetWriter
+}
+
+func (c *sessionConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	return c.writeToTTL(b, dst, c.ttl)
+}
+
+func (c *sessionConn) writeToTTL(b []byte, dst net.Addr, TTL int) (n int, err error) {
+	n, c.sent, err = c.sock.writer.writeTo(b, dst, TTL)
+	return n, err
+}
+
+func (c *sessionConn) lastSent() sendTimes {
+	return c.sent
+}
+
+func (c *sessionConn) SetTTL(TTL int) error {
+	c.ttl = TTL // goes out with the probe, see packetWriter
+	return nil
+}
+
+func (c *sessionConn) SetFlowLabel(label int, dst net.IP) error {
+	if label != 0 {
+		return errors.New("flow labels are not supported on a session, they are a setting of the shared socket")
+	}
+	return nil
+}
+
+func (c *sessionConn) EchoID(id int) int {
+	return c.id // handed out by the session instead of nextTraceID
+}
+
+func (c *sessionConn) Close() error {
+	c.sock.mu.Lock()
+	delete(c.sock.traces, c.id)
+	c.sock.mu.Unlock()
+	c.close() // a probeDemux reading it stops
+	return nil
+}
@@ -0,0 +1,62 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+)
+
+/*
+Shuffled TTLs (-shuffle)
+
+Probing the hops one after the other ties every hop to a moment of the trace: a burst of loss
+or a route flap a few seconds in shows up at the hops probed then, the first ones more often
+than not, and looks like a property of those routers. With Tracer.Shuffle the hops are
+probed in random order instead, so such events spread over all of them:
+
+	probed:   TTL 7  3  12  1  9  ...  (a new order every trace, every cycle of -report)
+	emitted:  TTL 1  2  3   4  5  ...  (each hop as soon as it and all hops before it are done)
+
+The results are still emitted in TTL order, so renderers, hooks and Result don't notice:
+a hop is held back until all hops before it were probed. The probes of a hop keep the sequence
+numbers they would have in order, (TTL-FirstTTL)×Queries+1 and on.
+
+Where the destination is doesn't show until it answered, so hops beyond it may be probed
+before: they are skipped once the destination answered at a lower TTL, and their results are
+dropped. A destination that never answers costs the probes of every hop up to MaxTTL, a
+GapLimit only ends the trace once the silent hops before it were all probed.
+*/
+
+// runShuffled is run with the hops probed in random order, see above
+func (tr *trace) runShuffled(ctx context.Context, emit func(HopResult)) error {
+	hops := make(map[int][]HopResult) // results of the hops probed but not emitted yet, by TTL
+	reachedTTL := tr.maxTTL + 1       // lowest TTL the destination answered at
+	nextTTL := tr.firstTTL            // the hop to emit next
+	gap := 0                          // hops in a row without any answer, up to nextTTL
+	for _, i := range rand.Perm(tr.maxTTL - tr.firstTTL + 1) {
+		TTL := tr.firstTTL + i
+		if TTL > reachedTTL {
+			continue // the destination would answer it too
+		}
+		hopResults, err := tr.probeHop(ctx, TTL, nil)
+		if err != nil {
+			return err
+		}
+		if hopReached(hopResults) {
+			reachedTTL = TTL
+		}
+		tr.logger.Debug("probed hop out of order", "ttl", TTL, "next_emitted", nextTTL)
+
+		hops[TTL] = hopResults
+		for ; hops[nextTTL] != nil; nextTTL++ {
+			for _, result := range hops[nextTTL] {
+				tr.emitProbe(result, emit)
+			}
+			if over, err := tr.completeHop(nextTTL, hops[nextTTL], &gap); over {
+				return err
+			}
+			delete(hops, nextTTL)
+		}
+	}
+	return fmt.Errorf("%w (%d hops)", ErrMaxTTLExceeded, tr.maxTTL)
+}
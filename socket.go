@@ -0,0 +1,311 @@
+package traceroute
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/*
+Socket types
+
+raw:   ip4:icmp / ip6:ipv6-icmp sockets. They see every ICMP packet arriving at the host,
+       which is exactly what traceroute needs, but opening one requires root (CAP_NET_RAW).
+
+dgram: "ping sockets", SOCK_DGRAM sockets with protocol ICMP. Any user may open them on
+       macOS, and on Linux if their group is in net.ipv4.ping_group_range. The kernel only
+       hands us replies to our own Echo Requests, and it picks the Echo Identifier itself.
+
+hdrincl: raw socket where we build the whole IPv4 header ourselves (see hdrincl.go).
+
+auto:  try raw first and fall back to dgram when we lack the privileges.
+*/
+
+const (
+	SocketAuto    = "auto"
+	SocketRaw     = "raw"
+	SocketDgram   = "dgram"
+	SocketHdrincl = "hdrincl"
+)
+
+// packetConn is the socket probes are sent and their replies are read on
+type packetConn interface {
+	// ReadFrom reads one ICMP message, without IP header, and who sent it
+	ReadFrom(b []byte) (int, net.Addr, error)
+	// WriteTo sends the ICMP message b to dst
+	WriteTo(b []byte, dst net.Addr) (int, error)
+	SetReadDeadline(t time.Time) error
+	// SetTTL sets the TTL (IPv4) or hop limit (IPv6) of the following probes
+	SetTTL(TTL int) error
+	// SetFlowLabel sets the IPv6 flow label of the following probes to dst, 0 leaves it to the kernel
+	SetFlowLabel(label int, dst net.IP) error
+	// EchoID returns the Echo Identifier that ends up on the wire when we ask for id
+	EchoID(id int) int
+	Close() error
+}
+
+// ttlReader is a packetConn that also tells the TTL (hop limit) a packet arrived with,
+// see readTTL
+type ttlReader interface {
+	readFromTTL(b []byte) (int, net.Addr, int, error)
+}
+
+// readTTL reads one ICMP message from conn like its ReadFrom does, also returning the TTL
+// (hop limit) it arrived with, 0 when conn doesn't tell: datagram sockets don't
+func readTTL(conn packetConn, b []byte) (n int, from net.Addr, TTL int, err error) {
+	if c, ok := conn.(ttlReader); ok {
+		return c.readFromTTL(b)
+	}
+	n, from, err = conn.ReadFrom(b)
+	return n, from, 0, err
+}
+
+// socketConfig is what the sockets a trace sends probes on are set up with
+type socketConfig struct {
+	ipOptions []byte // IPv4 options (IP_OPTIONS), for sockets where the kernel builds the header
+	device    string // interface to send on (SO_BINDTODEVICE, see forFamily), "" lets the routing table decide
+	tos       int    // TOS byte or Traffic Class (IP_TOS, IPV6_TCLASS, see tos.go), 0 leaves it
+
+	dontFragment bool   // set the DF bit and don't fragment locally (IP_MTU_DISCOVER), Linux only
+	source       net.IP // local address to bind to, nil lets the kernel pick one per route
+	sourcePort   int    // local port of UDP probe sockets, 0 lets the kernel pick one
+
+	hardwareTimestamps bool // time the probes on raw sockets with the NIC's clock where it can (see timestamps.go)
+}
+
+// listenAddr returns the local address sockets of family listen on
+func (cfg socketConfig) listenAddr(family ipFamily) string {
+	if cfg.source != nil {
+		return cfg.source.String()
+	}
+	return family.listenAddr
+}
+
+// forFamily returns cfg for sockets of family. Where sockets can't be bound to an interface
+// (everywhere but Linux), they are bound to the interface's address of family instead, unless
+// cfg has a source address already.
+func (cfg socketConfig) forFamily(family ipFamily) (socketConfig, error) {
+	if cfg.device == "" || canBindToDevice {
+		return cfg, nil
+	}
+	if cfg.source == nil {
+		addr, err := interfaceAddr(cfg.device, family)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.source = addr
+	}
+	cfg.device = ""
+	return cfg, nil
+}
+
+// apply sets the socket c of family up according to cfg
+func (cfg socketConfig) apply(c syscall.RawConn, family ipFamily) error {
+	if len(cfg.ipOptions) > 0 {
+		if err := setIPOptions(c, cfg.ipOptions); err != nil {
+			return err
+		}
+	}
+	if cfg.tos != 0 {
+		if err := setTOS(c, family, cfg.tos); err != nil {
+			return err
+		}
+	}
+	if cfg.dontFragment {
+		if err := setDontFragment(c, family); err != nil {
+			return err
+		}
+	}
+	if cfg.device != "" {
+		return bindToDevice(c, cfg.device)
+	}
+	return nil
+}
+
+// listen opens the socket probes are sent on, socketType is one of the socket* constants.
+// hdrincl sockets put header into every packet, the IP options of cfg are for the others.
+func listen(family ipFamily, socketType string, header ipHeader, cfg socketConfig) (packetConn, error) {
+	var conn packetConn
+	var err error
+	switch socketType {
+	case SocketHdrincl:
+		conn, err = listenHdrincl(family, header, cfg.listenAddr(family))
+		cfg.ipOptions = nil // already in header, the kernel wouldn't add them anyway
+	case SocketRaw:
+		conn, err = listenRaw(family, cfg.listenAddr(family))
+	case SocketDgram:
+		conn, err = listenDatagram(family, cfg.listenAddr(family))
+	case SocketAuto:
+		conn, err = listenRaw(family, cfg.listenAddr(family))
+		if errors.Is(err, os.ErrPermission) {
+			conn, err = listenDatagram(family, cfg.listenAddr(family))
+		}
+	default:
+		return nil, fmt.Errorf("unknown socket type %q (want %s, %s, %s or %s)", socketType, SocketAuto, SocketRaw, SocketDgram, SocketHdrincl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := conn.(*rawConn); ok && cfg.hardwareTimestamps {
+		c.tx = enableHardwareTimestamps(c.IPConn)
+	}
+
+	if len(cfg.ipOptions) > 0 || cfg.device != "" || cfg.tos != 0 || cfg.dontFragment {
+		sysConn, ok := conn.(syscall.Conn)
+		if !ok {
+			conn.Close()
+			return nil, errors.New("IP options, the TOS, Don't Fragment and binding to an interface are not supported on this socket type")
+		}
+		rawConn, err := sysConn.SyscallConn()
+		if err == nil {
+			err = cfg.apply(rawConn, family)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// rawConn is a privileged raw ICMP socket
+type rawConn struct {
+	*net.IPConn
+	family ipFamily
+	p4     *ipv4.PacketConn // for socket options, only one of them is set
+	p6     *ipv6.PacketConn
+
+	ttlMessages bool // the kernel hands us the TTL of every packet read
+	timestamps  bool // and the time it received it, see timestamps.go
+	flowLabel   int
+
+	tx *txStamps // the NIC's timestamps of the packets sent, nil unless asked for (see timestamps.go)
+
+	readMessages []ipv4.Message // reused by every readBatch, see batch_linux.go
+}
+
+func listenRaw(family ipFamily, addr string) (*rawConn, error) {
+	conn, err := net.ListenPacket(family.listenNetwork, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newRawConn(conn.(*net.IPConn), family), nil
+}
+
+// newRawConn wraps a raw socket of any protocol, asking the kernel for the TTL (hop limit)
+// of every packet read, and the time it received it, where it can tell
+func newRawConn(conn *net.IPConn, family ipFamily) *rawConn {
+	c := &rawConn{IPConn: conn, family: family}
+	if family.protocol == familyIPv6.protocol {
+		c.p6 = ipv6.NewPacketConn(c.IPConn)
+		c.ttlMessages = c.p6.SetControlMessage(ipv6.FlagHopLimit, true) == nil
+	} else {
+		c.p4 = ipv4.NewPacketConn(c.IPConn)
+		c.ttlMessages = c.p4.SetControlMessage(ipv4.FlagTTL, true) == nil
+	}
+	c.timestamps = enableTimestamps(conn)
+	return c
+}
+
+func (c *rawConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, peer, _, err := c.readFromTTL(b)
+	return n, peer, err
+}
+
+func (c *rawConn) readFromTTL(b []byte) (int, net.Addr, int, error) {
+	switch {
+	case c.p6 != nil && c.ttlMessages:
+		n, cm, peer, err := c.p6.ReadFrom(b)
+		if cm == nil {
+			return n, peer, 0, err
+		}
+		return n, peer, cm.HopLimit, err
+	// ipv4.NewPacketConn enables IP_STRIPHDR on Darwin, only reads through it come
+	// back without IP header (golang.org/issue/9395)
+	case c.p4 != nil && (c.ttlMessages || runtime.GOOS == "darwin" || runtime.GOOS == "ios"):
+		n, cm, peer, err := c.p4.ReadFrom(b)
+		if cm == nil {
+			return n, peer, 0, err
+		}
+		return n, peer, cm.TTL, err
+	}
+	n, peer, err := c.IPConn.ReadFrom(b)
+	return n, peer, 0, err
+}
+
+// SetBPF attaches a filter to the socket, see filter.go
+func (c *rawConn) SetBPF(filter []bpf.RawInstruction) error {
+	if c.p6 != nil {
+		return c.p6.SetBPF(filter)
+	}
+	return c.p4.SetBPF(filter)
+}
+
+func (c *rawConn) SetTTL(TTL int) error {
+	// IPv4 calls it TTL, IPv6 calls it hop limit, same thing
+	if c.p6 != nil {
+		return c.p6.SetHopLimit(TTL)
+	}
+	return c.p4.SetTTL(TTL)
+}
+
+func (c *rawConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	return c.write(b, dst, nil)
+}
+
+// write sends b to dst with the control messages oob (see writeToTTL) and the flow label
+func (c *rawConn) write(b []byte, dst net.Addr, oob []byte) (n int, err error) {
+	if c.tx != nil {
+		c.tx.mu.Lock()
+		defer c.tx.mu.Unlock()
+		c.tx.drain()
+	}
+	if c.flowLabel != 0 {
+		oob = append(oob, flowLabelControl(c.flowLabel)...)
+	}
+	if len(oob) == 0 {
+		n, err = c.IPConn.WriteTo(b, dst)
+	} else {
+		n, _, err = c.WriteMsgIP(b, oob, dst.(*net.IPAddr))
+	}
+	if err == nil && c.tx != nil {
+		c.tx.last = c.tx.count(1)
+	}
+	return n, err
+}
+
+// lastSent returns where the NIC's timestamp of the packet WriteTo sent last turns up, the
+// time it went out is taken by the caller
+func (c *rawConn) lastSent() sendTimes {
+	if c.tx == nil {
+		return sendTimes{}
+	}
+	c.tx.mu.Lock()
+	defer c.tx.mu.Unlock()
+	return sendTimes{tx: c.tx, txID: c.tx.last}
+}
+
+func (c *rawConn) SetFlowLabel(label int, dst net.IP) error {
+	if c.p6 == nil {
+		return errFlowLabelIPv6Only
+	}
+	if label != 0 {
+		if err := leaseFlowLabel(c.IPConn, label, dst); err != nil {
+			return err
+		}
+	}
+	c.flowLabel = label
+	return nil
+}
+
+func (c *rawConn) EchoID(id int) int {
+	return id // raw sockets send exactly what we wrote
+}
@@ -0,0 +1,337 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+/*
+Linux never returns ICMP errors like Time Exceeded from a normal read on ping (or UDP)
+sockets. With IP_RECVERR (IPV6_RECVERR) set, the kernel queues them on the socket's error
+queue instead, where recvmsg(MSG_ERRQUEUE) returns:
+	- data:    the quoted original datagram, from our ICMP Echo header on for ping sockets,
+	           from the UDP payload on for UDP sockets
+	- control: a sock_extended_err with the ICMP type/code, followed by the address of the
+	           router that sent the error (the "offender")
+
+datagramConn.ReadFrom turns such an entry back into an ICMP error message, so probe() can
+parse it the same way it parses messages from a raw socket. Only the quoted inner IP header
+(zeroed) and any RFC 4884 extensions are lost, the kernel doesn't give those to us.
+*/
+
+const sockExtendedErrLen = 16 // sizeof(struct sock_extended_err)
+
+// datagramConn is an unprivileged ICMP socket (see socket.go)
+type datagramConn struct {
+	*net.UDPConn // what net.FilePacketConn makes of a SOCK_DGRAM socket
+	family       ipFamily
+	rawConn      syscall.RawConn
+	echoID       int // the local "port" of a ping socket is its Echo Identifier
+	flowLabel    int
+}
+
+func listenDatagram(family ipFamily, addr string) (*datagramConn, error) {
+	ip := net.ParseIP(addr)
+	domain, protocol := unix.AF_INET, unix.IPPROTO_ICMP
+	bindAddr4 := &unix.SockaddrInet4{}
+	copy(bindAddr4.Addr[:], ip.To4())
+	var bindAddr unix.Sockaddr = bindAddr4
+	if family.protocol == familyIPv6.protocol {
+		domain, protocol = unix.AF_INET6, unix.IPPROTO_ICMPV6
+		bindAddr6 := &unix.SockaddrInet6{}
+		copy(bindAddr6.Addr[:], ip.To16())
+		bindAddr = bindAddr6
+	}
+
+	fd, err := unix.Socket(domain, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := setRecvErr(fd, family); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := unix.Bind(fd, bindAddr); err != nil { // port 0: let the kernel pick our Echo Identifier
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "datagram-oriented icmp")
+	conn, err := net.FilePacketConn(f)
+	f.Close() // FilePacketConn made its own copy of the descriptor
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn := conn.(*net.UDPConn)
+	rawConn, err := udpConn.SyscallConn()
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	return &datagramConn{
+		UDPConn: udpConn,
+		family:  family,
+		rawConn: rawConn,
+		echoID:  udpConn.LocalAddr().(*net.UDPAddr).Port,
+	}, nil
+}
+
+func (c *datagramConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	ipAddr := dst.(*net.IPAddr)
+	udpAddr := &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone}
+	if c.flowLabel == 0 {
+		return c.UDPConn.WriteTo(b, udpAddr)
+	}
+	n, _, err := c.WriteMsgUDP(b, flowLabelControl(c.flowLabel), udpAddr)
+	return n, err
+}
+
+// writeToTTL sends b to dst with TTL, see ttl.go
+func (c *datagramConn) writeToTTL(b []byte, dst net.Addr, TTL int) (int, error) {
+	ipAddr := dst.(*net.IPAddr)
+	oob := ttlControl(c.family, TTL)
+	if c.flowLabel != 0 {
+		oob = append(oob, flowLabelControl(c.flowLabel)...)
+	}
+	n, _, err := c.WriteMsgUDP(b, oob, &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone})
+	return n, err
+}
+
+func (c *datagramConn) SetFlowLabel(label int, dst net.IP) error {
+	if c.family.protocol != familyIPv6.protocol {
+		return errFlowLabelIPv6Only
+	}
+	if label != 0 {
+		if err := leaseFlowLabel(c.UDPConn, label, dst); err != nil {
+			return err
+		}
+	}
+	c.flowLabel = label
+	return nil
+}
+
+func (c *datagramConn) SetTTL(TTL int) error {
+	if c.family.protocol == familyIPv6.protocol {
+		return ipv6.NewPacketConn(c.UDPConn).SetHopLimit(TTL)
+	}
+	return ipv4.NewPacketConn(c.UDPConn).SetTTL(TTL)
+}
+
+func (c *datagramConn) EchoID(id int) int {
+	return c.echoID // the kernel overwrites whatever we put there
+}
+
+func (c *datagramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, _, err := c.readFromTTL(b)
+	return n, from, err
+}
+
+// readFromTTL reads like ReadFrom, also returning the TTL (hop limit) the message arrived with
+func (c *datagramConn) readFromTTL(b []byte) (int, net.Addr, int, error) {
+	// Leave room in front of the quoted datagram for the ICMP header and the inner IP header
+	headerLen := icmpErrorHeaderLen + c.family.innerHeaderLen
+	if len(b) < headerLen {
+		return 0, nil, 0, unix.ENOBUFS
+	}
+
+	n, from, TTL, queued, err := readWithErrorQueue(c.rawConn, b[headerLen:])
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if queued == nil {
+		// A normal read, i.e. an Echo Reply, move it to the front
+		copy(b, b[headerLen:headerLen+n])
+		return n, from, TTL, nil
+	}
+
+	// Rebuild the message: ICMP header, zeroed inner IP header, then the quoted datagram
+	clear(b[:headerLen])
+	b[0], b[1] = queued.icmpType, queued.icmpCode
+	return headerLen + n, from, TTL, nil
+}
+
+// queuedError is an ICMP error the kernel put on a socket's error queue
+type queuedError struct {
+	icmpType byte
+	icmpCode byte
+}
+
+// readWithErrorQueue waits until either a normal datagram or an error queue entry can be
+// read from a socket with IP_RECVERR/IPV6_RECVERR set, and reads it into b.
+//
+// For error queue entries queued is set, b holds the quoted original datagram (starting after
+// the header of our own protocol) and from is the router that sent the error. TTL is the TTL
+// (hop limit) the datagram or the ICMP error arrived with, 0 when the kernel didn't tell.
+func readWithErrorQueue(rawConn syscall.RawConn, b []byte) (n int, from *net.IPAddr, TTL int, queued *queuedError, err error) {
+	var readErr error
+	oob := make([]byte, 512)
+	err = rawConn.Read(func(fd uintptr) bool {
+		for {
+			// Errors first: reading the error queue also clears the pending socket error,
+			// which would otherwise make the normal read below fail
+			n, from, TTL, queued, readErr = readErrorQueue(int(fd), b)
+			if readErr != unix.EAGAIN {
+				return true
+			}
+
+			var oobn int
+			var sa unix.Sockaddr
+			n, oobn, _, sa, readErr = unix.Recvmsg(int(fd), b, oob, unix.MSG_DONTWAIT)
+			switch readErr {
+			case nil:
+				from = sockaddrToIPAddr(sa)
+				if messages, err := unix.ParseSocketControlMessage(oob[:oobn]); err == nil {
+					TTL = controlMessageTTL(messages)
+				}
+				return true
+			case unix.EAGAIN:
+				return false // nothing there yet, wait until the socket becomes readable
+			}
+			// Any other error is the socket error that came with a new error queue entry,
+			// go around and read that entry
+		}
+	})
+	if err != nil {
+		return 0, nil, 0, nil, err // e.g. the read deadline passed
+	}
+	return n, from, TTL, queued, readErr
+}
+
+// readErrorQueue reads one entry of the socket error queue and the TTL (hop limit) of the ICMP
+// error, unix.EAGAIN means there is none
+func readErrorQueue(fd int, b []byte) (int, *net.IPAddr, int, *queuedError, error) {
+	oob := make([]byte, 512)
+	n, oobn, _, _, err := unix.Recvmsg(fd, b, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+	if err != nil {
+		return 0, nil, 0, nil, err
+	}
+
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, 0, nil, err
+	}
+	for _, msg := range messages {
+		isIPv4Err := msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_RECVERR
+		isIPv6Err := msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_RECVERR
+		if (!isIPv4Err && !isIPv6Err) || len(msg.Data) < sockExtendedErrLen {
+			continue
+		}
+
+		/*
+			struct sock_extended_err {
+				__u32 ee_errno;
+				__u8  ee_origin;	- byte 4: SO_EE_ORIGIN_ICMP or SO_EE_ORIGIN_ICMP6 for errors sent by routers
+				__u8  ee_type;		- byte 5: ICMP type
+				__u8  ee_code;		- byte 6: ICMP code
+				__u8  ee_pad;
+				__u32 ee_info;
+				__u32 ee_data;
+			};
+			followed by the offender's sockaddr_in/sockaddr_in6
+		*/
+		origin := msg.Data[4]
+		if origin != unix.SO_EE_ORIGIN_ICMP && origin != unix.SO_EE_ORIGIN_ICMP6 {
+			continue // a local error, not an ICMP message
+		}
+		queued := &queuedError{icmpType: msg.Data[5], icmpCode: msg.Data[6]}
+		return n, offenderAddr(msg.Data[sockExtendedErrLen:]), controlMessageTTL(messages), queued, nil
+	}
+	return 0, nil, 0, nil, unix.EAGAIN // nothing we understand, treat as no error queued
+}
+
+// controlMessageTTL returns the TTL (IP_TTL) or hop limit (IPV6_HOPLIMIT) among messages, 0 when
+// there is none
+func controlMessageTTL(messages []unix.SocketControlMessage) int {
+	for _, msg := range messages {
+		isTTL := msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_TTL
+		isHopLimit := msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_HOPLIMIT
+		if (isTTL || isHopLimit) && len(msg.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(msg.Data))
+		}
+	}
+	return 0
+}
+
+// setRecvErr asks the kernel to queue ICMP errors for the socket on its error queue, and to
+// tell the TTL (hop limit) of everything read from it, errors included
+func setRecvErr(fd int, family ipFamily) error {
+	if family.protocol == familyIPv6.protocol {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVHOPLIMIT, 1); err != nil {
+			return err
+		}
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTTL, 1); err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVERR, 1)
+}
+
+// offenderAddr decodes the sockaddr_in/sockaddr_in6 following a sock_extended_err
+func offenderAddr(b []byte) *net.IPAddr {
+	if len(b) < 2 {
+		return &net.IPAddr{}
+	}
+	switch binary.NativeEndian.Uint16(b[0:2]) { // sa_family
+	case unix.AF_INET:
+		if len(b) >= 8 {
+			return &net.IPAddr{IP: net.IP(append([]byte(nil), b[4:8]...))} // sin_addr
+		}
+	case unix.AF_INET6:
+		if len(b) >= 24 {
+			return &net.IPAddr{IP: net.IP(append([]byte(nil), b[8:24]...))} // sin6_addr
+		}
+	}
+	return &net.IPAddr{}
+}
+
+func sockaddrToIPAddr(sa unix.Sockaddr) *net.IPAddr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.IPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...))}
+	case *unix.SockaddrInet6:
+		return &net.IPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...))}
+	}
+	return &net.IPAddr{}
+}
+
+// canBindToDevice tells that sockets can be bound to an interface (SO_BINDTODEVICE)
+const canBindToDevice = true
+
+// bindToDevice makes c send (and receive) only through the interface called device
+func bindToDevice(c syscall.RawConn, device string) error {
+	var sockoptErr error
+	err := c.Control(func(fd uintptr) {
+		sockoptErr = unix.BindToDevice(int(fd), device)
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", sockoptErr)
+}
+
+// setDontFragment sets the Don't Fragment bit on every packet sent on c, and has the kernel
+// refuse to fragment them itself (EMSGSIZE) instead of splitting packets larger than the
+// path MTU it knows of
+func setDontFragment(c syscall.RawConn, family ipFamily) error {
+	var sockoptErr error
+	err := c.Control(func(fd uintptr) {
+		if family.protocol == familyIPv6.protocol {
+			sockoptErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+		} else {
+			sockoptErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", sockoptErr)
+}
@@ -0,0 +1,76 @@
+//go:build !linux
+
+package traceroute
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+)
+
+// datagramConn is an unprivileged ICMP socket (see socket.go).
+// On macOS the kernel delivers ICMP errors for our probes with a normal read.
+type datagramConn struct {
+	*icmp.PacketConn
+	family ipFamily
+}
+
+func listenDatagram(family ipFamily, addr string) (*datagramConn, error) {
+	network := "udp4"
+	if family.protocol == familyIPv6.protocol {
+		network = "udp6"
+	}
+	conn, err := icmp.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{PacketConn: conn, family: family}, nil
+}
+
+func (c *datagramConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	ipAddr := dst.(*net.IPAddr)
+	return c.PacketConn.WriteTo(b, &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone})
+}
+
+func (c *datagramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.PacketConn.ReadFrom(b)
+	if udpAddr, ok := from.(*net.UDPAddr); ok {
+		from = &net.IPAddr{IP: udpAddr.IP, Zone: udpAddr.Zone}
+	}
+	return n, from, err
+}
+
+func (c *datagramConn) SetTTL(TTL int) error {
+	if c.family.protocol == familyIPv6.protocol {
+		return c.IPv6PacketConn().SetHopLimit(TTL)
+	}
+	return c.IPv4PacketConn().SetTTL(TTL)
+}
+
+func (c *datagramConn) SetFlowLabel(label int, dst net.IP) error {
+	if label == 0 {
+		return nil
+	}
+	if c.family.protocol != familyIPv6.protocol {
+		return errFlowLabelIPv6Only
+	}
+	return errFlowLabelUnsupported
+}
+
+func (c *datagramConn) EchoID(id int) int {
+	return id
+}
+
+// canBindToDevice tells that sockets can't be bound to an interface here, socketConfig.forFamily
+// binds them to its address instead
+const canBindToDevice = false
+
+func bindToDevice(c syscall.RawConn, device string) error {
+	return errors.New("binding to an interface is only supported on Linux")
+}
+
+func setDontFragment(c syscall.RawConn, family ipFamily) error {
+	return errors.New("setting the Don't Fragment bit is only supported on Linux")
+}
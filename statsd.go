@@ -0,0 +1,172 @@
+package traceroute
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/*
+statsd metrics (-statsd)
+
+A StatsdExporter sends the metrics of every trace (cycle) to a statsd server over UDP, from
+where they flow on to Graphite or whatever backend it feeds. Per hop, the name built from
+Prefix, the target and the TTL:
+
+	traceroute.example_com.hop_3.rtt:9.812|ms     a timer, one per answer
+	traceroute.example_com.hop_3.sent:3|c         probes sent
+	traceroute.example_com.hop_3.lost:1|c         probes nobody answered
+	traceroute.example_com.hops:12|g              hops of the trace, a gauge
+
+Characters other than letters, digits, "_" and "-" in the target are replaced with "_", so
+the dots of a host name don't make a Graphite path. The lines go out in datagrams of at most
+1432 bytes, the size statsd recommends for local networks.
+
+The probes are collected with Add while a trace runs and sent with Flush once it is over, or
+all at once with Export.
+*/
+
+// statsdMaxDatagram is the largest datagram sent to statsd
+const statsdMaxDatagram = 1432
+
+// StatsdExporter sends the metrics of traces to statsd, see above. It is safe for concurrent
+// use, traces of different targets may share one.
+type StatsdExporter struct {
+	Addr   string // host:port of the statsd server
+	Prefix string // first part of every metric name, "" means "traceroute"
+
+	mu      sync.Mutex
+	conn    net.Conn
+	targets map[string]*statsdTarget // probes added since the last Flush
+}
+
+// statsdTarget collects the probes of a trace to one target
+type statsdTarget struct {
+	hops map[int]*statsdHop // by TTL
+}
+
+type statsdHop struct {
+	sent, lost int
+	rtts       []float64 // in milliseconds
+}
+
+// Add collects the outcome of one probe for the next Flush
+func (e *StatsdExporter) Add(result HopResult) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.targets == nil {
+		e.targets = make(map[string]*statsdTarget)
+	}
+	target := e.targets[result.Target]
+	if target == nil {
+		target = &statsdTarget{hops: make(map[int]*statsdHop)}
+		e.targets[result.Target] = target
+	}
+	hop := target.hops[result.TTL]
+	if hop == nil {
+		hop = &statsdHop{}
+		target.hops[result.TTL] = hop
+	}
+	hop.sent++
+	if result.Addr == nil {
+		hop.lost++
+		return
+	}
+	hop.rtts = append(hop.rtts, milliseconds(result.RTT))
+}
+
+// Flush sends the metrics of the probes added since the last Flush
+func (e *StatsdExporter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Addr == "" {
+		return errors.New("no statsd address")
+	}
+	if e.conn == nil {
+		conn, err := net.Dial("udp", e.Addr)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+
+	prefix := e.Prefix
+	if prefix == "" {
+		prefix = "traceroute"
+	}
+	var lines []string
+	for _, name := range slices.Sorted(maps.Keys(e.targets)) {
+		target := e.targets[name]
+		base := prefix + "." + statsdName(name)
+		TTLs := slices.Sorted(maps.Keys(target.hops))
+		for _, TTL := range TTLs {
+			hop := target.hops[TTL]
+			for _, rtt := range hop.rtts {
+				lines = append(lines, fmt.Sprintf("%s.hop_%d.rtt:%.3f|ms", base, TTL, rtt))
+			}
+			lines = append(lines,
+				fmt.Sprintf("%s.hop_%d.sent:%d|c", base, TTL, hop.sent),
+				fmt.Sprintf("%s.hop_%d.lost:%d|c", base, TTL, hop.lost))
+		}
+		if len(TTLs) > 0 {
+			lines = append(lines, fmt.Sprintf("%s.hops:%d|g", base, TTLs[len(TTLs)-1]))
+		}
+	}
+	e.targets = nil
+
+	// As many lines per datagram as fit
+	var datagram []byte
+	for _, line := range lines {
+		if len(datagram) > 0 && len(datagram)+1+len(line) > statsdMaxDatagram {
+			if _, err := e.conn.Write(datagram); err != nil {
+				return err
+			}
+			datagram = datagram[:0]
+		}
+		if len(datagram) > 0 {
+			datagram = append(datagram, '\n')
+		}
+		datagram = append(datagram, line...)
+	}
+	if len(datagram) == 0 {
+		return nil
+	}
+	_, err := e.conn.Write(datagram)
+	return err
+}
+
+// Export sends the metrics of a whole trace, together with any probes added before
+func (e *StatsdExporter) Export(result *Result) error {
+	for _, hop := range result.Hops {
+		for i, probe := range hop.Probes {
+			e.Add(HopResult{Target: result.Target, TTL: hop.TTL, Probe: i + 1, Addr: probe.Addr, RTT: probe.RTT})
+		}
+	}
+	return e.Flush()
+}
+
+// Close closes the connection to statsd
+func (e *StatsdExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		return nil
+	}
+	err := e.conn.Close()
+	e.conn = nil
+	return err
+}
+
+// statsdName makes s usable as one part of a metric name, see above
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
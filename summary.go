@@ -0,0 +1,184 @@
+package traceroute
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+Summaries (-quiet, -summary)
+
+A Summary boils a trace down to what a script or cron job wants to know about a path:
+whether the destination was reached, after how many hops, who answered last, and the RTTs
+of the destination's answers. Its String is one line:
+
+	example.com (93.184.216.34) reached in 12 hops, rtt min/avg/max = 9.812/10.204/10.911 ms
+	example.com (93.184.216.34) not reached in 64 hops, last responder 10.0.0.1 at hop 7
+
+The last responder is the host that answered the highest TTL, the end of the known path
+when the destination wasn't reached.
+
+It also counts the probes, and PrintFooter prints all of it below the hops, like ping does
+after the last reply (Tracer.ShowSummary has Run do that):
+
+	--- example.com traceroute statistics ---
+	12 hops, 36 probes sent, 33 answered, 8.3% loss, 3.412s
+	destination rtt min/avg/max/stddev = 9.812/10.204/10.911/0.412 ms
+
+A Summary is built up probe by probe with Add while a trace runs, or from a whole Result.
+*/
+
+// Summary sums up a trace, see Add and Result.Summary
+type Summary struct {
+	Target   string      // destination as given to Trace
+	Addr     *net.IPAddr // address Target resolved to
+	Reached  bool        // the destination answered
+	Hops     int         // hops probed
+	Last     net.Addr    // who answered the highest TTL, nil when nobody answered at all
+	LastName string      // host name of Last, if looked up
+	LastTTL  int         // TTL Last answered at
+
+	Sent     int           // probes sent
+	Answered int           // probes anybody answered
+	Duration time.Duration // wall time of the trace, from the first probe on
+
+	// RTTs of the destination's answers, zero when it didn't answer
+	Min, Avg, Max, StdDev time.Duration
+
+	replies  int     // answers of the destination
+	mean, m2 float64 // running mean and sum of squared deviations of their RTTs, see ReportHop.add
+
+	topTTL, topSent, topReplies int // highest TTL probed, probes sent with it and the destination's answers to them
+}
+
+// Summary returns the summary of the trace
+func (r *Result) Summary() Summary {
+	s := Summary{Target: r.Target, Addr: r.Addr, Duration: r.End.Sub(r.Start)}
+	for _, hop := range r.Hops {
+		s.Hops = max(s.Hops, hop.TTL)
+		for _, probe := range hop.Probes {
+			s.add(hop.TTL, probe)
+		}
+	}
+	return s
+}
+
+// Add counts the outcome of one more probe, in the order the trace emits them
+func (s *Summary) Add(result HopResult) {
+	if s.Target == "" {
+		s.Target = result.Target
+	}
+	s.Hops = max(s.Hops, result.TTL)
+	s.add(result.TTL, result.probe())
+}
+
+func (s *Summary) add(TTL int, probe Probe) {
+	s.Sent++
+	if TTL > s.topTTL {
+		s.topTTL, s.topSent, s.topReplies = TTL, 0, 0
+	}
+	if TTL == s.topTTL {
+		s.topSent++
+		if probe.Reached {
+			s.topReplies++
+		}
+	}
+	if probe.Addr == nil {
+		return
+	}
+	s.Answered++
+	if s.Last == nil || TTL > s.LastTTL {
+		s.Last, s.LastName, s.LastTTL = probe.Addr, probe.Name, TTL
+	}
+	if !probe.Reached {
+		return
+	}
+
+	s.Reached = true
+	s.replies++
+	if s.replies == 1 || probe.RTT < s.Min {
+		s.Min = probe.RTT
+	}
+	s.Max = max(s.Max, probe.RTT)
+	rtt := float64(probe.RTT)
+	delta := rtt - s.mean
+	s.mean += delta / float64(s.replies)
+	s.m2 += delta * (rtt - s.mean)
+	s.Avg = time.Duration(s.mean)
+	if s.replies > 1 {
+		s.StdDev = time.Duration(math.Sqrt(s.m2 / float64(s.replies-1)))
+	}
+}
+
+// Loss returns the share of probes nobody answered, in percent
+func (s Summary) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Answered) / float64(s.Sent) * 100
+}
+
+// DestinationLoss returns the share of the probes of the last hop the destination didn't
+// answer, in percent: unlike Loss, it leaves out routers that don't answer on the way. It
+// is 100 when the destination wasn't reached.
+func (s Summary) DestinationLoss() float64 {
+	if !s.Reached || s.topSent == 0 {
+		return 100
+	}
+	return float64(s.topSent-s.topReplies) / float64(s.topSent) * 100
+}
+
+// PrintFooter prints the summary as the statistics below the hops, see above
+func (s Summary) PrintFooter(out io.Writer) {
+	fmt.Fprintf(out, "--- %s traceroute statistics ---\n", s.Target)
+	fmt.Fprintf(out, "%s, %d probes sent, %d answered, %.1f%% loss, %s\n",
+		hopCount(s.Hops), s.Sent, s.Answered, s.Loss(), s.Duration.Round(time.Millisecond))
+	if !s.Reached {
+		fmt.Fprintln(out, "destination not reached")
+		return
+	}
+	fmt.Fprintf(out, "destination rtt min/avg/max/stddev = %.3f/%.3f/%.3f/%.3f ms\n",
+		milliseconds(s.Min), milliseconds(s.Avg), milliseconds(s.Max), milliseconds(s.StdDev))
+}
+
+// String returns the summary as one line, see above
+func (s Summary) String() string {
+	var b strings.Builder
+	b.WriteString(s.name())
+	if s.Reached {
+		fmt.Fprintf(&b, " reached in %s, rtt min/avg/max = %.3f/%.3f/%.3f ms",
+			hopCount(s.Hops), milliseconds(s.Min), milliseconds(s.Avg), milliseconds(s.Max))
+		return b.String()
+	}
+	fmt.Fprintf(&b, " not reached in %s", hopCount(s.Hops))
+	if s.Last == nil {
+		b.WriteString(", nobody answered")
+		return b.String()
+	}
+	last := addrString(s.Last)
+	if s.LastName != "" {
+		last = fmt.Sprintf("%s (%s)", strings.TrimSuffix(s.LastName, "."), last)
+	}
+	fmt.Fprintf(&b, ", last responder %s at hop %d", last, s.LastTTL)
+	return b.String()
+}
+
+// name returns the target with the address it resolved to, "example.com (93.184.216.34)"
+func (s Summary) name() string {
+	if s.Addr != nil && s.Addr.IP.String() != s.Target {
+		return fmt.Sprintf("%s (%s)", s.Target, s.Addr.IP)
+	}
+	return s.Target
+}
+
+// hopCount returns "1 hop" or "n hops"
+func hopCount(n int) string {
+	if n == 1 {
+		return "1 hop"
+	}
+	return fmt.Sprintf("%d hops", n)
+}
@@ -0,0 +1,271 @@
+package traceroute
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Syslog (-syslog)
+
+A SyslogLogger logs the hops of traces to syslog, for monitoring from network appliances
+and other boxes whose logs are collected anyway. Every hop is one message, in key=value form
+for log parsers:
+
+	target=example.com ttl=3 sent=3 answered=2 responders=10.0.0.1 rtt_min_ms=9.812 rtt_avg_ms=10.204 rtt_max_ms=10.596
+
+When a hop is answered by other hosts than in the previous trace to the same target, a path
+change is logged, with its own severity (a reroute is worth more attention than the hops):
+
+	target=example.com ttl=3 event=path_change old=10.0.0.1 new=10.0.0.7,10.0.0.8
+
+Hops nobody answered in either trace aren't compared, that's loss rather than a new path.
+
+Messages go to the local syslog daemon (/dev/log, or /var/run/syslog on macOS) in the
+traditional BSD format, or to a remote one over UDP or TCP in the format of RFC 5424, TCP
+framed by octet counting (RFC 6587):
+
+	local   <30>Oct 16 00:31:07 traceroute[4242]: target=example.com ttl=3 ...
+	remote  <30>1 2026-10-16T00:31:07.123456Z myhost traceroute 4242 - - target=example.com ttl=3 ...
+
+<30> is the priority, the facility times 8 plus the severity (daemon, info).
+*/
+
+// SyslogFacility is the facility messages are logged with, e.g. SyslogDaemon
+type SyslogFacility int
+
+const (
+	SyslogKern SyslogFacility = iota
+	SyslogUser
+	SyslogMail
+	SyslogDaemon
+	SyslogAuth
+	SyslogSyslog
+	SyslogLPR
+	SyslogNews
+	SyslogUUCP
+	SyslogCron
+	SyslogAuthPriv
+	SyslogFTP
+	SyslogLocal0 SyslogFacility = iota + 4 // 12 to 15 are reserved
+	SyslogLocal1
+	SyslogLocal2
+	SyslogLocal3
+	SyslogLocal4
+	SyslogLocal5
+	SyslogLocal6
+	SyslogLocal7
+)
+
+var syslogFacilityNames = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+	"", "", "", "", "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+
+// ParseSyslogFacility parses a facility name, e.g. "daemon" or "local0"
+func ParseSyslogFacility(name string) (SyslogFacility, error) {
+	if i := slices.Index(syslogFacilityNames, strings.ToLower(name)); i >= 0 && name != "" {
+		return SyslogFacility(i), nil
+	}
+	return 0, fmt.Errorf("unknown syslog facility %q", name)
+}
+
+// SyslogSeverity is the severity of a message, e.g. SyslogInfo
+type SyslogSeverity int
+
+const (
+	SyslogEmerg SyslogSeverity = iota
+	SyslogAlert
+	SyslogCrit
+	SyslogErr
+	SyslogWarning
+	SyslogNotice
+	SyslogInfo
+	SyslogDebug
+)
+
+var syslogSeverityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// ParseSyslogSeverity parses a severity name, e.g. "info" or "warning"
+func ParseSyslogSeverity(name string) (SyslogSeverity, error) {
+	if i := slices.Index(syslogSeverityNames, strings.ToLower(name)); i >= 0 {
+		return SyslogSeverity(i), nil
+	}
+	return 0, fmt.Errorf("unknown syslog severity %q", name)
+}
+
+// ParseSyslogTarget parses where messages go: "local" for the local syslog daemon, or
+// udp://host[:port] or tcp://host[:port] for a remote one, port 514 unless given. It returns
+// the Network and Addr of a SyslogLogger.
+func ParseSyslogTarget(target string) (network, addr string, err error) {
+	if target == "local" {
+		return "", "", nil
+	}
+	network, addr, ok := strings.Cut(target, "://")
+	if !ok || network != "udp" && network != "tcp" {
+		return "", "", fmt.Errorf("syslog target %q is neither local nor udp://host[:port] or tcp://host[:port]", target)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "514")
+	}
+	return network, addr, nil
+}
+
+// syslogLocalPaths are where the local syslog daemon listens
+var syslogLocalPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogLogger logs hops and path changes to syslog, see above. It remembers the path of
+// every target for the next trace to it, and is safe for concurrent use.
+type SyslogLogger struct {
+	Network        string         // "udp" or "tcp" for a remote syslog server, "" means the local syslog daemon
+	Addr           string         // host:port of the remote server
+	Facility       SyslogFacility // of all messages, e.g. SyslogDaemon (the zero value is SyslogKern)
+	Severity       SyslogSeverity // of the hops, e.g. SyslogInfo
+	ChangeSeverity SyslogSeverity // of path changes, e.g. SyslogNotice
+	Tag            string         // name of the program in the messages, "" means "traceroute"
+
+	mu       sync.Mutex
+	conn     net.Conn
+	hostname string
+	paths    map[string]map[int][]string // responders of every hop of the last trace, by target and TTL
+}
+
+// LogHop logs hop TTL of a trace, made up of results, and whether its path changed since
+// the previous trace to the same target. It fits Hooks.OnHopComplete, but returns the
+// error of logging instead of ending the trace with it.
+func (l *SyslogLogger) LogHop(TTL int, results []HopResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	target := results[0].Target
+	answered := 0
+	var responders []string
+	var minRTT, maxRTT, sumRTT time.Duration
+	for _, result := range results {
+		if result.Addr == nil {
+			continue
+		}
+		if answered == 0 || result.RTT < minRTT {
+			minRTT = result.RTT
+		}
+		maxRTT = max(maxRTT, result.RTT)
+		sumRTT += result.RTT
+		answered++
+		if addr := addrString(result.Addr); !slices.Contains(responders, addr) {
+			responders = append(responders, addr)
+		}
+	}
+
+	msg := fmt.Sprintf("target=%s ttl=%d sent=%d answered=%d", target, TTL, len(results), answered)
+	if answered > 0 {
+		msg += fmt.Sprintf(" responders=%s rtt_min_ms=%.3f rtt_avg_ms=%.3f rtt_max_ms=%.3f", strings.Join(responders, ","),
+			milliseconds(minRTT), milliseconds(sumRTT/time.Duration(answered)), milliseconds(maxRTT))
+	}
+	err := l.send(l.Severity, msg)
+
+	slices.Sort(responders)
+	l.mu.Lock()
+	if l.paths == nil {
+		l.paths = make(map[string]map[int][]string)
+	}
+	if l.paths[target] == nil {
+		l.paths[target] = make(map[int][]string)
+	}
+	previous := l.paths[target][TTL]
+	if len(responders) > 0 {
+		l.paths[target][TTL] = responders
+	}
+	l.mu.Unlock()
+	if len(previous) > 0 && len(responders) > 0 && !slices.Equal(previous, responders) {
+		msg := fmt.Sprintf("target=%s ttl=%d event=path_change old=%s new=%s", target, TTL, strings.Join(previous, ","), strings.Join(responders, ","))
+		err = errors.Join(err, l.send(l.ChangeSeverity, msg))
+	}
+	return err
+}
+
+// Log logs every hop of a trace, see LogHop
+func (l *SyslogLogger) Log(result *Result) error {
+	var errs []error
+	for _, hop := range result.Hops {
+		results := make([]HopResult, len(hop.Probes))
+		for i, probe := range hop.Probes {
+			results[i] = HopResult{Target: result.Target, TTL: hop.TTL, Probe: i + 1, Sent: probe.Sent, Addr: probe.Addr, Name: probe.Name, RTT: probe.RTT, Reached: probe.Reached, Err: probe.Err}
+		}
+		errs = append(errs, l.LogHop(hop.TTL, results))
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the connection to syslog
+func (l *SyslogLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
+}
+
+// send sends one message, connecting again once if the connection broke (a syslog daemon
+// restarted meanwhile)
+func (l *SyslogLogger) send(severity SyslogSeverity, msg string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for range 2 {
+		if l.conn == nil {
+			if l.conn, err = l.dial(); err != nil {
+				return err
+			}
+		}
+		if _, err = l.conn.Write(l.format(severity, msg)); err == nil {
+			return nil
+		}
+		l.conn.Close()
+		l.conn = nil
+	}
+	return err
+}
+
+// dial connects to the syslog daemon. l.mu must be held.
+func (l *SyslogLogger) dial() (net.Conn, error) {
+	if l.Network != "" {
+		l.hostname, _ = os.Hostname()
+		return net.Dial(l.Network, l.Addr)
+	}
+	for _, path := range syslogLocalPaths {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, path); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, errors.New("no local syslog daemon found")
+}
+
+// format returns the message as sent, see above
+func (l *SyslogLogger) format(severity SyslogSeverity, msg string) []byte {
+	tag := l.Tag
+	if tag == "" {
+		tag = "traceroute"
+	}
+	priority := int(l.Facility)*8 + int(severity)
+	if l.Network == "" {
+		return fmt.Appendf(nil, "<%d>%s %s[%d]: %s\n", priority, time.Now().Format(time.Stamp), tag, os.Getpid(), msg)
+	}
+	hostname := l.hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", priority, TimestampRFC3339.Format(time.Now()), hostname, tag, os.Getpid(), msg)
+	if strings.HasPrefix(l.Network, "tcp") {
+		return fmt.Appendf(nil, "%d %s", len(line), line)
+	}
+	return []byte(line)
+}
@@ -0,0 +1,125 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+/*
+TCP probes (-M tcp)
+
+	TCP header - 20 bytes
+		Source Port (2) | Destination Port (2)
+		Sequence Number (4)
+		Acknowledgment Number (4)
+		Data Offset (4 bits) | Reserved (4 bits) | Flags (1): CWR ECE URG ACK PSH RST SYN FIN
+		Window (2) | Checksum (2) | Urgent Pointer (2)
+
+Which flags the probes carry is selectable (-tcp-flags):
+
+	syn:     a connection attempt, the destination answers SYN-ACK (port open) or RST (closed).
+	         Stateful firewalls and IDS/IPS pay a lot of attention to these.
+	ack:     looks like part of an existing connection, which stateless filters often let
+	         through. The destination has no such connection and answers RST.
+	fin:     same idea, the destination answers RST.
+	syn+ece: a SYN with ECN Echo set, to see how the path treats ECN-flagged connection attempts.
+
+The RST a host sends back follows RFC 9293 3.10.7.1: if our segment had ACK set, the RST takes
+its Sequence Number from our Acknowledgment Number, otherwise it acknowledges our Sequence
+Number plus the SYN/FIN flag. Either way it tells us which probe it belongs to.
+
+ICMP errors quote at least the ports and the Sequence Number, both are checked.
+*/
+
+const (
+	tcpDefaultPort = 80
+	tcpHeaderLen   = 20
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpACK = 0x10
+	tcpECE = 0x40
+)
+
+// tcpFlagSets are the values -tcp-flags accepts
+var tcpFlagSets = map[string]byte{
+	"syn":     tcpSYN,
+	"ack":     tcpACK,
+	"fin":     tcpFIN,
+	"syn+ece": tcpSYN | tcpECE,
+}
+
+// parseTCPFlags turns the -tcp-flags value into header flags
+func parseTCPFlags(s string) (byte, error) {
+	flags, ok := tcpFlagSets[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown TCP flags %q (want syn, ack, fin or syn+ece)", s)
+	}
+	return flags, nil
+}
+
+type tcpProtocol struct {
+	id    int  // goes into the upper half of the Sequence Number
+	flags byte // flags of every probe
+}
+
+func (p tcpProtocol) protocolNumber() int { return 6 }
+func (p tcpProtocol) defaultPort() int    { return tcpDefaultPort }
+
+// sequenceNumber is the Sequence (and, with ACK set, Acknowledgment) Number of a probe
+func (p tcpProtocol) sequenceNumber(seqNum int) uint32 {
+	return uint32(p.id)<<16 | uint32(seqNum&0xffff)
+}
+
+func (p tcpProtocol) packet(src, dst net.IP, srcPort, dstPort, seqNum int) []byte {
+	b := make([]byte, tcpHeaderLen)
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint32(b[4:8], p.sequenceNumber(seqNum))
+	if p.flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(b[8:12], p.sequenceNumber(seqNum))
+	}
+	b[12] = (tcpHeaderLen / 4) << 4 // Data Offset
+	b[13] = p.flags
+	binary.BigEndian.PutUint16(b[14:16], 65535) // Window
+
+	binary.BigEndian.PutUint16(b[16:18], pseudoHeaderChecksum(src, dst, p.protocolNumber(), b))
+	return b
+}
+
+func (p tcpProtocol) matchQuoted(quoted []byte, srcPort, dstPort, seqNum int) bool {
+	return int(binary.BigEndian.Uint16(quoted[0:2])) == srcPort &&
+		int(binary.BigEndian.Uint16(quoted[2:4])) == dstPort &&
+		binary.BigEndian.Uint32(quoted[4:8]) == p.sequenceNumber(seqNum)
+}
+
+func (p tcpProtocol) matchAnswer(packet []byte, srcPort, dstPort, seqNum int) (string, bool) {
+	if len(packet) < tcpHeaderLen {
+		return "", false
+	}
+	if int(binary.BigEndian.Uint16(packet[0:2])) != dstPort || int(binary.BigEndian.Uint16(packet[2:4])) != srcPort {
+		return "", false
+	}
+	answerSeq := binary.BigEndian.Uint32(packet[4:8])
+	answerAck := binary.BigEndian.Uint32(packet[8:12])
+	answerFlags := packet[13]
+
+	// SYN and FIN take up one sequence number each
+	expectedAck := p.sequenceNumber(seqNum)
+	if p.flags&(tcpSYN|tcpFIN) != 0 {
+		expectedAck += 1
+	}
+
+	switch {
+	case answerFlags&(tcpSYN|tcpACK) == tcpSYN|tcpACK && answerAck == expectedAck:
+		return " [SYN-ACK]", true
+	case answerFlags&tcpRST != 0 && answerFlags&tcpACK != 0 && answerAck == expectedAck:
+		return " [RST]", true
+	case answerFlags&tcpRST != 0 && p.flags&tcpACK != 0 && answerSeq == p.sequenceNumber(seqNum):
+		return " [RST]", true // reset of an ACK probe, sequenced by our Acknowledgment Number
+	}
+	return "", false
+}
@@ -0,0 +1,173 @@
+package traceroute
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+Kernel timestamps
+
+An RTT measured from the clock of the goroutine sending the probe to that of the goroutine
+reading the answer also measures everything in between that isn't the network: marshalling
+the probe, setting its TTL, waiting for its turn on a shared socket, and on the way back the
+time until the reading goroutine ran, read the answer and handed it on to the probe. On a
+busy host, or with many probes in flight, that is tens of microseconds to milliseconds, more
+than the RTT of the first hops. The RTT of probes is measured between the system calls
+instead:
+
+	sent:      time.Now() right before the write (sendmmsg, sendto) of the probe, in the
+	           goroutine making it, see packetWriter
+	received:  the time the kernel received the answer (SO_TIMESTAMPNS), handed on with the
+	           packet as a control message
+
+Where the kernel doesn't tell (everywhere but Linux, and the datagram sockets of unprivileged
+ICMP and UDP probes), the time the answer was read is taken instead. Both are real time:
+with another Clock than SystemClock (tests), RTTs are measured on it as before, from right
+before the write until the answer was read.
+
+Hardware timestamps (-hw-timestamps)
+
+Still, the kernel takes both times in software, on the way through the network stack. For
+sub-100µs paths in a datacenter that is the bigger part of the RTT. NICs with a clock of their
+own (PTP hardware clocks) timestamp packets as they go out and come in, on the wire. With
+Tracer.HardwareTimestamps, the raw sockets ask for those (SO_TIMESTAMPING):
+
+	sent:      the NIC's timestamp of the probe, queued on the socket's error queue under the
+	           number of the packet on the socket (SOF_TIMESTAMPING_OPT_ID), see txStamps
+	received:  the NIC's timestamp of the answer, as a control message like the kernel's
+
+Both are on the NIC's clock, which needn't be anywhere near the system's, so neither is ever
+set against a time of the other clocks: an RTT is taken from the NIC only when both of its
+timestamps are there. The receive timestamps only come from NICs whose receive filter is
+on (e.g. hwstamp_ctl -i eth0 -r 1, or a PTP daemon running), it isn't switched on here: it is
+a setting of the whole NIC. Everything else falls back to the kernel's timestamps: NICs
+and drivers without hardware timestamps, other sockets, outside Linux. An RTT the NIC tells
+that is longer than the one the kernel saw around it can't be right (an answer matched to
+the wrong timestamp), it falls back too.
+
+How the RTT of a probe was measured is in its results (HopResult.TimestampSource, the
+"timestamp_source" of JSON): "user", "kernel" or "hardware".
+*/
+
+// TimestampSource tells how the RTT of a probe was measured, see above
+type TimestampSource string
+
+// Timestamp sources
+const (
+	TimestampSourceUser     TimestampSource = "user"     // the answer was timed as it was read
+	TimestampSourceKernel   TimestampSource = "kernel"   // by the time the kernel received the answer (SO_TIMESTAMPNS)
+	TimestampSourceHardware TimestampSource = "hardware" // by the NIC, sending the probe and receiving the answer (SO_TIMESTAMPING)
+)
+
+// receiveTimes is when a packet was received, zero where it isn't known
+type receiveTimes struct {
+	kernel   time.Time // by the kernel
+	hardware time.Time // by the NIC, on its own clock
+}
+
+// sendTimes is when a probe went out
+type sendTimes struct {
+	call time.Time // right before the system call sending it, zero when unknown
+	tx   *txStamps // where the NIC's timestamp of it turns up, nil when none was asked for
+	txID uint32    // its number there
+}
+
+// stampReader is a packetConn that also tells when a packet was received, see above
+type stampReader interface {
+	readFromStamp(b []byte) (n int, from net.Addr, TTL int, received receiveTimes, err error)
+}
+
+// readStamped reads one ICMP message from conn like readTTL does, also returning when it
+// was received, zero when conn doesn't tell
+func readStamped(conn packetConn, b []byte) (n int, from net.Addr, TTL int, received receiveTimes, err error) {
+	if c, ok := conn.(stampReader); ok {
+		return c.readFromStamp(b)
+	}
+	n, from, TTL, err = readTTL(conn, b)
+	return n, from, TTL, receiveTimes{}, err
+}
+
+// sendStamper is a packetConn that tells when the last packet written went out
+type sendStamper interface {
+	lastSent() sendTimes
+}
+
+// rtt returns the RTT of a probe that went out on conn at sent on clock, with an answer
+// received at received (just read), and how it was measured, see above
+func rtt(clock Clock, conn packetConn, sent time.Time, received receiveTimes) (time.Duration, TimestampSource) {
+	if _, ok := clock.(systemClock); !ok {
+		return clock.Now().Sub(sent), TimestampSourceUser
+	}
+	var times sendTimes
+	if c, ok := conn.(sendStamper); ok {
+		times = c.lastSent()
+	}
+	if !times.call.IsZero() {
+		sent = times.call
+	}
+	source := TimestampSourceKernel
+	if received.kernel.IsZero() {
+		received.kernel, source = time.Now(), TimestampSourceUser
+	}
+	d := max(received.kernel.Sub(sent), 0)
+
+	if !received.hardware.IsZero() && times.tx != nil {
+		if tx := times.tx.lookup(times.txID); !tx.IsZero() {
+			if hw := received.hardware.Sub(tx); hw > 0 && hw <= d {
+				return hw, TimestampSourceHardware
+			}
+		}
+	}
+	return d, source
+}
+
+// txStampsLen is how many of the last packets sent on a socket txStamps keeps timestamps of
+const txStampsLen = 1024
+
+// txStamps collects the NIC's timestamps of the packets sent on a raw socket, from its error
+// queue. The kernel numbers the packets sent on the socket from 0 (SOF_TIMESTAMPING_OPT_ID),
+// so the packets are counted the same way: every write holds mu and counts what went out.
+// The error queue is drained before every write too, its entries take up receive buffer.
+type txStamps struct {
+	conn syscall.RawConn
+
+	mu     sync.Mutex
+	next   uint32               // number of the next packet sent
+	last   uint32               // number of the packet WriteTo sent last
+	stamps map[uint32]time.Time // by packet number, drained from the error queue
+}
+
+func newTxStamps(conn syscall.RawConn) *txStamps {
+	return &txStamps{conn: conn, stamps: make(map[uint32]time.Time)}
+}
+
+// count counts n packets that went out and returns the number of the first one, mu must
+// be held
+func (s *txStamps) count(n int) uint32 {
+	first := s.next
+	s.next += uint32(n)
+	return first
+}
+
+// add keeps the timestamp of packet id, mu must be held
+func (s *txStamps) add(id uint32, at time.Time) {
+	if len(s.stamps) >= txStampsLen {
+		for old := range s.stamps {
+			if s.next-old > txStampsLen {
+				delete(s.stamps, old)
+			}
+		}
+	}
+	s.stamps[id] = at
+}
+
+// lookup returns the timestamp of packet id, zero when the NIC didn't tell (yet)
+func (s *txStamps) lookup(id uint32) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drain()
+	return s.stamps[id]
+}
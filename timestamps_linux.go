@@ -0,0 +1,138 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// enableTimestamps asks the kernel for the time it received every packet read from conn
+// (SO_TIMESTAMPNS), and tells whether it will, see timestamps.go
+func enableTimestamps(conn *net.IPConn) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var serr error
+	err = rawConn.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+	})
+	return err == nil && serr == nil
+}
+
+// enableHardwareTimestamps asks the NIC for the times it sends and receives the packets of
+// conn (SO_TIMESTAMPING), before anything was sent on it. It returns where the timestamps
+// of the packets sent turn up, nil when the kernel doesn't do hardware timestamps at all;
+// whether the NIC does, only its timestamps tell.
+func enableHardwareTimestamps(conn *net.IPConn) *txStamps {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	flags := unix.SOF_TIMESTAMPING_TX_HARDWARE | unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE |
+		unix.SOF_TIMESTAMPING_OPT_ID | unix.SOF_TIMESTAMPING_OPT_TSONLY // numbered, without a copy of the packet
+	var serr error
+	err = rawConn.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags)
+	})
+	if err != nil || serr != nil {
+		return nil
+	}
+	return newTxStamps(rawConn)
+}
+
+// hardwareTimestampsLen is the size of the control message with the timestamps of
+// SO_TIMESTAMPING, the software, a deprecated and the hardware one
+var hardwareTimestampsLen = unix.CmsgSpace(int(unsafe.Sizeof(unix.ScmTimestamping{})))
+
+// controlTimes returns the times a packet read with the control messages oob was received
+func controlTimes(oob []byte) receiveTimes {
+	var times receiveTimes
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return times
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != unix.SOL_SOCKET {
+			continue
+		}
+		switch {
+		case msg.Header.Type == unix.SCM_TIMESTAMPNS && len(msg.Data) >= int(unsafe.Sizeof(unix.Timespec{})):
+			ts := (*unix.Timespec)(unsafe.Pointer(&msg.Data[0]))
+			times.kernel = time.Unix(ts.Unix())
+		case msg.Header.Type == unix.SCM_TIMESTAMPING && len(msg.Data) >= int(unsafe.Sizeof(unix.ScmTimestamping{})):
+			ts := (*unix.ScmTimestamping)(unsafe.Pointer(&msg.Data[0]))
+			if hw := ts.Ts[2]; hw.Sec != 0 || hw.Nsec != 0 {
+				times.hardware = time.Unix(hw.Unix())
+			}
+		}
+	}
+	return times
+}
+
+// readFromStamp reads one packet like readFromTTL, with the times it was received
+func (c *rawConn) readFromStamp(b []byte) (int, net.Addr, int, receiveTimes, error) {
+	if !c.timestamps && c.tx == nil {
+		n, from, TTL, err := c.readFromTTL(b)
+		return n, from, TTL, receiveTimes{}, err
+	}
+	packets := []batchPacket{{b: b}}
+	if _, err := c.readBatch(packets); err != nil {
+		return 0, nil, 0, receiveTimes{}, err
+	}
+	p := packets[0]
+	// readBatch strips the IPv4 header in place, the caller expects the message at the start of b
+	n := copy(b, p.b)
+	return n, p.addr, p.ttl, p.received, nil
+}
+
+// drain moves the timestamps of the packets sent waiting on the socket's error queue to
+// stamps, mu must be held. It doesn't wait for the socket's read lock (Control, not Read):
+// the goroutine reading the socket holds it while it waits for packets.
+func (s *txStamps) drain() {
+	var b [1]byte
+	oob := make([]byte, hardwareTimestampsLen+unix.CmsgSpace(sockExtendedErrLen+unix.SizeofSockaddrInet6))
+	s.conn.Control(func(fd uintptr) {
+		for {
+			_, oobn, _, _, err := unix.Recvmsg(int(fd), b[:], oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err != nil {
+				return // unix.EAGAIN: nothing (left) there
+			}
+			if id, at, ok := txStamp(oob[:oobn]); ok {
+				s.add(id, at)
+			}
+		}
+	})
+}
+
+// txStamp returns the number and hardware timestamp of a packet sent, from the control
+// messages of an entry of the error queue
+func txStamp(oob []byte) (id uint32, at time.Time, ok bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, at, false
+	}
+	var numbered bool
+	for _, msg := range msgs {
+		isIPv4Err := msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_RECVERR
+		isIPv6Err := msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_RECVERR
+		switch {
+		case (isIPv4Err || isIPv6Err) && len(msg.Data) >= sockExtendedErrLen:
+			// struct sock_extended_err, see readErrorQueue: ee_info tells which timestamp it
+			// is, ee_data the number of the packet
+			origin, info := msg.Data[4], binary.NativeEndian.Uint32(msg.Data[8:])
+			if origin == unix.SO_EE_ORIGIN_TIMESTAMPING && info == unix.SCM_TSTAMP_SND {
+				id, numbered = binary.NativeEndian.Uint32(msg.Data[12:]), true
+			}
+		case msg.Header.Level == unix.SOL_SOCKET && msg.Header.Type == unix.SCM_TIMESTAMPING && len(msg.Data) >= int(unsafe.Sizeof(unix.ScmTimestamping{})):
+			ts := (*unix.ScmTimestamping)(unsafe.Pointer(&msg.Data[0]))
+			if hw := ts.Ts[2]; hw.Sec != 0 || hw.Nsec != 0 {
+				at = time.Unix(hw.Unix())
+			}
+		}
+	}
+	return id, at, numbered && !at.IsZero()
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package traceroute
+
+import "net"
+
+func enableTimestamps(conn *net.IPConn) bool {
+	return false
+}
+
+func enableHardwareTimestamps(conn *net.IPConn) *txStamps {
+	return nil
+}
+
+func (s *txStamps) drain() {}
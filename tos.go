@@ -0,0 +1,58 @@
+package traceroute
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+DSCP and TOS marking (-tos, -dscp)
+
+QoS policies queue, police and sometimes route traffic by the DSCP in the TOS byte (IPv4) or
+Traffic Class (IPv6) of its packets. Probes marked like the traffic in question take the path
+and see the latency that traffic does, not those of best effort:
+
+	  0   1   2   3   4   5   6   7
+	+---+---+---+---+---+---+---+---+
+	|          DSCP         |  ECN  |      Tracer.TOS = DSCP << 2 | ECN
+	+---+---+---+---+---+---+---+---+
+
+ParseDSCP knows the names of RFC 4594 and RFC 8622:
+
+	ef          46    expedited forwarding, e.g. voice
+	af11-af43   10-38 assured forwarding, class 1-4 with drop precedence 1-3 (AFxy = 8x + 2y)
+	cs0-cs7     0-56  class selectors, the IP precedence of old (CSx = 8x)
+	va          44    voice admit
+	le          1     lower effort
+	be          0     best effort (default)
+
+The kernel sets the byte through a socket option (IP_TOS, IPV6_TCLASS), with SocketHdrincl
+it goes into the header we build. Routers rewriting the DSCP at their edge don't show up in
+the trace, the ICMP errors only quote the probe's header as it arrived at the router that
+answered.
+*/
+
+// ParseDSCP parses a DSCP name (e.g. "ef" or "af41", see above) or number (0-63)
+func ParseDSCP(s string) (int, error) {
+	name := strings.ToLower(s)
+	switch {
+	case name == "ef":
+		return 46, nil
+	case name == "va":
+		return 44, nil
+	case name == "le":
+		return 1, nil
+	case name == "be" || name == "default":
+		return 0, nil
+	case len(name) == 4 && strings.HasPrefix(name, "af") && name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3':
+		return 8*int(name[2]-'0') + 2*int(name[3]-'0'), nil
+	case len(name) == 3 && strings.HasPrefix(name, "cs") && name[2] >= '0' && name[2] <= '7':
+		return 8 * int(name[2]-'0'), nil
+	}
+	dscp, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || dscp > 63 {
+		return 0, fmt.Errorf("unknown DSCP %q (want a number from 0 to 63, ef, af11 to af43, cs0 to cs7, va, le or be)", s)
+	}
+	return int(dscp), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package traceroute
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setTOS(c syscall.RawConn, family ipFamily, tos int) error {
+	return errors.New("setting the TOS is not supported on this platform")
+}
@@ -0,0 +1,26 @@
+//go:build linux || darwin
+
+package traceroute
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setTOS sets the TOS byte (IPv4) or Traffic Class (IPv6) of every packet sent on c
+func setTOS(c syscall.RawConn, family ipFamily, tos int) error {
+	var sockoptErr error
+	err := c.Control(func(fd uintptr) {
+		if family.protocol == familyIPv6.protocol {
+			sockoptErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+		} else {
+			sockoptErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", sockoptErr)
+}
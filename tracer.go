@@ -0,0 +1,923 @@
+// Package traceroute traces the route packets take to a network host, hop by hop.
+//
+// A Tracer sends probes with increasing TTL (hop limit) and reports who answered each of
+// them. The traceroute command in cmd/traceroute is a thin command line interface over it.
+package traceroute
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// traceIDBase is the identifier of the first trace of this process, random so it tells
+// nothing about the process and two instances of the traceroute command started at the same
+// time (or with process IDs 65536 apart) don't end up with the same one
+var traceIDBase = rand.IntN(0x10000)
+
+// traceCount counts the traces this process started
+var traceCount atomic.Int64
+
+// nextTraceID returns the 16-bit identifier the probes of a new trace carry (Echo
+// Identifier, source port, ...), so replies to concurrent traces of this process are told
+// apart: traceIDBase for the first trace, counting up from there for the following ones.
+func nextTraceID() int {
+	return (traceIDBase + int(traceCount.Add(1)) - 1) & 0xffff
+}
+
+// defaultPayload is the data probes carry unless Tracer.Payload says otherwise, it can be anything
+var defaultPayload = []byte("hello")
+
+// ParsePayload decodes payload data given in hex, e.g. "0xdeadbeef" (the 0x is optional)
+func ParsePayload(s string) ([]byte, error) {
+	data, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload %q: %v", s, err)
+	}
+	return data, nil
+}
+
+// PayloadFunc returns the data the probe number seq (counting from 1 over the whole trace),
+// sent with the given TTL, carries. It lets every probe carry something else, e.g. a
+// timestamp, a cookie to recognize the probe by, or padding up to a size, see PaddedPayload.
+// Paris traceroute and MDA need the same data in every probe, the checksum covers it.
+type PayloadFunc func(TTL, seq int) []byte
+
+// PaddedPayload returns a PayloadFunc filling probes up to size bytes of data, by repeating
+// the default payload
+func PaddedPayload(size int) PayloadFunc {
+	data := padPayload(defaultPayload, size)
+	return func(TTL, seq int) []byte { return data }
+}
+
+// padPayload returns size bytes of data, data repeated as often as it takes (zeros without any)
+func padPayload(data []byte, size int) []byte {
+	if len(data) == 0 {
+		return make([]byte, size)
+	}
+	return bytes.Repeat(data, size/len(data)+1)[:size]
+}
+
+// MaxPacketSize is the largest Tracer.PacketSize, IP header included
+const MaxPacketSize = 65000
+
+// probeSize returns the size of the probes t sends to dst, IP header included, as far as it
+// is known up front (PayloadFunc may change it from probe to probe)
+func probeSize(t *Tracer, dst net.IP) int {
+	header := familyOf(dst).innerHeaderLen
+	if t.Method == MethodTCP {
+		return header + 20
+	}
+	if t.PacketSize != 0 {
+		return t.PacketSize
+	}
+	payload := t.Payload
+	if payload == nil {
+		payload = defaultPayload
+	}
+	return header + 8 + len(payload) // ICMP and UDP headers are 8 bytes
+}
+
+// Tracer holds the settings of a trace. The zero value sends ICMP Echo probes, 3 per hop,
+// waits 5 seconds for each and goes up to 64 hops, like the traceroute command does without
+// any flags. Unlike the command it never gives up early (the command's -gaplimit is 5, see
+// GapLimit), and Run prints no statistics below the hops (the command's -summary, see
+// ShowSummary).
+//
+// A Tracer is safe for concurrent use: Run, Trace and Stream may be called from any number
+// of goroutines at once, as long as nobody changes its fields meanwhile. Every trace sends
+// its probes on sockets of its own (or on its own Echo Identifier of a shared Session) and
+// sets their TTL there, and its probes carry an identifier of their own (see nextTraceID),
+// so replies to one trace are never taken for replies to another. Hooks, the Resolver and a
+// custom Prober or Scheduler are called from all of these traces, they must be safe for
+// concurrent use too. Output is shared as well, Run's hops to different destinations would
+// end up interleaved in it, give every goroutine a Tracer with an Output of its own instead.
+type Tracer struct {
+	Queries  int           // number of probes per hop, 0 means 3
+	Wait     time.Duration // time to wait for a response to a probe, 0 means 5 seconds
+	MaxTTL   int           // max time-to-live (max number of hops), 0 means 64
+	FirstTTL int           // TTL of the first hop probed, 0 means 1; the hops before it aren't probed
+	WaitHere float64       // bound the wait to this multiple of an RTT seen at the same hop, 0 doesn't (see adaptive.go)
+	WaitNear float64       // bound the wait to this multiple of an RTT seen at the nearest hop below, 0 doesn't
+	GapLimit int           // give up after this many hops in a row without any answer (ErrGapLimit), 0 never does
+	Retries  int           // send a probe nobody answered again up to this many times before it counts as lost
+	Shuffle  bool          // probe the hops in random order, the results still come in TTL order (see shuffle.go)
+	Fast     bool          // find the path length by a binary search first, so no hop beyond the destination is probed (see fast.go)
+
+	IPv4 bool // use IPv4 only
+	IPv6 bool // use IPv6 only
+
+	Method       string // probe method, one of the Method* constants, "" means MethodICMP
+	Socket       string // socket type for ICMP probes, one of the Socket* constants, "" means SocketAuto
+	Interface    string // network interface to send probes on, "" lets the routing table decide; outside Linux the sockets are bound to its address instead
+	TOS          int    // TOS byte (IPv4) or Traffic Class (IPv6) of the probes, DSCP << 2 (see tos.go); 0 leaves it
+	DontFragment bool   // set the Don't Fragment bit, so packets too large for a link are lost instead of fragmented (Linux only)
+	Source       net.IP // local address to send the probes from, nil lets the kernel pick one (e.g. on multihomed hosts)
+	Payload      []byte // data carried by ICMP Echo and UDP probes, nil means "hello"
+
+	HardwareTimestamps bool // time the probes with the NIC's clock where it can, else the kernel's (Linux only, see timestamps.go)
+
+	PayloadFunc PayloadFunc // data of every single ICMP Echo and UDP probe, takes precedence over Payload; not with Paris and Multipath
+	PacketSize  int         // total size of ICMP Echo and UDP probes, IP header included, reached by repeating Payload; 0 leaves Payload as it is
+
+	Paris          bool   // keep the flow identifier constant across probes (ICMP only, see paris.go)
+	Multipath      bool   // discover all load balanced paths instead (ICMP only, see mda.go)
+	XEchoInterface string // interface to ask the destination about with MethodXEcho, "" means the destination address
+
+	IPID        int      // IP Identification of the probes, 0 lets the kernel choose (SocketHdrincl only)
+	IPOptions   []byte   // raw IP options, see ParseIPOptions (SocketHdrincl only)
+	Gateways    []net.IP // loose source route, at most MaxGateways (IPv4 only)
+	RecordRoute bool     // set the Record Route option and show what was recorded (IPv4 ICMP only)
+
+	FlowLabel      int  // IPv6 flow label of the probes, 0 leaves it to the kernel (ICMP only)
+	FlowLabelSweep bool // give probe i of every hop the flow label FlowLabel+i
+
+	DCCPServiceCode uint32 // Service Code of DCCP probes, 0 means DCCPDefaultServiceCode
+	UDPPayload      string // request carried by UDP probes: "", "dns", "ntp" or "quic"
+	UDPPorts        string // destination ports of plain UDP probes: "increment" (default, classic) or "fixed" (see methods.go)
+	TCPFlags        string // flags of TCP probes: "syn" (default), "ack", "fin" or "syn+ece"
+	Port            int    // destination port of UDP, TCP, SCTP, DCCP and QUIC probes, the first of the incrementing ports of plain UDP probes; 0 means the method's default
+	SourcePort      int    // fixed source port of UDP, TCP, SCTP, DCCP and QUIC probes, 0 means one per probe
+
+	Hooks    Hooks    // called while the trace runs
+	Resolver Resolver // looks up the destination and hop names, nil means net.DefaultResolver
+	Prober   Prober   // sends the probes instead of the one Method picks, Tracer doesn't close it
+	Session  *Session // shares its ICMP sockets with other traces instead of opening new ones (ICMP only)
+
+	Scheduler   Scheduler    // when the probes of a hop are sent, nil means Sequential
+	Concurrency int          // keep up to this many probes of any hops in flight at once, 0 or 1 sends one at a time (see concurrency.go)
+	RateLimit   *RateLimiter // caps the probes of all Tracers sharing it, nil sends as fast as the Scheduler says (see ratelimit.go)
+	Middleware  []Middleware // wrap the sending of every probe, the first one outermost
+	Clock       Clock        // times the probes, nil means SystemClock
+	Capture     *PCAPWriter  // records the probes and the answers to them on the wire (Linux only, see pcap.go)
+	Logger      *slog.Logger // diagnostics about sockets and packets, nil logs nothing (see logging.go)
+
+	Numeric        bool      // print hop addresses numerically (skip address-to-name lookup)
+	ShowExtensions bool      // print ICMP extensions such as MPLS label stacks
+	Output         io.Writer // where hops are printed, nil means os.Stdout
+	Renderer       Renderer  // how Run prints the probes, nil means a TextRenderer following ShowExtensions
+	ShowSummary    bool      // have Run print statistics of the trace below the hops (see summary.go)
+}
+
+// renderer returns the Renderer Run prints the probes with
+func (t *Tracer) renderer() Renderer {
+	if t.Renderer != nil {
+		return t.Renderer
+	}
+	return &TextRenderer{ShowExtensions: t.ShowExtensions, ShowFlowLabel: t.FlowLabelSweep}
+}
+
+// HopResult is the outcome of one probe, as sent by Stream and printed by Run
+type HopResult struct {
+	Target  string        // destination of the trace, as given to Run, Trace or Stream
+	TTL     int           // TTL (hop limit) the probe was sent with
+	Probe   int           // number of the probe within its hop, counting from 1
+	Sent    time.Time     // when the probe was sent, on Tracer.Clock
+	Addr    net.Addr      // who answered, nil when nobody did
+	Name    string        // host name of Addr, unless Tracer.Numeric is set or it has none
+	RTT     time.Duration // time between sending the probe and receiving the answer
+	Reached bool          // the destination itself answered
+	Last    bool          // this was the last probe of the hop
+	Retries int           // how many times the probe was sent again for lack of an answer (Tracer.Retries)
+	Late    bool          // the answer arrived after the wait was over, see Hooks.OnLateReply
+	Err     error         // why nobody answered, e.g. the wait time passed
+
+	reply     *Reply       // all we know about the answer, for printing
+	flowLabel int          // flow label the probe was sent with, when sweeping
+	name      *pendingName // Name, while it is looked up (see rdns.go)
+}
+
+// Run traces the route to dest, a host name or IP address, and prints every hop to
+// t.Output as it is discovered. It returns once the destination answered, or with
+// ErrMaxTTLExceeded once MaxTTL is reached without an answer (ErrGapLimit once GapLimit hops
+// in a row didn't answer). When ctx is done, the probe in flight is abandoned and Run returns ctx.Err(),
+// after everything up to that point was printed.
+func (t *Tracer) Run(ctx context.Context, dest string) error {
+	out := t.Output
+	if out == nil {
+		out = os.Stdout
+	}
+
+	tr, err := t.start(ctx, dest)
+	if err != nil {
+		return err
+	}
+	defer tr.close()
+
+	if t.Multipath {
+		return tr.runMultipath(ctx, func(hop MultipathHop) {
+			printMultipathHop(out, hop)
+		})
+	}
+	renderer := t.renderer()
+	if r, ok := renderer.(HeaderRenderer); ok {
+		packetSize := tr.family.innerHeaderLen + 8 + len(tr.payload(1, 1)) // ICMP and UDP headers are 8 bytes
+		if t.Paris {
+			packetSize += 2 // see parisPayload
+		}
+		r.RenderHeader(out, TraceInfo{
+			Target:     dest,
+			Addr:       tr.dstAddr,
+			MaxTTL:     tr.maxTTL,
+			PacketSize: packetSize,
+		})
+	}
+	if !t.ShowSummary {
+		err = tr.run(ctx, func(result HopResult) {
+			renderer.Render(out, result)
+		})
+		printLate(out, renderer, tr.late.all())
+		return err
+	}
+
+	// Keep count of what was printed, for the statistics after the last hop
+	summary := Summary{Target: dest, Addr: tr.dstAddr}
+	start := tr.clock.Now()
+	err = tr.run(ctx, func(result HopResult) {
+		renderer.Render(out, result)
+		summary.Add(result)
+	})
+	summary.Duration = tr.clock.Now().Sub(start)
+	printLate(out, renderer, tr.late.all())
+	fmt.Fprintln(out)
+	summary.PrintFooter(out)
+	return err
+}
+
+// Stream traces the route to dest like Run, but sends the result of every probe on the
+// returned channel as soon as it is known instead of printing it. Errors setting up the
+// trace (resolving dest, opening sockets) are returned right away. The channel is closed
+// when the trace is over: the destination answered, MaxTTL was reached or ctx is done.
+// Multipath is not supported, its results don't come in probe by probe.
+func (t *Tracer) Stream(ctx context.Context, dest string) (<-chan HopResult, error) {
+	if t.Multipath {
+		return nil, errors.New("Stream doesn't support Multipath")
+	}
+
+	tr, err := t.start(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(chan HopResult)
+	go func() {
+		defer close(results)
+		defer tr.close()
+		tr.run(ctx, func(result HopResult) {
+			select {
+			case results <- result:
+			case <-ctx.Done(): // nobody is listening anymore
+			}
+		})
+	}()
+	return results, nil
+}
+
+// trace is a Tracer's run to one destination, with its sockets open
+type trace struct {
+	queries        int
+	wait           time.Duration
+	maxTTL         int
+	firstTTL       int
+	gapLimit       int
+	retries        int
+	shuffle        bool
+	fast           bool
+	concurrency    int
+	retrySeqNum    atomic.Int64 // the last sequence number handed out to a retry
+	method         string
+	flowLabel      int
+	flowLabelSweep bool
+	hooks          Hooks
+	scheduler      Scheduler
+	rateLimit      *RateLimiter
+	clock          Clock
+	id             int      // tells the probes of this trace apart from those of other traces, see nextTraceID
+	dest           string   // destination as given by the caller
+	names          Resolver // looks up the names of the hops, nil for numeric output
+
+	family  ipFamily
+	dstAddr *net.IPAddr
+	header  ipHeader
+	sockets socketConfig
+	payload PayloadFunc // data of ICMP Echo and UDP probes
+
+	prober     Prober
+	send       ProbeFunc     // prober.Probe wrapped into the middleware
+	ownsProber bool          // prober was created for the trace, and is closed with it
+	conn       packetConn    // the socket of ICMP probers, for multipath and flow labels
+	session    *Session      // opened for the Parallel scheduler and Concurrency, closed with the trace
+	capture    *capture      // records the packets for Tracer.Capture, stopped with the trace
+	adaptive   *adaptiveWait // the wait of every probe, nil when it is always wait
+	late       *lateAnswers  // answers after the wait, nil when the prober doesn't tell (see late.go)
+	lookups    *nameLookups  // of the names of the answers, nil for numeric output (see rdns.go)
+	emitter    *resultEmitter
+	logger     *slog.Logger
+}
+
+// start checks t's settings, resolves dest and opens the sockets for tracing it
+func (t *Tracer) start(ctx context.Context, dest string) (_ *trace, err error) {
+	tr := &trace{
+		dest:           dest,
+		names:          t.hopNames(),
+		queries:        t.Queries,
+		wait:           t.Wait,
+		maxTTL:         t.MaxTTL,
+		firstTTL:       t.FirstTTL,
+		method:         t.Method,
+		flowLabel:      t.FlowLabel,
+		flowLabelSweep: t.FlowLabelSweep,
+		hooks:          t.Hooks,
+		scheduler:      t.Scheduler,
+		rateLimit:      t.RateLimit,
+		clock:          t.Clock,
+		id:             nextTraceID(),
+		sockets:        socketConfig{device: t.Interface},
+		payload:        t.PayloadFunc,
+		logger:         t.Logger,
+	}
+	if tr.logger == nil {
+		tr.logger = discardLogger
+	}
+	tr.lookups = newNameLookups(ctx, tr.names)
+	if tr.payload == nil {
+		data := t.Payload
+		if data == nil {
+			data = defaultPayload
+		}
+		tr.payload = func(TTL, seq int) []byte { return data }
+	}
+	if tr.queries == 0 {
+		tr.queries = 3
+	}
+	if tr.wait == 0 {
+		tr.wait = 5 * time.Second
+	}
+	if t.GapLimit < 0 {
+		return nil, errors.New("GapLimit must not be negative")
+	}
+	tr.gapLimit = t.GapLimit
+	if t.Retries < 0 {
+		return nil, errors.New("Retries must not be negative")
+	}
+	if t.Retries > 0 && t.Multipath {
+		return nil, errors.New("Multipath has a stopping rule of its own, it doesn't go together with Retries")
+	}
+	tr.retries = t.Retries
+	if t.Shuffle && t.Multipath {
+		return nil, errors.New("Multipath decides itself which hop to probe next, it doesn't go together with Shuffle")
+	}
+	tr.shuffle = t.Shuffle
+	if t.Fast && t.Multipath {
+		return nil, errors.New("Multipath decides itself which hop to probe next, it doesn't go together with Fast")
+	}
+	tr.fast = t.Fast
+	if t.WaitHere < 0 || t.WaitNear < 0 {
+		return nil, errors.New("WaitHere and WaitNear must not be negative")
+	}
+	if t.WaitHere > 0 || t.WaitNear > 0 {
+		if t.Multipath {
+			return nil, errors.New("Multipath waits the full wait time, it doesn't go together with WaitHere and WaitNear")
+		}
+		tr.adaptive = newAdaptiveWait(tr.wait, t.WaitHere, t.WaitNear)
+	}
+	if tr.maxTTL == 0 {
+		tr.maxTTL = 64 // The current recommended default TTL for IP is 64 [RFC791] [RFC1122]
+	}
+	if tr.firstTTL == 0 {
+		tr.firstTTL = 1
+	}
+	if tr.firstTTL < 1 || tr.firstTTL > tr.maxTTL {
+		return nil, fmt.Errorf("the first TTL must be between 1 and the max TTL (%d)", tr.maxTTL)
+	}
+	// Retries get sequence numbers after those of the first tries, see probe
+	tr.retrySeqNum.Store(int64((tr.maxTTL - tr.firstTTL + 1) * tr.queries))
+	if tr.clock == nil {
+		tr.clock = SystemClock
+	}
+	if tr.scheduler == nil {
+		tr.scheduler = Sequential{}
+	}
+	if t.Concurrency < 0 {
+		return nil, errors.New("Concurrency must not be negative")
+	}
+	if t.Concurrency > 1 {
+		if _, ok := tr.scheduler.(Sequential); !ok {
+			return nil, errors.New("Concurrency sends the probes itself, it doesn't go together with a Scheduler")
+		}
+		tr.concurrency = t.Concurrency
+	}
+	if t.RateLimit != nil && !(t.RateLimit.Rate > 0) {
+		return nil, errors.New("the Rate of the RateLimit must be positive")
+	}
+	if tr.method == "" {
+		tr.method = MethodICMP
+	}
+	socketType := t.Socket
+	if socketType == "" {
+		socketType = SocketAuto
+	}
+	defer func() {
+		if err != nil {
+			tr.close()
+		}
+	}()
+
+	forceV4, forceV6 := t.forcedFamilies()
+	tr.dstAddr, err = resolveDestination(ctx, t.resolver(), dest, forceV4, forceV6, tr.sockets)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", ErrResolve, dest, err)
+	}
+	tr.family = familyOf(tr.dstAddr.IP)
+	if t.Source != nil && familyOf(t.Source).protocol != tr.family.protocol {
+		return nil, fmt.Errorf("the source address %s is not an %s address like %s", t.Source, tr.family.name, tr.dstAddr.IP)
+	}
+	if t.PacketSize != 0 {
+		if err := tr.padPayload(t); err != nil {
+			return nil, err
+		}
+	}
+	if (t.Paris || t.Multipath) && t.PayloadFunc != nil {
+		// The checksum covers the data, data changing from probe to probe changes the flow
+		return nil, errors.New("Paris traceroute and MDA keep the ICMP checksum constant, they don't go together with PayloadFunc")
+	}
+	tr.logger.Info("resolved destination", "target", dest, "addr", tr.dstAddr.IP)
+	family, dstAddr, method := tr.family, tr.dstAddr, tr.method
+
+	if t.Capture != nil {
+		tr.capture, err = startCapture(t.Capture, dstAddr.IP)
+		if err != nil {
+			return nil, fmt.Errorf("capturing packets: %w", err)
+		}
+	}
+
+	if t.Prober != nil {
+		if t.Multipath || t.FlowLabel != 0 || t.FlowLabelSweep {
+			return nil, errors.New("Multipath and flow labels need the built-in ICMP prober")
+		}
+		tr.prober = t.Prober
+		tr.send = chain(tr.prober.Probe, t.Middleware)
+		return tr, nil
+	}
+
+	session := t.Session
+	if tr.concurrentProbes() {
+		switch {
+		case t.Multipath:
+			return nil, errors.New("Multipath has a schedule of its own, it doesn't work with the Parallel scheduler and Concurrency")
+		case t.SourcePort != 0:
+			return nil, errors.New("a fixed source port doesn't work with the Parallel scheduler and Concurrency, the probes in flight at once would all need it")
+		case method == MethodICMP || method == MethodXEcho:
+			if session == nil {
+				session = NewSession() // every probe gets a socket of its own on it
+				session.HardwareTimestamps = t.HardwareTimestamps
+				tr.session = session
+			}
+		case method != MethodUDP && method != MethodQUIC:
+			return nil, fmt.Errorf("%s probes share one socket, they don't work with the Parallel scheduler and Concurrency", method)
+		}
+	}
+	if session != nil {
+		switch {
+		case method != MethodICMP && method != MethodXEcho:
+			return nil, fmt.Errorf("a Session only shares ICMP sockets, %s probes need sockets of their own", method)
+		case socketType != SocketAuto && socketType != SocketRaw:
+			return nil, errors.New("a Session shares raw sockets only")
+		case t.IPID != 0 || t.IPOptions != nil || len(t.Gateways) > 0 || t.RecordRoute || t.Interface != "" || t.FlowLabel != 0 || t.FlowLabelSweep || t.TOS != 0 || t.DontFragment || t.Source != nil:
+			return nil, errors.New("IP header settings, the TOS, Don't Fragment, source addresses, interfaces and flow labels are settings of the whole socket, they don't work with a Session, the Parallel scheduler and Concurrency")
+		case t.HardwareTimestamps && !session.HardwareTimestamps:
+			return nil, errors.New("hardware timestamps are a setting of the Session's sockets, see Session.HardwareTimestamps")
+		}
+	}
+
+	if t.TOS < 0 || t.TOS > 255 {
+		return nil, errors.New("the TOS must be between 0 and 255")
+	}
+	if t.Port < 0 || t.Port > 65535 || t.SourcePort < 0 || t.SourcePort > 65535 {
+		return nil, errors.New("ports must be between 1 and 65535")
+	}
+	if (t.Port != 0 || t.SourcePort != 0) && (method == MethodICMP || method == MethodXEcho) {
+		return nil, fmt.Errorf("%s probes have no ports, ports are only supported with UDP, TCP, SCTP, DCCP and QUIC probes", method)
+	}
+	tr.sockets.sourcePort = t.SourcePort
+	tr.sockets.tos, tr.sockets.dontFragment, tr.sockets.source = t.TOS, t.DontFragment, t.Source
+	tr.sockets.hardwareTimestamps = t.HardwareTimestamps
+	if tr.sockets, err = tr.sockets.forFamily(tr.family); err != nil {
+		return nil, err
+	}
+	header := ipHeader{id: t.IPID, options: t.IPOptions, tos: t.TOS, dontFrag: t.DontFragment, src: tr.sockets.source}
+	if (header.id != 0 || header.options != nil) && socketType != SocketHdrincl {
+		return nil, errors.New("IP ID and IP options need SocketHdrincl")
+	}
+	if len(t.Gateways) > 0 {
+		if family.protocol != familyIPv4.protocol {
+			return nil, errors.New("loose source routing only works over IPv4, IPv6 removed source routing (RFC 5095)")
+		}
+		if len(t.Gateways) > MaxGateways {
+			return nil, fmt.Errorf("at most %d gateways fit into the IP header", MaxGateways)
+		}
+		header.gateways = t.Gateways
+		tr.sockets.ipOptions = lsrrSocketOption(t.Gateways)
+		if len(tr.sockets.ipOptions)+len(header.options) > 40 {
+			return nil, errors.New("gateways and IP options don't fit into the 40 bytes of IP options together")
+		}
+	}
+	if t.RecordRoute {
+		if family.protocol != familyIPv4.protocol {
+			return nil, errors.New("Record Route only works over IPv4")
+		}
+		if method != MethodICMP && method != MethodXEcho {
+			return nil, errors.New("Record Route is only supported with ICMP probes")
+		}
+		switch socketType {
+		case SocketAuto:
+			socketType = SocketHdrincl // the reply's IP header is only visible on hdrincl sockets
+		case SocketHdrincl:
+		default:
+			return nil, errors.New("Record Route needs SocketHdrincl")
+		}
+		// Take whatever space the gateways and IP options leave
+		option := recordRouteOption(40 - len(tr.sockets.ipOptions) - len(header.options))
+		if option == nil {
+			return nil, errors.New("Record Route doesn't fit into the IP options next to the gateways and IP options")
+		}
+		header.options = append(header.options, option...)
+	}
+
+	tr.header = header
+	var query *interfaceQuery
+	payload, data := defaultUDPPayload, tr.payload
+	udpPayloadName := t.UDPPayload
+	if method == MethodQUIC {
+		method, udpPayloadName = MethodUDP, "quic"
+		tr.method = method
+	}
+	if t.UDPPorts != "" && method != MethodUDP {
+		return nil, errors.New("UDPPorts is only supported with UDP probes")
+	}
+	tr.ownsProber = true
+	switch method {
+	case MethodICMP, MethodXEcho:
+		if method == MethodXEcho {
+			query = parseInterfaceQuery(t.XEchoInterface, dstAddr)
+			if socketType == SocketDgram {
+				return nil, errors.New("MethodXEcho needs a raw socket, the kernel only sends plain Echo Requests on datagram sockets")
+			}
+			if socketType != SocketHdrincl {
+				socketType = SocketRaw
+			}
+		}
+		prober := &ICMPProber{id: tr.id, family: family, paris: t.Paris, payload: tr.payload, query: query}
+		switch {
+		case tr.concurrentProbes():
+			prober.session = session // opens a socket per probe
+		case session != nil:
+			tr.conn, err = session.open(family)
+		default:
+			tr.conn, err = listen(family, socketType, header, tr.sockets)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listening for ICMP packets: %w", permissionError(err))
+		}
+		if tr.conn != nil {
+			if err := filterEchoID(tr.conn, family, tr.conn.EchoID(tr.id&0xffff)); err != nil {
+				tr.logger.Debug("no in-kernel filter on the socket, reading every ICMP message", "err", err)
+			}
+		}
+		prober.conn = tr.conn
+		if tr.conn != nil && !t.Multipath {
+			prober.demux = newProbeDemux(tr.conn, family, tr.id, query != nil)
+			tr.late = newLateAnswers(tr.clock, t.Hooks.OnLateReply)
+			prober.demux.late = tr.late.answer
+		}
+		tr.prober = prober
+		if tr.conn != nil {
+			tr.logger.Info("opened socket", "family", family.name, "socket", socketKind(tr.conn))
+		} else {
+			tr.logger.Info("opening a socket per probe", "family", family.name)
+		}
+	case MethodUDP:
+		// Every UDP probe opens its own socket
+		if udpPayloadName != "" {
+			var ok bool
+			payload, ok = udpPayloads[udpPayloadName]
+			if !ok {
+				return nil, fmt.Errorf("unknown UDP payload %q (want dns, ntp or quic)", udpPayloadName)
+			}
+			data = nil // the request is the data
+		}
+		var fixedPort bool
+		switch t.UDPPorts {
+		case "", "increment":
+		case "fixed":
+			fixedPort = true
+			if tr.concurrentProbes() {
+				return nil, errors.New("fixed UDP ports don't work with the Parallel scheduler and Concurrency, the probes in flight at once would all need the same ports")
+			}
+			if tr.sockets.sourcePort == 0 {
+				if tr.sockets.sourcePort, err = freeUDPPort(family, tr.sockets); err != nil {
+					return nil, fmt.Errorf("picking a source port: %w", err)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown UDP port behavior %q (want increment or fixed)", t.UDPPorts)
+		}
+		port := cmp.Or(t.Port, payload.port, udpBasePort)
+		tr.prober = &UDPProber{family: family, payload: payload, data: data, port: port, fixedPort: fixedPort, sockets: tr.sockets}
+		tr.logger.Info("opening a UDP socket per probe", "payload", cmp.Or(udpPayloadName, "default"), "port", port)
+	case MethodSCTP, MethodDCCP, MethodTCP:
+		var protocol transportProtocol
+		switch method {
+		case MethodSCTP:
+			protocol = sctpProtocol{id: tr.id & 0x7fff}
+		case MethodDCCP:
+			serviceCode := t.DCCPServiceCode
+			if serviceCode == 0 {
+				serviceCode = DCCPDefaultServiceCode
+			}
+			protocol = dccpProtocol{id: tr.id & 0xffff, serviceCode: serviceCode}
+		case MethodTCP:
+			tcpFlags := t.TCPFlags
+			if tcpFlags == "" {
+				tcpFlags = "syn"
+			}
+			flags, err := parseTCPFlags(tcpFlags)
+			if err != nil {
+				return nil, err
+			}
+			protocol = tcpProtocol{id: tr.id & 0xffff, flags: flags}
+		}
+		tconn, err := listenTransport(family, protocol, dstAddr, tr.sockets)
+		if err != nil {
+			return nil, fmt.Errorf("opening raw sockets: %w", permissionError(err))
+		}
+		port := cmp.Or(t.Port, protocol.defaultPort())
+		tconn.srcPort = t.SourcePort
+		tr.prober = &TransportProber{conn: tconn, port: port}
+		tr.logger.Info("opened raw sockets", "protocol", method, "port", port)
+	default:
+		return nil, fmt.Errorf("unknown probe method %q (want %s, %s, %s, %s, %s, %s or %s)", method, MethodICMP, MethodUDP, MethodXEcho, MethodSCTP, MethodDCCP, MethodTCP, MethodQUIC)
+	}
+	if (t.Paris || t.Multipath) && method != MethodICMP {
+		return nil, errors.New("Paris traceroute and MDA are only supported with ICMP probes")
+	}
+	if t.FlowLabel != 0 || t.FlowLabelSweep {
+		if family.protocol != familyIPv6.protocol {
+			return nil, errors.New("flow labels only work over IPv6")
+		}
+		if method != MethodICMP && method != MethodXEcho {
+			return nil, errors.New("flow labels are only supported with ICMP probes")
+		}
+		if t.FlowLabel < 0 || t.FlowLabel > MaxFlowLabel {
+			return nil, fmt.Errorf("the flow label must be between 0 and %d", MaxFlowLabel)
+		}
+		if err := tr.conn.SetFlowLabel(t.FlowLabel, dstAddr.IP); err != nil {
+			return nil, fmt.Errorf("setting the flow label: %w", err)
+		}
+	}
+
+	tr.send = chain(tr.prober.Probe, t.Middleware)
+	return tr, nil
+}
+
+// padPayload makes the payload fill the probes up to t.PacketSize, now that the size of their
+// IP header is known
+func (tr *trace) padPayload(t *Tracer) error {
+	switch {
+	case t.PayloadFunc != nil:
+		return errors.New("PacketSize pads Payload, it doesn't go together with PayloadFunc")
+	case tr.method != MethodICMP && tr.method != MethodUDP:
+		return fmt.Errorf("PacketSize is only supported with ICMP and UDP probes, %s probes have a size of their own", tr.method)
+	case tr.method == MethodUDP && t.UDPPayload != "":
+		return errors.New("PacketSize doesn't go together with a UDPPayload, the request is the payload")
+	}
+	headers := tr.family.innerHeaderLen + 8 // ICMP and UDP headers are 8 bytes
+	if t.Paris || t.Multipath {
+		headers += 2 // the checksum compensation, see parisPayload
+	}
+	if t.PacketSize < headers || t.PacketSize > MaxPacketSize {
+		return fmt.Errorf("the packet size must be between %d (the headers of %s probes over %s) and %d", headers, tr.method, tr.family.name, MaxPacketSize)
+	}
+	data := t.Payload
+	if data == nil {
+		data = defaultPayload
+	}
+	data = padPayload(data, t.PacketSize-headers)
+	tr.payload = func(TTL, seq int) []byte { return data }
+	return nil
+}
+
+// close closes the sockets of the trace
+func (tr *trace) close() {
+	tr.lookups.close()
+	if tr.ownsProber && tr.prober != nil {
+		tr.prober.Close()
+		tr.logger.Info("closed sockets", "target", tr.dest)
+	}
+	if tr.session != nil {
+		tr.session.Close()
+	}
+	if tr.capture != nil {
+		tr.capture.close() // after the sockets, so late answers still make it into the file
+	}
+}
+
+// run sends the probes hop by hop and hands the result of each to emit, until the destination
+// answered, maxTTL was reached (then it returns ErrMaxTTLExceeded), gapLimit hops in a row
+// didn't answer (then it returns ErrGapLimit) or ctx is done (then it returns ctx.Err())
+func (tr *trace) run(ctx context.Context, emit func(HopResult)) error {
+	tr.emitter = newResultEmitter(ctx, (tr.maxTTL-tr.firstTTL+1)*(tr.queries+1))
+	defer tr.emitter.close() // everything probed is emitted before run returns
+
+	if tr.fast {
+		if err := tr.findPathLength(ctx); err != nil {
+			return err
+		}
+	}
+	if tr.concurrency > 1 {
+		return tr.runConcurrent(ctx, emit)
+	}
+	if tr.shuffle {
+		return tr.runShuffled(ctx, emit)
+	}
+
+	// IANA (https://www.iana.org/assignments/ip-parameters/ip-parameters.xhtml)
+	// currently recommends default TTL of 64
+	gap := 0 // hops in a row without any answer
+	for TTL := tr.firstTTL; TTL <= tr.maxTTL; TTL++ {
+		hopResults, err := tr.probeHop(ctx, TTL, func(result HopResult) { tr.emitProbe(result, emit) })
+		if err != nil {
+			return err
+		}
+		if over, err := tr.completeHop(TTL, hopResults, &gap); over {
+			return err
+		}
+	}
+	return fmt.Errorf("%w (%d hops)", ErrMaxTTLExceeded, tr.maxTTL)
+}
+
+// probeHop sends the probes of the hop TTL and returns their results. The scheduler sends
+// them in whatever order and at whatever pace it likes, while they are handed to emit (unless
+// it is nil) in order, each as soon as it and those before it are done.
+func (tr *trace) probeHop(ctx context.Context, TTL int, emit func(HopResult)) ([]HopResult, error) {
+	firstSeqNum := (TTL-tr.firstTTL)*tr.queries + 1
+	hopResults := make([]HopResult, tr.queries)
+	done := make([]chan struct{}, tr.queries)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	scheduled := make(chan struct{})
+	go func() {
+		defer close(scheduled)
+		tr.scheduler.Schedule(ctx, tr.queries, func(i int) {
+			hopResults[i] = tr.probe(ctx, TTL, i, firstSeqNum+i)
+			close(done[i])
+		})
+	}()
+
+	for i := range hopResults {
+		select {
+		case <-done[i]:
+		case <-scheduled:
+			select {
+			case <-done[i]:
+			default:
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("the scheduler skipped probe %d of hop %d", i+1, TTL)
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			<-scheduled
+			return nil, err // cancelled mid-hop, everything up to here was emitted
+		}
+		if emit != nil {
+			emit(hopResults[i])
+		}
+	}
+	return hopResults, nil
+}
+
+// emitProbe hands the result of a probe to the OnProbeReply hook and to emit, once its name
+// is in, see rdns.go
+func (tr *trace) emitProbe(result HopResult, emit func(HopResult)) {
+	tr.emitter.queue <- func() {
+		result := tr.emitter.named(result)[0]
+		if tr.hooks.OnProbeReply != nil {
+			tr.hooks.OnProbeReply(result)
+		}
+		emit(result)
+	}
+}
+
+// completeHop is called once all probes of the hop TTL were handed to emitProbe, gap counting
+// the hops in a row before it without any answer. It reports whether the trace is over, with the error
+// run returns then: nil when the destination answered or OnHopComplete stopped the trace.
+func (tr *trace) completeHop(TTL int, hopResults []HopResult, gap *int) (over bool, err error) {
+	if tr.hooks.OnHopComplete != nil {
+		// After the hop's probes were emitted, with their names
+		verdict := make(chan error, 1)
+		tr.emitter.queue <- func() { verdict <- tr.hooks.OnHopComplete(TTL, tr.emitter.named(hopResults...)) }
+		if err := <-verdict; errors.Is(err, StopTrace) {
+			return true, nil
+		} else if err != nil {
+			return true, err
+		}
+	}
+	if hopReached(hopResults) {
+		return true, nil
+	}
+	if *gap++; hopAnswered(hopResults) {
+		*gap = 0
+	}
+	if tr.gapLimit > 0 && *gap >= tr.gapLimit && TTL < tr.maxTTL {
+		return true, fmt.Errorf("%w (hops %d to %d)", ErrGapLimit, TTL-*gap+1, TTL)
+	}
+	return false, nil
+}
+
+// hopReached reports whether the destination answered any of hopResults
+func hopReached(hopResults []HopResult) bool {
+	for _, result := range hopResults {
+		if result.Reached {
+			return true
+		}
+	}
+	return false
+}
+
+// hopAnswered reports whether anyone answered any of hopResults
+func hopAnswered(hopResults []HopResult) bool {
+	for _, result := range hopResults {
+		if result.Addr != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// probe sends probe number i of the hop TTL, the seqNum-th of the trace
+func (tr *trace) probe(ctx context.Context, TTL, i, seqNum int) HopResult {
+	result := HopResult{Target: tr.dest, TTL: TTL, Probe: i + 1, Last: i == tr.queries-1}
+	if tr.flowLabelSweep {
+		result.flowLabel = sweepFlowLabel(tr.flowLabel, i)
+		if err := tr.conn.SetFlowLabel(result.flowLabel, tr.dstAddr.IP); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	var sent func()
+	if tr.hooks.OnProbeSent != nil {
+		sent = func() { tr.hooks.OnProbeSent(result.TTL, result.Probe) }
+	}
+	var reply *Reply
+	var err error
+	for {
+		wait := tr.wait
+		if tr.adaptive != nil {
+			wait = tr.adaptive.wait(TTL)
+		}
+		if err = tr.rateLimit.wait(ctx); err != nil {
+			break // cancelled while waiting for its turn
+		}
+		result.Sent = tr.clock.Now()
+		tr.logger.Debug("sending probe", "ttl", TTL, "probe", result.Probe, "seq", seqNum, "wait", wait)
+		reply, err = tr.send(withLogger(ctx, tr.logger), ProbeRequest{Dst: tr.dstAddr, TTL: TTL, Seq: seqNum, Wait: wait, Clock: tr.clock, Sent: sent})
+		if tr.late != nil && errors.Is(timeoutError(err), ErrTimeout) {
+			tr.late.expired(seqNum, result) // the answer may still come, see late.go
+		}
+		if err == nil || result.Retries == tr.retries || !errors.Is(timeoutError(err), ErrTimeout) || ctx.Err() != nil {
+			break
+		}
+		// Lost, most likely: send it again, as a probe of its own that late answers to the
+		// lost one aren't taken for
+		result.Retries++
+		seqNum = int(tr.retrySeqNum.Add(1))
+		tr.logger.Debug("no answer, retrying", "ttl", TTL, "probe", result.Probe, "retry", result.Retries, "err", err)
+	}
+	if err != nil {
+		result.Err = timeoutError(err)
+		tr.logger.Debug("no answer", "ttl", TTL, "seq", seqNum, "err", err)
+	} else {
+		result.Addr, result.RTT, result.Reached, result.reply = reply.Addr, reply.RTT, reply.Reached, reply
+		if tr.adaptive != nil {
+			tr.adaptive.record(TTL, reply.RTT)
+		}
+		tr.logger.Debug("answer", "ttl", TTL, "seq", seqNum, "from", reply.Addr, "rtt", reply.RTT, "reached", reply.Reached)
+		result.name = tr.lookups.start(reply.Addr) // emitted once it is in, the probing goes on
+	}
+	return result
+}
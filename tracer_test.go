@@ -0,0 +1,279 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// fakePath returns the number of hops to dst, a 192.0.2.n address in the tests: n
+func fakePath(dst net.IP) int {
+	return int(dst.To4()[3])
+}
+
+// fakeRouter returns the address of the router at hop TTL on the path to a destination n
+// hops away, unique to every path so probes answered for another trace stand out
+func fakeRouter(n, TTL int) *net.IPAddr {
+	return &net.IPAddr{IP: net.IPv4(10, byte(n), byte(TTL), 1)}
+}
+
+// pathProber is a Prober answering every probe right away, as the router of fakeRouter or
+// the destination would
+type pathProber struct{}
+
+func (pathProber) Probe(ctx context.Context, req ProbeRequest) (*Reply, error) {
+	if req.Sent != nil {
+		req.Sent()
+	}
+	runtime.Gosched() // let the other traces get in between
+	n := fakePath(req.Dst.IP)
+	if req.TTL < n {
+		return &Reply{Addr: fakeRouter(n, req.TTL), RTT: time.Duration(req.TTL) * time.Millisecond, Type: ipv4.ICMPTypeTimeExceeded}, nil
+	}
+	return &Reply{Addr: req.Dst, RTT: time.Duration(n) * time.Millisecond, Type: ipv4.ICMPTypeEchoReply, Reached: true}, nil
+}
+
+func (pathProber) Close() error {
+	return nil
+}
+
+// fakeNetwork is a raw ICMPv4 packetConn answering Echo Requests like the hops of
+// fakeRouter and the destination would: Time Exceeded below the destination, Echo Reply
+// from it. It is safe for concurrent use, like a socket.
+type fakeNetwork struct {
+	clock  *manualClock  // advanced by delay when a probe goes out, nil leaves the time alone
+	delay  time.Duration // how long an answer takes on clock
+	silent bool          // nobody answers
+
+	mu       sync.Mutex
+	ttl      int
+	expired  chan struct{} // closed once the read deadline passed
+	replies  chan fakePacket
+	closed   chan struct{}
+	closeErr sync.Once
+}
+
+type fakePacket struct {
+	b    []byte
+	from net.Addr
+}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{expired: make(chan struct{}), replies: make(chan fakePacket, 1024), closed: make(chan struct{})}
+}
+
+func (n *fakeNetwork) WriteTo(b []byte, dst net.Addr) (int, error) {
+	msg, err := icmp.ParseMessage(familyIPv4.protocol, b)
+	if err != nil {
+		return 0, err
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	if msg.Type != ipv4.ICMPTypeEcho || !ok {
+		return 0, fmt.Errorf("not an Echo Request: %v", msg.Type)
+	}
+	n.mu.Lock()
+	TTL := n.ttl
+	n.mu.Unlock()
+	if n.silent {
+		return len(b), nil
+	}
+	if n.clock != nil {
+		n.clock.Advance(n.delay)
+	}
+
+	dstIP := dst.(*net.IPAddr).IP.To4()
+	hops := fakePath(dstIP)
+	var from net.Addr = dst
+	answer := icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: echo.ID, Seq: echo.Seq, Data: echo.Data}}
+	if TTL < hops {
+		// The IPv4 header of the probe as it arrived, and the first 8 bytes of it
+		quoted := append([]byte{0x45, 0, 0, byte(20 + len(b)), 0, 0, 0, 0, 1, 1, 0, 0, 192, 0, 2, 254}, dstIP...)
+		quoted = append(quoted, b[:8]...)
+		from = fakeRouter(hops, TTL)
+		answer = icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoted}}
+	}
+	reply, err := answer.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	n.replies <- fakePacket{b: reply, from: from}
+	return len(b), nil
+}
+
+func (n *fakeNetwork) ReadFrom(b []byte) (int, net.Addr, error) {
+	n.mu.Lock()
+	expired := n.expired
+	n.mu.Unlock()
+	select {
+	case p := <-n.replies:
+		return copy(b, p.b), p.from, nil
+	case <-expired:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-n.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// SetReadDeadline takes any deadline but none for passed, probes only move it to now
+func (n *fakeNetwork) SetReadDeadline(t time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.expired:
+		if t.IsZero() {
+			n.expired = make(chan struct{})
+		}
+	default:
+		if !t.IsZero() {
+			close(n.expired)
+		}
+	}
+	return nil
+}
+
+func (n *fakeNetwork) SetTTL(TTL int) error {
+	n.mu.Lock()
+	n.ttl = TTL
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *fakeNetwork) SetFlowLabel(label int, dst net.IP) error { return nil }
+func (n *fakeNetwork) EchoID(id int) int                        { return id }
+
+func (n *fakeNetwork) Close() error {
+	n.closeErr.Do(func() { close(n.closed) })
+	return nil
+}
+
+// checkPath checks that result is the trace to a destination n hops away, every probe
+// answered by the hop of that path
+func checkPath(t *testing.T, result *Result, n, queries int) {
+	t.Helper()
+	if !result.Reached || len(result.Hops) != n {
+		t.Errorf("%s: reached %v in %d hops, want reached in %d", result.Target, result.Reached, len(result.Hops), n)
+		return
+	}
+	for i, hop := range result.Hops {
+		want := fakeRouter(n, i+1).String()
+		if i == n-1 {
+			want = result.Target
+		}
+		if hop.TTL != i+1 || len(hop.Probes) != queries {
+			t.Errorf("%s: hop %d has TTL %d and %d probes, want %d probes", result.Target, i+1, hop.TTL, len(hop.Probes), queries)
+			continue
+		}
+		for _, probe := range hop.Probes {
+			if probe.Addr == nil || probe.Addr.String() != want {
+				t.Errorf("%s: hop %d answered by %v, want %s", result.Target, hop.TTL, probe.Addr, want)
+			}
+		}
+	}
+}
+
+// traceConcurrently traces a destination 3 to 10 hops away twice each, all at once with
+// tracer, and checks the results and what the hooks saw
+func traceConcurrently(t *testing.T, tracer *Tracer) {
+	const queries = 2
+	tracer.Queries = queries
+	tracer.Numeric = true
+
+	var sent atomic.Int64
+	var mu sync.Mutex
+	replies := make(map[string][]HopResult)
+	hops := make(map[string]int)
+	tracer.Hooks = Hooks{
+		OnProbeSent: func(TTL, probe int) {
+			sent.Add(1)
+		},
+		OnProbeReply: func(result HopResult) {
+			mu.Lock()
+			replies[result.Target] = append(replies[result.Target], result)
+			mu.Unlock()
+		},
+		OnHopComplete: func(TTL int, results []HopResult) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, result := range results {
+				if result.Target != results[0].Target || result.TTL != TTL {
+					return fmt.Errorf("hop %d of %s completed with probe %d of %s", TTL, results[0].Target, result.TTL, result.Target)
+				}
+			}
+			hops[results[0].Target]++
+			return nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	var probes int64
+	for n := 3; n <= 10; n++ {
+		target := fmt.Sprintf("192.0.2.%d", n)
+		probes += int64(2 * n * queries)
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := tracer.Trace(context.Background(), target)
+				if err != nil {
+					t.Errorf("%s: %v", target, err)
+					return
+				}
+				checkPath(t, result, n, queries)
+			}()
+		}
+	}
+	wg.Wait()
+
+	if got := sent.Load(); got != probes {
+		t.Errorf("OnProbeSent called %d times, want %d", got, probes)
+	}
+	for n := 3; n <= 10; n++ {
+		target := fmt.Sprintf("192.0.2.%d", n)
+		if len(replies[target]) != 2*n*queries || hops[target] != 2*n {
+			t.Errorf("%s: %d probes and %d hops handed to the hooks, want %d and %d", target, len(replies[target]), hops[target], 2*n*queries, 2*n)
+		}
+		for _, result := range replies[target] {
+			want := fakeRouter(n, result.TTL).String()
+			if result.TTL == n {
+				want = target
+			}
+			if result.Addr == nil || result.Addr.String() != want {
+				t.Errorf("%s: OnProbeReply got hop %d answered by %v, want %s", target, result.TTL, result.Addr, want)
+			}
+		}
+	}
+}
+
+func TestConcurrentTracesProber(t *testing.T) {
+	traceConcurrently(t, &Tracer{Prober: pathProber{}})
+}
+
+func TestConcurrentTracesSession(t *testing.T) {
+	network := newFakeNetwork()
+	session := NewSession()
+	session.sockets[familyIPv4.protocol] = newSessionSocket(network, familyIPv4)
+	defer session.Close()
+
+	traceConcurrently(t, &Tracer{Session: session})
+}
+
+func TestConcurrentTracesSessionClosed(t *testing.T) {
+	session := NewSession()
+	session.sockets[familyIPv4.protocol] = newSessionSocket(newFakeNetwork(), familyIPv4)
+	session.Close()
+
+	_, err := (&Tracer{Session: session, Numeric: true}).Trace(context.Background(), "192.0.2.3")
+	if !errors.Is(err, errSessionClosed) {
+		t.Errorf("trace on a closed session: %v, want %v", err, errSessionClosed)
+	}
+}
@@ -0,0 +1,314 @@
+package traceroute
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+/*
+Transport protocol probes (SCTP, ...)
+
+These probes are built byte by byte and sent on a raw socket of their protocol (e.g. "ip4:132"
+for SCTP), the kernel only adds the IP header. Two kinds of answers can come back:
+
+	- ICMP errors (Time Exceeded from routers, Unreachable from the destination), read from a
+	  separate raw ICMP socket. They quote the IP header and at least the first 8 bytes of
+	  our transport header, which is what we match on.
+	- A packet of the same protocol from the destination itself (e.g. SCTP INIT-ACK),
+	  read from the raw protocol socket.
+
+Both sockets are read at the same time, whichever matches first wins.
+
+Each probe is sent from its own source port, derived from its sequence number, so the ICMP
+errors (which only quote the ports for sure) can be told apart. With a fixed source port
+(Tracer.SourcePort, for a flow that load balancers keep on one path) TCP probes are still told
+apart by their sequence number; the errors about SCTP and DCCP probes only differ by the
+ports, so one about an earlier probe arriving late may be taken for the current probe's.
+*/
+
+// transportSrcPortBase is the source port of the probe with sequence number 0
+const transportSrcPortBase = 0x8000 // 32768, keeps us out of the well-known ports
+
+// transportProtocol builds probes of one transport protocol and recognizes the answers to them
+type transportProtocol interface {
+	// protocolNumber is the IANA protocol number, e.g. 132 for SCTP
+	protocolNumber() int
+	// defaultPort is the destination port probes go to unless Tracer.Port says otherwise
+	defaultPort() int
+	// packet builds a probe: transport header and payload, checksum included
+	packet(src, dst net.IP, srcPort, dstPort, seqNum int) []byte
+	// matchQuoted reports whether the transport header quoted in an ICMP error (at least 8 bytes) belongs to the probe
+	matchQuoted(quoted []byte, srcPort, dstPort, seqNum int) bool
+	// matchAnswer checks a packet the destination sent us, and describes it for the output
+	matchAnswer(packet []byte, srcPort, dstPort, seqNum int) (note string, ok bool)
+}
+
+// transportSrcPort returns the source port of the probe with sequence number seqNum
+func transportSrcPort(seqNum int) int {
+	return transportSrcPortBase + seqNum%(0x10000-transportSrcPortBase)
+}
+
+// transportConn holds the sockets needed to send probes of a transport protocol
+type transportConn struct {
+	family   ipFamily
+	protocol transportProtocol
+	conn     *rawConn   // raw socket of the protocol: sends probes, receives answers from the destination
+	icmpConn packetConn // raw ICMP socket: receives errors about our probes
+	src      net.IP     // our source address, part of the checksum of some protocols
+	srcPort  int        // source port of every probe, 0 means one per probe (transportSrcPort)
+}
+
+// listenTransport opens the sockets for probing with protocol, cfg is applied to the one sending probes
+func listenTransport(family ipFamily, protocol transportProtocol, dstAddr *net.IPAddr, cfg socketConfig) (*transportConn, error) {
+	src, err := sourceAddrFor(dstAddr, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	network := fmt.Sprintf("ip4:%d", protocol.protocolNumber())
+	if family.protocol == familyIPv6.protocol {
+		network = fmt.Sprintf("ip6:%d", protocol.protocolNumber())
+	}
+	listenConfig := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return cfg.apply(c, family)
+	}}
+	conn, err := listenConfig.ListenPacket(context.Background(), network, cfg.listenAddr(family))
+	if err != nil {
+		return nil, err
+	}
+
+	// ICMP errors may come back on any interface
+	icmpConn, err := listen(family, SocketRaw, ipHeader{}, socketConfig{hardwareTimestamps: cfg.hardwareTimestamps})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	raw := newRawConn(conn.(*net.IPConn), family)
+	if cfg.hardwareTimestamps {
+		raw.tx = enableHardwareTimestamps(raw.IPConn)
+	}
+	return &transportConn{
+		family:   family,
+		protocol: protocol,
+		conn:     raw,
+		icmpConn: icmpConn,
+		src:      src,
+	}, nil
+}
+
+func (c *transportConn) Close() error {
+	c.icmpConn.Close()
+	return c.conn.Close()
+}
+
+// probe sends one probe and waits for the answer to it, until waitTime passed on clock or ctx is done.
+// sent, if not nil, is called once the probe went out.
+func (c *transportConn) probe(ctx context.Context, dstAddr *net.IPAddr, dstPort int, TTL int, seqNum int, waitTime time.Duration, clock Clock, sent func()) (*Reply, error) {
+	srcPort := transportSrcPort(seqNum)
+	if c.srcPort != 0 {
+		srcPort = c.srcPort
+	}
+	packet := c.protocol.packet(c.src, dstAddr.IP, srcPort, dstPort, seqNum)
+
+	logger := loggerFrom(ctx)
+
+	// Like probe(), the wait ends when clock says so or ctx is cancelled
+	c.conn.SetReadDeadline(time.Time{})
+	c.icmpConn.SetReadDeadline(time.Time{})
+	stop := expire(ctx, clock, waitTime, func() {
+		now := time.Now()
+		c.conn.SetReadDeadline(now)
+		c.icmpConn.SetReadDeadline(now)
+	})
+	defer stop()
+
+	startTime := clock.Now() // as close to the write as it gets, see timestamps.go
+	if _, err := writeTTL(c.conn, packet, dstAddr, TTL); err != nil {
+		logger.Debug("sending probe failed", "ttl", TTL, "seq", seqNum, "err", err)
+		return nil, err
+	}
+	logger.Debug("sent probe", "ttl", TTL, "seq", seqNum, "src_port", srcPort, "dst_port", dstPort, "bytes", len(packet))
+	if sent != nil {
+		sent()
+	}
+
+	// --- wait for response on both sockets ---
+	replies := make(chan *Reply, 2)
+	done := make(chan struct{}, 2)
+
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buf := getPacketBuffer()
+		defer putPacketBuffer(buf)
+		responseBytes := buf[:]
+		for {
+			responseLen, responderAddr, replyTTL, received, err := readStamped(c.conn, responseBytes)
+			if err != nil { // timeout, or the other reader found the answer
+				return
+			}
+			if !responderAddr.(*net.IPAddr).IP.Equal(dstAddr.IP) {
+				logger.Debug("ignoring packet: not from the destination", "from", responderAddr)
+				continue // only the destination talks to us in our protocol
+			}
+			// readStamped already removed the IP header
+			if note, ok := c.protocol.matchAnswer(responseBytes[:responseLen], srcPort, dstPort, seqNum); ok {
+				logger.Debug("matched answer", "from", responderAddr, "seq", seqNum, "note", strings.TrimSpace(note))
+				elapsedTime, source := rtt(clock, c.conn, startTime, received)
+				replies <- &Reply{Addr: responderAddr, RTT: elapsedTime, TimestampSource: source, Reached: true, Note: note, TTL: replyTTL}
+				return
+			}
+			logger.Debug("ignoring packet: ports or sequence number don't match the probe", "from", responderAddr, "bytes", responseLen)
+		}
+	}()
+
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buf := getPacketBuffer()
+		defer putPacketBuffer(buf)
+		responseBytes := buf[:]
+		for {
+			responseLen, responderAddr, replyTTL, received, err := readStamped(c.icmpConn, responseBytes)
+			if err != nil {
+				return
+			}
+			elapsedTime, source := rtt(clock, c.conn, startTime, received) // sent on c.conn
+			if r := c.matchICMP(logger, responseBytes[:responseLen], responderAddr, dstAddr, srcPort, dstPort, seqNum); r != nil {
+				r.RTT, r.TimestampSource, r.TTL = elapsedTime, source, replyTTL
+				replies <- r
+				return
+			}
+		}
+	}()
+
+	var result *Reply
+	for finished := 0; finished < 2; {
+		select {
+		case result = <-replies:
+			// The first answer stops the other reader, so it doesn't eat the next probe's answer
+			now := time.Now()
+			c.conn.SetReadDeadline(now)
+			c.icmpConn.SetReadDeadline(now)
+		case <-done:
+			finished++
+		}
+	}
+	if result == nil {
+		select {
+		case result = <-replies: // sent right before its reader finished
+		default:
+		}
+	}
+	if result == nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if result == nil {
+		return nil, fmt.Errorf("%w (%v)", ErrTimeout, waitTime)
+	}
+	return result, nil
+}
+
+// matchICMP checks whether an ICMP message is an error about our probe, logging why not
+func (c *transportConn) matchICMP(logger *slog.Logger, msgBytes []byte, responderAddr net.Addr, dstAddr *net.IPAddr, srcPort, dstPort, seqNum int) *Reply {
+	msg, err := icmp.ParseMessage(c.family.protocol, msgBytes)
+	if err != nil {
+		logger.Debug("ignoring packet: not ICMP", "from", responderAddr, "err", err)
+		return nil
+	}
+	if msg.Type != c.family.timeExceeded && msg.Type != c.family.unreachable {
+		logger.Debug("ignoring ICMP message", "from", responderAddr, "type", msg.Type, "code", msg.Code)
+		return nil
+	}
+
+	errorBody, err := parseICMPError(c.family.protocol, msgBytes)
+	if err != nil {
+		logger.Debug("ignoring ICMP error: unparseable", "from", responderAddr, "err", err)
+		return nil
+	}
+	quoted := quotedTransportHeader(c.family, errorBody.originalDatagram, c.protocol.protocolNumber())
+	if quoted == nil {
+		logger.Debug("ignoring ICMP error: quotes no probe of ours", "from", responderAddr, "type", msg.Type)
+		return nil
+	}
+	if !c.protocol.matchQuoted(quoted, srcPort, dstPort, seqNum) {
+		logger.Debug("ignoring ICMP error: ports or sequence number don't match the probe", "from", responderAddr, "type", msg.Type)
+		return nil
+	}
+
+	r := &Reply{Addr: responderAddr, Type: msg.Type, Code: msg.Code, extensions: errorBody.extensions}
+	if msg.Type == c.family.unreachable {
+		// The destination telling us there is nobody listening (or it doesn't speak the
+		// protocol at all) still means we got all the way there
+		r.Reached = responderAddr.(*net.IPAddr).IP.Equal(dstAddr.IP)
+		if !r.Reached {
+			logger.Debug("ignoring Destination Unreachable: not from the destination", "from", responderAddr)
+			return nil
+		}
+	}
+	logger.Debug("matched ICMP error", "from", responderAddr, "type", msg.Type, "code", msg.Code, "seq", seqNum)
+	return r
+}
+
+// quotedTransportHeader returns the transport header inside the original datagram quoted by an
+// ICMP error, or nil when it isn't of the given protocol or is shorter than 8 bytes
+func quotedTransportHeader(family ipFamily, datagram []byte, protocol int) []byte {
+	headerLen := family.innerHeaderLen
+	if family.protocol == familyIPv6.protocol {
+		if len(datagram) < headerLen || int(datagram[6]) != protocol { // Next Header
+			return nil
+		}
+	} else {
+		if len(datagram) < ipv4.HeaderLen || int(datagram[9]) != protocol { // Protocol
+			return nil
+		}
+		headerLen = family.quotedHeaderLen(datagram) // the header may carry options
+	}
+	if len(datagram) < headerLen+8 {
+		return nil
+	}
+	return datagram[headerLen:]
+}
+
+// pseudoHeaderChecksum computes the Internet checksum of a TCP/UDP/DCCP style segment,
+// including the pseudo header (addresses, protocol, length) of RFC 793 / RFC 8200
+func pseudoHeaderChecksum(src, dst net.IP, protocol int, segment []byte) uint16 {
+	var pseudo []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		pseudo = append(pseudo, src4...)
+		pseudo = append(pseudo, dst4...)
+		pseudo = append(pseudo, 0, byte(protocol))
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		pseudo = append(pseudo, src.To16()...)
+		pseudo = append(pseudo, dst.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, byte(protocol))
+	}
+	return checksum(append(pseudo, segment...))
+}
+
+// TransportProber sends SCTP, DCCP or TCP probes (MethodSCTP, MethodDCCP, MethodTCP) on raw
+// sockets. Tracer creates it from its settings.
+type TransportProber struct {
+	conn *transportConn
+	port int // destination port of the probes
+}
+
+// Probe sends one probe to the destination port and waits for the answer to it
+func (p *TransportProber) Probe(ctx context.Context, req ProbeRequest) (*Reply, error) {
+	return p.conn.probe(ctx, req.Dst, p.port, req.TTL, req.Seq, req.Wait, req.clock(), req.Sent)
+}
+
+// Close closes the raw sockets
+func (p *TransportProber) Close() error {
+	return p.conn.Close()
+}
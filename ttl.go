@@ -0,0 +1,45 @@
+package traceroute
+
+import "net"
+
+/*
+Per-packet TTL
+
+The TTL (IPv4) or hop limit (IPv6) of a probe is a setting of the socket it is sent on
+(IP_TTL, IPV6_UNICAST_HOPS): set it, then send. With several probes in flight on one socket
+(Concurrency, the Parallel scheduler, traces on a Session), another probe may set its TTL
+in between, and the probe goes out with the wrong one:
+
+	probe TTL 3:  SetTTL(3)                WriteTo  -> leaves with TTL 7
+	probe TTL 7:            SetTTL(7)  WriteTo      -> TTL 7
+
+Where the kernel takes the TTL along with the packet, as a control message (IP_TTL,
+IPV6_HOPLIMIT, see ttlControl), it is sent that way and the socket's is left alone:
+
+	raw sockets:       Linux, IPv4 and IPv6 (sendmsg, and sendmmsg in batches, see batch.go)
+	datagram sockets:  Linux, unprivileged ICMP
+	IP_HDRINCL:        the TTL is in the IP header the packet is sent with
+
+Everywhere else (raw sockets outside Linux) the socket's TTL is set and the probe sent under
+a lock, see packetWriter, so probes on a shared socket can't mix up their TTLs either; it
+only takes them one at a time.
+*/
+
+// ttlWriter is a packetConn that sends a packet with a TTL (hop limit) of its own, without
+// changing the socket's, see writeTTL
+type ttlWriter interface {
+	writeToTTL(b []byte, dst net.Addr, TTL int) (int, error)
+}
+
+// writeTTL sends the ICMP message b to dst with TTL (hop limit). Where conn can't send it
+// with the packet, it sets the TTL of the socket first: then it must not be shared by probes
+// sent at the same time, see above.
+func writeTTL(conn packetConn, b []byte, dst net.Addr, TTL int) (int, error) {
+	if c, ok := conn.(ttlWriter); ok {
+		return c.writeToTTL(b, dst, TTL)
+	}
+	if err := conn.SetTTL(TTL); err != nil {
+		return 0, err
+	}
+	return conn.WriteTo(b, dst)
+}
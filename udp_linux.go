@@ -0,0 +1,119 @@
+package traceroute
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/*
+Unprivileged UDP probing
+
+Every probe gets its own connected UDP socket, so there is no need to match replies to
+probes: whatever arrives on a socket is about its probe. The ICMP errors caused by a probe
+(Time Exceeded from routers, Port Unreachable from the destination) are collected from the
+socket's error queue (see socket_linux.go), no raw socket needed.
+*/
+
+func probeUDP(ctx context.Context, family ipFamily, dstAddr *net.IPAddr, port int, TTL int, seqNum int, waitTime time.Duration, clock Clock, payload udpPayload, cfg socketConfig, sent func()) (*Reply, error) {
+	network := "udp4"
+	if family.protocol == familyIPv6.protocol {
+		network = "udp6"
+	}
+
+	// cfg goes on before connecting, so the route (and source address) is picked with it
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		return cfg.apply(c, family)
+	}}
+	if cfg.source != nil || cfg.sourcePort != 0 {
+		dialer.LocalAddr = &net.UDPAddr{IP: cfg.source, Port: cfg.sourcePort}
+	}
+	dstUDPAddr := &net.UDPAddr{IP: dstAddr.IP, Port: port, Zone: dstAddr.Zone}
+	udpConn, err := dialer.DialContext(ctx, network, dstUDPAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := udpConn.(*net.UDPConn)
+	defer conn.Close()
+	logger := loggerFrom(ctx)
+	logger.Debug("opened UDP socket", "local", conn.LocalAddr(), "remote", dstUDPAddr)
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockoptErr = setRecvErr(int(fd), family)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockoptErr != nil {
+		return nil, os.NewSyscallError("setsockopt", sockoptErr)
+	}
+
+	if family.protocol == familyIPv6.protocol {
+		err = ipv6.NewConn(conn).SetHopLimit(TTL)
+	} else {
+		err = ipv4.NewConn(conn).SetTTL(TTL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := clock.Now()
+
+	// Like probe(), the wait ends when clock says so or ctx is cancelled
+	stop := expire(ctx, clock, waitTime, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	data := payload.build(seqNum)
+	if _, err = conn.Write(data); err != nil {
+		logger.Debug("sending UDP probe failed", "ttl", TTL, "seq", seqNum, "err", err)
+		return nil, err
+	}
+	logger.Debug("sent UDP probe", "ttl", TTL, "seq", seqNum, "bytes", len(data))
+	if sent != nil {
+		sent()
+	}
+
+	// --- wait for response ---
+	buf := getPacketBuffer()
+	defer putPacketBuffer(buf)
+	responseBytes := buf[:]
+	for {
+		responseLen, responderAddr, replyTTL, queued, err := readWithErrorQueue(rawConn, responseBytes)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil { // timeout or other error
+			return nil, err
+		}
+
+		elapsedTime := clock.Now().Sub(startTime)
+
+		if queued == nil {
+			// The destination answered with actual data, it's clearly reached
+			logger.Debug("matched UDP answer", "from", responderAddr, "bytes", responseLen)
+			return &Reply{Addr: responderAddr, RTT: elapsedTime, Reached: true, Note: payload.describe(responseBytes[:responseLen]), TTL: replyTTL}, nil
+		}
+
+		// The error queue of a connected socket only holds errors about its own probes
+		switch msgType := family.icmpType(queued.icmpType); {
+		case msgType == family.timeExceeded:
+			logger.Debug("matched Time Exceeded from the error queue", "from", responderAddr, "seq", seqNum)
+			return &Reply{Addr: responderAddr, RTT: elapsedTime, Type: msgType, Code: int(queued.icmpCode), TTL: replyTTL}, nil
+		case msgType == family.unreachable && int(queued.icmpCode) == family.portUnreachable:
+			logger.Debug("matched Port Unreachable from the error queue", "from", responderAddr, "seq", seqNum)
+			return &Reply{Addr: responderAddr, RTT: elapsedTime, Type: msgType, Code: int(queued.icmpCode), Reached: true, TTL: replyTTL}, nil
+		default:
+			logger.Debug("ignoring ICMP error from the error queue", "from", responderAddr, "type", msgType, "code", queued.icmpCode)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+func probeUDP(ctx context.Context, family ipFamily, dstAddr *net.IPAddr, port int, TTL int, seqNum int, waitTime time.Duration, clock Clock, payload udpPayload, cfg socketConfig, sent func()) (*Reply, error) {
+	return nil, errors.New("UDP probes need the Linux socket error queue (IP_RECVERR) and are not supported on this platform")
+}
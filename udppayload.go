@@ -0,0 +1,118 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+UDP probe payloads (-udp-payload)
+
+Plain UDP probes go to ports nobody listens on, and the destination is expected to answer
+with ICMP Port Unreachable. Lots of hosts and firewalls don't send (or let through) those,
+so the trace ends in silence. Sending a real request to a real service instead, e.g. a DNS
+query to a resolver, makes the destination answer with data, giving a usable last hop.
+
+These payloads always go to the service's well known port instead of incrementing ports.
+*/
+
+// udpPayload builds the data UDP probes carry, and makes sense of what the destination answers
+type udpPayload struct {
+	port     int                        // the service's well known port, 0 for classic incrementing ports
+	build    func(seqNum int) []byte    // data of the probe with the given sequence number
+	describe func(answer []byte) string // note shown for the destination's answer
+}
+
+// defaultUDPPayload is what UDP probes carry without -udp-payload
+var defaultUDPPayload = udpPayload{
+	build:    func(seqNum int) []byte { return defaultPayload },
+	describe: func(answer []byte) string { return "" },
+}
+
+// udpPayloads are the values -udp-payload accepts
+var udpPayloads = map[string]udpPayload{
+	"dns":  {port: 53, build: dnsQuery, describe: describeDNSAnswer},
+	"ntp":  {port: 123, build: ntpRequest, describe: describeNTPAnswer},
+	"quic": {port: quicPort, build: quicInitial, describe: describeQUICAnswer}, // see quic.go
+}
+
+/*
+DNS query (RFC 1035)
+
+	Header - 12 bytes
+		ID (2) | Flags (2): RD = recursion desired | QDCOUNT (2) = 1 | ANCOUNT, NSCOUNT, ARCOUNT (2 each) = 0
+	Question
+		QNAME: the root, "." (a single zero length label) | QTYPE (2) = NS | QCLASS (2) = IN
+
+Every resolver can answer "who are the root servers" from its cache, and authoritative-only
+servers at least answer with REFUSED, which still proves we reached them.
+*/
+
+const (
+	dnsFlagRD    = 0x0100
+	dnsRCodeMask = 0x000f // low 4 bits of the flags
+	dnsTypeNS    = 2
+	dnsClassIN   = 1
+)
+
+var dnsRCodes = []string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED"}
+
+func dnsQuery(seqNum int) []byte {
+	b := make([]byte, 12, 17)
+	binary.BigEndian.PutUint16(b[0:2], uint16(seqNum))
+	binary.BigEndian.PutUint16(b[2:4], dnsFlagRD)
+	binary.BigEndian.PutUint16(b[4:6], 1) // QDCOUNT
+	b = append(b, 0)                      // QNAME: root
+	b = binary.BigEndian.AppendUint16(b, dnsTypeNS)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	return b
+}
+
+func describeDNSAnswer(answer []byte) string {
+	if len(answer) < 12 {
+		return " [DNS]"
+	}
+	rcode := int(binary.BigEndian.Uint16(answer[2:4]) & dnsRCodeMask)
+	name := fmt.Sprintf("RCODE %d", rcode)
+	if rcode < len(dnsRCodes) {
+		name = dnsRCodes[rcode]
+	}
+	answers := binary.BigEndian.Uint16(answer[6:8])
+	return fmt.Sprintf(" [DNS %s, %d answers]", name, answers)
+}
+
+/*
+NTP client request (RFC 5905)
+
+	48 bytes, all zero except:
+		LI (2 bits) = 0 | VN (3 bits) = 4 | Mode (3 bits) = 3 (client)
+		Transmit Timestamp (8), which the server copies into the Origin Timestamp of its answer
+*/
+
+const ntpPacketLen = 48
+
+// ntpEpochOffset is the number of seconds between 1900 (NTP epoch) and 1970 (Unix epoch)
+const ntpEpochOffset = 2208988800
+
+func ntpRequest(seqNum int) []byte {
+	b := make([]byte, ntpPacketLen)
+	b[0] = 0<<6 | 4<<3 | 3
+	now := time.Now()
+	binary.BigEndian.PutUint32(b[40:44], uint32(now.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[44:48], uint32(seqNum)) // fraction, carries the sequence number instead
+	return b
+}
+
+func describeNTPAnswer(answer []byte) string {
+	if len(answer) < ntpPacketLen {
+		return " [NTP]"
+	}
+	stratum := answer[1]
+	if stratum == 0 {
+		// Kiss-o'-Death, the reference ID holds a 4 character code
+		return fmt.Sprintf(" [NTP kiss code %s]", strings.TrimRight(string(answer[12:16]), "\x00"))
+	}
+	return fmt.Sprintf(" [NTP stratum %d]", stratum)
+}
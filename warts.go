@@ -0,0 +1,302 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/*
+Warts output (-o warts)
+
+WriteWarts writes a Result as a warts file, the binary format of CAIDA's scamper
+(https://www.caida.org/catalog/software/scamper/), so traces can go through sc_warts2json,
+sc_analysis_dump and the other tools research pipelines are built on. A file is a sequence
+of objects, all numbers big-endian:
+
+	object header   uint16 magic 0x1205, uint16 type, uint32 length of what follows
+	list (1)        uint32 id, uint32 list id, name (NUL-terminated), flags
+	cycle start (2) uint32 id, uint32 list, uint32 cycle id, uint32 start time, flags
+	trace (6)       flags and parameters, uint16 hop count, hop records, uint16 0
+	cycle stop (4)  uint32 cycle, uint32 stop time, flags
+
+Most fields are optional: a run of flag bytes tells which parameters follow, bit i-1 (7 bits
+to a byte, 0x80 meaning another byte follows) for parameter i, then a uint16 length of the
+parameters and the parameters themselves, in flag order. No flags at all is one zero byte.
+
+	trace   1 list  2 cycle  5 start (timeval)  6 stop reason  9 attempts  10 hop limit
+	        11 type  12 probe size  15 first hop  17 wait  19 hop count  26 source  27 destination
+	hop     2 probe TTL  3 reply TTL  4 hop flags  5 probe id  6 RTT (us)  7 ICMP type/code
+	        8 probe size  15 TCP flags  18 address  19 probe sent (timeval)
+
+Addresses are a uint8 length and a uint8 type (1 IPv4, 2 IPv6) before the bytes, timevals
+uint32 seconds and uint32 microseconds. Only answered probes have a hop record, warts lists
+the probes nobody answered by leaving them out.
+
+Scamper has no trace types for SCTP, DCCP and Extended Echo probes, traces with those can't
+be written. QUIC probes are UDP probes to scamper.
+*/
+
+const wartsMagic = 0x1205
+
+// Warts object types
+const (
+	wartsList       = 1
+	wartsCycleStart = 2
+	wartsCycleStop  = 4
+	wartsTrace      = 6
+)
+
+// Scamper trace types, stop reasons and hop flags
+const (
+	wartsTypeICMPEcho      = 0x01
+	wartsTypeUDP           = 0x02
+	wartsTypeTCP           = 0x03
+	wartsTypeICMPEchoParis = 0x04
+	wartsTypeTCPAck        = 0x06
+
+	wartsStopCompleted = 1
+	wartsStopGapLimit  = 5
+	wartsStopHopLimit  = 7
+	wartsStopHalted    = 9
+
+	wartsHopReplyTTL = 0x10
+	wartsHopTCP      = 0x20
+	wartsHopUDP      = 0x40
+)
+
+// wartsParams builds the flags and parameters of an object, see above
+type wartsParams struct {
+	flags []byte
+	data  []byte
+}
+
+// add appends parameter flag, which must be higher than those added before
+func (p *wartsParams) add(flag int, value ...byte) {
+	for len(p.flags) <= (flag-1)/7 {
+		p.flags = append(p.flags, 0)
+	}
+	p.flags[(flag-1)/7] |= 1 << ((flag - 1) % 7)
+	p.data = append(p.data, value...)
+}
+
+func (p *wartsParams) uint8(flag, n int) { p.add(flag, byte(n)) }
+
+func (p *wartsParams) uint16(flag, n int) {
+	p.add(flag, binary.BigEndian.AppendUint16(nil, uint16(n))...)
+}
+
+func (p *wartsParams) uint32(flag int, n uint32) {
+	p.add(flag, binary.BigEndian.AppendUint32(nil, n)...)
+}
+
+func (p *wartsParams) timeval(flag int, t time.Time) { p.add(flag, wartsTimeval(t)...) }
+
+func (p *wartsParams) addr(flag int, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		p.add(flag, append([]byte{4, 1}, ip4...)...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		p.add(flag, append([]byte{16, 2}, ip16...)...)
+	}
+}
+
+// bytes returns the flag bytes followed by the parameters
+func (p *wartsParams) bytes() []byte {
+	if len(p.flags) == 0 {
+		return []byte{0}
+	}
+	b := make([]byte, 0, len(p.flags)+2+len(p.data))
+	for i, flags := range p.flags {
+		if i < len(p.flags)-1 {
+			flags |= 0x80
+		}
+		b = append(b, flags)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(p.data)))
+	return append(b, p.data...)
+}
+
+// wartsTimeval encodes t as seconds and microseconds
+func wartsTimeval(t time.Time) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(t.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()/1000))
+}
+
+// wartsObject prepends the object header to body
+func wartsObject(typ uint16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, wartsMagic)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+// WriteWarts writes r to w as a warts file of one list, one cycle and the trace, see
+// warts.go. t is the Tracer that traced r, the file records how it probed.
+func (r *Result) WriteWarts(w io.Writer, t *Tracer) error {
+	if r.Addr == nil {
+		return errors.New("no destination address to write")
+	}
+	traceType, err := wartsTraceType(t)
+	if err != nil {
+		return err
+	}
+
+	// The list and the cycle the trace is part of, both with file-local id 1
+	list := binary.BigEndian.AppendUint32(nil, 1)
+	list = binary.BigEndian.AppendUint32(list, 0)
+	list = append(list, "traceroute\x00"...)
+	list = append(list, 0)
+	cycleStart := binary.BigEndian.AppendUint32(nil, 1)
+	cycleStart = binary.BigEndian.AppendUint32(cycleStart, 1)
+	cycleStart = binary.BigEndian.AppendUint32(cycleStart, 0)
+	cycleStart = binary.BigEndian.AppendUint32(cycleStart, uint32(r.Start.Unix()))
+	cycleStart = append(cycleStart, 0)
+	cycleStop := binary.BigEndian.AppendUint32(nil, 1)
+	cycleStop = binary.BigEndian.AppendUint32(cycleStop, uint32(r.End.Unix()))
+	cycleStop = append(cycleStop, 0)
+
+	b := wartsObject(wartsList, list)
+	b = append(b, wartsObject(wartsCycleStart, cycleStart)...)
+	b = append(b, wartsObject(wartsTrace, r.wartsTrace(t, traceType))...)
+	b = append(b, wartsObject(wartsCycleStop, cycleStop)...)
+	_, err = w.Write(b)
+	return err
+}
+
+// wartsTraceType returns the scamper trace type of the probes t sends
+func wartsTraceType(t *Tracer) (int, error) {
+	switch t.Method {
+	case "", MethodICMP:
+		if t.Paris {
+			return wartsTypeICMPEchoParis, nil
+		}
+		return wartsTypeICMPEcho, nil
+	case MethodUDP, MethodQUIC:
+		return wartsTypeUDP, nil
+	case MethodTCP:
+		if t.TCPFlags == "ack" {
+			return wartsTypeTCPAck, nil
+		}
+		return wartsTypeTCP, nil
+	}
+	return 0, fmt.Errorf("warts has no trace type for %s probes", t.Method)
+}
+
+// wartsTrace returns the body of the trace object
+func (r *Result) wartsTrace(t *Tracer, traceType int) []byte {
+	queries, wait, maxTTL := t.Queries, t.Wait, t.MaxTTL
+	if queries == 0 {
+		queries = 3
+	}
+	if wait == 0 {
+		wait = 5 * time.Second
+	}
+	if maxTTL == 0 {
+		maxTTL = 64
+	}
+	probeSize := probeSize(t, r.Addr.IP)
+
+	var hops []byte
+	records := 0
+	for _, hop := range r.Hops {
+		for i, probe := range hop.Probes {
+			if probe.Addr != nil {
+				hops = append(hops, wartsHop(hop.TTL, i+1, probe, probeSize)...)
+				records++
+			}
+		}
+	}
+
+	stopReason := wartsStopHalted
+	switch {
+	case r.Reached:
+		stopReason = wartsStopCompleted
+	case r.lastTTL() >= maxTTL:
+		stopReason = wartsStopHopLimit
+	case t.GapLimit > 0 && r.silentHops() >= t.GapLimit:
+		stopReason = wartsStopGapLimit
+	}
+
+	var p wartsParams
+	p.uint32(1, 1) // list
+	p.uint32(2, 1) // cycle
+	p.timeval(5, r.Start)
+	p.uint8(6, stopReason)
+	p.uint8(9, queries)
+	p.uint8(10, min(maxTTL, 255))
+	p.uint8(11, traceType)
+	p.uint16(12, probeSize)
+	p.uint8(15, max(t.FirstTTL, 1))
+	p.uint8(17, int((wait+time.Second-1)/time.Second)) // whole seconds, rounded up so a sub-second wait isn't 0
+	p.uint16(19, r.lastTTL())
+	if src, err := sourceAddrFor(r.Addr, socketConfig{device: t.Interface, source: t.Source}); err == nil {
+		p.addr(26, src)
+	}
+	p.addr(27, r.Addr.IP)
+
+	b := p.bytes()
+	b = binary.BigEndian.AppendUint16(b, uint16(records))
+	b = append(b, hops...)
+	return binary.BigEndian.AppendUint16(b, 0) // no more hop records
+}
+
+// wartsHop returns the hop record of an answered probe
+func wartsHop(TTL, id int, probe Probe, probeSize int) []byte {
+	flags := 0
+	if probe.ReplyTTL != 0 {
+		flags |= wartsHopReplyTTL
+	}
+	tcpFlags := 0
+	if probe.Type == nil {
+		// The destination answered in the probe's own protocol
+		switch probe.Note {
+		case " [SYN-ACK]":
+			flags, tcpFlags = flags|wartsHopTCP, 0x12
+		case " [RST]":
+			flags, tcpFlags = flags|wartsHopTCP, 0x14
+		default:
+			flags |= wartsHopUDP
+		}
+	}
+
+	var p wartsParams
+	p.uint8(2, TTL)
+	if probe.ReplyTTL != 0 {
+		p.uint8(3, probe.ReplyTTL)
+	}
+	p.uint8(4, flags)
+	p.uint8(5, id)
+	p.uint32(6, uint32(probe.RTT/time.Microsecond))
+	if probe.Type != nil {
+		p.uint16(7, wartsICMPType(probe.Type)<<8|probe.Code)
+	}
+	p.uint16(8, probeSize)
+	if tcpFlags != 0 {
+		p.uint8(15, tcpFlags)
+	}
+	if ipAddr, ok := probe.Addr.(*net.IPAddr); ok {
+		p.addr(18, ipAddr.IP)
+	}
+	if !probe.Sent.IsZero() {
+		p.timeval(19, probe.Sent)
+	}
+	return p.bytes()
+}
+
+// wartsICMPType returns the number of an ICMP or ICMPv6 type
+func wartsICMPType(typ icmp.Type) int {
+	switch typ := typ.(type) {
+	case ipv4.ICMPType:
+		return int(typ)
+	case ipv6.ICMPType:
+		return int(typ)
+	}
+	return 0
+}
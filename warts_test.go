@@ -0,0 +1,206 @@
+package traceroute
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// wartsTestResult is a trace of 3 hops to 192.0.2.1, answered by the first and the last
+func wartsTestResult() *Result {
+	start := time.Unix(1760616000, 250_000_000)
+	return &Result{
+		Target:  "192.0.2.1",
+		Addr:    &net.IPAddr{IP: net.ParseIP("192.0.2.1")},
+		Reached: true,
+		Start:   start,
+		End:     start.Add(2 * time.Second),
+		Hops: []Hop{
+			{TTL: 1, Probes: []Probe{
+				{Sent: start.Add(1500 * time.Microsecond), Addr: &net.IPAddr{IP: net.ParseIP("10.0.0.1")}, RTT: 1500 * time.Microsecond, Type: ipv4.ICMPTypeTimeExceeded, ReplyTTL: 64},
+				{Err: ErrTimeout},
+			}},
+			{TTL: 2, Probes: []Probe{{Err: ErrTimeout}, {Err: ErrTimeout}}},
+			{TTL: 3, Probes: []Probe{
+				{Err: ErrTimeout},
+				{Addr: &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, RTT: 70 * time.Millisecond, Type: ipv4.ICMPTypeEchoReply, Reached: true},
+			}},
+		},
+	}
+}
+
+// wartsTestFile is the warts file of wartsTestResult traced with waitSecs, stopped for stop
+func wartsTestFile(waitSecs, stop byte) []byte {
+	list := []byte{
+		0x12, 0x05, 0, 1, 0, 0, 0, 20, // magic, list, length
+		0, 0, 0, 1, // id
+		0, 0, 0, 0, // list id
+		't', 'r', 'a', 'c', 'e', 'r', 'o', 'u', 't', 'e', 0, // name
+		0, // no flags
+	}
+	cycleStart := []byte{
+		0x12, 0x05, 0, 2, 0, 0, 0, 17, // magic, cycle start, length
+		0, 0, 0, 1, // id
+		0, 0, 0, 1, // list
+		0, 0, 0, 0, // cycle id
+		0x68, 0xf0, 0xde, 0x40, // start: 1760616000
+		0, // no flags
+	}
+	trace := []byte{
+		0xb3, 0x9e, 0x95, 0x30, // flags 1 2 5 6, 9 10 11 12, 15 17 19, 26 27
+		0, 38, // length of the parameters
+		0, 0, 0, 1, // 1 list
+		0, 0, 0, 1, // 2 cycle
+		0x68, 0xf0, 0xde, 0x40, 0, 0x03, 0xd0, 0x90, // 5 start: 1760616000 s 250000 us
+		stop,  // 6 stop reason
+		2,     // 9 attempts
+		30,    // 10 hop limit
+		1,     // 11 type: ICMP Echo
+		0, 60, // 12 probe size
+		1,        // 15 first hop
+		waitSecs, // 17 wait
+		0, 3,     // 19 hop count
+		4, 1, 192, 0, 2, 254, // 26 source
+		4, 1, 192, 0, 2, 1, // 27 destination
+		0, 2, // hop records
+		0xfe, 0x81, 0x18, // flags 2 3 4 5 6 7, 8, 18 19
+		0, 26, // length of the parameters
+		1,                // 2 probe TTL
+		64,               // 3 reply TTL
+		0x10,             // 4 hop flags: reply TTL
+		1,                // 5 probe id
+		0, 0, 0x05, 0xdc, // 6 RTT: 1500 us
+		11, 0, // 7 Time Exceeded, code 0
+		0, 60, // 8 probe size
+		4, 1, 10, 0, 0, 1, // 18 address
+		0x68, 0xf0, 0xde, 0x40, 0, 0x03, 0xd6, 0x6c, // 19 sent: 1760616000 s 251500 us
+		0xfa, 0x81, 0x08, // flags 2 4 5 6 7, 8, 18
+		0, 17, // length of the parameters
+		3,                   // 2 probe TTL
+		0,                   // 4 hop flags
+		2,                   // 5 probe id
+		0, 0x01, 0x11, 0x70, // 6 RTT: 70000 us
+		0, 0, // 7 Echo Reply
+		0, 60, // 8 probe size
+		4, 1, 192, 0, 2, 1, // 18 address
+		0, 0, // no more hop records
+	}
+	cycleStop := []byte{
+		0x12, 0x05, 0, 4, 0, 0, 0, 9, // magic, cycle stop, length
+		0, 0, 0, 1, // cycle
+		0x68, 0xf0, 0xde, 0x42, // stop: 1760616002
+		0, // no flags
+	}
+
+	file := append(list, cycleStart...)
+	file = append(file, 0x12, 0x05, 0, 6, 0, 0, 0, byte(len(trace))) // magic, trace, length
+	file = append(file, trace...)
+	return append(file, cycleStop...)
+}
+
+func TestWartsGolden(t *testing.T) {
+	for _, test := range []struct {
+		wait     time.Duration
+		waitSecs byte
+	}{
+		{1500 * time.Millisecond, 2},
+		{0, 5}, // the default
+		{200 * time.Millisecond, 1},
+		{time.Second, 1},
+		{3 * time.Second, 3},
+		{3*time.Second + time.Nanosecond, 4},
+	} {
+		tracer := &Tracer{Queries: 2, Wait: test.wait, MaxTTL: 30, PacketSize: 60, Source: net.ParseIP("192.0.2.254")}
+		var got bytes.Buffer
+		if err := wartsTestResult().WriteWarts(&got, tracer); err != nil {
+			t.Fatal(err)
+		}
+		if want := wartsTestFile(test.waitSecs, wartsStopCompleted); !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("wait %v: file\n% x\nwant\n% x", test.wait, got.Bytes(), want)
+		}
+	}
+}
+
+func TestWartsStopReason(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		reached bool
+		tracer  Tracer
+		stop    byte
+	}{
+		{"reached", true, Tracer{}, wartsStopCompleted},
+		{"hop limit", false, Tracer{MaxTTL: 3}, wartsStopHopLimit},
+		{"gap limit", false, Tracer{GapLimit: 1}, wartsStopGapLimit},
+		{"halted", false, Tracer{GapLimit: 3}, wartsStopHalted},
+	} {
+		r := wartsTestResult()
+		r.Reached = test.reached
+		r.Hops[2].Probes = r.Hops[2].Probes[:1] // nobody answered the last hop
+		// Right after the parameter flags and their length, list and cycle, and the start
+		if got := r.wartsTrace(&test.tracer, wartsTypeICMPEcho)[4+2+4+4+8]; got != test.stop {
+			t.Errorf("%s: stop reason %d, want %d", test.name, got, test.stop)
+		}
+	}
+}
+
+func TestWartsHop(t *testing.T) {
+	addr := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	for _, test := range []struct {
+		name  string
+		probe Probe
+		want  []byte
+	}{
+		{
+			name:  "SYN-ACK",
+			probe: Probe{Addr: addr, RTT: time.Millisecond, Reached: true, Note: " [SYN-ACK]"},
+			want: []byte{
+				0xba, 0x81, 0x09, // flags 2 4 5 6, 8, 15 18
+				0, 16, // length of the parameters
+				5, 0x20, 1, 0, 0, 0x03, 0xe8, 0, 40, // TTL, hop flags: TCP, id, RTT, size
+				0x12,               // 15 TCP flags
+				4, 1, 192, 0, 2, 1, // 18 address
+			},
+		},
+		{
+			name:  "RST",
+			probe: Probe{Addr: addr, RTT: time.Millisecond, Reached: true, Note: " [RST]"},
+			want: []byte{
+				0xba, 0x81, 0x09,
+				0, 16,
+				5, 0x20, 1, 0, 0, 0x03, 0xe8, 0, 40,
+				0x14,
+				4, 1, 192, 0, 2, 1,
+			},
+		},
+		{
+			name:  "UDP",
+			probe: Probe{Addr: addr, RTT: time.Millisecond, Reached: true},
+			want: []byte{
+				0xba, 0x81, 0x08, // flags 2 4 5 6, 8, 18
+				0, 15,
+				5, 0x40, 1, 0, 0, 0x03, 0xe8, 0, 40, // hop flags: UDP
+				4, 1, 192, 0, 2, 1,
+			},
+		},
+		{
+			name:  "IPv6",
+			probe: Probe{Addr: &net.IPAddr{IP: net.ParseIP("2001:db8::1")}, RTT: time.Millisecond, Type: ipv6.ICMPTypeTimeExceeded, Code: 1},
+			want: append([]byte{
+				0xfa, 0x81, 0x08, // flags 2 4 5 6 7, 8, 18
+				0, 29,
+				5, 0, 1, 0, 0, 0x03, 0xe8, // TTL, hop flags, id, RTT
+				3, 1, // 7 Time Exceeded, code 1
+				0, 40, // 8 probe size
+				16, 2, // 18 address, IPv6
+			}, net.ParseIP("2001:db8::1")...),
+		},
+	} {
+		if got := wartsHop(5, 1, test.probe, 40); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: hop record\n% x\nwant\n% x", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package traceroute
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+Webhook notifications (-webhook)
+
+A Webhook POSTs an event as JSON to a URL when something happens to a trace, so a trace can
+set off a Slack message, a PagerDuty incident or any other automation behind a webhook:
+
+	trace_completed          a trace is over, reached or not
+	destination_unreachable  a trace is over and the destination didn't answer
+	loss_above_threshold     the destination answered, but lost more of the probes of its hop
+	                         than LossThreshold percent
+	path_change              the path changed since the previous trace (see pathchange.go)
+
+The events of a trace carry its summary (see summary.go); every event carries a line of text
+too, which is all Slack's incoming webhooks show:
+
+	{"event": "destination_unreachable", "time": "2024-05-01T12:00:00Z",
+	 "text": "example.com (93.184.216.34) not reached in 30 hops, last responder 10.0.0.1 at hop 7",
+	 "target": "example.com", "address": "93.184.216.34", "reached": false, "hops": 30,
+	 "sent": 90, "answered": 21, "loss_percent": 76.7, "destination_loss_percent": 100,
+	 "last_responder": "10.0.0.1", "last_ttl": 7, "duration_ms": 31240}
+
+A path_change event is the change as -path-events writes it, with the text added: the
+target, the kinds of change and the fingerprints of the old and new path,
+
+	"text": "path to example.com changed (responder): 5d41402abc4b2a76 -> 7d793037a0760186"
+
+Events are posted one at a time, in order; a webhook that doesn't answer 2xx is an error, and
+the next event is posted anyway.
+*/
+
+// Events of a Webhook, see above
+const (
+	WebhookCompleted   = "trace_completed"
+	WebhookUnreachable = "destination_unreachable"
+	WebhookLoss        = "loss_above_threshold"
+	WebhookPathChange  = "path_change"
+)
+
+// ParseWebhookEvents parses a comma-separated list of events, e.g.
+// "destination_unreachable,path_change", or "all", which returns nil
+func ParseWebhookEvents(list string) ([]string, error) {
+	if list == "all" {
+		return nil, nil
+	}
+	var events []string
+	for _, event := range strings.Split(list, ",") {
+		switch event = strings.TrimSpace(event); event {
+		case WebhookCompleted, WebhookUnreachable, WebhookLoss, WebhookPathChange:
+			events = append(events, event)
+		default:
+			return nil, fmt.Errorf("unknown webhook event %q", event)
+		}
+	}
+	return events, nil
+}
+
+// Webhook posts trace events to URL, see above
+type Webhook struct {
+	URL           string
+	Events        []string     // events to post, nil means all of them
+	LossThreshold float64      // destination loss in percent WebhookLoss is posted above
+	Client        *http.Client // nil means http.DefaultClient
+}
+
+type webhookSummary struct {
+	Event           string   `json:"event"`
+	Time            string   `json:"time"`
+	Text            string   `json:"text"`
+	Target          string   `json:"target"`
+	Address         string   `json:"address,omitempty"`
+	Reached         bool     `json:"reached"`
+	Hops            int      `json:"hops"`
+	Sent            int      `json:"sent"`
+	Answered        int      `json:"answered"`
+	Loss            float64  `json:"loss_percent"`
+	DestinationLoss float64  `json:"destination_loss_percent"`
+	Threshold       *float64 `json:"threshold_percent,omitempty"`
+	Min             *float64 `json:"rtt_min_ms,omitempty"`
+	Avg             *float64 `json:"rtt_avg_ms,omitempty"`
+	Max             *float64 `json:"rtt_max_ms,omitempty"`
+	LastResponder   string   `json:"last_responder,omitempty"`
+	LastTTL         int      `json:"last_ttl,omitempty"`
+	Duration        int64    `json:"duration_ms"`
+}
+
+// wants reports whether event is one of w.Events
+func (w *Webhook) wants(event string) bool {
+	return w.Events == nil || slices.Contains(w.Events, event)
+}
+
+// TraceDone posts the events of a trace that is over, summed up by s: WebhookCompleted, and
+// WebhookUnreachable or WebhookLoss when they apply
+func (w *Webhook) TraceDone(ctx context.Context, s Summary) error {
+	now := time.Now()
+	event := func(name, text string) webhookSummary {
+		e := webhookSummary{
+			Event: name, Time: TimestampRFC3339.Format(now), Text: text,
+			Target: s.Target, Reached: s.Reached, Hops: s.Hops, Sent: s.Sent, Answered: s.Answered,
+			Loss: round1(s.Loss()), DestinationLoss: round1(s.DestinationLoss()),
+			LastTTL: s.LastTTL, Duration: s.Duration.Milliseconds(),
+		}
+		if s.Addr != nil {
+			e.Address = s.Addr.IP.String()
+		}
+		if s.Last != nil {
+			e.LastResponder = addrString(s.Last)
+		}
+		if s.Reached {
+			e.Min, e.Avg, e.Max = rttMS(s.Min), rttMS(s.Avg), rttMS(s.Max)
+		}
+		return e
+	}
+
+	var errs []error
+	if w.wants(WebhookCompleted) {
+		errs = append(errs, w.post(ctx, event(WebhookCompleted, s.String())))
+	}
+	switch loss := s.DestinationLoss(); {
+	case !s.Reached && w.wants(WebhookUnreachable):
+		errs = append(errs, w.post(ctx, event(WebhookUnreachable, s.String())))
+	case s.Reached && loss > w.LossThreshold && w.wants(WebhookLoss):
+		e := event(WebhookLoss, fmt.Sprintf("%s lost %.1f%% of the probes at hop %d, more than %g%%", s.name(), loss, s.Hops, w.LossThreshold))
+		e.Threshold = &w.LossThreshold
+		errs = append(errs, w.post(ctx, e))
+	}
+	return errors.Join(errs...)
+}
+
+// PathChanged posts change as a WebhookPathChange event
+func (w *Webhook) PathChanged(ctx context.Context, change PathChange) error {
+	if !w.wants(WebhookPathChange) {
+		return nil
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(body, &event); err != nil {
+		return err
+	}
+	text, _ := json.Marshal(fmt.Sprintf("path to %s changed (%s): %s -> %s", change.Target,
+		strings.Join(change.Kinds, ", "), change.Old.Fingerprint(), change.New.Fingerprint()))
+	event["text"] = text
+	return w.post(ctx, event)
+}
+
+// post posts event to w.URL
+func (w *Webhook) post(ctx context.Context, event any) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, w.Client, w.URL, body)
+}
+
+// postJSON posts body to the webhook at url, with client, nil meaning http.DefaultClient.
+// Answers other than 2xx are errors.
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// rttMS returns d in milliseconds, rounded to microseconds
+func rttMS(d time.Duration) *float64 {
+	ms := float64(d.Microseconds()) / 1000
+	return &ms
+}
+
+// round1 rounds a percentage to one decimal
+func round1(percent float64) float64 {
+	return math.Round(percent*10) / 10
+}
@@ -0,0 +1,65 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Wide output (--wide)
+
+A WideRenderer prints probes like a TextRenderer, adding to every answer who runs the
+responder and where it is (see hopinfo.go), the TTL the answer arrived with and how many
+hops it took back (see HopResult.ReturnHops):
+
+	Hop 2:
+	  dns.google (8.8.8.8)             9.812ms  AS15169 GOOGLE US Mountain View  ttl=120 back=9
+
+The reply TTL tells how far away the responder really is, and answers whose TTL doesn't
+fit the others (a different path back, a middlebox answering for the destination) stand
+out. Sockets that don't tell the TTL (datagram sockets outside Linux) leave it out.
+
+Every responder is looked up once, the lookups happen while printing, each limited to
+Timeout.
+*/
+
+// WideRenderer prints probes like a TextRenderer with hop information and the reply TTL,
+// see above. It caches the lookups, and is safe for concurrent use.
+type WideRenderer struct {
+	TextRenderer
+	Sources []HopInfoSource // looked up in order, the first answer winning field by field
+	Timeout time.Duration   // limit of every lookup, 0 means 5 seconds
+
+	once  sync.Once
+	cache *hopInfoCache // of Sources, created with the first lookup
+}
+
+func (r *WideRenderer) Render(out io.Writer, result HopResult) {
+	if result.Probe == 1 {
+		fmt.Fprintf(out, "Hop %d:\n", result.TTL)
+	}
+	line := r.probeLine(result)
+	if result.Addr == nil {
+		fmt.Fprintln(out, line)
+		return
+	}
+
+	if ipAddr, ok := result.Addr.(*net.IPAddr); ok && len(r.Sources) > 0 {
+		timeout := r.Timeout
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+		r.once.Do(func() { r.cache = &hopInfoCache{sources: r.Sources} })
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		line += "  " + r.cache.lookup(ctx, ipAddr.IP).String()
+		cancel()
+	}
+	if !r.ShowReplyTTL { // or probeLine has it already
+		line += formatReplyTTL(result)
+	}
+	fmt.Fprintln(out, line)
+}
@@ -0,0 +1,117 @@
+package traceroute
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/icmp"
+)
+
+/*
+ICMP Extended Echo, a.k.a. PROBE (RFC 8335)
+
+A regular Echo Request only tells us whether a node is up. An Extended Echo Request asks a
+node about one of its interfaces, named in an Interface Identification Object (class 3)
+attached to the request, which identifies the interface by name, ifIndex or address.
+
+	Extended Echo Request, after the 4 byte ICMP header:
+		Identifier (16 bits) | Sequence Number (8 bits!) | Reserved (7 bits) | L (1 bit)
+		Extension header + Interface Identification Object
+	L ("local") says the interface lives on the node we're probing. It must be set when
+	the interface is identified by name or index.
+
+	Extended Echo Reply, after the 4 byte ICMP header:
+		Identifier (16 bits) | Sequence Number (8 bits) | State (3 bits) | Res (2 bits) | A | 4 | 6
+	The ICMP Code tells whether the query could be answered at all, State/A/4/6 describe
+	the interface: its neighbor state (for proxied queries), whether it is active and
+	whether it runs IPv4 and IPv6.
+
+Routers on the way treat it like any other packet, so we still get Time Exceeded messages
+and can use it for traceroute. Since the sequence number is only 8 bits wide, only its low
+byte is compared when matching replies.
+*/
+
+const (
+	interfaceByName    = 1 // C-Types of the Interface Identification Object
+	interfaceByIndex   = 2
+	interfaceByAddress = 3
+
+	afiIPv4 = 1 // IANA address family numbers
+	afiIPv6 = 2
+)
+
+// interfaceQuery is the interface an Extended Echo Request asks about
+type interfaceQuery struct {
+	ident *icmp.InterfaceIdent
+	local bool   // L bit
+	spec  string // as given by the user, for printing
+}
+
+// parseInterfaceQuery turns the -xecho-if value into an interfaceQuery.
+// spec can be an interface name ("eth0"), an ifIndex ("2") or an address ("192.0.2.1").
+// An empty spec asks about the interface holding the destination address.
+func parseInterfaceQuery(spec string, dstAddr *net.IPAddr) *interfaceQuery {
+	if spec == "" {
+		spec = dstAddr.IP.String()
+	}
+
+	if ip := net.ParseIP(spec); ip != nil {
+		afi, addr := afiIPv6, []byte(ip.To16())
+		if ip4 := ip.To4(); ip4 != nil {
+			afi, addr = afiIPv4, []byte(ip4)
+		}
+		return &interfaceQuery{
+			ident: &icmp.InterfaceIdent{Class: 3, Type: interfaceByAddress, AFI: afi, Addr: addr},
+			local: ip.Equal(dstAddr.IP), // any other address is a neighbor of the destination (a proxy query)
+			spec:  spec,
+		}
+	}
+
+	if index, err := strconv.Atoi(spec); err == nil {
+		return &interfaceQuery{
+			ident: &icmp.InterfaceIdent{Class: 3, Type: interfaceByIndex, Index: index},
+			local: true,
+			spec:  spec,
+		}
+	}
+
+	return &interfaceQuery{
+		ident: &icmp.InterfaceIdent{Class: 3, Type: interfaceByName, Name: spec},
+		local: true,
+		spec:  spec,
+	}
+}
+
+// extendedEchoCodes are the ICMP Codes of Extended Echo Replies
+var extendedEchoCodes = map[int]string{
+	0: "No Error",
+	1: "Malformed Query",
+	2: "No Such Interface",
+	3: "No Such Table Entry",
+	4: "Multiple Interfaces Satisfy Query",
+}
+
+// neighborStates are the State values of Extended Echo Replies, only meaningful for proxied queries
+var neighborStates = map[int]string{
+	0: "Reserved",
+	1: "Incomplete",
+	2: "Reachable",
+	3: "Stale",
+	4: "Delay",
+	5: "Probe",
+	6: "Failed",
+}
+
+// formatExtendedEchoReply describes what the destination told us about the queried interface
+func formatExtendedEchoReply(query *interfaceQuery, code int, body *icmp.ExtendedEchoReply) string {
+	if code != 0 {
+		return fmt.Sprintf(" [interface %s: %s]", query.spec, extendedEchoCodes[code])
+	}
+
+	state := ""
+	if !query.local {
+		state = " state=" + neighborStates[body.State]
+	}
+	return fmt.Sprintf(" [interface %s:%s active=%t ipv4=%t ipv6=%t]", query.spec, state, body.Active, body.IPv4, body.IPv6)
+}